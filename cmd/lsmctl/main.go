@@ -0,0 +1,281 @@
+// lsmctl 打开一个db目录，执行get、put、delete、scan、compact、resume、stats、checkpoint等命令。
+//
+//	用法: lsmctl -dir path [-cf name] [-json] [-v] [-readonly] [command args...]
+//	没有command时从标准输入逐行读取命令(REPL)，参数中可以使用双引号包含空格。
+//	输出每行一条记录，默认key和value以tab分隔，-json时每行一个json对象。命令失败时错误输出到stderr，退出码为1。
+//	-v时db的日志输出到stderr。-readonly时只读打开，可以查看其他进程正在写入的db
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"lsmtree/db"
+	"lsmtree/kv"
+	"lsmtree/logger"
+)
+
+var errNotFound = errors.New("not found")
+
+type ctl struct {
+	db     *db.Db
+	cf     *db.ColumnFamily
+	out    io.Writer
+	asJson bool
+}
+
+func main() {
+	dir := flag.String("dir", "", "db目录")
+	cfName := flag.String("cf", db.DefaultColumnFamilyName, "列族")
+	asJson := flag.Bool("json", false, "以json输出，每行一个对象")
+	verbose := flag.Bool("v", false, "将db的日志输出到stderr")
+	readOnly := flag.Bool("readonly", false, "只读打开，不获取目录锁")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: lsmctl -dir path [flags] [command args...]\n")
+		flag.PrintDefaults()
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+	}
+	flag.Parse()
+	if *dir == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var opts db.Options
+	if *verbose {
+		opts.Logger = logger.Std{Logger: log.New(os.Stderr, "", log.LstdFlags)}
+	}
+	open := db.Open
+	if *readOnly {
+		open = db.OpenReadOnly
+	}
+	d, err := open(*dir, opts)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer d.Shutdown()
+	c := &ctl{db: d, out: os.Stdout, asJson: *asJson}
+	c.cf = d.ColumnFamily(*cfName)
+	if c.cf == nil {
+		fmt.Fprintf(os.Stderr, "column family %v not found\n", *cfName)
+		os.Exit(1)
+	}
+
+	if flag.NArg() > 0 {
+		err = c.run(flag.Args())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			d.Shutdown()
+			os.Exit(1)
+		}
+		return
+	}
+	c.repl(os.Stdin)
+}
+
+func (c *ctl) repl(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for {
+		fmt.Fprint(os.Stderr, "> ")
+		if !scanner.Scan() {
+			return
+		}
+		args, err := split(scanner.Text())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			continue
+		}
+		if len(args) == 0 {
+			continue
+		}
+		if args[0] == "quit" || args[0] == "exit" {
+			return
+		}
+		err = c.run(args)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+}
+
+const usage = `commands:
+  get <key>
+  put <key> <value>
+  delete <key>
+  scan [-prefix p] [-start key] [-end key] [-limit n]
+  compact
+  resume             后台任务失败进入只读模式后，排除故障并恢复写入
+  stats
+  property <name>    例如lsm.levelstats、lsm.estimate-num-keys、lsm.stats
+  checkpoint <dir>
+  help
+`
+
+func (c *ctl) run(args []string) error {
+	switch args[0] {
+	case "get":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: get <key>")
+		}
+		item, res, err := c.cf.GetKvContext(context.Background(), []byte(args[1]))
+		if err != nil {
+			return err // sst损坏时不能当作key不存在
+		}
+		if res != kv.Success {
+			return errNotFound
+		}
+		c.printKv(string(item.Key), item.Value)
+	case "put":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: put <key> <value>")
+		}
+		return c.cf.SetKv(kv.Kv{Key: []byte(args[1]), Value: []byte(args[2])})
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: delete <key>")
+		}
+		return c.cf.DeleteKv([]byte(args[1]))
+	case "scan":
+		return c.scan(args[1:])
+	case "compact":
+		return c.db.Compact()
+	case "resume":
+		return c.db.Resume()
+	case "stats":
+		for _, cf := range c.db.ColumnFamilies() {
+			c.printStats(cf.Stats())
+		}
+	case "property":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: property <name>")
+		}
+		value, ok := c.cf.GetProperty(args[1])
+		if !ok {
+			return fmt.Errorf("unknown property:%v", args[1])
+		}
+		fmt.Fprintln(c.out, strings.TrimRight(value, "\n"))
+	case "checkpoint":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: checkpoint <dir>")
+		}
+		return c.db.Checkpoint(args[1])
+	case "help":
+		fmt.Fprint(c.out, usage)
+	default:
+		return fmt.Errorf("unknown command:%v, see help", args[0])
+	}
+	return nil
+}
+
+func (c *ctl) scan(args []string) error {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	prefix := fs.String("prefix", "", "只输出以prefix开头的key")
+	start := fs.String("start", "", "起始key，包含")
+	end := fs.String("end", "", "结束key，不包含，为空表示不限制")
+	limit := fs.Int("limit", 0, "最多输出的个数，0表示不限制")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *prefix != "" {
+		*start, *end = *prefix, prefixEnd(*prefix)
+	}
+	it, err := c.cf.NewIterator([]byte(*start), []byte(*end))
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+	for n := 0; it.Valid() && (*limit <= 0 || n < *limit); n++ {
+		c.printKv(string(it.Key()), it.Value())
+		it.Next()
+	}
+	return it.Err()
+}
+
+// 比所有以prefix开头的key都大的最小的key，不存在时返回空字符串
+func prefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] < 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+func (c *ctl) printKv(key string, value []byte) {
+	if c.asJson {
+		c.printJson(map[string]string{"key": key, "value": string(value)})
+		return
+	}
+	fmt.Fprintf(c.out, "%v\t%v\n", escape(key), escape(string(value)))
+}
+
+func (c *ctl) printStats(stats db.ColumnFamilyStats) {
+	if c.asJson {
+		c.printJson(stats)
+		return
+	}
+	levels := make([]string, 0, len(stats.Levels))
+	for _, n := range stats.Levels {
+		levels = append(levels, strconv.Itoa(n))
+	}
+	fmt.Fprintf(c.out, "%v\tmemtable_keys=%v\timmemtables=%v\tlevels=%v\n",
+		stats.Name, stats.MemtableKeys, stats.Immemtables, strings.Join(levels, ","))
+}
+
+func (c *ctl) printJson(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+	fmt.Fprintf(c.out, "%s\n", data)
+}
+
+// 包含tab、换行等字符时加上双引号转义，保证一行一条记录
+func escape(s string) string {
+	quoted := strconv.Quote(s)
+	if quoted[1:len(quoted)-1] == s && !strings.ContainsAny(s, " \"") {
+		return s
+	}
+	return quoted
+}
+
+// 按空白分割一行命令，双引号中的内容作为一个参数，支持Go的转义规则
+func split(line string) ([]string, error) {
+	var args []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return args, nil
+		}
+		if line[0] != '"' {
+			i := strings.IndexAny(line, " \t")
+			if i < 0 {
+				i = len(line)
+			}
+			args = append(args, line[:i])
+			line = line[i:]
+			continue
+		}
+		prefix, err := strconv.QuotedPrefix(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid quoted argument: %v", line)
+		}
+		arg, _ := strconv.Unquote(prefix)
+		args = append(args, arg)
+		line = line[len(prefix):]
+	}
+}
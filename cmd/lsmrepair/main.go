@@ -0,0 +1,72 @@
+// lsmrepair 修复无法打开的db目录，打印每个文件的修复结果。无法解码的文件移到db目录下的lost目录中。
+//
+//	用法: lsmrepair [-json] [-check] dir
+//	修复前需要先停止使用这个目录的程序。有文件丢失或者部分丢失时退出码为1。
+//	-check只检查校验和，打印每处损坏的位置，不修改任何文件，有损坏时退出码为1
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"lsmtree/db"
+)
+
+func main() {
+	asJson := flag.Bool("json", false, "以json输出修复结果")
+	check := flag.Bool("check", false, "只检查校验和，不修复")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: lsmrepair [flags] dir\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if *check {
+		verify(flag.Arg(0), *asJson)
+		return
+	}
+
+	report, err := db.Repair(flag.Arg(0))
+	if *asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(report)
+	} else {
+		fmt.Print(report)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	for _, f := range report.Files {
+		if f.Status != db.RepairOK {
+			os.Exit(1)
+		}
+	}
+}
+
+func verify(dir string, asJson bool) {
+	list, err := db.VerifyChecksums(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if asJson {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(list)
+	} else {
+		for _, c := range list {
+			fmt.Printf("%v offset:%v %v\n", c.Path, c.Offset, c.Reason)
+		}
+	}
+	if len(list) > 0 {
+		os.Exit(1)
+	}
+}
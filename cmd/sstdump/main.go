@@ -0,0 +1,156 @@
+// sstdump 打印sst文件的元数据、索引和kv，并检查索引和数据是否一致。
+//
+//	用法: sstdump [-format text|json] [-comparator Bytewise|ReverseBytewise] [-start key] [-end key] [-values=false] file.db...
+//	kv按comparator排序和过滤，需要和创建db时的Comparator一致，名称记录在db的MANIFEST中。检查不通过时退出码为1
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"lsmtree/kv"
+	"lsmtree/sstable"
+	"lsmtree/vfs"
+)
+
+func main() {
+	format := flag.String("format", "text", "输出格式，text或json")
+	comparator := flag.String("comparator", kv.Bytewise{}.Name(), "key的顺序，Bytewise或ReverseBytewise")
+	start := flag.String("start", "", "只输出不小于start的key")
+	end := flag.String("end", "", "只输出小于end的key，为空表示不限制")
+	values := flag.Bool("values", true, "是否输出value")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: sstdump [flags] file.db...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	cmp, err := comparatorByName(*comparator)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(2)
+	}
+
+	ok := true
+	for _, path := range flag.Args() {
+		info, err := sstable.InspectFS(vfs.Default, path, kv.Json{}, cmp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			ok = false
+			continue
+		}
+		info.Entries = filter(info.Entries, cmp, *start, *end)
+		if !*values {
+			for i := range info.Entries {
+				info.Entries[i].Kv.Value = nil
+				info.Entries[i].Kv.Operands = nil
+			}
+		}
+		if *format == "json" {
+			err = printJson(os.Stdout, info)
+		} else {
+			printText(os.Stdout, info, *values)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", path, err)
+			ok = false
+		}
+		if len(info.Problems) > 0 {
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+func comparatorByName(name string) (kv.Comparator, error) {
+	for _, cmp := range []kv.Comparator{kv.Bytewise{}, kv.ReverseBytewise{}} {
+		if cmp.Name() == name {
+			return cmp, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown comparator:%v", name)
+}
+
+// 保留按cmp排列在[start, end)内的key，start或end为空时不限制
+func filter(entries []sstable.Entry, cmp kv.Comparator, start, end string) []sstable.Entry {
+	var list []sstable.Entry
+	for _, e := range entries {
+		if (start != "" && cmp.Compare(e.Key, []byte(start)) < 0) || (end != "" && cmp.Compare(e.Key, []byte(end)) >= 0) {
+			continue
+		}
+		list = append(list, e)
+	}
+	return list
+}
+
+func printJson(w io.Writer, info sstable.TableInfo) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+func printText(w io.Writer, info sstable.TableInfo, values bool) {
+	m := info.Meta
+	fmt.Fprintf(w, "file: %v\n", info.Path)
+	fmt.Fprintf(w, "size: %v\n", info.Size)
+	fmt.Fprintf(w, "meta: version=%v data=[%v, +%v) index=[%v, +%v) range_del=[%v, +%v)\n",
+		m.Version, m.DataStart, m.PointStart, m.PointStart, m.PointLen, m.RangeDelStart, m.RangeDelLen)
+
+	fmt.Fprintf(w, "range tombstones: %v\n", len(info.RangeDels))
+	for _, r := range info.RangeDels {
+		fmt.Fprintf(w, "  [%q, %q)\n", r.Start, r.End)
+	}
+
+	fmt.Fprintf(w, "entries: %v\n", len(info.Entries))
+	for _, e := range info.Entries {
+		fmt.Fprintf(w, "  %q @%v+%v %v\n", e.Key, e.Position.Start, e.Position.Len, describe(e.Kv, values))
+	}
+
+	if len(info.Problems) == 0 {
+		fmt.Fprintf(w, "check: ok\n")
+		return
+	}
+	fmt.Fprintf(w, "check: %v problems\n", len(info.Problems))
+	for _, p := range info.Problems {
+		fmt.Fprintf(w, "  %v\n", p)
+	}
+}
+
+func describe(item kv.Kv, values bool) string {
+	var s string
+	switch {
+	case item.Deleted:
+		s = "DELETED"
+	case item.Kind == kv.KindMerge:
+		s = fmt.Sprintf("MERGE operands=%v", len(item.Operands))
+		if item.HasBase {
+			s += " base"
+			if values {
+				s += "=" + strconv.Quote(string(item.Value))
+			}
+		}
+		if values {
+			for _, op := range item.Operands {
+				s += " " + strconv.Quote(string(op))
+			}
+		}
+	case values:
+		s = strconv.Quote(string(item.Value))
+	default:
+		s = "SET"
+	}
+	if item.ExpireAt > 0 {
+		s += " expire=" + time.Unix(0, item.ExpireAt).Format(time.RFC3339Nano)
+	}
+	return s
+}
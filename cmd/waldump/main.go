@@ -0,0 +1,171 @@
+// waldump 按顺序解码wal目录下的*.wal.log文件，打印每条记录和它的位置，并标出末尾不完整或者损坏的记录。
+//
+//	用法: waldump [-format text|json] [-values=false] [-export dir] {wal目录|file.wal.log}...
+//	-export 将每个文件中完整的记录写入dir下同名的新wal文件，可以替换损坏的wal。有文件损坏时退出码为1
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"lsmtree/kv"
+	"lsmtree/wal"
+)
+
+func main() {
+	format := flag.String("format", "text", "输出格式，text或json")
+	values := flag.Bool("values", true, "是否输出value")
+	export := flag.String("export", "", "将完整的记录导出到这个目录")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: waldump [flags] {wal dir|file.wal.log}...\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	files, err := walFiles(flag.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *export != "" {
+		err = os.MkdirAll(*export, 0755)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+	}
+
+	ok := true
+	for _, file := range files {
+		info, err := wal.ReadFile(file, kv.Json{})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+			ok = false
+			continue
+		}
+		if info.Err != "" {
+			ok = false
+		}
+		if *export != "" {
+			err = exportFile(info, path.Join(*export, path.Base(file)))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+				ok = false
+			}
+		}
+		if !*values {
+			for i := range info.Records {
+				hideValues(&info.Records[i].Record)
+			}
+		}
+		if *format == "json" {
+			err = printJson(os.Stdout, info)
+		} else {
+			printText(os.Stdout, info)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+			ok = false
+		}
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// 参数是目录时展开为目录下的wal文件
+func walFiles(args []string) ([]string, error) {
+	var files []string
+	for _, arg := range args {
+		fi, err := os.Stat(arg)
+		if err != nil {
+			return nil, err
+		}
+		if !fi.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		list, err := wal.ListFiles(arg)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, list...)
+	}
+	return files, nil
+}
+
+func exportFile(info wal.FileInfo, dst string) error {
+	records := make([]wal.Record, 0, len(info.Records))
+	for _, r := range info.Records {
+		records = append(records, r.Record)
+	}
+	return wal.WriteFile(dst, records, kv.Json{})
+}
+
+func hideValues(rec *wal.Record) {
+	if rec.Kind != kv.KindRangeDelete {
+		rec.Value = nil
+	}
+	rec.Operands = nil
+	for i := range rec.Batch {
+		hideValues(&rec.Batch[i])
+	}
+}
+
+func printJson(w io.Writer, info wal.FileInfo) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(info)
+}
+
+func printText(w io.Writer, info wal.FileInfo) {
+	fmt.Fprintf(w, "file: %v size: %v records: %v\n", info.Path, info.Size, len(info.Records))
+	for _, r := range info.Records {
+		fmt.Fprintf(w, "  @%v %v\n", r.Offset, describe(r.Record))
+		for _, item := range r.Record.Batch {
+			fmt.Fprintf(w, "      %v\n", describe(item))
+		}
+	}
+	if info.Err != "" {
+		fmt.Fprintf(w, "  corrupt tail: %v bytes after offset %v lost: %v\n", info.Size-info.Valid, info.Valid, info.Err)
+	}
+}
+
+func describe(rec wal.Record) string {
+	if len(rec.Batch) > 0 {
+		return fmt.Sprintf("BATCH ops=%v", len(rec.Batch))
+	}
+	var s string
+	switch {
+	case rec.Kind == kv.KindRangeDelete:
+		s = fmt.Sprintf("DELETE_RANGE cf=%v [%q, %q)", rec.CF, rec.Key, string(rec.Value))
+	case rec.Kind == kv.KindMerge:
+		var ops []string
+		for _, op := range rec.Operands {
+			ops = append(ops, strconv.Quote(string(op)))
+		}
+		s = fmt.Sprintf("MERGE cf=%v %q %v", rec.CF, rec.Key, strings.Join(ops, " "))
+	case rec.Deleted:
+		s = fmt.Sprintf("DELETE cf=%v %q", rec.CF, rec.Key)
+	default:
+		s = fmt.Sprintf("SET cf=%v %q", rec.CF, rec.Key)
+		if rec.Value != nil {
+			s += " " + strconv.Quote(string(rec.Value))
+		}
+	}
+	if rec.ExpireAt > 0 {
+		s += " expire=" + time.Unix(0, rec.ExpireAt).Format(time.RFC3339Nano)
+	}
+	return strings.TrimSpace(s)
+}
@@ -0,0 +1,133 @@
+package db
+
+import (
+	"fmt"
+
+	"lsmtree/errs"
+)
+
+// ErrorSeverity 后台错误的严重程度
+type ErrorSeverity int
+
+const (
+	NoError    ErrorSeverity = iota
+	SoftError                // 合并失败，写入不受影响，下次后台任务时重试，成功后自动清除
+	HardError                // flush失败或者后台任务panic，db进入只读模式，排除故障后调用Resume恢复
+	FatalError               // 文件损坏，db进入只读模式并且不能Resume，需要关闭后使用Repair修复
+)
+
+func (s ErrorSeverity) String() string {
+	switch s {
+	case NoError:
+		return "no error"
+	case SoftError:
+		return "soft error"
+	case HardError:
+		return "hard error"
+	case FatalError:
+		return "fatal error"
+	}
+	return fmt.Sprintf("ErrorSeverity(%d)", int(s))
+}
+
+// 由db.lock保护
+type backgroundError struct {
+	err      error
+	severity ErrorSeverity
+}
+
+// BackgroundError 返回后台任务记录的最严重的错误，没有错误时为NoError和nil
+func (d *Db) BackgroundError() (ErrorSeverity, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.bgErr.severity, d.bgErr.err
+}
+
+// Resume 清除HardError，重新执行flush和合并，成功后恢复写入。再次失败时返回错误并保持只读。FatalError不能恢复
+func (d *Db) Resume() error {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	defer d.setStall(WriteStallNormal)
+	if d.closed.Load() {
+		return errs.NewErr(errs.ErrCodeDbClosed, fmt.Errorf("db:%v closed", d.dir))
+	}
+
+	switch d.bgErr.severity {
+	case NoError:
+		return nil
+	case FatalError:
+		return errs.NewErr(errs.ErrCodeReadOnly, fmt.Errorf("can not resume from fatal error:%v, use Repair", d.bgErr.err))
+	}
+	d.logger.Info("resume", "err", d.bgErr.err, "severity", d.bgErr.severity)
+	d.bgErr = backgroundError{}
+	return d.backgroundWork()
+}
+
+// 只读打开或者处于只读模式时返回ErrCodeReadOnly。调用方需要持有db.lock
+func (d *Db) checkWritable() error {
+	if d.closed.Load() {
+		return errs.NewErr(errs.ErrCodeDbClosed, fmt.Errorf("db:%v closed", d.dir))
+	}
+	if d.readOnly() {
+		return errs.NewErr(errs.ErrCodeReadOnly, fmt.Errorf("db:%v opened as %v", d.dir, d.mode))
+	}
+	if d.bgErr.severity < HardError {
+		return nil
+	}
+	return errs.NewErr(errs.ErrCodeReadOnly, fmt.Errorf("%v:%v", d.bgErr.severity, d.bgErr.err))
+}
+
+// 执行flush和合并，失败或者panic时记录后台错误。调用方需要持有db.lock
+func (d *Db) backgroundWork() (err error) {
+	reason := BackgroundErrorFlush
+	defer func() {
+		if e := recover(); e != nil {
+			// panic时内存中的状态可能不完整，至少是HardError
+			err, _ = e.(error)
+			if err == nil {
+				err = errs.NewErr(errs.ErrCodeUnknown, fmt.Errorf("%v", e))
+			}
+			d.setBackgroundError(reason, err, HardError)
+		}
+	}()
+
+	err = d.flush()
+	if err != nil {
+		d.setBackgroundError(reason, err, NoError)
+		return err
+	}
+	reason = BackgroundErrorCompaction
+	for _, cf := range d.sortedColumnFamilies() {
+		err = cf.compact() // 检查是否触发sst合并
+		if err != nil {
+			d.setBackgroundError(reason, err, NoError)
+			return err
+		}
+	}
+	if d.bgErr.severity == SoftError {
+		d.logger.Info("background error cleared", "err", d.bgErr.err)
+		d.bgErr = backgroundError{}
+	}
+	return nil
+}
+
+// 记录后台错误，只保留最严重的一个。调用方需要持有db.lock
+func (d *Db) setBackgroundError(reason BackgroundErrorReason, err error, atLeast ErrorSeverity) {
+	severity := SoftError
+	if code, _ := errs.FromError(err); code == errs.ErrCodeChecksum {
+		severity = FatalError
+	} else if reason == BackgroundErrorFlush {
+		severity = HardError
+	}
+	if severity < atLeast {
+		severity = atLeast
+	}
+	if severity > d.bgErr.severity {
+		d.bgErr = backgroundError{err: err, severity: severity}
+	}
+	d.logger.Error("background error", "reason", reason, "severity", severity, "err", err)
+	info := BackgroundErrorInfo{Reason: reason, Severity: severity, Err: err}
+	d.events.push(func(l EventListener) { l.OnBackgroundError(info) })
+}
@@ -0,0 +1,347 @@
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"lsmtree/errs"
+	"lsmtree/vfs"
+)
+
+/*
+BackupEngine 增量备份，目录结构：
+
+	shared/{sha256}_{size}.db  所有备份共享的sst，按内容命名，内容不变的sst只保存一份
+	private/{id}/...           每个备份自己的wal和MANIFEST
+	meta/{id}.json             备份包含的文件列表和校验和
+
+sst的文件名在合并后会被复用，所以不能按文件名判断sst是否变化。
+*/
+type BackupEngine struct {
+	dir string
+	fs  vfs.FS
+}
+
+// BackupInfo 一个备份的信息
+type BackupInfo struct {
+	ID        int
+	Timestamp int64 // 创建时间，UnixNano
+	Size      int64 // 所有文件的大小之和，包括共享的sst
+	Files     []BackupFile
+}
+
+// BackupFile 备份中的一个文件
+type BackupFile struct {
+	Path     string // 相对db目录的路径
+	Shared   bool   // 是否保存在shared目录下
+	Size     int64
+	Checksum string // sha256
+}
+
+const (
+	backupSharedDir  = "shared"
+	backupPrivateDir = "private"
+	backupMetaDir    = "meta"
+	backupTmpDir     = "tmp"
+)
+
+// OpenBackupEngine 打开dir下的备份，dir不存在时创建
+func OpenBackupEngine(dir string) (*BackupEngine, error) {
+	return OpenBackupEngineFS(vfs.Default, dir)
+}
+
+// OpenBackupEngineFS 打开fs上dir下的备份。备份的db可以在另一个文件系统上，恢复的db和备份在同一个文件系统上
+func OpenBackupEngineFS(fs vfs.FS, dir string) (*BackupEngine, error) {
+	for _, sub := range []string{backupSharedDir, backupPrivateDir, backupMetaDir} {
+		err := fs.MkdirAll(path.Join(dir, sub), 0755)
+		if err != nil {
+			return nil, errs.NewErr(errs.ErrCodeBackup, err)
+		}
+	}
+	return &BackupEngine{dir: dir, fs: fs}, nil
+}
+
+// CreateBackup 先在db的文件系统上创建checkpoint，再将checkpoint中的文件放入备份目录，已经备份过的sst不会重复保存
+func (e *BackupEngine) CreateBackup(d *Db) (BackupInfo, error) {
+	infos, err := e.GetBackupInfo()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	id := 1
+	if len(infos) > 0 {
+		id = infos[len(infos)-1].ID + 1
+	}
+
+	tmp := path.Join(e.dir, backupTmpDir)
+	err = d.fs.RemoveAll(tmp) // 上次备份中断时残留的checkpoint
+	if err != nil {
+		return BackupInfo{}, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	defer d.fs.RemoveAll(tmp)
+	err = d.Checkpoint(tmp)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	info := BackupInfo{ID: id, Timestamp: time.Now().UnixNano()}
+	rels, err := walkFiles(d.fs, tmp, "")
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	for _, rel := range rels {
+		file, err := e.addFile(id, d.fs, path.Join(tmp, rel), rel)
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		info.Size += file.Size
+		info.Files = append(info.Files, file)
+	}
+
+	// meta最后写入，没有meta的备份视为不存在
+	data, err := json.Marshal(info)
+	if err != nil {
+		return BackupInfo{}, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	metaPath := e.metaPath(id)
+	err = vfs.WriteFile(e.fs, metaPath+".tmp", data)
+	if err != nil {
+		return BackupInfo{}, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	err = e.fs.Rename(metaPath+".tmp", metaPath)
+	if err == nil {
+		err = e.fs.Sync(path.Dir(metaPath))
+	}
+	if err != nil {
+		return BackupInfo{}, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	return info, nil
+}
+
+// 按名称顺序返回dir下所有文件相对于dir的路径，rel为dir相对于最外层目录的路径
+func walkFiles(fs vfs.FS, dir, rel string) ([]string, error) {
+	names, err := fs.List(path.Join(dir, rel))
+	if err != nil {
+		return nil, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	var files []string
+	for _, name := range names {
+		p := path.Join(rel, name)
+		if !isDir(fs, path.Join(dir, p)) {
+			files = append(files, p)
+			continue
+		}
+		sub, err := walkFiles(fs, dir, p)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sub...)
+	}
+	return files, nil
+}
+
+// 将checkpoint中的文件放入备份目录，sst放入shared目录，其他文件放入备份自己的目录
+func (e *BackupEngine) addFile(id int, srcFS vfs.FS, src, rel string) (BackupFile, error) {
+	checksum, size, err := fileChecksum(srcFS, src)
+	if err != nil {
+		return BackupFile{}, err
+	}
+	file := BackupFile{
+		Path:     rel,
+		Shared:   strings.HasSuffix(rel, ".db"),
+		Size:     size,
+		Checksum: checksum,
+	}
+	dst := e.filePath(id, file)
+	// 备份需要独立于db，即使是sst也复制而不是硬链接
+	if _, err := e.fs.Stat(dst); file.Shared && err == nil {
+		return file, nil
+	}
+	err = e.fs.MkdirAll(path.Dir(dst), 0755)
+	if err != nil {
+		return BackupFile{}, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	return file, copyFile(srcFS, src, e.fs, dst)
+}
+
+// GetBackupInfo 返回所有备份，按id从小到大排序
+func (e *BackupEngine) GetBackupInfo() ([]BackupInfo, error) {
+	files, err := e.fs.List(path.Join(e.dir, backupMetaDir))
+	if err != nil {
+		return nil, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	var infos []BackupInfo
+	for _, name := range files {
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		data, err := vfs.ReadFile(e.fs, path.Join(e.dir, backupMetaDir, name))
+		if err != nil {
+			return nil, errs.NewErr(errs.ErrCodeBackup, err)
+		}
+		var info BackupInfo
+		err = json.Unmarshal(data, &info)
+		if err != nil {
+			return nil, errs.NewErr(errs.ErrCodeBackup, fmt.Errorf("unmarshal %v err:%v", name, err))
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos, nil
+}
+
+// VerifyBackup 检查备份中每个文件都存在，并且大小和校验和与备份时一致
+func (e *BackupEngine) VerifyBackup(id int) error {
+	info, err := e.backupInfo(id)
+	if err != nil {
+		return err
+	}
+	for _, file := range info.Files {
+		checksum, size, err := fileChecksum(e.fs, e.filePath(id, file))
+		if err != nil {
+			return err
+		}
+		if size != file.Size || checksum != file.Checksum {
+			return errs.NewErr(errs.ErrCodeBackup, fmt.Errorf("backup:%v file:%v checksum mismatch", id, file.Path))
+		}
+	}
+	return nil
+}
+
+// RestoreDbFromBackup 将备份恢复到dbDir，dbDir不能已经存在。恢复前会校验备份
+func (e *BackupEngine) RestoreDbFromBackup(id int, dbDir string) error {
+	_, err := e.fs.Stat(dbDir)
+	if err == nil {
+		return errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("restore dir:%v already exists", dbDir))
+	}
+	err = e.VerifyBackup(id)
+	if err != nil {
+		return err
+	}
+	info, err := e.backupInfo(id)
+	if err != nil {
+		return err
+	}
+	for _, file := range info.Files {
+		dst := path.Join(dbDir, file.Path)
+		err = e.fs.MkdirAll(path.Dir(dst), 0755)
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeBackup, err)
+		}
+		err = copyFile(e.fs, e.filePath(id, file), e.fs, dst)
+		if err != nil {
+			return err
+		}
+	}
+	// 没有数据的目录不会出现在备份中，wal目录需要存在
+	err = e.fs.MkdirAll(path.Join(dbDir, "wal"), 0755)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	return nil
+}
+
+// DeleteBackup 删除备份，并清理不再被任何备份使用的sst
+func (e *BackupEngine) DeleteBackup(id int) error {
+	err := e.fs.Remove(e.metaPath(id))
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	err = e.fs.RemoveAll(path.Join(e.dir, backupPrivateDir, fmt.Sprint(id)))
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	return e.garbageCollect()
+}
+
+// PurgeOldBackups 只保留最新的keep个备份
+func (e *BackupEngine) PurgeOldBackups(keep int) error {
+	infos, err := e.GetBackupInfo()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(infos)-keep; i++ {
+		err = e.DeleteBackup(infos[i].ID)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 删除没有被任何备份引用的共享sst
+func (e *BackupEngine) garbageCollect() error {
+	infos, err := e.GetBackupInfo()
+	if err != nil {
+		return err
+	}
+	used := make(map[string]struct{})
+	for _, info := range infos {
+		for _, file := range info.Files {
+			if file.Shared {
+				used[path.Base(e.filePath(info.ID, file))] = struct{}{}
+			}
+		}
+	}
+	files, err := e.fs.List(path.Join(e.dir, backupSharedDir))
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	for _, name := range files {
+		if _, ok := used[name]; ok {
+			continue
+		}
+		err = e.fs.Remove(path.Join(e.dir, backupSharedDir, name))
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeBackup, err)
+		}
+	}
+	return nil
+}
+
+func (e *BackupEngine) backupInfo(id int) (BackupInfo, error) {
+	data, err := vfs.ReadFile(e.fs, e.metaPath(id))
+	if err != nil {
+		return BackupInfo{}, errs.NewErr(errs.ErrCodeBackup, fmt.Errorf("backup:%v err:%v", id, err))
+	}
+	var info BackupInfo
+	err = json.Unmarshal(data, &info)
+	if err != nil {
+		return BackupInfo{}, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	return info, nil
+}
+
+func (e *BackupEngine) metaPath(id int) string {
+	return path.Join(e.dir, backupMetaDir, fmt.Sprintf("%v.json", id))
+}
+
+// 文件在备份目录中的位置
+func (e *BackupEngine) filePath(id int, file BackupFile) string {
+	if file.Shared {
+		return path.Join(e.dir, backupSharedDir, fmt.Sprintf("%v_%v.db", file.Checksum, file.Size))
+	}
+	return path.Join(e.dir, backupPrivateDir, fmt.Sprint(id), file.Path)
+}
+
+func fileChecksum(fs vfs.FS, p string) (string, int64, error) {
+	f, err := fs.Open(p)
+	if err != nil {
+		return "", 0, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
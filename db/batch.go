@@ -0,0 +1,75 @@
+package db
+
+import (
+	"context"
+
+	"lsmtree/kv"
+	"lsmtree/wal"
+)
+
+// WriteBatch 批量写入，可以跨列族。Db.Write时所有操作作为一条wal记录写入，恢复时要么全部生效，要么全部不生效
+type WriteBatch struct {
+	db      *Db
+	records []wal.Record
+	err     error // 添加操作时的第一个错误，Write时返回
+}
+
+func (d *Db) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{db: d}
+}
+
+// SetKv cf为nil时写入默认列族，其他方法同理
+func (b *WriteBatch) SetKv(cf *ColumnFamily, val kv.Kv) {
+	b.records = append(b.records, b.cf(cf).setRecord(val))
+}
+
+func (b *WriteBatch) DeleteKv(cf *ColumnFamily, key []byte) {
+	b.records = append(b.records, b.cf(cf).deleteRecord(key))
+}
+
+func (b *WriteBatch) DeleteRange(cf *ColumnFamily, start, end []byte) {
+	rec, err := b.cf(cf).deleteRangeRecord(start, end)
+	b.add(rec, err)
+}
+
+func (b *WriteBatch) Merge(cf *ColumnFamily, key []byte, operand []byte) {
+	rec, err := b.cf(cf).mergeRecord(key, operand)
+	b.add(rec, err)
+}
+
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+func (b *WriteBatch) cf(cf *ColumnFamily) *ColumnFamily {
+	if cf == nil {
+		return b.db.DefaultColumnFamily()
+	}
+	return cf
+}
+
+func (b *WriteBatch) add(rec wal.Record, err error) {
+	if err != nil {
+		if b.err == nil {
+			b.err = err
+		}
+		return
+	}
+	b.records = append(b.records, rec)
+}
+
+// Write 原子地写入batch中的所有操作
+func (d *Db) Write(b *WriteBatch) error {
+	return d.WriteContext(context.Background(), b)
+}
+
+// WriteContext 可以取消的Write，取消规则见SetKvContext
+func (d *Db) WriteContext(ctx context.Context, b *WriteBatch) error {
+	if b.err != nil {
+		return b.err
+	}
+	if len(b.records) == 0 {
+		return nil
+	}
+	return d.writeNonTxn(ctx, wal.Record{Batch: b.records})
+}
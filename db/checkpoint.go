@@ -0,0 +1,127 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"lsmtree/errs"
+	"lsmtree/vfs"
+)
+
+// Checkpoint 在dir下创建db当前状态的一致性快照，dir可以作为一个独立的db打开。
+//
+//	sst写入后不会再修改，通过硬链接共享，不能硬链接时复制；wal还会被追加写入，需要复制。
+//	创建期间会阻塞写入和后台的flush、合并，保证sst不会被删除，wal不会被切换。dir不能已经存在。
+//	只读打开时不能阻塞写入db的其他进程，返回ErrCodeReadOnly
+func (d *Db) Checkpoint(dir string) error {
+	return d.CheckpointContext(context.Background(), dir)
+}
+
+// CheckpointContext 可以取消的Checkpoint。等待锁和复制每个文件之前检查ctx，取消或者失败时删除已经创建的dir
+func (d *Db) CheckpointContext(ctx context.Context, dir string) (err error) {
+	if d.readOnly() {
+		return errs.NewErr(errs.ErrCodeReadOnly, fmt.Errorf("db:%v opened as %v, can not checkpoint", d.dir, d.mode))
+	}
+	_, err = d.fs.Stat(dir)
+	if err == nil {
+		return errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("checkpoint dir:%v already exists", dir))
+	}
+
+	err = lockContext(ctx, d.writeLock)
+	if err != nil {
+		return err
+	}
+	defer d.writeLock.Unlock()
+	err = lockContext(ctx, readLocker{d.lock})
+	if err != nil {
+		return err
+	}
+	defer d.lock.RUnlock()
+	defer func() {
+		if err != nil {
+			_ = d.fs.RemoveAll(dir)
+		}
+	}()
+
+	for _, cf := range d.sortedColumnFamilies() {
+		err = copyDir(ctx, d.fs, sstDir(d.dir, cf.id), sstDir(dir, cf.id), true)
+		if err != nil {
+			return err
+		}
+	}
+	err = copyDir(ctx, d.fs, path.Join(d.dir, "wal"), path.Join(dir, "wal"), false)
+	if err != nil {
+		return err
+	}
+
+	m := *d.manifest
+	m.path = path.Join(dir, manifestFileName)
+	return m.save()
+}
+
+// 将src下的所有文件复制到dst后目录落盘，link为true时优先使用硬链接。src不存在时只创建dst。每个文件之前检查ctx
+func copyDir(ctx context.Context, fs vfs.FS, src, dst string, link bool) error {
+	err := fs.MkdirAll(dst, 0755)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	files, err := fs.List(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	for _, name := range files {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		from, to := path.Join(src, name), path.Join(dst, name)
+		if isDir(fs, from) {
+			continue
+		}
+		if link && fs.Link(from, to) == nil {
+			continue
+		}
+		err = copyFile(fs, from, fs, to)
+		if err != nil {
+			return err
+		}
+	}
+	err = fs.Sync(dst)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	return nil
+}
+
+// 将srcFS上的src复制到dstFS上的dst并落盘
+func copyFile(srcFS vfs.FS, src string, dstFS vfs.FS, dst string) error {
+	in, err := srcFS.Open(src)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	defer in.Close()
+	out, err := dstFS.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, fmt.Errorf("copy %v err:%v", src, err))
+	}
+	err = out.Sync()
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeBackup, err)
+	}
+	return nil
+}
+
+func isDir(fs vfs.FS, name string) bool {
+	info, err := fs.Stat(name)
+	return err == nil && info.IsDir()
+}
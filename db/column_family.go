@@ -0,0 +1,399 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"time"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+	"lsmtree/memtable"
+	"lsmtree/sstable"
+	"lsmtree/wal"
+)
+
+const DefaultColumnFamilyName = "default"
+
+// ColumnFamily 列族，每个列族有自己的memtable、immemtable和tabletree，所有列族共用一个wal和MANIFEST。
+//
+//	通过Db.CreateColumnFamily或Db.ColumnFamily获取，Db上的读写方法都作用于默认列族
+type ColumnFamily struct {
+	id   int
+	name string
+	opts ColumnFamilyOptions
+	db   *Db
+
+	// 以下字段由db.lock保护
+	mem     memtable.MemtableOp
+	imm     []memtable.ImmemtableOp // 从新到旧排序
+	sst     sstable.TableTreeOp
+	dropped bool
+}
+
+func (cf *ColumnFamily) Name() string {
+	return cf.name
+}
+
+// 默认列族的sst放在sst目录下，其他列族使用自己的id区分目录
+func sstDir(dir string, id int) string {
+	if id == 0 {
+		return path.Join(dir, "sst")
+	}
+	return path.Join(dir, fmt.Sprintf("sst_%v", id))
+}
+
+func (d *Db) newColumnFamily(id int, name string, opts ColumnFamilyOptions) (*ColumnFamily, error) {
+	cf := &ColumnFamily{
+		id:   id,
+		name: name,
+		opts: opts,
+		db:   d,
+	}
+	sst, err := cf.restoreTableTree()
+	if err != nil {
+		return nil, err
+	}
+	cf.sst = sst
+	return cf, nil
+}
+
+// 从列族的sst目录构建tabletree
+func (cf *ColumnFamily) restoreTableTree() (sstable.TableTreeOp, error) {
+	return sstable.RestoreTableTree(sstDir(cf.db.dir, cf.id), sstable.Options{
+		MergeOperator: cf.mergeOperator(),
+		Now:           cf.db.opts.Now,
+		LevelLimit:    cf.opts.LevelLimit,
+		Marshaller:    cf.opts.Marshaller,
+		Comparator:    cf.db.opts.Comparator,
+
+		VerifyChecksums: cf.db.opts.VerifyChecksumsInCompaction,
+		ReadOnly:        cf.db.readOnly(),
+		Stats:           cf.db.stats,
+		Logger:          cf.db.logger,
+		FS:              cf.db.fs,
+	})
+}
+
+func (cf *ColumnFamily) mergeOperator() kv.MergeOperator {
+	if cf.opts.MergeOperator != nil {
+		return cf.opts.MergeOperator
+	}
+	return cf.db.opts.MergeOperator
+}
+
+// 创建一个新的memtable，使用当前wal的path作为名称
+func (cf *ColumnFamily) newMemtable() memtable.MemtableOp {
+	mem := memtable.NewMemtableWithComparator(cf.db.w.GetPath(), cf.db.opts.Comparator)
+	mem.SetLimit(cf.opts.MemtableSize)
+	return mem
+}
+
+// SetKv 写入kv，val.ExpireAt不为0时，key在这个时间之后视为不存在
+func (cf *ColumnFamily) SetKv(val kv.Kv) error {
+	return cf.SetKvContext(context.Background(), val)
+}
+
+// SetKvContext 可以取消的SetKv，写入的取消规则见Db.SetKvContext
+func (cf *ColumnFamily) SetKvContext(ctx context.Context, val kv.Kv) error {
+	return cf.db.writeNonTxn(ctx, cf.setRecord(val))
+}
+
+func (cf *ColumnFamily) setRecord(val kv.Kv) wal.Record {
+	val = kv.Kv{
+		Key:      val.Key,
+		Value:    val.Value,
+		ExpireAt: val.ExpireAt,
+	}
+	if val.ExpireAt == 0 && cf.db.opts.DefaultTTL > 0 {
+		val.ExpireAt = cf.db.opts.now().Add(cf.db.opts.DefaultTTL).UnixNano()
+	}
+	return wal.Record{Kv: val, CF: cf.id}
+}
+
+func (cf *ColumnFamily) DeleteKv(key []byte) error {
+	return cf.DeleteKvContext(context.Background(), key)
+}
+
+func (cf *ColumnFamily) DeleteKvContext(ctx context.Context, key []byte) error {
+	return cf.db.writeNonTxn(ctx, cf.deleteRecord(key))
+}
+
+func (cf *ColumnFamily) deleteRecord(key []byte) wal.Record {
+	val := kv.Kv{
+		Key:     key,
+		Value:   nil,
+		Deleted: true,
+	}
+	return wal.Record{Kv: val, CF: cf.id}
+}
+
+// DeleteRange 删除[start, end)内的所有key，只写入一条范围删除记录
+func (cf *ColumnFamily) DeleteRange(start, end []byte) error {
+	return cf.DeleteRangeContext(context.Background(), start, end)
+}
+
+func (cf *ColumnFamily) DeleteRangeContext(ctx context.Context, start, end []byte) error {
+	rec, err := cf.deleteRangeRecord(start, end)
+	if err != nil {
+		return err
+	}
+	return cf.db.writeNonTxn(ctx, rec)
+}
+
+func (cf *ColumnFamily) deleteRangeRecord(start, end []byte) (wal.Record, error) {
+	if cf.db.opts.comparator().Compare(start, end) >= 0 {
+		return wal.Record{}, errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("start:%q >= end:%q", start, end))
+	}
+	val := kv.Kv{
+		Key:   start,
+		Value: end,
+		Kind:  kv.KindRangeDelete,
+	}
+	return wal.Record{Kv: val, CF: cf.id}, nil
+}
+
+// Merge 写入一个合并操作数，读取时使用MergeOperator与已有的值合并
+func (cf *ColumnFamily) Merge(key []byte, operand []byte) error {
+	return cf.MergeContext(context.Background(), key, operand)
+}
+
+func (cf *ColumnFamily) MergeContext(ctx context.Context, key []byte, operand []byte) error {
+	rec, err := cf.mergeRecord(key, operand)
+	if err != nil {
+		return err
+	}
+	return cf.db.writeNonTxn(ctx, rec)
+}
+
+func (cf *ColumnFamily) mergeRecord(key []byte, operand []byte) (wal.Record, error) {
+	op := cf.mergeOperator()
+	if op == nil {
+		return wal.Record{}, errs.New(errs.ErrCodeMergeOperator)
+	}
+	// 提前检查操作数本身能否被合并，避免读取时才发现
+	_, err := op.FullMerge(key, nil, [][]byte{operand})
+	if err != nil {
+		return wal.Record{}, errs.NewErr(errs.ErrCodeMergeOperator, err)
+	}
+	val := kv.Kv{
+		Key:      key,
+		Kind:     kv.KindMerge,
+		Operands: [][]byte{operand},
+	}
+	return wal.Record{Kv: val, CF: cf.id}, nil
+}
+
+// 将一条已经写入wal的记录写入memtable，调用方需要持有db.lock
+func (cf *ColumnFamily) apply(val kv.Kv) {
+	apply(cf.mem, val)
+}
+
+func apply(mem memtable.MemtableOp, val kv.Kv) {
+	switch {
+	case val.Kind == kv.KindRangeDelete:
+		mem.DeleteRange(val.Key, val.Value)
+	case val.Kind == kv.KindMerge:
+		for _, operand := range val.Operands {
+			mem.MergeOperand(val.Key, operand)
+		}
+	case val.Deleted:
+		mem.Delete(val.Key)
+	default:
+		mem.Put(val)
+	}
+}
+
+// GetKv 读取key。sst损坏时记录错误日志并返回kv.None，需要区分损坏和不存在时使用GetKvContext
+func (cf *ColumnFamily) GetKv(key []byte) (kv.Kv, kv.SearchResult) {
+	val, result, err := cf.GetKvContext(context.Background(), key) // 不会取消
+	if err != nil {
+		cf.db.logger.Error("get key failed", "cf", cf.name, "key", string(key), "err", err)
+	}
+	return val, result
+}
+
+// GetKvContext 可以取消的GetKv，后台flush、合并持有db.lock时，等待期间ctx取消返回ctx.Err()。
+// sst损坏时返回错误，校验和不一致时为ErrCodeChecksum。只影响这次读取，不会记录为后台错误，db可以继续写入
+func (cf *ColumnFamily) GetKvContext(ctx context.Context, key []byte) (kv.Kv, kv.SearchResult, error) {
+	start := time.Now()
+	err := lockContext(ctx, readLocker{cf.db.lock})
+	if err != nil {
+		return kv.Kv{}, kv.None, err
+	}
+	val, result, err := cf.getKv(key)
+	cf.db.lock.RUnlock()
+	if err != nil {
+		return kv.Kv{}, kv.None, err
+	}
+	cf.db.stats.recordGet(val, result, start)
+	return val, result, nil
+}
+
+// 调用方需要持有db.lock的读锁
+func (cf *ColumnFamily) getKv(key []byte) (kv.Kv, kv.SearchResult, error) {
+	if cf.dropped {
+		return kv.Kv{}, kv.None, nil
+	}
+	// 遇到合并记录时需要继续向更旧的数据查找基准值
+	chain := kv.MergeChain{Now: cf.db.opts.now().UnixNano()} // 过期的key视为已删除
+	if chain.Add(cf.mem.Search(key)) {
+		cf.db.logger.Debug("get key", "cf", cf.name, "key", string(key), "from", "memtable")
+		cf.db.stats.memtableHit.Add(1)
+		res, result := cf.resolve(chain.Result())
+		return res, result, nil
+	}
+
+	for _, imm := range cf.imm { // 从新到旧遍历immemtable，然后进行二分查找
+		if chain.Add(imm.Search(key)) {
+			cf.db.logger.Debug("get key", "cf", cf.name, "key", string(key), "from", "immemtable")
+			cf.db.stats.memtableHit.Add(1)
+			res, result := cf.resolve(chain.Result())
+			return res, result, nil
+		}
+	}
+	cf.db.stats.memtableMiss.Add(1)
+
+	res, result, err := cf.sst.Search(key) //从tabletree上检索key
+	if err != nil {
+		return kv.Kv{}, kv.None, err
+	}
+	chain.Add(res, result)
+	if _, result := chain.Result(); result != kv.None {
+		cf.db.logger.Debug("get key", "cf", cf.name, "key", string(key), "from", "sst")
+	}
+	res, result = cf.resolve(chain.Result())
+	return res, result, nil
+}
+
+// 合并查找到的操作数
+func (cf *ColumnFamily) resolve(res kv.Kv, result kv.SearchResult) (kv.Kv, kv.SearchResult) {
+	if result != kv.Success {
+		return kv.Kv{}, result
+	}
+	merged, err := kv.Resolve(cf.mergeOperator(), res, cf.db.opts.now().UnixNano())
+	if err != nil {
+		cf.db.logger.Warn("merge failed", "cf", cf.name, "key", string(res.Key), "err", err)
+		return kv.Kv{}, kv.None
+	}
+	return merged, kv.Success
+}
+
+// 将imm转化为sst，从旧到新写入，保证越新的imm对应的sst index越大。
+// 每个imm写入sst后立即移除，并把它的wal加入walPaths，失败重试时不会重复写入。调用方需要持有db.lock
+func (cf *ColumnFamily) flush(walPaths map[string]struct{}) error {
+	for i := len(cf.imm) - 1; i >= 0; i-- {
+		imm := cf.imm[i]
+		cf.db.setStall(WriteStallStopped)
+		info := FlushJobInfo{ColumnFamily: cf.name, WalFile: imm.GetName(), Keys: len(imm.GetValues())}
+		begin := info
+		cf.db.events.push(func(l EventListener) { l.OnFlushBegin(begin) })
+		start := time.Now()
+		err := cf.sst.Insert(imm) // 将imm转化为sst，放入tabletree管理
+		if err != nil {
+			return err
+		}
+		cf.imm = cf.imm[:i]
+		walPaths[imm.GetName()] = struct{}{}
+		info.Duration = time.Since(start)
+		files, err := cf.sst.Files()
+		if err != nil {
+			return err
+		}
+		info.File = files[0][len(files[0])-1] // 新的sst放在第0层的最后
+		cf.db.events.push(func(l EventListener) { l.OnFlushCompleted(info) })
+		cf.db.logger.Info("flush immemtable", "cf", cf.name, "file", imm.GetName(), "duration", info.Duration)
+	}
+	return nil
+}
+
+// 检查是否触发sst合并。调用方需要持有db.lock
+func (cf *ColumnFamily) compact() error {
+	levels := cf.sst.CheckCompactLevels() // 检查是否触发sst合并
+	for _, level := range levels {
+		err := cf.compactLevel(level) // 将level的所有sst合并为一个sst后，放入level+1的tabletree上
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 将所有sst合并到最深的一层，每合并一层之前检查ctx，取消时已经完成的合并不会回滚。调用方需要持有db.lock
+func (cf *ColumnFamily) compactAll(ctx context.Context) error {
+	for level := 0; ; level++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		levels := cf.sst.Levels()
+		if level >= len(levels) {
+			return nil
+		}
+		if level == len(levels)-1 && levels[level] <= 1 {
+			return nil
+		}
+		if levels[level] == 0 {
+			continue
+		}
+		err := cf.compactLevel(level)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 调用方需要持有db.lock
+func (cf *ColumnFamily) compactLevel(level int) error {
+	cf.db.setStall(WriteStallStopped)
+	info := CompactionJobInfo{ColumnFamily: cf.name, Level: level, OutputLevel: level + 1}
+	files, err := cf.sst.Files()
+	if err != nil {
+		return err
+	}
+	info.Inputs = append(info.Inputs, files[level]...)
+	for _, file := range info.Inputs {
+		info.ReadBytes += file.Size
+	}
+	begin := info
+	cf.db.events.push(func(l EventListener) { l.OnCompactionBegin(begin) })
+
+	start := time.Now()
+	err = cf.sst.CompactLevel(level)
+	if err != nil {
+		return err
+	}
+	info.Duration = time.Since(start)
+	files, err = cf.sst.Files()
+	if err != nil {
+		return err
+	}
+	output := files[level+1][len(files[level+1])-1] // 合并产生的sst放在下一层的最后
+	info.Outputs = []sstable.TableFileInfo{output}
+	info.WriteBytes = output.Size
+	for _, file := range info.Inputs {
+		deleted := file
+		cf.db.events.push(func(l EventListener) { l.OnTableFileDeleted(deleted) })
+	}
+	cf.db.events.push(func(l EventListener) { l.OnCompactionCompleted(info) })
+	cf.db.logger.Info("compact level", "cf", cf.name, "level", level, "duration", info.Duration)
+	return nil
+}
+
+// ColumnFamilyStats 列族当前的状态
+type ColumnFamilyStats struct {
+	Name         string
+	MemtableKeys int   // memtable中kv的个数
+	Immemtables  int   // 还没有写入sst的immemtable个数
+	Levels       []int // 每一层sst的个数
+}
+
+func (cf *ColumnFamily) Stats() ColumnFamilyStats {
+	cf.db.lock.RLock()
+	defer cf.db.lock.RUnlock()
+	return ColumnFamilyStats{
+		Name:         cf.name,
+		MemtableKeys: len(cf.mem.GetValues()),
+		Immemtables:  len(cf.imm),
+		Levels:       cf.sst.Levels(),
+	}
+}
@@ -0,0 +1,46 @@
+package db
+
+import (
+	"context"
+	"sync"
+)
+
+// 在ctx取消之前获取l，取消时返回ctx.Err()。
+//
+//	sync.Mutex的等待不能取消，有竞争时在另一个goroutine中等待；ctx先取消时，由这个goroutine在获取到锁之后立即释放
+func lockContext(ctx context.Context, l sync.Locker) error {
+	if ctx.Done() == nil { // context.Background等永远不会取消的ctx
+		l.Lock()
+		return nil
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if t, ok := l.(interface{ TryLock() bool }); ok && t.TryLock() {
+		return nil
+	}
+	locked := make(chan struct{})
+	go func() {
+		l.Lock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+		return nil
+	case <-ctx.Done():
+		go func() {
+			<-locked
+			l.Unlock()
+		}()
+		return ctx.Err()
+	}
+}
+
+// 将RWMutex的读锁作为sync.Locker，用于lockContext
+type readLocker struct {
+	rw *sync.RWMutex
+}
+
+func (l readLocker) Lock()         { l.rw.RLock() }
+func (l readLocker) Unlock()       { l.rw.RUnlock() }
+func (l readLocker) TryLock() bool { return l.rw.TryRLock() }
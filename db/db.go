@@ -1,125 +1,659 @@
 package db
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"io"
+	"os"
 	"path"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"lsmtree/errs"
 	"lsmtree/kv"
+	"lsmtree/logger"
 	"lsmtree/memtable"
-	"lsmtree/sstable"
+	"lsmtree/vfs"
 	"lsmtree/wal"
 )
 
 type Db struct {
-	mem memtable.MemtableOp
-	w   *wal.Wal
-	sst sstable.TableTreeOp
-	imm []memtable.ImmemtableOp // 后续imm列表是从新到旧排序的。后续查找imm时直接顺序查找即可。
+	w         *wal.Wal
+	cfs       map[int]*ColumnFamily // 所有列族共用一个wal，默认列族的id为0
+	defaultCF *ColumnFamily
+	manifest  *manifest
+	dir       string
+	fs        vfs.FS
+	dirLock   io.Closer // dir/LOCK上的排他锁，Shutdown时释放。只读打开时为nil
+	mode      openMode
 
-	lock   *sync.RWMutex // 保护memtable到immemtable，wal的删除，immemtable到sstable，sstable的合并。
-	stopCh chan struct{}
+	obsoleteWals map[string]struct{} // 数据已经写入sst或者只属于已删除列族的wal，所有列族的imm都写入sst之后删除
+
+	lock      *sync.RWMutex // 保护memtable到immemtable，wal的删除，immemtable到sstable，sstable的合并。
+	writeLock *sync.Mutex   // 保证wal和memtable的写入顺序一致
+	txns      *txnTracker   // 由writeLock保护
+	locks     *lockManager
+	stopCh    chan struct{} // 关闭时通知后台goroutine退出
+	stopOnce  *sync.Once
+	stopped   chan struct{} // 后台goroutine退出时关闭
+	closed    *atomic.Bool  // Close开始后为true，之后的写入返回ErrCodeDbClosed
+	closeLock *sync.Mutex   // 保护closeDone和closeErr，同时只有一个Close在执行
+	closeDone bool          // Close已经完成，等待后台任务超时的Close不算完成
+	closeErr  error
+	opts      Options
+	stats     *Statistics
+	logger    logger.Logger
+	events    *eventQueue
+	stall     WriteStallCondition // 由db.lock保护
+	bgErr     backgroundError
 }
 
+const lockFileName = "LOCK"
+
 // 程序启动时
 func (d *Db) Init(dir string) *Db {
-	// 构建tabletree
-	d.sst = sstable.RestoreTableTree(path.Join(dir, "sst"))
+	return d.InitWithOptions(dir, Options{})
+}
+
+// InitWithOptions 打开dir下的db，失败时panic。dir已经被打开时panic的错误为ErrCodeDbLocked
+func (d *Db) InitWithOptions(dir string, opts Options) *Db {
+	err := d.open(dir, opts, modePrimary)
+	if err != nil {
+		panic(err)
+	}
+	return d
+}
+
+// Open 打开dir下的db，dir不存在时创建。dir已经被其他进程或者Db打开时返回ErrCodeDbLocked
+func Open(dir string, opts Options) (*Db, error) {
+	return open(dir, opts, modePrimary)
+}
+
+func open(dir string, opts Options, mode openMode) (*Db, error) {
+	d := &Db{}
+	err := d.open(dir, opts, mode)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// 先获取dir/LOCK上的排他锁，避免两个进程同时写入wal和sst。恢复失败时释放锁。
+// 只读打开时不获取锁，不修改dir下的任何文件，也不启动后台goroutine
+func (d *Db) open(dir string, opts Options, mode openMode) (err error) {
+	d.mode = mode
+	d.closed = &atomic.Bool{}
+	d.closeLock = &sync.Mutex{}
+	d.closeErr = nil
+	d.opts = opts
+	d.dir = dir
+	d.fs = opts.fs()
+	d.stats = &Statistics{}
+	d.logger = logger.OrNop(opts.Logger)
+	d.events = newEventQueue(opts.EventListeners)
+	if d.readOnly() {
+		_, err = d.fs.Stat(dir)
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeInvalidArgument, err)
+		}
+	} else {
+		err = d.fs.MkdirAll(dir, 0755)
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeInvalidArgument, err)
+		}
+		d.dirLock, err = d.fs.Lock(path.Join(dir, lockFileName))
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeDbLocked, fmt.Errorf("dir:%v err:%v", dir, err))
+		}
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			var ok bool
+			if err, ok = e.(error); !ok {
+				err = errs.NewErr(errs.ErrCodeUnknown, fmt.Errorf("%v", e))
+			}
+		}
+		if err != nil && d.dirLock != nil {
+			d.dirLock.Close()
+		}
+	}()
+
+	m, err := loadManifest(d.fs, dir)
+	if err != nil {
+		return err
+	}
+	err = m.checkComparator(opts.comparator(), dir)
+	if err != nil {
+		return err
+	}
+	if m.Comparator == "" && !d.readOnly() {
+		// 记录Comparator的名称，之后使用其他Comparator打开时返回错误
+		m.Comparator = opts.comparator().Name()
+		err = m.save()
+		if err != nil {
+			return err
+		}
+	}
+	d.manifest = m
 
-	d.w = wal.New()
-	d.mem, d.imm = d.w.Restore(path.Join(dir, "wal"))
+	// 构建每个列族的tabletree
+	d.cfs = make(map[int]*ColumnFamily)
+	records := append([]columnFamilyRecord{{ID: 0, Name: DefaultColumnFamilyName}}, m.ColumnFamilies...)
+	for _, record := range records {
+		cf, err := d.newColumnFamily(record.ID, record.Name, opts.ColumnFamilies[record.Name])
+		if err != nil {
+			return err
+		}
+		d.cfs[record.ID] = cf
+	}
+	d.defaultCF = d.cfs[0]
+
+	// 从wal恢复每个列族的memtable和immemtable，已经删除的列族的记录会被忽略
+	d.w = d.newWal()
+	mems, imms := d.w.RestoreColumnFamilies(path.Join(dir, "wal"))
+	for id, cf := range d.cfs {
+		cf.mem = cf.newMemtable()
+		if mem, ok := mems[id]; ok {
+			cf.mem = mem
+			cf.mem.SetLimit(cf.opts.MemtableSize)
+		}
+		cf.imm = imms[id]
+	}
+	d.obsoleteWals = make(map[string]struct{})
+	for id, list := range imms {
+		if _, ok := d.cfs[id]; ok {
+			continue
+		}
+		for _, imm := range list {
+			d.obsoleteWals[imm.GetName()] = struct{}{}
+		}
+	}
 
 	d.lock = &sync.RWMutex{}
+	d.writeLock = &sync.Mutex{}
+	d.txns = newTxnTracker(opts.comparator())
+	d.locks = newLockManager()
 	d.stopCh = make(chan struct{})
+	d.stopOnce = &sync.Once{}
+	d.stopped = make(chan struct{})
+	if d.readOnly() {
+		return nil
+	}
 	// 触发后台进程
 	d.DemonTask()
-	return d
+	return nil
 }
 
+func (d *Db) newWal() *wal.Wal {
+	return wal.NewWithOptions(wal.Options{
+		FS:         d.fs,
+		Logger:     d.logger,
+		Sync:       d.opts.Sync,
+		ReadOnly:   d.readOnly(),
+		Comparator: d.opts.Comparator,
+	})
+}
+
+// Shutdown 关闭db，失败时只记录日志，见Close
 func (d *Db) Shutdown() {
-	d.stopCh <- struct{}{}
-	d.demonTask()
+	err := d.Close()
+	if err != nil {
+		d.logger.Error("close db failed", "dir", d.dir, "err", err)
+	}
+}
+
+// Close 关闭db，可以重复调用，完成之后的调用返回完成时的结果。
+//
+//	先拒绝新的写入，之后的写入返回ErrCodeDbClosed；再停止后台goroutine，等待正在执行的flush、合并结束，
+//	最多等待Options.CloseTimeout，超时时返回ErrCodeDbClosed，不会关闭文件和释放目录锁，可以再次调用Close继续等待。
+//	然后将immemtable写入sst并检查合并，Options.FlushOnClose时memtable也写入sst；
+//	最后将wal落盘，关闭所有wal和sst文件并释放目录锁。这期间产生的事件在Close返回前调用。Close之后不能再读取db
+func (d *Db) Close() error {
+	d.closeLock.Lock()
+	defer d.closeLock.Unlock()
+	if d.closeDone {
+		return d.closeErr
+	}
+	timeout, err := d.close()
+	if timeout {
+		return err
+	}
+	d.closeDone, d.closeErr = true, err
+	return err
+}
+
+// 返回的timeout为true时后台任务还没有结束，没有关闭任何文件
+func (d *Db) close() (bool, error) {
+	d.closed.Store(true)
+	if !d.readOnly() {
+		d.stopOnce.Do(func() { close(d.stopCh) })
+		if d.opts.CloseTimeout > 0 {
+			timer := time.NewTimer(d.opts.CloseTimeout)
+			defer timer.Stop()
+			select {
+			case <-d.stopped:
+			case <-timer.C:
+				return true, errs.NewErr(errs.ErrCodeDbClosed, fmt.Errorf("timeout after %v waiting for background work", d.opts.CloseTimeout))
+			}
+		}
+		<-d.stopped
+	}
+
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var first error
+	keep := func(err error) {
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	if !d.readOnly() && d.bgErr.severity < HardError {
+		if d.opts.FlushOnClose {
+			d.rotateNonEmptyMemtables()
+		}
+		keep(d.backgroundWork())
+		d.setStall(WriteStallNormal)
+	}
+	d.events.dispatch() // 后台goroutine已经退出
+	keep(d.w.Close())
+	for _, cf := range d.sortedColumnFamilies() {
+		keep(cf.sst.Close())
+	}
+	if d.dirLock != nil {
+		keep(d.dirLock.Close())
+	}
+	d.logger.Debug("db closed", "dir", d.dir, "err", first)
+	return false, first
+}
+
+// 停止后台goroutine并释放目录锁，不执行flush，也不关闭文件，相当于进程退出
+func (d *Db) stop() {
+	if d.readOnly() {
+		return
+	}
+	d.stopOnce.Do(func() { close(d.stopCh) }) // 后台goroutine退出前会调用剩余的事件
+	<-d.stopped
+	d.dirLock.Close()
+}
+
+// DefaultColumnFamily 返回默认列族，Db上的读写方法都作用于默认列族
+func (d *Db) DefaultColumnFamily() *ColumnFamily {
+	return d.defaultCF
+}
+
+// ColumnFamily 根据名称获取列族，不存在时返回nil
+func (d *Db) ColumnFamily(name string) *ColumnFamily {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	for _, cf := range d.cfs {
+		if cf.name == name {
+			return cf
+		}
+	}
+	return nil
+}
+
+// CreateColumnFamily 创建一个列族并记录到MANIFEST
+func (d *Db) CreateColumnFamily(name string, opts ColumnFamilyOptions) (*ColumnFamily, error) {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	for _, cf := range d.cfs {
+		if cf.name == name {
+			return nil, errs.NewErr(errs.ErrCodeColumnFamily, fmt.Errorf("column family:%v already exists", name))
+		}
+	}
+	id := d.manifest.NextID
+	cf, err := d.newColumnFamily(id, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	d.manifest.NextID++
+	d.manifest.ColumnFamilies = append(d.manifest.ColumnFamilies, columnFamilyRecord{ID: id, Name: name})
+	err = d.manifest.save()
+	if err != nil {
+		_ = cf.sst.Close()
+		return nil, err
+	}
+
+	cf.mem = cf.newMemtable()
+	d.cfs[id] = cf
+	return cf, nil
+}
+
+// ColumnFamilies 返回所有列族，按创建顺序排序
+func (d *Db) ColumnFamilies() []*ColumnFamily {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return d.sortedColumnFamilies()
+}
+
+// DropColumnFamily 删除列族和它的所有sst。默认列族不能删除
+func (d *Db) DropColumnFamily(cf *ColumnFamily) error {
+	if cf.id == 0 {
+		return errs.NewErr(errs.ErrCodeColumnFamily, fmt.Errorf("can not drop default column family"))
+	}
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+
+	if cf.dropped {
+		return nil
+	}
+	files, err := cf.sst.Files()
+	if err != nil {
+		return err
+	}
+	var list []columnFamilyRecord
+	for _, record := range d.manifest.ColumnFamilies {
+		if record.ID != cf.id {
+			list = append(list, record)
+		}
+	}
+	d.manifest.ColumnFamilies = list
+	err = d.manifest.save()
+	if err != nil {
+		return err
+	}
+
+	// wal中这个列族的记录在恢复时会被忽略，只需要删除sst
+	for _, level := range files {
+		for _, file := range level {
+			deleted := file
+			d.events.push(func(l EventListener) { l.OnTableFileDeleted(deleted) })
+		}
+	}
+	_ = cf.sst.Close() // 文件随后被删除，关闭失败不影响删除
+	cf.dropped = true
+	delete(d.cfs, cf.id)
+	for _, imm := range cf.imm {
+		d.obsoleteWals[imm.GetName()] = struct{}{}
+	}
+	return d.fs.RemoveAll(sstDir(d.dir, cf.id))
 }
 
+// SetKv 写入kv，val.ExpireAt不为0时，key在这个时间之后视为不存在
 func (d *Db) SetKv(val kv.Kv) error {
-	err := d.w.Write(val)
+	return d.DefaultColumnFamily().SetKv(val)
+}
+
+// SetKvContext 可以取消的SetKv。
+//
+//	等待其他写入释放写锁、等待后台flush和合并(写入被阻塞)时，ctx取消返回ctx.Err()，写入不会生效；
+//	开始写入wal之后不再检查ctx。其他写入方法的Context版本同理
+func (d *Db) SetKvContext(ctx context.Context, val kv.Kv) error {
+	return d.DefaultColumnFamily().SetKvContext(ctx, val)
+}
+
+func (d *Db) DeleteKv(key []byte) error {
+	return d.DefaultColumnFamily().DeleteKv(key)
+}
+
+func (d *Db) DeleteKvContext(ctx context.Context, key []byte) error {
+	return d.DefaultColumnFamily().DeleteKvContext(ctx, key)
+}
+
+// DeleteRange 删除[start, end)内的所有key，只写入一条范围删除记录
+func (d *Db) DeleteRange(start, end []byte) error {
+	return d.DefaultColumnFamily().DeleteRange(start, end)
+}
+
+func (d *Db) DeleteRangeContext(ctx context.Context, start, end []byte) error {
+	return d.DefaultColumnFamily().DeleteRangeContext(ctx, start, end)
+}
+
+// Merge 写入一个合并操作数，读取时使用Options.MergeOperator与已有的值合并
+func (d *Db) Merge(key []byte, operand []byte) error {
+	return d.DefaultColumnFamily().Merge(key, operand)
+}
+
+func (d *Db) MergeContext(ctx context.Context, key []byte, operand []byte) error {
+	return d.DefaultColumnFamily().MergeContext(ctx, key, operand)
+}
+
+func (d *Db) GetKv(key []byte) (kv.Kv, kv.SearchResult) {
+	return d.DefaultColumnFamily().GetKv(key)
+}
+
+func (d *Db) GetKvContext(ctx context.Context, key []byte) (kv.Kv, kv.SearchResult, error) {
+	return d.DefaultColumnFamily().GetKvContext(ctx, key)
+}
+
+// Statistics 返回db打开以来的统计
+func (d *Db) Statistics() *Statistics {
+	return d.stats
+}
+
+// 将记录写入wal和对应列族的memtable。等待锁时ctx取消返回ctx.Err()
+func (d *Db) write(ctx context.Context, rec wal.Record) error {
+	start := time.Now()
+	err := lockContext(ctx, d.writeLock)
 	if err != nil {
 		return err
 	}
-	d.mem.Set(val.Key, val.Value)
-	if d.mem.CheckCap() {
-		fmt.Printf("mem->imm,%v\n", d.mem.GetName())
-		d.lock.Lock()
-		d.w = d.w.Reset()
-		d.imm = append(d.imm, memtable.NewImmemtable(d.mem))
-		d.mem = memtable.NewMemtable(d.w.GetPath())
-		d.lock.Unlock()
+	defer d.writeLock.Unlock()
+	err = d.writeLocked(ctx, rec)
+	d.stats.putLatency.Add(time.Since(start))
+	return err
+}
+
+// 事务之外的写入。Options.TransactionDB为true时，先对写入的key加行锁，写入后释放，
+// 不会覆盖悲观事务已经加锁但还没有提交的key。等待行锁超时返回ErrCodeTxnLockTimeout；范围删除不加锁
+func (d *Db) writeNonTxn(ctx context.Context, rec wal.Record) error {
+	if !d.opts.TransactionDB {
+		return d.write(ctx, rec)
+	}
+	records := rec.Batch
+	if len(records) == 0 {
+		records = []wal.Record{rec}
 	}
-	return nil
+	var keys []cfKey
+	for _, item := range records {
+		if item.Kv.Kind != kv.KindRangeDelete {
+			keys = append(keys, cfKey{cf: item.CF, key: string(item.Kv.Key)})
+		}
+	}
+	// 按相同的顺序加锁，并发的批量写入之间不会互相等待
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].cf != keys[j].cf {
+			return keys[i].cf < keys[j].cf
+		}
+		return keys[i].key < keys[j].key
+	})
+	owner := &Txn{db: d, pessimistic: true, locked: make(map[cfKey]struct{})}
+	defer d.locks.unlock(owner, owner.locked)
+	for _, k := range keys {
+		err := d.locks.lock(ctx, owner, k, d.opts.lockTimeout())
+		if err != nil {
+			return err
+		}
+		owner.locked[k] = struct{}{}
+	}
+	return d.write(ctx, rec)
 }
 
-func (d *Db) DeleteKv(key string) error {
-	val := kv.Kv{
-		Key:     key,
-		Value:   nil,
-		Deleted: true,
+// 调用方需要持有db.writeLock。后台任务持有db.lock时写入被阻塞，等待期间ctx取消返回ctx.Err()；
+// 写入wal之后必须写入memtable，不再检查ctx
+func (d *Db) writeLocked(ctx context.Context, rec wal.Record) error {
+	records := rec.Batch
+	if len(records) == 0 {
+		records = []wal.Record{rec}
 	}
-	err := d.w.Write(val)
+	if err := lockContext(ctx, readLocker{d.lock}); err != nil {
+		return err
+	}
+	if err := d.checkWritable(); err != nil {
+		d.lock.RUnlock()
+		return err
+	}
+	for _, item := range records {
+		cf, ok := d.cfs[item.CF]
+		if !ok || cf.dropped {
+			d.lock.RUnlock()
+			return errs.NewErr(errs.ErrCodeColumnFamily, fmt.Errorf("column family id:%v not found", item.CF))
+		}
+	}
+	d.lock.RUnlock()
+
+	err := d.w.WriteRecord(rec)
 	if err != nil {
 		return err
 	}
-	d.mem.Delete(val.Key)
-	if d.mem.CheckCap() { // 如果memtable达到阈值，形成immemtable
-		d.lock.Lock() // todo 这里锁的范围，应该加什么锁？
-		d.w = d.w.Reset()
-		d.imm = append(d.imm, memtable.NewImmemtable(d.mem))
-		d.mem = memtable.NewMemtable(d.w.GetPath())
-		d.lock.Unlock()
+	d.stats.recordWrite(records)
+
+	// 批量写入时持有写锁，读取时要么看到全部的操作，要么一个都看不到
+	start := time.Now()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.stats.stallNanos.Add(int64(time.Since(start)))
+	for _, item := range records {
+		d.cfs[item.CF].apply(item.Kv)
 	}
+	d.txns.track(records)
+	d.checkMemtable()
 	return nil
 }
 
-func (d *Db) GetKv(key string) (kv.Kv, kv.SearchResult) {
-	d.lock.RLock()
-	defer d.lock.RUnlock()
-	res, result := d.mem.Search(key)
-	if result != kv.None {
-		log.Println("从mem获取key")
-		return res, result
+// 如果有列族的memtable达到阈值，所有列族一起形成immemtable，这样每个wal文件对应每个列族的一个imm。
+// 调用方需要持有db.lock
+func (d *Db) checkMemtable() {
+	full := false
+	for _, cf := range d.cfs {
+		if cf.mem.CheckCap() {
+			full = true
+		}
+	}
+	if !full {
+		return
+	}
+	d.rotateMemtables()
+}
+
+// 所有列族的memtable形成immemtable，并切换到新的wal。调用方需要持有db.lock
+func (d *Db) rotateMemtables() {
+	d.logger.Debug("rotate memtable", "file", d.w.GetPath())
+	d.w = d.w.Reset()
+	walFile := WalFileInfo{Path: d.w.GetPath()}
+	d.events.push(func(l EventListener) { l.OnWalFileCreated(walFile) })
+	for _, cf := range d.cfs {
+		if len(cf.mem.GetValues()) > 0 || len(cf.mem.GetRangeDels()) > 0 {
+			cf.imm = append([]memtable.ImmemtableOp{memtable.NewImmemtable(cf.mem)}, cf.imm...) // 新的imm放在最前面
+		}
+		cf.mem = cf.newMemtable()
 	}
+}
+
+// Flush 将所有列族的memtable写入sst，并删除对应的wal
+func (d *Db) Flush() error {
+	return d.FlushContext(context.Background())
+}
+
+// FlushContext 可以取消的Flush，只在等待锁时检查ctx，开始写入sst之后不能取消
+func (d *Db) FlushContext(ctx context.Context) error {
+	if err := d.lockAll(ctx); err != nil {
+		return err
+	}
+	defer d.writeLock.Unlock()
+	defer d.lock.Unlock()
+	defer d.setStall(WriteStallNormal)
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	return d.flushAll()
+}
+
+// 调用方需要持有db.writeLock和db.lock
+func (d *Db) flushAll() error {
+	d.rotateNonEmptyMemtables()
+	return d.flush()
+}
 
-	for _, imm := range d.imm { // 从新到旧遍历immemtable，然后进行二分查找
-		res, result = imm.Search(key)
-		if result != kv.None {
-			log.Println("从imm获取key")
-			return res, result
+// 有列族的memtable不为空时，所有列族一起形成immemtable。调用方需要持有db.lock
+func (d *Db) rotateNonEmptyMemtables() {
+	for _, cf := range d.cfs {
+		if len(cf.mem.GetValues()) > 0 || len(cf.mem.GetRangeDels()) > 0 {
+			d.rotateMemtables()
+			return
+		}
+	}
+}
+
+// Compact 将memtable写入sst后，把每个列族的所有sst合并到最深的一层
+func (d *Db) Compact() error {
+	return d.CompactContext(context.Background())
+}
+
+// CompactContext 可以取消的Compact。等待锁和每合并一层之前检查ctx，取消时返回ctx.Err()，已经完成的flush和合并不会回滚
+func (d *Db) CompactContext(ctx context.Context) error {
+	if err := d.lockAll(ctx); err != nil {
+		return err
+	}
+	defer d.writeLock.Unlock()
+	defer d.lock.Unlock()
+	defer d.setStall(WriteStallNormal)
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	err := d.flushAll()
+	if err != nil {
+		return err
+	}
+	for _, cf := range d.sortedColumnFamilies() {
+		err = cf.compactAll(ctx)
+		if err != nil {
+			return err
 		}
 	}
+	return nil
+}
 
-	res, result = d.sst.Search(key) //从tabletree上检索key
-	if result != kv.None {
-		log.Println("从sst获取key")
-		return res, result
+// 依次获取db.writeLock和db.lock，ctx取消时返回ctx.Err()，不持有任何锁
+func (d *Db) lockAll(ctx context.Context) error {
+	err := lockContext(ctx, d.writeLock)
+	if err != nil {
+		return err
 	}
-	return kv.Kv{}, kv.None
+	err = lockContext(ctx, d.lock)
+	if err != nil {
+		d.writeLock.Unlock()
+		return err
+	}
+	return nil
 }
 
 // 后台进程
 func (d *Db) DemonTask() {
 	go func() {
+		defer close(d.stopped)
 		ticker := time.NewTicker(10 * time.Second)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
-				fmt.Println("DemonTask start")
+				start := time.Now()
 				err := d.demonTask()
 				if err != nil {
-					fmt.Printf("DemonTask err:%v", err)
+					d.logger.Error("background task failed", "err", err, "duration", time.Since(start))
 				}
+				d.events.dispatch()
+			case <-d.events.notify:
+				d.events.dispatch()
 			case <-d.stopCh:
-				fmt.Println("DemonTask finish.")
+				d.events.dispatch()
+				d.logger.Debug("background task stopped")
 				return
 			}
 		}
@@ -129,34 +663,77 @@ func (d *Db) DemonTask() {
 func (d *Db) demonTask() error {
 	d.lock.Lock()
 	defer d.lock.Unlock()
+	defer d.setStall(WriteStallNormal)
 
-	for _, imm := range d.imm {
-		fmt.Printf("imm->sst,%v\n", imm.GetName())
-		err := d.sst.Insert(imm) // 将imm转化为sst，放入tabletree管理
-		if err != nil {
-			return err
-		}
-		// 删除imm的wal
-		err = d.w.Delete(imm.GetName())
+	if d.readOnly() {
+		return nil
+	}
+	if d.bgErr.severity >= HardError {
+		return nil // 只读模式下不再重试，等待Resume
+	}
+	return d.backgroundWork()
+}
+
+// 后台任务开始flush、合并时写入被阻塞，结束时恢复。调用方需要持有db.lock
+func (d *Db) setStall(condition WriteStallCondition) {
+	if d.stall == condition {
+		return
+	}
+	info := WriteStallInfo{Condition: condition, Prev: d.stall}
+	d.stall = condition
+	d.events.push(func(l EventListener) { l.OnStallConditionsChanged(info) })
+}
+
+// 将所有列族的imm写入sst，然后删除imm的wal。调用方需要持有db.lock
+func (d *Db) flush() error {
+	cfs := d.sortedColumnFamilies()
+	// 所有列族的imm都写入sst之后，才能删除imm的wal。
+	// 失败或者panic时，已经移除的imm的wal写回obsoleteWals，重试时删除
+	walPaths := make(map[string]struct{}, len(d.obsoleteWals))
+	for walPath := range d.obsoleteWals {
+		walPaths[walPath] = struct{}{}
+	}
+	defer func() {
+		d.obsoleteWals = walPaths
+	}()
+	for _, cf := range cfs {
+		err := cf.flush(walPaths)
 		if err != nil {
 			return err
 		}
 	}
-	//删除 imm
-	d.imm = []memtable.ImmemtableOp{}
-
-	levels := d.sst.CheckCompactLevels() // 检查是否触发sst合并
-	if len(levels) == 0 {
-		return nil
+	// 从旧到新删除，崩溃时只会留下较新的wal，恢复后重新写入sst的数据不会比已有的sst旧
+	var sorted []string
+	for walPath := range walPaths {
+		sorted = append(sorted, walPath)
 	}
-	for _, level := range levels {
-		fmt.Printf("compact sst[%v]->sst[%v] \n", level, level+1)
-		err := d.sst.CompactLevel(level) // 将level的所有sst合并为一个sst后，放入level+1的tabletree上
-		if err != nil {
+	sort.Slice(sorted, func(i, j int) bool {
+		// 同一个目录下的wal，序号越大文件名越长，按字符串比较时9.wal.log比10.wal.log大
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) < len(sorted[j])
+		}
+		return sorted[i] < sorted[j]
+	})
+	for _, walPath := range sorted {
+		err := d.w.Delete(walPath)
+		if err != nil && !os.IsNotExist(err) { // 上次flush删除了一部分wal后失败
 			return err
 		}
+		walFile := WalFileInfo{Path: walPath}
+		d.events.push(func(l EventListener) { l.OnWalFileDeleted(walFile) })
 	}
+	walPaths = make(map[string]struct{})
 	return nil
 }
 
-// todo 增加单测 demonTask GetKv DeleteKv Init
+// 按id排序的所有列族，调用方需要持有db.lock
+func (d *Db) sortedColumnFamilies() []*ColumnFamily {
+	var list []*ColumnFamily
+	for _, cf := range d.cfs {
+		list = append(list, cf)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].id < list[j].id
+	})
+	return list
+}
@@ -1,15 +1,28 @@
 package db
 
 import (
+	"bytes"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"math/rand"
 	"os"
+	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 
+	"lsmtree/errs"
 	"lsmtree/kv"
+	"lsmtree/logger"
+	"lsmtree/sstable"
+	"lsmtree/vfs"
+	"lsmtree/wal"
 )
 
 func TestDb_Op(t *testing.T) {
@@ -22,45 +35,2062 @@ func TestDb_Op(t *testing.T) {
 	db := &Db{}
 	db = db.Init(dir)
 
-	kv1 := kv.Kv{"1", []byte("1"), false}
+	kv1 := kv.Kv{Key: []byte("1"), Value: []byte("1"), Deleted: false}
 	err = db.SetKv(kv1)
 	assert.Nil(t, err)
-	k, res := db.GetKv("1")
+	k, res := db.GetKv([]byte("1"))
 	assert.Equal(t, kv1, k) // 预期是从mem获取
-	err = db.SetKv(kv.Kv{"2", []byte("1"), false})
+	err = db.SetKv(kv.Kv{Key: []byte("2"), Value: []byte("1"), Deleted: false})
 	assert.Nil(t, err)
-	err = db.DeleteKv("2")
+	err = db.DeleteKv([]byte("2"))
 	assert.Nil(t, err)
-	_, res = db.GetKv("2")
+	_, res = db.GetKv([]byte("2"))
 	assert.Equal(t, kv.Deleted, res) // 预期是从mem获取
 
 	db.Shutdown()
 
 	t.Log("case:模拟重启，此时wal构造出来memtable,还是可以让db正常工作")
 	db = db.Init(dir)
-	k, res = db.GetKv("1")
+	k, res = db.GetKv([]byte("1"))
 	assert.Equal(t, kv1, k) // 预期是从mem获取
 
 	t.Log("case: set足够多的数据，mem->imm。再imm从wal恢复后，可正常工作。")
 	for i := 0; i < 60; i++ {
-		err = db.SetKv(kv.Kv{strconv.Itoa(i), []byte("1"), false})
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("1"), Deleted: false})
 		assert.Nil(t, err)
 	}
-	k, res = db.GetKv("1")
+	k, res = db.GetKv([]byte("1"))
 	assert.Equal(t, kv1, k) // 预期是从imm获取
 	//db.Shutdown()
-	db.stopCh <- struct{}{} //这里不可以使用shutdown，会触发d.demonTask()
+	db.stop() //这里不可以使用shutdown，会触发d.demonTask()
 	db = db.Init(dir)
-	k, res = db.GetKv("1")
+	k, res = db.GetKv([]byte("1"))
 	assert.Equal(t, kv1, k) // 预期是从imm获取
 
 	t.Log("case: 确保imm->sst。从sst恢复后，可正常工作。")
 	time.Sleep(11 * time.Second) // 需要确保demonTask触发
-	db.stopCh <- struct{}{}
+	db.stop()
 	db = db.Init(dir)
-	k, res = db.GetKv("1")
+	k, res = db.GetKv([]byte("1"))
 	assert.Equal(t, kv1, k) // 预期是从sst获取
 
 	// todo 构造10个sst。触发合并后再恢复，可正常工作。
 
 }
+
+func TestDb_DeleteRange(t *testing.T) {
+	dir := fmt.Sprintf("out/db/range/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.Init(dir)
+	for i := 0; i < 5; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("1"), Deleted: false})
+		assert.Nil(t, err)
+	}
+	err = db.DeleteRange([]byte("3"), []byte("1"))
+	assert.NotNil(t, err)
+
+	err = db.DeleteRange([]byte("1"), []byte("3"))
+	assert.Nil(t, err)
+	_, res := db.GetKv([]byte("2"))
+	assert.Equal(t, kv.Deleted, res)
+	k, res := db.GetKv([]byte("3"))
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, kv.Kv{Key: []byte("3"), Value: []byte("1"), Deleted: false}, k)
+
+	keys := func() []string {
+		it, err := db.NewIterator([]byte(""), []byte(""))
+		assert.Nil(t, err)
+		var list []string
+		for ; it.Valid(); it.Next() {
+			list = append(list, string(it.Key()))
+		}
+		return list
+	}
+	assert.Equal(t, []string{"0", "3", "4"}, keys())
+
+	t.Log("case: imm->sst后，墓碑依然覆盖更旧的sst")
+	err = db.demonTask()
+	assert.Nil(t, err)
+	err = db.DeleteRange([]byte("3"), []byte("4"))
+	assert.Nil(t, err)
+	for i := 0; i < 60; i++ { // 触发mem->imm
+		err = db.SetKv(kv.Kv{Key: []byte(fmt.Sprintf("5%v", i)), Value: []byte("1"), Deleted: false})
+		assert.Nil(t, err)
+	}
+	err = db.demonTask()
+	assert.Nil(t, err)
+	_, res = db.GetKv([]byte("3"))
+	assert.Equal(t, kv.Deleted, res)
+
+	it, err := db.NewIterator([]byte("0"), []byte("5"))
+	assert.Nil(t, err)
+	var list []string
+	for ; it.Valid(); it.Next() {
+		list = append(list, string(it.Key()))
+	}
+	assert.Equal(t, []string{"0", "4"}, list)
+
+	db.stop()
+	db = db.Init(dir)
+	_, res = db.GetKv([]byte("1"))
+	assert.Equal(t, kv.Deleted, res)
+	db.stop()
+}
+
+func TestDb_Merge(t *testing.T) {
+	dir := fmt.Sprintf("out/db/merge/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.Init(dir)
+	err = db.Merge([]byte("1"), kv.EncodeInt64(1))
+	assert.NotNil(t, err) // 没有配置合并操作
+	db.stop()
+
+	db = db.InitWithOptions(dir, Options{MergeOperator: kv.Int64Add{}})
+	err = db.Merge([]byte("1"), []byte("1"))
+	assert.NotNil(t, err) // 操作数不是int64
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.Nil(t, db.Merge([]byte("1"), kv.EncodeInt64(1)))
+		}()
+	}
+	wg.Wait()
+	k, res := db.GetKv([]byte("1"))
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, kv.Kv{Key: []byte("1"), Value: kv.EncodeInt64(10)}, k)
+
+	t.Log("case: imm->sst后，新的操作数叠加在sst的值上")
+	for i := 0; i < 60; i++ { // 触发mem->imm
+		err = db.SetKv(kv.Kv{Key: []byte(fmt.Sprintf("5%v", i)), Value: []byte("1"), Deleted: false})
+		assert.Nil(t, err)
+	}
+	err = db.demonTask()
+	assert.Nil(t, err)
+	assert.Nil(t, db.Merge([]byte("1"), kv.EncodeInt64(5)))
+	k, _ = db.GetKv([]byte("1"))
+	assert.Equal(t, kv.EncodeInt64(15), k.Value)
+
+	it, err := db.NewIterator([]byte("1"), []byte("2"))
+	assert.Nil(t, err)
+	assert.True(t, it.Valid())
+	assert.Equal(t, kv.EncodeInt64(15), it.Value())
+	assert.Nil(t, it.Close())
+
+	t.Log("case: 重启后从wal恢复操作数")
+	db.stop()
+	db = db.InitWithOptions(dir, Options{MergeOperator: kv.Int64Add{}})
+	k, _ = db.GetKv([]byte("1"))
+	assert.Equal(t, kv.EncodeInt64(15), k.Value)
+	db.stop()
+}
+
+func TestDb_TTL(t *testing.T) {
+	dir := fmt.Sprintf("out/db/ttl/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	now := time.Unix(100, 0)
+	opts := Options{
+		DefaultTTL: 10 * time.Second,
+		Now:        func() time.Time { return now },
+	}
+	db := &Db{}
+	db = db.InitWithOptions(dir, opts)
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("1")}) // 使用默认的过期时间
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("2"), Value: []byte("1"), ExpireAt: time.Unix(200, 0).UnixNano()})
+	assert.Nil(t, err)
+
+	k, res := db.GetKv([]byte("1"))
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, time.Unix(110, 0).UnixNano(), k.ExpireAt)
+
+	now = time.Unix(110, 0)
+	_, res = db.GetKv([]byte("1"))
+	assert.Equal(t, kv.Deleted, res)
+	_, res = db.GetKv([]byte("2"))
+	assert.Equal(t, kv.Success, res)
+
+	it, err := db.NewIterator([]byte(""), []byte(""))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("2"), it.Key())
+	it.Next()
+	assert.False(t, it.Valid())
+
+	t.Log("case: 重启后从wal恢复过期时间")
+	db.stop()
+	db = db.InitWithOptions(dir, opts)
+	_, res = db.GetKv([]byte("1"))
+	assert.Equal(t, kv.Deleted, res)
+
+	t.Log("case: imm->sst后依然按过期时间读取")
+	for i := 0; i < 60; i++ { // 触发mem->imm
+		err = db.SetKv(kv.Kv{Key: []byte(fmt.Sprintf("5%v", i)), Value: []byte("1"), Deleted: false})
+		assert.Nil(t, err)
+	}
+	err = db.demonTask()
+	assert.Nil(t, err)
+	_, res = db.GetKv([]byte("2"))
+	assert.Equal(t, kv.Success, res)
+	now = time.Unix(200, 0)
+	_, res = db.GetKv([]byte("2"))
+	assert.Equal(t, kv.Deleted, res)
+
+	t.Log("case: 合并后过期的key从sst中删除")
+	v, ok := db.GetProperty(PropertyEstimateNumKeys)
+	assert.True(t, ok)
+	assert.NotEqual(t, "0", v) // 合并前过期的key还在sst中
+	err = db.Compact()
+	assert.Nil(t, err)
+	v, _ = db.GetProperty(PropertyEstimateNumKeys)
+	assert.Equal(t, "0", v)
+	files, err := filepath.Glob(dir + "/sst/*.db")
+	assert.Nil(t, err)
+	for _, file := range files {
+		info, err := sstable.Inspect(file, nil)
+		assert.Nil(t, err)
+		assert.Equal(t, 0, len(info.Entries), file)
+	}
+	_, res = db.GetKv([]byte("2"))
+	assert.Equal(t, kv.None, res)
+	db.stop()
+}
+
+func TestDb_ColumnFamily(t *testing.T) {
+	dir := fmt.Sprintf("out/db/cf/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.Init(dir)
+	meta, err := db.CreateColumnFamily("meta", ColumnFamilyOptions{MemtableSize: 5})
+	assert.Nil(t, err)
+	_, err = db.CreateColumnFamily("meta", ColumnFamilyOptions{})
+	assert.NotNil(t, err)
+	blob, err := db.CreateColumnFamily("blob", ColumnFamilyOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, meta, db.ColumnFamily("meta"))
+
+	// 不同列族的数据互不影响
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("default")})
+	assert.Nil(t, err)
+	err = meta.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("meta")})
+	assert.Nil(t, err)
+	k, _ := db.GetKv([]byte("1"))
+	assert.Equal(t, []byte("default"), k.Value)
+	k, _ = meta.GetKv([]byte("1"))
+	assert.Equal(t, []byte("meta"), k.Value)
+	_, res := blob.GetKv([]byte("1"))
+	assert.Equal(t, kv.None, res)
+
+	t.Log("case: 跨列族的批量写入")
+	batch := db.NewWriteBatch()
+	batch.SetKv(nil, kv.Kv{Key: []byte("2"), Value: []byte("default")})
+	batch.SetKv(blob, kv.Kv{Key: []byte("2"), Value: []byte("blob")})
+	batch.DeleteKv(meta, []byte("1"))
+	err = db.Write(batch)
+	assert.Nil(t, err)
+	k, _ = db.GetKv([]byte("2"))
+	assert.Equal(t, []byte("default"), k.Value)
+	k, _ = blob.GetKv([]byte("2"))
+	assert.Equal(t, []byte("blob"), k.Value)
+	_, res = meta.GetKv([]byte("1"))
+	assert.Equal(t, kv.Deleted, res)
+
+	batch = db.NewWriteBatch()
+	batch.SetKv(nil, kv.Kv{Key: []byte("3"), Value: []byte("default")})
+	batch.DeleteRange(nil, []byte("2"), []byte("1"))
+	assert.NotNil(t, db.Write(batch))
+	_, res = db.GetKv([]byte("3"))
+	assert.Equal(t, kv.None, res)
+
+	t.Log("case: meta的memtable较小，写满后所有列族一起形成imm，并写入各自的sst")
+	for i := 0; i < 6; i++ {
+		err = meta.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("meta")})
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, 1, len(meta.imm))
+	assert.Equal(t, 1, len(blob.imm))
+	err = db.demonTask()
+	assert.Nil(t, err)
+	k, _ = blob.GetKv([]byte("2"))
+	assert.Equal(t, []byte("blob"), k.Value)
+	k, _ = meta.GetKv([]byte("5"))
+	assert.Equal(t, []byte("meta"), k.Value)
+
+	t.Log("case: 重启后从MANIFEST和wal恢复列族")
+	err = blob.SetKv(kv.Kv{Key: []byte("4"), Value: []byte("blob")})
+	assert.Nil(t, err)
+	db.stop()
+	db = db.Init(dir)
+	blob = db.ColumnFamily("blob")
+	k, _ = blob.GetKv([]byte("2"))
+	assert.Equal(t, []byte("blob"), k.Value)
+	k, _ = blob.GetKv([]byte("4"))
+	assert.Equal(t, []byte("blob"), k.Value)
+
+	t.Log("case: 删除列族后，数据不再可见，重启后也不会恢复")
+	err = db.DropColumnFamily(db.DefaultColumnFamily())
+	assert.NotNil(t, err)
+	err = db.DropColumnFamily(blob)
+	assert.Nil(t, err)
+	assert.NotNil(t, blob.SetKv(kv.Kv{Key: []byte("5"), Value: []byte("blob")}))
+	_, res = blob.GetKv([]byte("2"))
+	assert.Equal(t, kv.None, res)
+	db.stop()
+	db = db.Init(dir)
+	assert.Nil(t, db.ColumnFamily("blob"))
+	blob, err = db.CreateColumnFamily("blob", ColumnFamilyOptions{})
+	assert.Nil(t, err)
+	_, res = blob.GetKv([]byte("4"))
+	assert.Equal(t, kv.None, res)
+	db.stop()
+}
+
+func TestDb_Txn(t *testing.T) {
+	dir := fmt.Sprintf("out/db/txn/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.Init(dir)
+	err = db.SetKv(kv.Kv{Key: []byte("a"), Value: []byte("100")})
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("b"), Value: []byte("0")})
+	assert.Nil(t, err)
+
+	t.Log("case: 事务内读到自己的写入，提交前其他人不可见")
+	txn := db.BeginTxn()
+	k, _, err := txn.Get(nil, []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("100"), k.Value)
+	txn.Set(nil, kv.Kv{Key: []byte("a"), Value: []byte("50")})
+	txn.Set(nil, kv.Kv{Key: []byte("b"), Value: []byte("50")})
+	k, _, err = txn.Get(nil, []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("50"), k.Value)
+	k, _ = db.GetKv([]byte("a"))
+	assert.Equal(t, []byte("100"), k.Value)
+	assert.Nil(t, txn.Commit())
+	k, _ = db.GetKv([]byte("a"))
+	assert.Equal(t, []byte("50"), k.Value)
+	k, _ = db.GetKv([]byte("b"))
+	assert.Equal(t, []byte("50"), k.Value)
+	code, _ := errs.FromError(txn.Commit())
+	assert.Equal(t, errs.ErrCodeTxnClosed, code)
+
+	t.Log("case: 读取过的key在事务开始后被修改，提交冲突")
+	txn = db.BeginTxn()
+	other := db.BeginTxn()
+	_, _, err = txn.Get(nil, []byte("a"))
+	assert.Nil(t, err)
+	txn.Set(nil, kv.Kv{Key: []byte("b"), Value: []byte("0")})
+	err = db.SetKv(kv.Kv{Key: []byte("a"), Value: []byte("0")})
+	assert.Nil(t, err)
+	code, _ = errs.FromError(txn.Commit())
+	assert.Equal(t, errs.ErrCodeTxnConflict, code)
+	k, _ = db.GetKv([]byte("b"))
+	assert.Equal(t, []byte("50"), k.Value)
+
+	t.Log("case: 范围删除覆盖读取过的key，同样冲突")
+	_, _, err = other.Get(nil, []byte("b"))
+	assert.Nil(t, err)
+	err = db.DeleteRange([]byte("b"), []byte("c"))
+	assert.Nil(t, err)
+	code, _ = errs.FromError(other.Commit())
+	assert.Equal(t, errs.ErrCodeTxnConflict, code)
+
+	t.Log("case: 只写不读的事务不会冲突，回滚丢弃写入")
+	txn = db.BeginTxn()
+	txn.Delete(nil, []byte("a"))
+	_, res, err := txn.Get(nil, []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+	assert.Nil(t, txn.Rollback())
+	k, _ = db.GetKv([]byte("a"))
+	assert.Equal(t, []byte("0"), k.Value)
+
+	txn = db.BeginTxn()
+	txn.Set(nil, kv.Kv{Key: []byte("c"), Value: []byte("1")})
+	err = db.SetKv(kv.Kv{Key: []byte("c"), Value: []byte("2")})
+	assert.Nil(t, err)
+	assert.Nil(t, txn.Commit())
+
+	t.Log("case: 提交的事务重启后从wal恢复")
+	db.stop()
+	db = db.Init(dir)
+	k, _ = db.GetKv([]byte("c"))
+	assert.Equal(t, []byte("1"), k.Value)
+	assert.Equal(t, 0, len(db.txns.keys))
+	db.stop()
+}
+
+func TestDb_PessimisticTxn(t *testing.T) {
+	dir := fmt.Sprintf("out/db/ptxn/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.InitWithOptions(dir, Options{
+		MergeOperator: kv.Int64Add{},
+		TransactionDB: true,
+		LockTimeout:   100 * time.Millisecond,
+	})
+
+	t.Log("case: 多个事务并发对同一个key加1，加锁后不会丢失更新")
+	err = db.SetKv(kv.Kv{Key: []byte("counter"), Value: kv.EncodeInt64(0)})
+	assert.Nil(t, err)
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				txn := db.BeginTxn()
+				k, _, err := txn.GetForUpdate(nil, []byte("counter"))
+				if err != nil {
+					_ = txn.Rollback()
+					continue
+				}
+				n, _ := kv.DecodeInt64(k.Value)
+				_ = txn.Set(nil, kv.Kv{Key: []byte("counter"), Value: kv.EncodeInt64(n + 1)})
+				if txn.Commit() == nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	k, _ := db.GetKv([]byte("counter"))
+	n, err := kv.DecodeInt64(k.Value)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(10), n)
+
+	t.Log("case: 锁被其他事务持有时等待超时")
+	txn1 := db.BeginTxn()
+	txn2 := db.BeginTxn()
+	assert.Nil(t, txn1.Set(nil, kv.Kv{Key: []byte("a"), Value: []byte("1")}))
+	err = txn2.Set(nil, kv.Kv{Key: []byte("a"), Value: []byte("2")})
+	code, _ := errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeTxnLockTimeout, code)
+
+	t.Log("case: 提交后释放锁，等待者获得锁")
+	done := make(chan error)
+	go func() {
+		done <- txn2.Delete(nil, []byte("a"))
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, txn1.Commit())
+	assert.Nil(t, <-done)
+	_, res, err := txn2.Get(nil, []byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+	assert.Nil(t, txn2.Commit())
+	_, res = db.GetKv([]byte("a"))
+	assert.Equal(t, kv.Deleted, res)
+
+	t.Log("case: 两个事务互相等待对方的锁，后等待的一方检测到死锁")
+	txn1 = db.BeginTxn()
+	txn2 = db.BeginTxn()
+	_, _, err = txn1.GetForUpdate(nil, []byte("x"))
+	assert.Nil(t, err)
+	_, _, err = txn2.GetForUpdate(nil, []byte("y"))
+	assert.Nil(t, err)
+	go func() {
+		_, _, err := txn1.GetForUpdate(nil, []byte("y"))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	_, _, err = txn2.GetForUpdate(nil, []byte("x"))
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeTxnDeadlock, code)
+	assert.Nil(t, txn2.Rollback())
+	assert.Nil(t, <-done)
+	assert.Nil(t, txn1.Set(nil, kv.Kv{Key: []byte("y"), Value: []byte("1")}))
+	assert.Nil(t, txn1.Commit())
+	k, _ = db.GetKv([]byte("y"))
+	assert.Equal(t, []byte("1"), k.Value)
+	assert.Equal(t, 0, len(db.locks.locks))
+
+	t.Log("case: 事务之外的写入等待事务持有的锁")
+	txn1 = db.BeginTxn()
+	assert.Nil(t, txn1.Set(nil, kv.Kv{Key: []byte("b"), Value: []byte("txn")}))
+	err = db.SetKv(kv.Kv{Key: []byte("b"), Value: []byte("set")})
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeTxnLockTimeout, code)
+	err = db.DeleteKv([]byte("b"))
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeTxnLockTimeout, code)
+	batch := db.NewWriteBatch()
+	batch.SetKv(nil, kv.Kv{Key: []byte("c"), Value: []byte("batch")})
+	batch.SetKv(nil, kv.Kv{Key: []byte("b"), Value: []byte("batch")})
+	err = db.Write(batch)
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeTxnLockTimeout, code)
+	_, res = db.GetKv([]byte("c"))
+	assert.Equal(t, kv.None, res) // 批量写入中的操作都没有生效
+	go func() {
+		done <- db.SetKv(kv.Kv{Key: []byte("b"), Value: []byte("set")})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Nil(t, txn1.Commit())
+	assert.Nil(t, <-done)
+	k, _ = db.GetKv([]byte("b"))
+	assert.Equal(t, []byte("set"), k.Value)
+	assert.Equal(t, 0, len(db.locks.locks))
+	db.stop()
+}
+
+func TestDb_Checkpoint(t *testing.T) {
+	dir := fmt.Sprintf("out/db/checkpoint/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	opts := Options{ColumnFamilies: map[string]ColumnFamilyOptions{
+		DefaultColumnFamilyName: {MemtableSize: 5, LevelLimit: 1},
+	}}
+	db := &Db{}
+	db = db.InitWithOptions(dir+"/db", opts)
+	meta, err := db.CreateColumnFamily("meta", ColumnFamilyOptions{})
+	assert.Nil(t, err)
+	for i := 0; i < 12; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("v1")})
+		assert.Nil(t, err)
+	}
+	err = db.demonTask()
+	assert.Nil(t, err)
+	err = meta.SetKv(kv.Kv{Key: []byte("m"), Value: []byte("meta")})
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("wal"), Value: []byte("v1")}) // 只在wal中
+	assert.Nil(t, err)
+
+	t.Log("case: checkpoint之后的写入和合并不影响checkpoint")
+	err = db.Checkpoint(dir + "/cp")
+	assert.Nil(t, err)
+	assert.NotNil(t, db.Checkpoint(dir+"/cp"))
+	for i := 0; i < 12; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("v2")})
+		assert.Nil(t, err)
+	}
+	err = db.demonTask()
+	assert.Nil(t, err)
+	err = db.demonTask()
+	assert.Nil(t, err)
+	k, _ := db.GetKv([]byte("0"))
+	assert.Equal(t, []byte("v2"), k.Value)
+	db.stop()
+
+	cp := &Db{}
+	cp = cp.InitWithOptions(dir+"/cp", opts)
+	for i := 0; i < 12; i++ {
+		k, _ = cp.GetKv([]byte(strconv.Itoa(i)))
+		assert.Equal(t, []byte("v1"), k.Value)
+	}
+	k, _ = cp.GetKv([]byte("wal"))
+	assert.Equal(t, []byte("v1"), k.Value)
+	k, _ = cp.ColumnFamily("meta").GetKv([]byte("m"))
+	assert.Equal(t, []byte("meta"), k.Value)
+	cp.stop()
+}
+
+func TestBackupEngine(t *testing.T) {
+	dir := fmt.Sprintf("out/db/backup/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.InitWithOptions(dir+"/db", Options{ColumnFamilies: map[string]ColumnFamilyOptions{
+		DefaultColumnFamilyName: {MemtableSize: 5},
+	}})
+	for i := 0; i < 12; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("v1")})
+		assert.Nil(t, err)
+	}
+	err = db.demonTask()
+	assert.Nil(t, err)
+
+	engine, err := OpenBackupEngine(dir + "/backup")
+	assert.Nil(t, err)
+	info1, err := engine.CreateBackup(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, info1.ID)
+
+	t.Log("case: 增量备份，没有变化的sst只保存一份")
+	err = db.SetKv(kv.Kv{Key: []byte("0"), Value: []byte("v2")})
+	assert.Nil(t, err)
+	info2, err := engine.CreateBackup(db)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, info2.ID)
+	shared, err := os.ReadDir(dir + "/backup/shared")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(shared))
+	infos, err := engine.GetBackupInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(infos))
+	db.stop()
+
+	t.Log("case: 从备份恢复")
+	assert.Nil(t, engine.VerifyBackup(1))
+	err = engine.RestoreDbFromBackup(1, dir+"/restore1")
+	assert.Nil(t, err)
+	restored := &Db{}
+	restored = restored.Init(dir + "/restore1")
+	k, _ := restored.GetKv([]byte("0"))
+	assert.Equal(t, []byte("v1"), k.Value)
+	k, _ = restored.GetKv([]byte("11"))
+	assert.Equal(t, []byte("v1"), k.Value)
+	restored.stop()
+
+	t.Log("case: 删除旧的备份后，仍被使用的sst不会被删除")
+	err = engine.PurgeOldBackups(1)
+	assert.Nil(t, err)
+	infos, err = engine.GetBackupInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(infos))
+	assert.Nil(t, engine.VerifyBackup(2))
+	err = engine.RestoreDbFromBackup(2, dir+"/restore2")
+	assert.Nil(t, err)
+	restored = restored.Init(dir + "/restore2")
+	k, _ = restored.GetKv([]byte("0"))
+	assert.Equal(t, []byte("v2"), k.Value)
+	restored.stop()
+
+	t.Log("case: 备份文件损坏时校验失败")
+	shared, err = os.ReadDir(dir + "/backup/shared")
+	assert.Nil(t, err)
+	err = os.WriteFile(dir+"/backup/shared/"+shared[0].Name(), []byte("broken"), 0666)
+	assert.Nil(t, err)
+	code, _ := errs.FromError(engine.VerifyBackup(2))
+	assert.Equal(t, errs.ErrCodeBackup, code)
+	assert.NotNil(t, engine.RestoreDbFromBackup(2, dir+"/restore3"))
+}
+
+func TestDb_IngestExternalFiles(t *testing.T) {
+	dir := fmt.Sprintf("out/db/ingest/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.Init(dir + "/db")
+	err = db.SetKv(kv.Kv{Key: []byte("b"), Value: []byte("old")})
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("c"), Value: []byte("old")})
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("z"), Value: []byte("old")})
+	assert.Nil(t, err)
+
+	write := func(name string, keys ...string) string {
+		p := fmt.Sprintf("%v/%v", dir, name)
+		w, err := sstable.NewWriter(p, nil)
+		assert.Nil(t, err)
+		for _, key := range keys {
+			assert.Nil(t, w.Set([]byte(key), []byte("ingested")))
+		}
+		assert.Nil(t, w.Finish())
+		return p
+	}
+
+	t.Log("case: 文件之间重叠时导入失败")
+	p1 := write("1.sst", "a", "c")
+	p2 := write("2.sst", "b")
+	assert.NotNil(t, db.IngestExternalFiles([]string{p1, p2}))
+
+	t.Log("case: 和memtable重叠时，导入的数据比memtable中的数据新")
+	txn := db.BeginTxn()
+	_, _, err = txn.Get(nil, []byte("b"))
+	assert.Nil(t, err)
+	p3 := write("3.sst", "x", "y")
+	err = db.IngestExternalFiles([]string{p1, p3})
+	assert.Nil(t, err)
+	for _, key := range []string{"a", "c", "x", "y"} {
+		k, _ := db.GetKv([]byte(key))
+		assert.Equal(t, []byte("ingested"), k.Value)
+	}
+	k, _ := db.GetKv([]byte("b"))
+	assert.Equal(t, []byte("old"), k.Value)
+	k, _ = db.GetKv([]byte("z"))
+	assert.Equal(t, []byte("old"), k.Value)
+	// b在导入的key范围内，读取过b的事务冲突
+	code, _ := errs.FromError(txn.Commit())
+	assert.Equal(t, errs.ErrCodeTxnConflict, code)
+
+	t.Log("case: 导入之后的写入覆盖导入的数据，flush、合并和重启后不变")
+	err = db.SetKv(kv.Kv{Key: []byte("a"), Value: []byte("new")})
+	assert.Nil(t, err)
+	err = db.DeleteKv([]byte("c"))
+	assert.Nil(t, err)
+	check := func() {
+		k, _ := db.GetKv([]byte("a"))
+		assert.Equal(t, []byte("new"), k.Value)
+		_, res := db.GetKv([]byte("c"))
+		assert.NotEqual(t, kv.Success, res)
+		k, _ = db.GetKv([]byte("x"))
+		assert.Equal(t, []byte("ingested"), k.Value)
+	}
+	check()
+	assert.Nil(t, db.Flush())
+	check()
+	assert.Nil(t, db.Compact())
+	check()
+	db.stop()
+	db = db.Init(dir + "/db")
+	k, _ = db.GetKv([]byte("a"))
+	assert.Equal(t, []byte("new"), k.Value)
+	k, _ = db.GetKv([]byte("y"))
+	assert.Equal(t, []byte("ingested"), k.Value)
+	db.stop()
+}
+
+func TestDb_Compact(t *testing.T) {
+	dir := fmt.Sprintf("out/db/compact/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.InitWithOptions(dir, Options{ColumnFamilies: map[string]ColumnFamilyOptions{
+		DefaultColumnFamilyName: {MemtableSize: 5},
+	}})
+	for i := 0; i < 20; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("1")})
+		assert.Nil(t, err)
+	}
+	stats := db.DefaultColumnFamily().Stats()
+	assert.Equal(t, DefaultColumnFamilyName, stats.Name)
+	assert.Equal(t, 3, stats.Immemtables)
+	assert.Equal(t, 2, stats.MemtableKeys)
+
+	err = db.Flush()
+	assert.Nil(t, err)
+	stats = db.DefaultColumnFamily().Stats()
+	assert.Equal(t, 0, stats.Immemtables)
+	assert.Equal(t, 0, stats.MemtableKeys)
+	assert.Equal(t, []int{4}, stats.Levels)
+
+	err = db.Compact()
+	assert.Nil(t, err)
+	assert.Equal(t, []int{0, 1}, db.DefaultColumnFamily().Stats().Levels)
+	for i := 0; i < 20; i++ {
+		k, _ := db.GetKv([]byte(strconv.Itoa(i)))
+		assert.Equal(t, []byte("1"), k.Value)
+	}
+	db.stop()
+}
+
+func TestDb_Statistics(t *testing.T) {
+	dir := fmt.Sprintf("out/db/statistics/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.Init(dir)
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("11")})
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("2"), Value: []byte("22")})
+	assert.Nil(t, err)
+	err = db.Flush()
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("3"), Value: []byte("33")})
+	assert.Nil(t, err)
+	err = db.Flush()
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("4"), Value: []byte("44")})
+	assert.Nil(t, err)
+
+	db.GetKv([]byte("4")) // memtable
+	db.GetKv([]byte("1")) // 第二个sst中没有，第一个sst中有
+	db.GetKv([]byte("5"))
+	data := db.Statistics().Data()
+	assert.Equal(t, int64(12), data.BytesWritten)
+	assert.Equal(t, int64(4), data.BytesRead)
+	assert.Equal(t, int64(1), data.MemtableHit)
+	assert.Equal(t, int64(2), data.MemtableMiss)
+	assert.Equal(t, []int64{1}, data.LevelHits)
+	assert.Contains(t, db.Statistics().String(), "sst.hit.level0: 1\n")
+	assert.Equal(t, int64(3), data.FilterUseful) // 第二个sst过滤掉1和5，第一个sst过滤掉5
+	assert.Equal(t, int64(0), data.FilterUseless)
+	assert.Contains(t, db.Statistics().String(), "filter.useful: 3\n")
+	assert.Equal(t, int64(3), data.GetLatency.Count)
+	assert.Equal(t, int64(4), data.PutLatency.Count)
+
+	v, ok := db.GetProperty("lsm.num-files-at-level0")
+	assert.True(t, ok)
+	assert.Equal(t, "2", v)
+	v, ok = db.GetProperty("lsm.num-files-at-level3")
+	assert.True(t, ok)
+	assert.Equal(t, "0", v)
+	v, ok = db.GetProperty(PropertyEstimateNumKeys)
+	assert.True(t, ok)
+	assert.Equal(t, "4", v)
+	v, ok = db.GetProperty(PropertyLevelStats)
+	assert.True(t, ok)
+	assert.Contains(t, v, "Level Files")
+	_, ok = db.GetProperty("lsm.unknown")
+	assert.False(t, ok)
+
+	err = db.Compact()
+	assert.Nil(t, err)
+	data = db.Statistics().Data()
+	assert.True(t, data.CompactReadBytes > 0)
+	assert.True(t, data.CompactWriteBytes > 0)
+	v, _ = db.GetProperty(PropertyStats)
+	assert.Contains(t, v, "compact.read.bytes")
+	db.stop()
+}
+
+type recordLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (l *recordLogger) add(level logger.Level, msg string, keyvals []any) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.lines = append(l.lines, logger.Format(level, msg, keyvals...))
+}
+
+func (l *recordLogger) Debug(msg string, keyvals ...any) { l.add(logger.LevelDebug, msg, keyvals) }
+func (l *recordLogger) Info(msg string, keyvals ...any)  { l.add(logger.LevelInfo, msg, keyvals) }
+func (l *recordLogger) Warn(msg string, keyvals ...any)  { l.add(logger.LevelWarn, msg, keyvals) }
+func (l *recordLogger) Error(msg string, keyvals ...any) { l.add(logger.LevelError, msg, keyvals) }
+
+func TestDb_Logger(t *testing.T) {
+	dir := fmt.Sprintf("out/db/logger/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	l := &recordLogger{}
+	db := &Db{}
+	db = db.InitWithOptions(dir, Options{Logger: l})
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	db.GetKv([]byte("1"))
+	err = db.Compact()
+	assert.Nil(t, err)
+	db.stop()
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	assert.Contains(t, l.lines, "DEBUG get key cf=default key=1 from=memtable")
+	var flush, sst bool
+	for _, line := range l.lines {
+		if strings.HasPrefix(line, "INFO flush immemtable cf=default file=") && strings.Contains(line, "duration=") {
+			flush = true
+		}
+		if strings.HasPrefix(line, "DEBUG write sst file="+dir+"/sst/0.0.db level=0") {
+			sst = true
+		}
+	}
+	assert.True(t, flush, l.lines)
+	assert.True(t, sst, l.lines)
+}
+
+type recordListener struct {
+	EventListenerBase
+	events []string
+	flush  FlushJobInfo
+	compac CompactionJobInfo
+	errs   []BackgroundErrorInfo
+}
+
+func (l *recordListener) OnFlushBegin(info FlushJobInfo) {
+	l.events = append(l.events, "flush begin")
+}
+
+func (l *recordListener) OnFlushCompleted(info FlushJobInfo) {
+	l.events = append(l.events, "flush completed")
+	l.flush = info
+}
+
+func (l *recordListener) OnCompactionBegin(info CompactionJobInfo) {
+	l.events = append(l.events, "compaction begin")
+}
+
+func (l *recordListener) OnCompactionCompleted(info CompactionJobInfo) {
+	l.events = append(l.events, "compaction completed")
+	l.compac = info
+}
+
+func (l *recordListener) OnWalFileCreated(info WalFileInfo) {
+	l.events = append(l.events, "wal created "+path.Base(info.Path))
+}
+
+func (l *recordListener) OnWalFileDeleted(info WalFileInfo) {
+	l.events = append(l.events, "wal deleted "+path.Base(info.Path))
+}
+
+func (l *recordListener) OnTableFileDeleted(info sstable.TableFileInfo) {
+	l.events = append(l.events, "sst deleted "+path.Base(info.Path))
+}
+
+func (l *recordListener) OnStallConditionsChanged(info WriteStallInfo) {
+	l.events = append(l.events, fmt.Sprintf("stall %v->%v", info.Prev, info.Condition))
+}
+
+func (l *recordListener) OnBackgroundError(info BackgroundErrorInfo) {
+	l.events = append(l.events, "background error")
+	l.errs = append(l.errs, info)
+}
+
+func TestDb_EventListener(t *testing.T) {
+	dir := fmt.Sprintf("out/db/listener/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	l := &recordListener{}
+	db := &Db{}
+	db = db.InitWithOptions(dir, Options{EventListeners: []EventListener{l}})
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	err = db.Flush()
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("2"), Value: []byte("2")})
+	assert.Nil(t, err)
+	err = db.Compact()
+	assert.Nil(t, err)
+	db.stop() // 后台goroutine退出前调用剩余的事件
+
+	assert.Equal(t, []string{
+		"wal created 2.wal.log",
+		"stall 0->1",
+		"flush begin",
+		"flush completed",
+		"wal deleted 1.wal.log",
+		"stall 1->0",
+		"wal created 3.wal.log",
+		"stall 0->1",
+		"flush begin",
+		"flush completed",
+		"wal deleted 2.wal.log",
+		"compaction begin",
+		"sst deleted 0.0.db",
+		"sst deleted 0.1.db",
+		"compaction completed",
+		"stall 1->0",
+	}, l.events)
+	assert.Equal(t, DefaultColumnFamilyName, l.flush.ColumnFamily)
+	assert.Equal(t, 1, l.flush.Keys)
+	assert.Equal(t, dir+"/sst/0.1.db", l.flush.File.Path)
+	assert.Equal(t, 2, len(l.compac.Inputs))
+	assert.Equal(t, l.compac.Inputs[0].Size+l.compac.Inputs[1].Size, l.compac.ReadBytes)
+	assert.Equal(t, dir+"/sst/1.0.db", l.compac.Outputs[0].Path)
+	assert.True(t, l.compac.WriteBytes > 0)
+
+	t.Log("case: 后台合并失败")
+	l = &recordListener{}
+	db = db.InitWithOptions(dir, Options{
+		EventListeners:              []EventListener{l},
+		VerifyChecksumsInCompaction: true,
+		ColumnFamilies:              map[string]ColumnFamilyOptions{DefaultColumnFamilyName: {LevelLimit: 1}},
+	})
+	for i := 0; i < 2; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte("3"), Value: []byte("3")})
+		assert.Nil(t, err)
+		err = db.Flush()
+		assert.Nil(t, err)
+	}
+	err = os.WriteFile(dir+"/sst/0.0.db", []byte("broken"), 0666)
+	assert.Nil(t, err)
+	err = db.demonTask()
+	assert.NotNil(t, err)
+	db.stop()
+	assert.Equal(t, 1, len(l.errs))
+	assert.Equal(t, BackgroundErrorCompaction, l.errs[0].Reason)
+	assert.Equal(t, FatalError, l.errs[0].Severity) // 校验和不一致
+}
+
+func TestDb_BackgroundError(t *testing.T) {
+	dir := fmt.Sprintf("out/db/bgerror/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.Init(dir)
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	db.lock.Lock()
+	db.rotateMemtables()
+	db.lock.Unlock()
+
+	// sst目录的位置被一个文件占用，flush失败
+	err = os.WriteFile(dir+"/sst", []byte("1"), 0666)
+	assert.Nil(t, err)
+	err = db.demonTask()
+	assert.NotNil(t, err)
+	severity, err := db.BackgroundError()
+	assert.Equal(t, HardError, severity)
+	assert.NotNil(t, err)
+
+	t.Log("case: 只读模式下写入失败，读取不受影响")
+	err = db.SetKv(kv.Kv{Key: []byte("2"), Value: []byte("2")})
+	code, _ := errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeReadOnly, code)
+	err = db.Flush()
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeReadOnly, code)
+	k, _ := db.GetKv([]byte("1"))
+	assert.Equal(t, []byte("1"), k.Value)
+	assert.Nil(t, db.demonTask()) // 不再重试
+
+	t.Log("case: 故障没有排除时Resume失败")
+	assert.NotNil(t, db.Resume())
+	severity, _ = db.BackgroundError()
+	assert.Equal(t, HardError, severity)
+
+	t.Log("case: 排除故障后Resume恢复写入")
+	err = os.Remove(dir + "/sst")
+	assert.Nil(t, err)
+	assert.Nil(t, db.Resume())
+	severity, err = db.BackgroundError()
+	assert.Equal(t, NoError, severity)
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("2"), Value: []byte("2")})
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, db.DefaultColumnFamily().Stats().Levels)
+
+	t.Log("case: 文件损坏是FatalError，不能Resume")
+	db.lock.Lock()
+	db.setBackgroundError(BackgroundErrorCompaction, errs.New(errs.ErrCodeChecksum), NoError)
+	db.lock.Unlock()
+	err = db.Resume()
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeReadOnly, code)
+	db.Shutdown()
+}
+
+func TestDb_FlushPartialFailure(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	db, err := Open("db", Options{FS: fs})
+	assert.Nil(t, err)
+	cf := db.DefaultColumnFamily()
+	var wals []string
+	for i := 1; i <= 2; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte(strconv.Itoa(i))})
+		assert.Nil(t, err)
+		db.lock.Lock()
+		wals = append(wals, db.w.GetPath())
+		db.rotateMemtables()
+		db.lock.Unlock()
+	}
+
+	// 写入sst失败时可能panic
+	flush := func() (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				err = fmt.Errorf("panic:%v", e)
+			}
+		}()
+		return db.flush()
+	}
+
+	// 第一个imm写入sst后，第二个imm写入sst失败
+	fs.FailNth(vfs.OpCreate, 4)
+	db.lock.Lock()
+	err = flush()
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(cf.imm))
+	assert.Equal(t, wals[1], cf.imm[0].GetName())
+	assert.Equal(t, map[string]struct{}{wals[0]: {}}, db.obsoleteWals)
+	assert.Equal(t, []int{1}, cf.sst.Levels())
+	db.lock.Unlock()
+
+	// 重试时只写入剩下的imm，然后删除两个wal
+	db.lock.Lock()
+	err = flush()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(cf.imm))
+	assert.Equal(t, 0, len(db.obsoleteWals))
+	assert.Equal(t, []int{2}, cf.sst.Levels())
+	db.lock.Unlock()
+	for _, walPath := range wals {
+		_, err = fs.Stat(walPath)
+		assert.True(t, os.IsNotExist(err))
+	}
+	for i := 1; i <= 2; i++ {
+		k, result := db.GetKv([]byte(strconv.Itoa(i)))
+		assert.Equal(t, kv.Success, result)
+		assert.Equal(t, []byte(strconv.Itoa(i)), k.Value)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestRepair(t *testing.T) {
+	dir := fmt.Sprintf("out/db/repair/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.Init(dir)
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			err = db.SetKv(kv.Kv{Key: []byte(fmt.Sprintf("%v_%v", i, j)), Value: []byte("1")})
+			assert.Nil(t, err)
+		}
+		err = db.Flush()
+		assert.Nil(t, err)
+	}
+	err = db.SetKv(kv.Kv{Key: []byte("wal_1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("wal_2"), Value: []byte("1")})
+	assert.Nil(t, err)
+	db.stop()
+
+	// 0.0.db的元数据损坏，0.1.db中的一个kv损坏，wal的最后一条记录不完整
+	sstDir := dir + "/sst"
+	err = os.WriteFile(sstDir+"/0.0.db", []byte("broken"), 0666)
+	assert.Nil(t, err)
+	info, err := sstable.Inspect(sstDir+"/0.1.db", nil)
+	assert.Nil(t, err)
+	data, err := os.ReadFile(sstDir + "/0.1.db")
+	assert.Nil(t, err)
+	data[info.Entries[0].Position.Start] = 'x'
+	err = os.WriteFile(sstDir+"/0.1.db", data, 0666)
+	assert.Nil(t, err)
+	walFiles, err := wal.ListFiles(dir + "/wal")
+	assert.Nil(t, err)
+	walFile := walFiles[len(walFiles)-1]
+	data, err = os.ReadFile(walFile)
+	assert.Nil(t, err)
+	err = os.WriteFile(walFile, data[:len(data)-5], 0666)
+	assert.Nil(t, err)
+
+	report, err := Repair(dir)
+	assert.Nil(t, err)
+	t.Log(report)
+	status := make(map[string]RepairStatus)
+	for _, f := range report.Files {
+		status[f.Path] = f.Status
+	}
+	assert.Equal(t, RepairLost, status["sst/0.0.db"])
+	assert.Equal(t, RepairSalvaged, status["sst/0.1.db"])
+	assert.Equal(t, RepairOK, status["sst/0.2.db"])
+	assert.Equal(t, RepairSalvaged, status["wal/"+path.Base(walFile)])
+	_, err = os.Stat(dir + "/lost/sst/0.0.db")
+	assert.Nil(t, err)
+
+	db = db.Init(dir)
+	_, res := db.GetKv([]byte("0_0"))
+	assert.Equal(t, kv.None, res)
+	_, res = db.GetKv([]byte("1_0")) // 损坏的kv
+	assert.Equal(t, kv.None, res)
+	k, _ := db.GetKv([]byte("1_1"))
+	assert.Equal(t, []byte("1"), k.Value)
+	k, _ = db.GetKv([]byte("2_2"))
+	assert.Equal(t, []byte("1"), k.Value)
+	k, _ = db.GetKv([]byte("wal_1"))
+	assert.Equal(t, []byte("1"), k.Value)
+	_, res = db.GetKv([]byte("wal_2"))
+	assert.Equal(t, kv.None, res)
+	assert.Equal(t, []int{2}, db.DefaultColumnFamily().Stats().Levels)
+	db.stop()
+}
+
+func TestDb_OpenWithRepairLeftover(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("db", Options{FS: fs})
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Flush())
+	assert.Nil(t, db.Close())
+
+	// Repair中断时残留的临时文件不影响打开，也不会被删除
+	err = vfs.WriteFile(fs, "db/sst/0.0.db.repair", []byte("x"))
+	assert.Nil(t, err)
+	db, err = Open("db", Options{FS: fs})
+	assert.Nil(t, err)
+	k, result := db.GetKv([]byte("1"))
+	assert.Equal(t, kv.Success, result)
+	assert.Equal(t, []byte("1"), k.Value)
+	assert.Nil(t, db.Close())
+	_, err = fs.Stat("db/sst/0.0.db.repair")
+	assert.Nil(t, err)
+}
+
+func TestRepair_Marshaller(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	opts := Options{FS: fs, ColumnFamilies: map[string]ColumnFamilyOptions{"gob": {Marshaller: kv.Gob{}}}}
+	db, err := Open("db", opts)
+	assert.Nil(t, err)
+	cf, err := db.CreateColumnFamily("gob", opts.ColumnFamilies["gob"])
+	assert.Nil(t, err)
+	for i := 0; i < 3; i++ {
+		err = cf.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("1")})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Flush())
+	assert.Nil(t, db.Close())
+
+	// 一个kv损坏，其他kv需要用列族的Marshaller解码后重新写入
+	file := sstDir("db", cf.id) + "/0.0.db"
+	info, err := sstable.InspectFS(fs, file, kv.Gob{}, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Corrupt(file, info.Entries[0].Position.Start))
+
+	list, err := VerifyChecksumsWithOptions("db", opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []Corruption{{Path: file, Offset: info.Entries[0].Position.Start, Reason: list[0].Reason}}, list)
+	list, err = VerifyChecksumsFS(fs, "db") // 使用kv.Json无法解码
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.NotEqual(t, info.Entries[0].Position.Start, list[0].Offset)
+
+	report, err := RepairWithOptions("db", opts)
+	assert.Nil(t, err)
+	files := make(map[string]RepairFile)
+	for _, f := range report.Files {
+		files[f.Path] = f
+	}
+	rel := path.Base(sstDir("", cf.id)) + "/0.0.db"
+	assert.Equal(t, RepairSalvaged, files[rel].Status)
+	assert.Equal(t, 2, files[rel].Kept)
+
+	db, err = Open("db", opts)
+	assert.Nil(t, err)
+	_, res := db.ColumnFamily("gob").GetKv([]byte("0"))
+	assert.Equal(t, kv.None, res)
+	for _, key := range []string{"1", "2"} {
+		k, res := db.ColumnFamily("gob").GetKv([]byte(key))
+		assert.Equal(t, kv.Success, res)
+		assert.Equal(t, []byte("1"), k.Value)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDb_VerifyChecksums(t *testing.T) {
+	dir := fmt.Sprintf("out/db/verify/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+
+	db := &Db{}
+	db = db.InitWithOptions(dir, Options{VerifyChecksumsInCompaction: true})
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("abc")})
+	assert.Nil(t, err)
+	err = db.Flush()
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("2"), Value: []byte("2")})
+	assert.Nil(t, err)
+	list, err := db.VerifyChecksums()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(list))
+
+	// sst中的value被修改后仍然可以解码，只有校验和能发现
+	sst := dir + "/sst/0.0.db"
+	data, err := os.ReadFile(sst)
+	assert.Nil(t, err)
+	i := bytes.Index(data, []byte("YWJj")) // base64("abc")
+	assert.True(t, i > 0)
+	data[i+3] = 'k'
+	err = os.WriteFile(sst, data, 0666)
+	assert.Nil(t, err)
+	list, err = db.VerifyChecksums()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+	assert.Equal(t, sst, list[0].Path)
+	assert.Contains(t, list[0].Reason, "checksum mismatch")
+
+	err = db.Compact()
+	code, _ := errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	db.stop()
+
+	list, err = VerifyChecksums(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(list))
+
+	t.Log("case: 不校验时合并返回错误，不会panic")
+	db = (&Db{}).InitWithOptions(dir, Options{})
+	err = db.Compact()
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+
+	t.Log("case: 读取损坏的kv返回错误，不影响写入")
+	_, res, err := db.GetKvContext(context.Background(), []byte("1"))
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	assert.Equal(t, kv.None, res)
+	severity, err := db.BackgroundError()
+	assert.Equal(t, NoError, severity)
+	assert.Nil(t, err)
+	assert.Nil(t, db.SetKv(kv.Kv{Key: []byte("3"), Value: []byte("3")}))
+	_, res = db.GetKv([]byte("1"))
+	assert.Equal(t, kv.None, res)
+	txn := db.BeginTxn()
+	_, _, err = txn.Get(nil, []byte("1"))
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	txn.Rollback()
+	k, _ := db.GetKv([]byte("2"))
+	assert.Equal(t, []byte("2"), k.Value)
+	db.stop()
+}
+
+func TestDb_Iterator(t *testing.T) {
+	mem := vfs.NewMem()
+	fs := vfs.NewFault(mem)
+	db, err := Open("db", Options{FS: fs})
+	assert.Nil(t, err)
+	for _, key := range []string{"a", "b", "c"} {
+		assert.Nil(t, db.SetKv(kv.Kv{Key: []byte(key), Value: []byte("old")}))
+	}
+	assert.Nil(t, db.Flush())
+	assert.Nil(t, db.SetKv(kv.Kv{Key: []byte("d"), Value: []byte("old")}))
+
+	collect := func(it *Iterator) []string {
+		var list []string
+		for ; it.Valid(); it.Next() {
+			list = append(list, string(it.Key())+"="+string(it.Value()))
+		}
+		return list
+	}
+
+	t.Log("case: 创建后的写入和合并不影响Iterator，被合并删除的sst在遍历结束后释放")
+	it, err := db.NewIterator(nil, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, db.SetKv(kv.Kv{Key: []byte("b"), Value: []byte("new")}))
+	assert.Nil(t, db.DeleteKv([]byte("c")))
+	assert.Nil(t, db.Compact())
+	open := mem.OpenFiles()
+	assert.Equal(t, []string{"a=old", "b=old", "c=old", "d=old"}, collect(it))
+	assert.Nil(t, it.Err())
+	assert.Equal(t, open-1, mem.OpenFiles())
+	assert.Nil(t, it.Close())
+
+	t.Log("case: 提前结束时Close释放sst")
+	it, err = db.NewIterator([]byte("b"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), it.Value())
+	assert.Nil(t, db.Compact())
+	assert.Nil(t, it.Close())
+	assert.Equal(t, open-1, mem.OpenFiles())
+
+	t.Log("case: 只读取范围内的kv，读到损坏的kv时Err返回错误")
+	file, err := db.DefaultColumnFamily().sst.Files()
+	assert.Nil(t, err)
+	var sst string
+	for _, level := range file {
+		for _, f := range level {
+			sst = f.Path
+		}
+	}
+	info, err := sstable.InspectFS(fs, sst, nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a"), info.Entries[0].Key)
+	assert.Nil(t, fs.Corrupt(sst, info.Entries[0].Position.Start))
+	it, err = db.NewIterator([]byte("b"), nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b=new", "d=old"}, collect(it))
+	assert.Nil(t, it.Err())
+	it, err = db.NewIterator(nil, nil)
+	assert.Nil(t, err)
+	assert.False(t, it.Valid())
+	code, _ := errs.FromError(it.Err())
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	assert.Equal(t, open-1, mem.OpenFiles())
+	assert.Nil(t, db.Close())
+}
+
+func TestDb_MemFS(t *testing.T) {
+	dir := fmt.Sprintf("out/db/memfs/%v", time.Now().Unix())
+	fs := vfs.NewMem()
+	opts := Options{FS: fs, ColumnFamilies: map[string]ColumnFamilyOptions{
+		DefaultColumnFamilyName: {MemtableSize: 5, LevelLimit: 1},
+	}}
+	db := &Db{}
+	db = db.InitWithOptions(dir, opts)
+	meta, err := db.CreateColumnFamily("meta", ColumnFamilyOptions{})
+	assert.Nil(t, err)
+	for i := 0; i < 12; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("v1")})
+		assert.Nil(t, err)
+	}
+	err = meta.SetKv(kv.Kv{Key: []byte("m"), Value: []byte("meta")})
+	assert.Nil(t, err)
+	err = db.Compact()
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("wal"), Value: []byte("v1")}) // 只在wal中
+	assert.Nil(t, err)
+	err = db.Checkpoint(dir + "/cp")
+	assert.Nil(t, err)
+	list, err := db.VerifyChecksums()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(list))
+	db.stop()
+
+	// 所有文件都只在内存中
+	_, err = os.Stat(dir)
+	assert.True(t, os.IsNotExist(err))
+	names, err := fs.List(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"LOCK", "MANIFEST", "cp", "sst", "sst_1", "wal"}, names)
+	list, err = VerifyChecksumsFS(fs, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(list))
+
+	for _, d := range []string{dir, dir + "/cp"} {
+		db = &Db{}
+		db = db.InitWithOptions(d, opts)
+		for i := 0; i < 12; i++ {
+			k, _ := db.GetKv([]byte(strconv.Itoa(i)))
+			assert.Equal(t, []byte("v1"), k.Value)
+		}
+		k, _ := db.GetKv([]byte("wal"))
+		assert.Equal(t, []byte("v1"), k.Value)
+		k, _ = db.ColumnFamily("meta").GetKv([]byte("m"))
+		assert.Equal(t, []byte("meta"), k.Value)
+		db.stop()
+	}
+}
+
+func TestDb_Lock(t *testing.T) {
+	dir := fmt.Sprintf("out/db/lock/%v", time.Now().UnixNano())
+	for _, fs := range []vfs.FS{vfs.Default, vfs.NewMem()} {
+		opts := Options{FS: fs}
+		db, err := Open(dir, opts)
+		assert.Nil(t, err)
+
+		// 同一个目录不能被打开两次
+		_, err = Open(dir, opts)
+		code, _ := errs.FromError(err)
+		assert.Equal(t, errs.ErrCodeDbLocked, code)
+		assert.Panics(t, func() { (&Db{}).InitWithOptions(dir, opts) })
+		_, err = RepairFS(fs, dir)
+		code, _ = errs.FromError(err)
+		assert.Equal(t, errs.ErrCodeDbLocked, code)
+
+		err = db.SetKv(kv.Kv{Key: []byte("k"), Value: []byte("v")})
+		assert.Nil(t, err)
+		db.Shutdown()
+
+		// 关闭后释放锁
+		db, err = Open(dir, opts)
+		assert.Nil(t, err)
+		k, _ := db.GetKv([]byte("k"))
+		assert.Equal(t, []byte("v"), k.Value)
+		db.Shutdown()
+	}
+}
+
+// 在OnWalFileCreated中阻塞后台goroutine，直到release被关闭
+type blockingListener struct {
+	EventListenerBase
+	release chan struct{}
+}
+
+func (l blockingListener) OnWalFileCreated(info WalFileInfo) {
+	<-l.release
+}
+
+func TestDb_Close(t *testing.T) {
+	dir := "db"
+	fs := vfs.NewMem()
+	opts := Options{FS: fs, ColumnFamilies: map[string]ColumnFamilyOptions{
+		DefaultColumnFamilyName: {MemtableSize: 5},
+	}}
+	for _, flush := range []bool{false, true} {
+		opts.FlushOnClose = flush
+		db, err := Open(dir, opts)
+		assert.Nil(t, err)
+		meta, err := db.CreateColumnFamily(fmt.Sprintf("meta_%v", flush), ColumnFamilyOptions{})
+		assert.Nil(t, err)
+		for i := 0; i < 8; i++ {
+			err = db.SetKv(kv.Kv{Key: []byte(fmt.Sprintf("%v_%v", flush, i)), Value: []byte("v1")})
+			assert.Nil(t, err)
+		}
+		err = meta.SetKv(kv.Kv{Key: []byte("m"), Value: []byte("meta")})
+		assert.Nil(t, err)
+		assert.Nil(t, db.Close())
+		assert.Nil(t, db.Close()) // 可以重复调用
+
+		// 所有的wal和sst都已经关闭，之后的写入失败
+		assert.Equal(t, 0, fs.OpenFiles())
+		code, _ := errs.FromError(db.SetKv(kv.Kv{Key: []byte("k"), Value: []byte("v1")}))
+		assert.Equal(t, errs.ErrCodeDbClosed, code)
+		code, _ = errs.FromError(db.Flush())
+		assert.Equal(t, errs.ErrCodeDbClosed, code)
+		code, _ = errs.FromError(db.Resume())
+		assert.Equal(t, errs.ErrCodeDbClosed, code)
+
+		db, err = Open(dir, opts)
+		assert.Nil(t, err)
+		for i := 0; i < 8; i++ {
+			k, _ := db.GetKv([]byte(fmt.Sprintf("%v_%v", flush, i)))
+			assert.Equal(t, []byte("v1"), k.Value)
+		}
+		k, _ := db.ColumnFamily(fmt.Sprintf("meta_%v", flush)).GetKv([]byte("m"))
+		assert.Equal(t, []byte("meta"), k.Value)
+		// 默认只写入immemtable，memtable中的kv还在wal中
+		assert.Equal(t, flush, len(db.DefaultColumnFamily().mem.GetValues()) == 0)
+		assert.Nil(t, db.Close())
+	}
+
+	t.Log("case: 等待后台任务超时")
+	release := make(chan struct{})
+	opts.CloseTimeout = 10 * time.Millisecond
+	opts.EventListeners = []EventListener{blockingListener{release: release}}
+	db, err := Open(dir, opts)
+	assert.Nil(t, err)
+	for i := 0; i < 6; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte("v1")})
+		assert.Nil(t, err)
+	}
+	err = db.Close()
+	code, _ := errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeDbClosed, code)
+	code, _ = errs.FromError(db.Close()) // 后台任务还没有结束，再次等待
+	assert.Equal(t, errs.ErrCodeDbClosed, code)
+	_, err = Open(dir, opts) // 没有释放目录锁
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeDbLocked, code)
+	err = db.SetKv(kv.Kv{Key: []byte("a"), Value: []byte("v1")})
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeDbClosed, code)
+
+	t.Log("case: 后台任务结束后再次Close完成关闭")
+	close(release)
+	opts.EventListeners = nil
+	assert.Nil(t, db.Close())
+	assert.Nil(t, db.Close())
+	db, err = Open(dir, opts)
+	assert.Nil(t, err)
+	for i := 0; i < 6; i++ {
+		k, _ := db.GetKv([]byte(strconv.Itoa(i)))
+		assert.Equal(t, []byte("v1"), k.Value)
+	}
+	assert.Nil(t, db.Close())
+}
+
+func TestDb_Context(t *testing.T) {
+	dir := "db"
+	fs := vfs.NewMem()
+	db, err := Open(dir, Options{FS: fs, TransactionDB: true, LockTimeout: time.Minute})
+	assert.Nil(t, err)
+	defer db.Shutdown()
+	err = db.SetKv(kv.Kv{Key: []byte("a"), Value: []byte("1")})
+	assert.Nil(t, err)
+
+	t.Log("case: 已经取消的ctx不执行任何操作")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, db.SetKvContext(ctx, kv.Kv{Key: []byte("b"), Value: []byte("2")}))
+	_, _, err = db.GetKvContext(ctx, []byte("a"))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, db.FlushContext(ctx))
+	assert.Equal(t, context.Canceled, db.CompactContext(ctx))
+	_, err = db.NewIteratorContext(ctx, []byte(""), []byte(""))
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, context.Canceled, db.CheckpointContext(ctx, "checkpoint"))
+	assert.False(t, vfs.Exists(fs, "checkpoint"))
+	_, res := db.GetKv([]byte("b"))
+	assert.Equal(t, kv.None, res)
+
+	t.Log("case: 等待写入停顿时超时，写入不生效")
+	db.lock.Lock()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	err = db.SetKvContext(ctx, kv.Kv{Key: []byte("b"), Value: []byte("2")})
+	cancel()
+	assert.Equal(t, context.DeadlineExceeded, err)
+	db.lock.Unlock()
+	_, res = db.GetKv([]byte("b"))
+	assert.Equal(t, kv.None, res)
+	// 超时的等待者不会一直持有锁
+	assert.Nil(t, db.SetKv(kv.Kv{Key: []byte("b"), Value: []byte("3")}))
+	k, _, err := db.GetKvContext(context.Background(), []byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("3"), k.Value)
+
+	t.Log("case: 等待行锁时取消")
+	txn1 := db.BeginTxn()
+	txn2 := db.BeginTxn()
+	assert.Nil(t, txn1.Set(nil, kv.Kv{Key: []byte("a"), Value: []byte("4")}))
+	ctx, cancel = context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- txn2.SetContext(ctx, nil, kv.Kv{Key: []byte("a"), Value: []byte("5")})
+	}()
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Nil(t, txn2.Rollback())
+	assert.Nil(t, txn1.Commit())
+	k, _ = db.GetKv([]byte("a"))
+	assert.Equal(t, []byte("4"), k.Value)
+}
+
+func TestDb_ReadOnly(t *testing.T) {
+	dir := "db"
+	fs := vfs.NewMem()
+	opts := Options{FS: fs, ColumnFamilies: map[string]ColumnFamilyOptions{
+		DefaultColumnFamilyName: {MemtableSize: 5},
+	}}
+	_, err := OpenReadOnly(dir, opts)
+	code, _ := errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeInvalidArgument, code)
+	assert.False(t, vfs.Exists(fs, dir))
+
+	primary, err := Open(dir, opts)
+	assert.Nil(t, err)
+	for i := 0; i < 8; i++ {
+		err = primary.SetKv(kv.Kv{Key: []byte(fmt.Sprintf("k%v", i)), Value: []byte("v1")})
+		assert.Nil(t, err)
+	}
+	err = primary.Flush()
+	assert.Nil(t, err)
+	err = primary.SetKv(kv.Kv{Key: []byte("wal"), Value: []byte("v1")}) // 只在wal中
+	assert.Nil(t, err)
+	walFiles, err := fs.List(dir + "/wal")
+	assert.Nil(t, err)
+
+	t.Log("case: 主实例打开时可以只读打开，不修改任何文件")
+	ro, err := OpenReadOnly(dir, opts)
+	assert.Nil(t, err)
+	secondary, err := OpenSecondary(dir, opts)
+	assert.Nil(t, err)
+	list, err := fs.List(dir + "/wal")
+	assert.Nil(t, err)
+	assert.Equal(t, walFiles, list)
+	for _, d := range []*Db{ro, secondary} {
+		k, result := d.GetKv([]byte("k0"))
+		assert.Equal(t, kv.Success, result)
+		assert.Equal(t, []byte("v1"), k.Value)
+		k, _ = d.GetKv([]byte("wal"))
+		assert.Equal(t, []byte("v1"), k.Value)
+
+		code, _ = errs.FromError(d.SetKv(kv.Kv{Key: []byte("k0"), Value: []byte("v2")}))
+		assert.Equal(t, errs.ErrCodeReadOnly, code)
+		code, _ = errs.FromError(d.Flush())
+		assert.Equal(t, errs.ErrCodeReadOnly, code)
+		_, err = d.CreateColumnFamily("meta", ColumnFamilyOptions{})
+		code, _ = errs.FromError(err)
+		assert.Equal(t, errs.ErrCodeReadOnly, code)
+		code, _ = errs.FromError(d.Checkpoint(dir + "_cp"))
+		assert.Equal(t, errs.ErrCodeReadOnly, code)
+	}
+	code, _ = errs.FromError(ro.TryCatchUpWithPrimary())
+	assert.Equal(t, errs.ErrCodeInvalidArgument, code)
+
+	t.Log("case: 从实例追赶主实例的写入、flush、合并和新建的列族")
+	err = primary.SetKv(kv.Kv{Key: []byte("new"), Value: []byte("v1")})
+	assert.Nil(t, err)
+	err = primary.DeleteKv([]byte("k0"))
+	assert.Nil(t, err)
+	meta, err := primary.CreateColumnFamily("meta", ColumnFamilyOptions{})
+	assert.Nil(t, err)
+	err = meta.SetKv(kv.Kv{Key: []byte("m"), Value: []byte("meta")})
+	assert.Nil(t, err)
+	err = primary.Compact()
+	assert.Nil(t, err)
+	err = primary.SetKv(kv.Kv{Key: []byte("k1"), Value: []byte("v2")})
+	assert.Nil(t, err)
+
+	_, result := secondary.GetKv([]byte("new"))
+	assert.Equal(t, kv.None, result)
+	assert.Nil(t, secondary.ColumnFamily("meta"))
+	assert.Nil(t, secondary.TryCatchUpWithPrimary())
+	for _, d := range []*Db{secondary, primary} {
+		k, _ := d.GetKv([]byte("new"))
+		assert.Equal(t, []byte("v1"), k.Value)
+		_, result = d.GetKv([]byte("k0"))
+		assert.Equal(t, kv.Deleted, result)
+		k, _ = d.GetKv([]byte("k1"))
+		assert.Equal(t, []byte("v2"), k.Value)
+		k, _ = d.ColumnFamily("meta").GetKv([]byte("m"))
+		assert.Equal(t, []byte("meta"), k.Value)
+	}
+	_, result = ro.GetKv([]byte("new")) // 只读打开时保持打开时的内容
+	assert.Equal(t, kv.None, result)
+
+	ro.Shutdown()
+	secondary.Shutdown()
+	primary.Shutdown()
+}
+
+// 随机写入、删除、批量写入，在随机的位置崩溃后重新打开，检查所有返回成功的写入都没有丢失，删除的key没有重新出现
+func TestDb_Crash(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("seed:%v", seed)
+	rnd := rand.New(rand.NewSource(seed))
+
+	dir := "db"
+	fs := vfs.NewFault(vfs.NewMem())
+	fs.PartialWrites(seed) // 崩溃时正在写入的记录只写了一部分
+	opts := Options{FS: fs, Sync: true, ColumnFamilies: map[string]ColumnFamilyOptions{
+		DefaultColumnFamilyName: {MemtableSize: 8, LevelLimit: 2},
+	}}
+	// key可能的值，nil表示不存在。返回成功的写入只有一个可能的值，失败的写入可能生效也可能没有生效
+	model := make(map[string][][]byte)
+	update := func(key string, value []byte, err error) {
+		if err == nil {
+			model[key] = [][]byte{value}
+			return
+		}
+		if _, ok := model[key]; !ok {
+			model[key] = [][]byte{nil}
+		}
+		model[key] = append(model[key], value)
+	}
+	// 崩溃时正在执行的操作可能panic
+	call := func(f func() error) (err error) {
+		defer func() {
+			if e := recover(); e != nil {
+				err = fmt.Errorf("panic:%v", e)
+			}
+		}()
+		return f()
+	}
+
+	db := (&Db{}).InitWithOptions(dir, opts)
+	for round := 0; round < 30; round++ {
+		fs.CrashAfter(rnd.Intn(200) + 1)
+		for i := 0; i < 100 && !fs.Crashed(); i++ {
+			key := fmt.Sprintf("k%02d", rnd.Intn(40))
+			value := []byte(fmt.Sprintf("%v-%v", round, i))
+			switch n := rnd.Intn(100); {
+			case n < 50:
+				err := call(func() error { return db.SetKv(kv.Kv{Key: []byte(key), Value: value}) })
+				update(key, value, err)
+			case n < 70:
+				err := call(func() error { return db.DeleteKv([]byte(key)) })
+				update(key, nil, err)
+			case n < 85:
+				b := db.NewWriteBatch()
+				values := make(map[string][]byte)
+				for j := rnd.Intn(5); j >= 0; j-- {
+					key = fmt.Sprintf("k%02d", rnd.Intn(40))
+					if rnd.Intn(3) == 0 {
+						b.DeleteKv(nil, []byte(key))
+						values[key] = nil
+					} else {
+						b.SetKv(nil, kv.Kv{Key: []byte(key), Value: value})
+						values[key] = value
+					}
+				}
+				err := call(func() error { return db.Write(b) })
+				for key, value := range values {
+					update(key, value, err)
+				}
+			case n < 95:
+				_ = call(db.demonTask)
+			default:
+				_ = call(db.Flush)
+			}
+		}
+		db.stop()
+		fs.Crash()
+
+		db = (&Db{}).InitWithOptions(dir, opts)
+		for key, values := range model {
+			val, result := db.GetKv([]byte(key))
+			var actual []byte
+			if result == kv.Success {
+				actual = val.Value
+			}
+			found := false
+			for _, v := range values {
+				if bytes.Equal(v, actual) {
+					found = true
+				}
+			}
+			if !assert.True(t, found, "round:%v key:%v actual:%q expected one of:%q", round, key, actual, values) {
+				return
+			}
+			model[key] = [][]byte{actual} // 重新打开后读到的值已经落盘
+		}
+	}
+	db.stop()
+}
+
+func TestDb_TornWal(t *testing.T) {
+	fs := vfs.NewMem()
+	db, err := Open("db", Options{FS: fs})
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	// 写入wal记录时崩溃，只留下了长度的一部分
+	names, err := fs.List("db/wal")
+	assert.Nil(t, err)
+	path := "db/wal/" + names[len(names)-1]
+	data, err := vfs.ReadFile(fs, path)
+	assert.Nil(t, err)
+	err = vfs.WriteFile(fs, path, append(data, 1, 2, 3))
+	assert.Nil(t, err)
+
+	db, err = Open("db", Options{FS: fs})
+	assert.Nil(t, err)
+	k, result := db.GetKv([]byte("1"))
+	assert.Equal(t, kv.Success, result)
+	assert.Equal(t, []byte("1"), k.Value)
+	err = db.SetKv(kv.Kv{Key: []byte("2"), Value: []byte("2")})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Close())
+
+	db, err = Open("db", Options{FS: fs})
+	assert.Nil(t, err)
+	k, result = db.GetKv([]byte("2"))
+	assert.Equal(t, kv.Success, result)
+	assert.Equal(t, []byte("2"), k.Value)
+	assert.Nil(t, db.Close())
+}
+
+func TestDb_CorruptWalLength(t *testing.T) {
+	fs := vfs.NewFault(vfs.NewMem())
+	db, err := Open("db", Options{FS: fs})
+	assert.Nil(t, err)
+	walPath := db.w.GetPath()
+	err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	info, err := fs.Stat(walPath)
+	assert.Nil(t, err)
+	middle := info.Size()
+	for i := 2; i <= 3; i++ {
+		err = db.SetKv(kv.Kv{Key: []byte(strconv.Itoa(i)), Value: []byte(strconv.Itoa(i))})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, db.Close())
+
+	// 第二条记录的长度前缀损坏，看起来像是超出文件末尾的记录，但后面还有完整的记录，不能截断
+	err = fs.Corrupt(walPath, middle+7)
+	assert.Nil(t, err)
+	_, err = Open("db", Options{FS: fs})
+	code, _ := errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	info, err = fs.Stat(walPath)
+	assert.Nil(t, err)
+	assert.True(t, info.Size() > middle)
+}
+
+func TestDb_CrashTornWal(t *testing.T) {
+	torn := 0
+	for seed := int64(0); seed < 20; seed++ {
+		fs := vfs.NewFault(vfs.NewMem())
+		fs.PartialWrites(seed)
+		db, err := Open("db", Options{FS: fs, Sync: true})
+		assert.Nil(t, err)
+		err = db.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+		assert.Nil(t, err)
+		walPath := db.w.GetPath()
+		before, err := fs.Stat(walPath)
+		assert.Nil(t, err)
+
+		// 写入下一条wal记录时崩溃
+		fs.CrashAfter(1)
+		err = db.SetKv(kv.Kv{Key: []byte("2"), Value: bytes.Repeat([]byte("2"), 100)})
+		assert.NotNil(t, err)
+		db.stop()
+		fs.Crash()
+		after, err := fs.Stat(walPath)
+		assert.Nil(t, err)
+		if after.Size() > before.Size() {
+			torn++
+		}
+
+		db, err = Open("db", Options{FS: fs, Sync: true})
+		if !assert.Nil(t, err, "seed:%v", seed) {
+			return
+		}
+		k, result := db.GetKv([]byte("1"))
+		assert.Equal(t, kv.Success, result)
+		assert.Equal(t, []byte("1"), k.Value)
+		_, result = db.GetKv([]byte("2"))
+		assert.Equal(t, kv.None, result)
+		err = db.SetKv(kv.Kv{Key: []byte("3"), Value: []byte("3")})
+		assert.Nil(t, err)
+		assert.Nil(t, db.Close())
+	}
+	assert.True(t, torn > 0)
+}
+
+func TestDb_Comparator(t *testing.T) {
+	dir := "db"
+	fs := vfs.NewMem()
+	opts := Options{FS: fs, Comparator: kv.ReverseBytewise{}, ColumnFamilies: map[string]ColumnFamilyOptions{
+		DefaultColumnFamilyName: {MemtableSize: 5, LevelLimit: 1},
+	}}
+	// key为大端序的时间戳，ReverseBytewise下新的key排在前面
+	key := func(ts uint64) []byte {
+		return binary.BigEndian.AppendUint64(nil, ts)
+	}
+	db, err := Open(dir, opts)
+	assert.Nil(t, err)
+	for i := uint64(0); i < 12; i++ {
+		err = db.SetKv(kv.Kv{Key: key(i << 8), Value: []byte(strconv.Itoa(int(i)))})
+		assert.Nil(t, err)
+	}
+	err = db.DeleteRange(key(9<<8), key(6<<8))
+	assert.Nil(t, err)
+	err = db.Compact()
+	assert.Nil(t, err)
+	err = db.SetKv(kv.Kv{Key: key(20 << 8), Value: []byte("20")}) // 只在wal中
+	assert.Nil(t, err)
+
+	check := func(db *Db) {
+		var list []string
+		it, err := db.NewIterator(key(20<<8), key(3<<8))
+		assert.Nil(t, err)
+		for ; it.Valid(); it.Next() {
+			list = append(list, string(it.Value()))
+		}
+		assert.Equal(t, []string{"20", "11", "10", "6", "5", "4"}, list)
+		k, res := db.GetKv(key(7 << 8))
+		assert.NotEqual(t, kv.Success, res)
+		k, _ = db.GetKv(key(1 << 8))
+		assert.Equal(t, []byte("1"), k.Value)
+	}
+	check(db)
+	assert.Nil(t, db.Close())
+
+	db, err = Open(dir, opts)
+	assert.Nil(t, err)
+	check(db)
+	assert.Nil(t, db.Close())
+
+	t.Log("case: 使用和创建时不同的comparator打开")
+	for _, cmp := range []kv.Comparator{nil, kv.Bytewise{}} {
+		_, err = Open(dir, Options{FS: fs, Comparator: cmp})
+		code, _ := errs.FromError(err)
+		assert.Equal(t, errs.ErrCodeComparator, code)
+		_, err = OpenReadOnly(dir, Options{FS: fs, Comparator: cmp})
+		code, _ = errs.FromError(err)
+		assert.Equal(t, errs.ErrCodeComparator, code)
+	}
+	_, err = RepairWithOptions(dir, Options{FS: fs})
+	code, _ := errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeComparator, code)
+
+	t.Log("case: 没有记录comparator的db视为Bytewise")
+	dir = "legacy"
+	db, err = Open(dir, Options{FS: fs})
+	assert.Nil(t, err)
+	assert.Nil(t, db.SetKv(kv.Kv{Key: []byte("k"), Value: []byte("v")}))
+	assert.Nil(t, db.Close())
+	assert.Nil(t, fs.Remove(dir+"/MANIFEST"))
+	_, err = Open(dir, opts)
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeComparator, code)
+	db, err = Open(dir, Options{FS: fs})
+	assert.Nil(t, err)
+	k, _ := db.GetKv([]byte("k"))
+	assert.Equal(t, []byte("v"), k.Value)
+	assert.Nil(t, db.Close())
+}
+
+func TestTyped(t *testing.T) {
+	type user struct {
+		Name string
+		Age  int
+	}
+	db, err := Open("db", Options{FS: vfs.NewMem()})
+	assert.Nil(t, err)
+	for i, values := range []kv.MarshalOp{nil, kv.Gob{}} {
+		cf, err := db.CreateColumnFamily(fmt.Sprintf("users_%v", i), ColumnFamilyOptions{})
+		assert.Nil(t, err)
+		users := NewTyped[int64, user](cf, kv.IntKey[int64]{}, values)
+		for _, id := range []int64{3, -1, 10, 0} {
+			assert.Nil(t, users.Put(id, user{Name: strconv.Itoa(int(id)), Age: int(id) + 20}))
+		}
+		u, ok, err := users.Get(3)
+		assert.Nil(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, user{Name: "3", Age: 23}, u)
+		assert.Nil(t, users.Delete(3))
+		_, ok, err = users.Get(3)
+		assert.Nil(t, err)
+		assert.False(t, ok)
+
+		// 负数排在正数之前
+		it, err := users.NewFullIterator()
+		assert.Nil(t, err)
+		var ids []int64
+		for ; it.Valid(); it.Next() {
+			ids = append(ids, it.Key())
+			assert.Equal(t, strconv.Itoa(int(it.Key())), it.Value().Name)
+		}
+		assert.Nil(t, it.Err())
+		assert.Equal(t, []int64{-1, 0, 10}, ids)
+		it, err = users.NewIterator(-1, 10)
+		assert.Nil(t, err)
+		ids = nil
+		for ; it.Valid(); it.Next() {
+			ids = append(ids, it.Key())
+		}
+		assert.Equal(t, []int64{-1, 0}, ids)
+	}
+
+	t.Log("case: 无法解码的value")
+	err = db.SetKv(kv.Kv{Key: []byte("k"), Value: []byte("{")})
+	assert.Nil(t, err)
+	names := NewTyped[string, user](db.DefaultColumnFamily(), kv.StringKey{}, kv.Json{})
+	_, ok, err := names.Get("k")
+	code, _ := errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeMarshal, code)
+	assert.False(t, ok)
+	it, err := names.NewFullIterator()
+	assert.Nil(t, err)
+	assert.False(t, it.Valid())
+	code, _ = errs.FromError(it.Err())
+	assert.Equal(t, errs.ErrCodeMarshal, code)
+
+	t.Log("case: 编码为空的end不能作为上界")
+	_, err = names.NewIterator("a", "")
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeInvalidArgument, code)
+
+	t.Log("case: 超出UnixNano范围的时间")
+	events := NewTyped[time.Time, string](db.DefaultColumnFamily(), kv.TimeKey{}, nil)
+	err = events.Put(time.Time{}, "zero")
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeInvalidArgument, code)
+	_, _, err = events.Get(time.Time{})
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeInvalidArgument, code)
+	_, err = events.NewIterator(time.Unix(0, 0), time.Time{})
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeInvalidArgument, code)
+	assert.Nil(t, events.Put(time.Unix(1, 0), "1"))
+	v, ok, err := events.Get(time.Unix(1, 0))
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, "1", v)
+	assert.Nil(t, db.Close())
+}
@@ -0,0 +1,143 @@
+package db
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"lsmtree/sstable"
+)
+
+// EventListener 接收db内部的事件，通过Options.EventListeners注册。
+//
+//	事件按发生的顺序，在DemonTask启动的后台goroutine中依次调用，不会阻塞写入和flush、合并。
+//	回调中可以调用Db的方法，但是耗时的回调会推迟后续事件和后台任务。只关心部分事件时可以嵌入EventListenerBase
+type EventListener interface {
+	OnFlushBegin(info FlushJobInfo)
+	OnFlushCompleted(info FlushJobInfo)
+	OnCompactionBegin(info CompactionJobInfo)
+	OnCompactionCompleted(info CompactionJobInfo)
+	OnWalFileCreated(info WalFileInfo)
+	OnWalFileDeleted(info WalFileInfo)
+	OnTableFileDeleted(info sstable.TableFileInfo)
+	OnStallConditionsChanged(info WriteStallInfo)
+	OnBackgroundError(info BackgroundErrorInfo)
+}
+
+// EventListenerBase 所有方法都为空的EventListener
+type EventListenerBase struct{}
+
+func (EventListenerBase) OnFlushBegin(info FlushJobInfo)                {}
+func (EventListenerBase) OnFlushCompleted(info FlushJobInfo)            {}
+func (EventListenerBase) OnCompactionBegin(info CompactionJobInfo)      {}
+func (EventListenerBase) OnCompactionCompleted(info CompactionJobInfo)  {}
+func (EventListenerBase) OnWalFileCreated(info WalFileInfo)             {}
+func (EventListenerBase) OnWalFileDeleted(info WalFileInfo)             {}
+func (EventListenerBase) OnTableFileDeleted(info sstable.TableFileInfo) {}
+func (EventListenerBase) OnStallConditionsChanged(info WriteStallInfo)  {}
+func (EventListenerBase) OnBackgroundError(info BackgroundErrorInfo)    {}
+
+// FlushJobInfo 一个immemtable写入sst。OnFlushBegin时还没有File
+type FlushJobInfo struct {
+	ColumnFamily string
+	WalFile      string // immemtable对应的wal
+	Keys         int
+	File         sstable.TableFileInfo
+	Duration     time.Duration
+}
+
+// CompactionJobInfo 将Level的所有sst合并为OutputLevel的一个sst。OnCompactionBegin时还没有Outputs
+type CompactionJobInfo struct {
+	ColumnFamily string
+	Level        int
+	OutputLevel  int
+	Inputs       []sstable.TableFileInfo
+	Outputs      []sstable.TableFileInfo
+	ReadBytes    int64
+	WriteBytes   int64
+	Duration     time.Duration
+}
+
+type WalFileInfo struct {
+	Path string
+}
+
+// WriteStallCondition 写入是否被后台任务阻塞
+type WriteStallCondition int
+
+const (
+	WriteStallNormal  WriteStallCondition = iota
+	WriteStallStopped                     // 后台flush、合并持有db.lock，写入需要等待
+)
+
+type WriteStallInfo struct {
+	Condition WriteStallCondition
+	Prev      WriteStallCondition
+}
+
+// BackgroundErrorReason 出错的后台任务
+type BackgroundErrorReason int
+
+const (
+	BackgroundErrorFlush BackgroundErrorReason = iota
+	BackgroundErrorCompaction
+)
+
+func (r BackgroundErrorReason) String() string {
+	switch r {
+	case BackgroundErrorFlush:
+		return "flush"
+	case BackgroundErrorCompaction:
+		return "compaction"
+	}
+	return fmt.Sprintf("BackgroundErrorReason(%d)", int(r))
+}
+
+type BackgroundErrorInfo struct {
+	Reason   BackgroundErrorReason
+	Severity ErrorSeverity
+	Err      error
+}
+
+// 待调用的事件。事件在持有db.lock时产生，先放入队列，由后台goroutine调用listener
+type eventQueue struct {
+	lock      sync.Mutex
+	listeners []EventListener
+	events    []func(l EventListener)
+	notify    chan struct{}
+}
+
+func newEventQueue(listeners []EventListener) *eventQueue {
+	return &eventQueue{listeners: listeners, notify: make(chan struct{}, 1)}
+}
+
+func (q *eventQueue) push(event func(l EventListener)) {
+	if len(q.listeners) == 0 {
+		return
+	}
+	q.lock.Lock()
+	q.events = append(q.events, event)
+	q.lock.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// 依次调用队列中的事件，只在后台goroutine中调用
+func (q *eventQueue) dispatch() {
+	for {
+		q.lock.Lock()
+		events := q.events
+		q.events = nil
+		q.lock.Unlock()
+		if len(events) == 0 {
+			return
+		}
+		for _, event := range events {
+			for _, l := range q.listeners {
+				event(l)
+			}
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package db
+
+import (
+	"fmt"
+
+	"lsmtree/errs"
+	"lsmtree/memtable"
+	"lsmtree/sstable"
+)
+
+// IngestExternalFiles 将sstable.Writer构建的sst导入默认列族
+func (d *Db) IngestExternalFiles(paths []string) error {
+	return d.DefaultColumnFamily().IngestExternalFiles(paths)
+}
+
+// IngestExternalFiles 将sstable.Writer构建的sst导入列族，不经过wal和memtable。
+//
+//	文件从Options.FS上读取并复制到列族的sst目录，导入的数据比列族中已有的数据都新。文件之间的key范围不能重叠；
+//	和memtable或immemtable重叠时，会先将所有列族的memtable写入sst。
+//	kv和sst中都没有序列号，新旧只由位置决定：导入的sst放在和它重叠的sst之上，之后的写入先进入memtable，
+//	flush后放在第0层的最后，所以总是比导入的数据新，合并时同样按层和序号保留较新的kv。
+//	导入只推进事务的序号，key范围内被活跃的乐观事务读取过的key在提交时会冲突
+func (cf *ColumnFamily) IngestExternalFiles(paths []string) error {
+	ranges := make([]sstable.KeyRange, len(paths))
+	for i, p := range paths {
+		r, err := sstable.ReadKeyRangeFS(cf.db.fs, p, cf.opts.Marshaller, cf.db.opts.Comparator)
+		if err != nil {
+			return err
+		}
+		for j := 0; j < i; j++ {
+			if ranges[j].Overlaps(r, cf.db.opts.comparator()) {
+				return errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("file:%v overlaps file:%v", p, paths[j]))
+			}
+		}
+		ranges[i] = r
+	}
+
+	d := cf.db
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	defer d.setStall(WriteStallNormal)
+	if err := d.checkWritable(); err != nil {
+		return err
+	}
+	if cf.dropped {
+		return errs.NewErr(errs.ErrCodeColumnFamily, fmt.Errorf("column family:%v dropped", cf.name))
+	}
+
+	for _, r := range ranges {
+		if cf.memOverlaps(r) {
+			err := d.flushAll()
+			if err != nil {
+				return err
+			}
+			break
+		}
+	}
+	for i, p := range paths {
+		level, err := cf.sst.Ingest(p, ranges[i])
+		if err != nil {
+			return err
+		}
+		cf.db.logger.Info("ingest sst", "cf", cf.name, "file", p, "level", level)
+	}
+	d.txns.trackRanges(cf.id, ranges)
+	return nil
+}
+
+// 判断memtable或immemtable中是否有r范围内的key。调用方需要持有db.lock
+func (cf *ColumnFamily) memOverlaps(r sstable.KeyRange) bool {
+	cmp := cf.db.opts.comparator()
+	mems := []memtable.ImmemtableOp{cf.mem}
+	mems = append(mems, cf.imm...)
+	for _, mem := range mems {
+		for _, item := range mem.GetValues() {
+			if cmp.Compare(item.Key, r.Smallest) >= 0 && cmp.Compare(item.Key, r.Largest) <= 0 {
+				return true
+			}
+		}
+		for _, rd := range mem.GetRangeDels() {
+			if r.Overlaps(sstable.KeyRange{Smallest: rd.Start, Largest: rd.End}, cmp) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package db
+
+import (
+	"context"
+	"sort"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+	"lsmtree/memtable"
+	"lsmtree/sstable"
+)
+
+// Iterator 按Comparator的顺序从小到大遍历[start, end)内的有效kv
+//
+//	创建时复制memtable和immemtable中范围内的kv，并在每个sst上打开只读取了索引的sstable.Iterator，
+//	之后的写入、flush和合并不会影响已经创建的Iterator。移动时对所有来源做k路归并，只读取需要的kv。
+//	遍历到末尾或者出错时自动释放sst的文件句柄，提前结束遍历时需要调用Close
+type Iterator struct {
+	sources []mergeSource         // 从新到旧
+	covers  [][]kv.RangeTombstone // covers[i]为比sources[i]新的来源中的墓碑
+	ssts    []*sstable.Iterator
+	op      kv.MergeOperator
+	cmp     kv.Comparator
+	now     int64
+	item    kv.Kv
+	valid   bool
+	err     error
+}
+
+// 参与归并的一个来源，按cmp的顺序遍历，包含删除标记和合并记录
+type mergeSource interface {
+	Valid() bool
+	Item() kv.Kv
+	Next()
+	Err() error
+}
+
+// memtable或immemtable中范围内的kv
+type memSource struct {
+	items []kv.Kv
+	index int
+}
+
+func (s *memSource) Valid() bool {
+	return s.index < len(s.items)
+}
+
+func (s *memSource) Item() kv.Kv {
+	return s.items[s.index]
+}
+
+func (s *memSource) Next() {
+	s.index++
+}
+
+func (s *memSource) Err() error {
+	return nil
+}
+
+// NewIterator 遍历默认列族的[start, end)，start为空表示没有下界，end为空表示没有上界
+func (d *Db) NewIterator(start, end []byte) (*Iterator, error) {
+	return d.DefaultColumnFamily().NewIterator(start, end)
+}
+
+// NewIteratorContext 可以取消的NewIterator
+func (d *Db) NewIteratorContext(ctx context.Context, start, end []byte) (*Iterator, error) {
+	return d.DefaultColumnFamily().NewIteratorContext(ctx, start, end)
+}
+
+// NewIterator 遍历[start, end)，start为空表示没有下界，end为空表示没有上界
+func (cf *ColumnFamily) NewIterator(start, end []byte) (*Iterator, error) {
+	return cf.NewIteratorContext(context.Background(), start, end)
+}
+
+// NewIteratorContext 可以取消的NewIterator。等待db.lock时ctx取消返回ctx.Err()。
+// sst的索引损坏时返回错误，遍历时读到损坏的kv由Iterator.Err返回
+func (cf *ColumnFamily) NewIteratorContext(ctx context.Context, start, end []byte) (*Iterator, error) {
+	err := lockContext(ctx, readLocker{cf.db.lock})
+	if err != nil {
+		return nil, err
+	}
+	defer cf.db.lock.RUnlock()
+	if cf.dropped {
+		return &Iterator{}, nil
+	}
+
+	cmp := cf.db.opts.comparator()
+	it := &Iterator{op: cf.mergeOperator(), cmp: cmp, now: cf.db.opts.now().UnixNano()}
+	var tombstones []kv.RangeTombstone
+	mems := []memtable.ImmemtableOp{cf.mem}
+	mems = append(mems, cf.imm...)
+	for _, mem := range mems {
+		it.add(newMemSource(mem, start, end, cmp), tombstones)
+		tombstones = append(tombstones, mem.GetRangeDels()...)
+	}
+	it.ssts, err = cf.sst.NewIterators(start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, sst := range it.ssts {
+		it.add(sst, tombstones)
+		tombstones = append(tombstones, sst.RangeDels()...)
+	}
+	it.advance()
+	return it, nil
+}
+
+// 复制mem中[start, end)内的kv
+func newMemSource(mem memtable.ImmemtableOp, start, end []byte, cmp kv.Comparator) *memSource {
+	items := mem.GetValues()
+	lo, hi := 0, len(items)
+	if len(start) > 0 {
+		lo = sort.Search(len(items), func(i int) bool { return cmp.Compare(items[i].Key, start) >= 0 })
+	}
+	if len(end) > 0 {
+		hi = sort.Search(len(items), func(i int) bool { return cmp.Compare(items[i].Key, end) >= 0 })
+	}
+	if hi < lo {
+		hi = lo
+	}
+	return &memSource{items: items[lo:hi]}
+}
+
+// 加入一个比已有来源都旧的来源，tombstones为比它新的来源中的墓碑
+func (it *Iterator) add(source mergeSource, tombstones []kv.RangeTombstone) {
+	it.sources = append(it.sources, source)
+	it.covers = append(it.covers, tombstones)
+}
+
+func (it *Iterator) Valid() bool {
+	return it.valid
+}
+
+func (it *Iterator) Next() {
+	it.advance()
+}
+
+func (it *Iterator) Key() []byte {
+	return it.item.Key
+}
+
+func (it *Iterator) Value() []byte {
+	return it.item.Value
+}
+
+// Err 遍历时读取sst失败或者合并操作数失败的错误，出错后Valid返回false
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close 释放sst的文件句柄，可以重复调用
+func (it *Iterator) Close() error {
+	var first error
+	for _, sst := range it.ssts {
+		err := sst.Close()
+		if err != nil && first == nil {
+			first = errs.NewErr(errs.ErrCodeSstable, err)
+		}
+	}
+	it.ssts = nil
+	it.valid = false
+	return first
+}
+
+// 移动到下一个有效的kv：取所有来源中最小的key，从新到旧合并这个key的记录，同一个key只保留最新的记录，
+// 删除的、被更新的墓碑覆盖的、过期的key继续向后查找。遇到合并记录时继续向更旧的来源查找基准值，最后使用op合并
+func (it *Iterator) advance() {
+	it.valid = false
+	for {
+		var key []byte
+		for _, source := range it.sources {
+			if err := source.Err(); err != nil {
+				it.fail(err)
+				return
+			}
+			if source.Valid() && (key == nil || it.cmp.Compare(source.Item().Key, key) < 0) {
+				key = source.Item().Key
+			}
+		}
+		if key == nil {
+			it.Close()
+			return
+		}
+
+		chain := kv.MergeChain{Now: it.now}
+		for i, source := range it.sources {
+			if !source.Valid() || it.cmp.Compare(source.Item().Key, key) != 0 {
+				continue
+			}
+			item := source.Item()
+			if !chain.Done() {
+				result := kv.Success
+				if item.Deleted || kv.Covered(it.cmp, it.covers[i], item.Key) {
+					result = kv.Deleted
+				}
+				chain.Add(item, result)
+			}
+			source.Next()
+		}
+		item, result := chain.Result()
+		if result != kv.Success {
+			continue
+		}
+		item, err := kv.Resolve(it.op, item, it.now)
+		if err != nil {
+			it.fail(errs.NewErr(errs.ErrCodeMergeOperator, err))
+			return
+		}
+		it.item, it.valid = item, true
+		return
+	}
+}
+
+func (it *Iterator) fail(err error) {
+	it.err = err
+	it.Close()
+}
@@ -0,0 +1,116 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"lsmtree/errs"
+)
+
+const defaultLockTimeout = time.Second
+
+// lockManager 悲观事务使用的行锁，每个key同时只能被一个事务持有，事务提交或回滚时释放。
+//
+//	等待锁时记录 等待者->key 的边，key的持有者又可能在等待其他key，由此形成wait-for图，加锁前检查图中是否有环来发现死锁
+type lockManager struct {
+	mu      sync.Mutex
+	locks   map[cfKey]*rowLock
+	waiting map[*Txn]cfKey // 事务正在等待的key
+}
+
+type rowLock struct {
+	owner    *Txn
+	released chan struct{} // 锁释放时关闭，唤醒所有等待者
+}
+
+func newLockManager() *lockManager {
+	return &lockManager{
+		locks:   make(map[cfKey]*rowLock),
+		waiting: make(map[*Txn]cfKey),
+	}
+}
+
+// 为t加锁，已经持有时直接返回。超过timeout返回ErrCodeTxnLockTimeout，ctx取消时返回ctx.Err()，
+// 等待会形成死锁时立即返回ErrCodeTxnDeadlock
+func (m *lockManager) lock(ctx context.Context, t *Txn, k cfKey, timeout time.Duration) error {
+	var timer <-chan time.Time
+	for {
+		m.mu.Lock()
+		l, ok := m.locks[k]
+		if !ok {
+			m.locks[k] = &rowLock{owner: t, released: make(chan struct{})}
+			m.mu.Unlock()
+			return nil
+		}
+		if l.owner == t {
+			m.mu.Unlock()
+			return nil
+		}
+		if m.deadlock(t, l.owner) {
+			m.mu.Unlock()
+			return errs.NewErr(errs.ErrCodeTxnDeadlock, fmt.Errorf("key:%v", k.key))
+		}
+		m.waiting[t] = k
+		m.mu.Unlock()
+
+		if timer == nil {
+			timer = time.After(timeout)
+		}
+		select {
+		case <-l.released: // 锁被释放后重新竞争
+		case <-timer:
+			m.mu.Lock()
+			delete(m.waiting, t)
+			m.mu.Unlock()
+			return errs.NewErr(errs.ErrCodeTxnLockTimeout, fmt.Errorf("key:%v timeout:%v", k.key, timeout))
+		case <-ctx.Done():
+			m.mu.Lock()
+			delete(m.waiting, t)
+			m.mu.Unlock()
+			return ctx.Err()
+		}
+		m.mu.Lock()
+		delete(m.waiting, t)
+		m.mu.Unlock()
+	}
+}
+
+// 沿着 持有者->等待的key->持有者 的边查找，回到t说明t等待owner会形成环。调用方需要持有m.mu
+func (m *lockManager) deadlock(t *Txn, owner *Txn) bool {
+	visited := make(map[*Txn]struct{})
+	for owner != nil {
+		if owner == t {
+			return true
+		}
+		if _, ok := visited[owner]; ok {
+			return false
+		}
+		visited[owner] = struct{}{}
+		k, ok := m.waiting[owner]
+		if !ok {
+			return false
+		}
+		l, ok := m.locks[k]
+		if !ok {
+			return false
+		}
+		owner = l.owner
+	}
+	return false
+}
+
+// 释放t持有的锁
+func (m *lockManager) unlock(t *Txn, keys map[cfKey]struct{}) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k := range keys {
+		l, ok := m.locks[k]
+		if !ok || l.owner != t {
+			continue
+		}
+		delete(m.locks, k)
+		close(l.released)
+	}
+}
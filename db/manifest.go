@@ -0,0 +1,97 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+	"lsmtree/vfs"
+)
+
+const manifestFileName = "MANIFEST"
+
+// manifest 记录db中的所有列族，所有列族共用一个MANIFEST文件
+type manifest struct {
+	path   string
+	fs     vfs.FS
+	exists bool // 打开时MANIFEST已经存在
+
+	NextID         int                  // 下一个列族的id，id不会复用，避免旧wal中已删除列族的记录被恢复
+	ColumnFamilies []columnFamilyRecord // 不包含默认列族
+	Comparator     string               `json:",omitempty"` // 创建db时Comparator的名称，之前版本创建的db为空
+}
+
+type columnFamilyRecord struct {
+	ID   int
+	Name string
+}
+
+// 每个列族的sst目录名称对应opts中这个列族的Marshaller，用于没有打开db时解码sst。m为nil时只有默认列族
+func sstMarshallers(m *manifest, opts Options) map[string]kv.MarshalOp {
+	marshallers := map[string]kv.MarshalOp{
+		path.Base(sstDir("", 0)): opts.ColumnFamilies[DefaultColumnFamilyName].Marshaller,
+	}
+	if m == nil {
+		return marshallers
+	}
+	for _, record := range m.ColumnFamilies {
+		marshallers[path.Base(sstDir("", record.ID))] = opts.ColumnFamilies[record.Name].Marshaller
+	}
+	return marshallers
+}
+
+// 读取dir下的MANIFEST，不存在时返回只有默认列族的manifest
+func loadManifest(fs vfs.FS, dir string) (*manifest, error) {
+	m := &manifest{path: path.Join(dir, manifestFileName), fs: fs, NextID: 1}
+	data, err := vfs.ReadFile(fs, m.path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, errs.NewErr(errs.ErrCodeManifest, err)
+	}
+	err = json.Unmarshal(data, m)
+	if err != nil {
+		return nil, errs.NewErr(errs.ErrCodeManifest, fmt.Errorf("unmarshal %v err:%v", m.path, err))
+	}
+	m.exists = true
+	return m, nil
+}
+
+// 检查cmp的名称和MANIFEST中记录的是否一致。没有记录时，已有数据的db是key为string时创建的，按kv.Bytewise排列；
+// 新建的db没有MANIFEST和wal目录，可以使用任意的Comparator
+func (m *manifest) checkComparator(cmp kv.Comparator, dir string) error {
+	recorded := m.Comparator
+	if recorded == "" && (m.exists || vfs.Exists(m.fs, path.Join(dir, "wal"))) {
+		recorded = kv.Bytewise{}.Name()
+	}
+	if recorded != "" && recorded != cmp.Name() {
+		return errs.NewErr(errs.ErrCodeComparator, fmt.Errorf("db:%v created with comparator:%v, opened with:%v", dir, recorded, cmp.Name()))
+	}
+	return nil
+}
+
+// 先写入临时文件再重命名，保证MANIFEST不会只写了一半，最后目录落盘，崩溃后不会回到旧的MANIFEST
+func (m *manifest) save() error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeManifest, err)
+	}
+	tmp := m.path + ".tmp"
+	err = vfs.WriteFile(m.fs, tmp, data)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeManifest, err)
+	}
+	err = m.fs.Rename(tmp, m.path)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeManifest, err)
+	}
+	err = m.fs.Sync(path.Dir(m.path))
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeManifest, err)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package db
+
+import (
+	"time"
+
+	"lsmtree/kv"
+	"lsmtree/logger"
+	"lsmtree/vfs"
+)
+
+// Options Db的配置，零值可以直接使用
+type Options struct {
+	MergeOperator kv.MergeOperator // Merge使用的合并操作，不配置时不能调用Merge
+	DefaultTTL    time.Duration    // SetKv没有指定过期时间时使用的过期时长，0表示永不过期
+	Now           func() time.Time // 时钟，用于计算和判断过期时间，默认为time.Now。测试时可以注入
+
+	// key的顺序，默认为kv.Bytewise。名称记录在MANIFEST中，之后打开db时Comparator的名称不一致会返回ErrCodeComparator
+	Comparator kv.Comparator
+
+	TransactionDB bool          // 为true时BeginTxn开启悲观事务，否则开启乐观事务。事务之外的写入也会等待事务持有的行锁
+	LockTimeout   time.Duration // 悲观事务等待行锁的最长时间，默认1秒
+
+	VerifyChecksumsInCompaction bool // 合并前校验参与合并的sst，发现损坏时放弃这次合并
+
+	// 每次写入后将wal落盘，返回成功的写入在进程或者机器崩溃后不会丢失。
+	// 为false时wal只写入操作系统的缓存，进程崩溃不丢数据，机器崩溃可能丢失最近的写入
+	Sync bool
+
+	FlushOnClose bool          // Close时将memtable写入sst，下次打开时不需要从wal恢复。默认只写入immemtable
+	CloseTimeout time.Duration // Close等待正在执行的flush、合并的最长时间，0表示一直等待
+
+	Logger         logger.Logger   // flush、合并、恢复等的日志，默认丢弃。可以使用logger.Std或者logger.Slog
+	EventListeners []EventListener // 在后台goroutine中按顺序接收flush、合并、wal等事件
+	FS             vfs.FS          // db目录所在的文件系统，默认为vfs.Default。测试时可以使用vfs.NewMem
+
+	// 打开db时已有列族的配置，key为列族名称，默认列族为DefaultColumnFamilyName。没有配置的列族使用默认值
+	ColumnFamilies map[string]ColumnFamilyOptions
+}
+
+func (o Options) now() time.Time {
+	if o.Now == nil {
+		return time.Now()
+	}
+	return o.Now()
+}
+
+func (o Options) comparator() kv.Comparator {
+	return kv.OrBytewise(o.Comparator)
+}
+
+func (o Options) fs() vfs.FS {
+	if o.FS == nil {
+		return vfs.Default
+	}
+	return o.FS
+}
+
+func (o Options) lockTimeout() time.Duration {
+	if o.LockTimeout <= 0 {
+		return defaultLockTimeout
+	}
+	return o.LockTimeout
+}
+
+// ColumnFamilyOptions 列族的配置，零值表示使用默认值
+type ColumnFamilyOptions struct {
+	MemtableSize  int              // memtable中kv的个数超过这个值时形成immemtable
+	LevelLimit    int              // 每一层sst的个数超过这个值时触发合并
+	Marshaller    kv.MarshalOp     // sst的序列化方式，默认为kv.Json
+	MergeOperator kv.MergeOperator // 为nil时使用Options.MergeOperator
+}
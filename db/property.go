@@ -0,0 +1,74 @@
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"lsmtree/sstable"
+)
+
+// 支持的属性名称
+const (
+	PropertyNumFilesAtLevelPrefix = "lsm.num-files-at-level" // 后面跟层数，例如lsm.num-files-at-level0
+	PropertyEstimateNumKeys       = "lsm.estimate-num-keys"  // memtable、immemtable和sst中key的个数之和，相同的key会重复计算
+	PropertyNumImmutableMemtable  = "lsm.num-immutable-mem-table"
+	PropertyLevelStats            = "lsm.levelstats" // 每一层的sst个数、大小和key的个数
+	PropertyStats                 = "lsm.stats"      // Statistics的全部内容
+)
+
+// GetProperty 返回默认列族的属性，名称不支持时ok为false
+func (d *Db) GetProperty(name string) (string, bool) {
+	return d.DefaultColumnFamily().GetProperty(name)
+}
+
+// GetProperty 返回列族的属性，名称不支持时ok为false。lsm.stats是整个db的统计
+func (cf *ColumnFamily) GetProperty(name string) (string, bool) {
+	switch {
+	case name == PropertyStats:
+		return cf.db.stats.String(), true
+	case strings.HasPrefix(name, PropertyNumFilesAtLevelPrefix):
+		level, err := strconv.Atoi(strings.TrimPrefix(name, PropertyNumFilesAtLevelPrefix))
+		if err != nil || level < 0 {
+			return "", false
+		}
+		levels := cf.Stats().Levels
+		if level >= len(levels) {
+			return "0", true
+		}
+		return strconv.Itoa(levels[level]), true
+	}
+
+	cf.db.lock.RLock()
+	defer cf.db.lock.RUnlock()
+	var stats []sstable.LevelStat
+	if name == PropertyEstimateNumKeys || name == PropertyLevelStats {
+		var err error
+		stats, err = cf.sst.LevelStats()
+		if err != nil {
+			cf.db.logger.Warn("get property failed", "cf", cf.name, "name", name, "err", err)
+			return "", false
+		}
+	}
+	switch name {
+	case PropertyEstimateNumKeys:
+		n := len(cf.mem.GetValues())
+		for _, imm := range cf.imm {
+			n += len(imm.GetValues())
+		}
+		for _, stat := range stats {
+			n += stat.Entries
+		}
+		return strconv.Itoa(n), true
+	case PropertyNumImmutableMemtable:
+		return strconv.Itoa(len(cf.imm)), true
+	case PropertyLevelStats:
+		b := &strings.Builder{}
+		fmt.Fprintf(b, "Level Files Size(bytes) Entries\n")
+		for level, stat := range stats {
+			fmt.Fprintf(b, "%5v %5v %11v %7v\n", level, stat.Files, stat.Size, stat.Entries)
+		}
+		return b.String(), true
+	}
+	return "", false
+}
@@ -0,0 +1,432 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+	"lsmtree/sstable"
+	"lsmtree/vfs"
+	"lsmtree/wal"
+)
+
+const lostDirName = "lost"
+
+// RepairStatus 修复后文件的状态
+type RepairStatus string
+
+const (
+	RepairOK       RepairStatus = "ok"       // 文件完好
+	RepairSalvaged RepairStatus = "salvaged" // 文件部分损坏，可以解码的部分写入了新文件，原文件移到lost目录
+	RepairLost     RepairStatus = "lost"     // 文件无法解码，移到lost目录
+)
+
+// RepairReport Repair的结果
+type RepairReport struct {
+	Files   []RepairFile
+	Renamed [][2]string // 为了保证序号连续而重命名的文件，[旧路径, 新路径]
+}
+
+// RepairFile 一个文件的修复结果，路径都相对于db目录
+type RepairFile struct {
+	Path   string
+	Status RepairStatus
+	Kept   int    // 保留的记录数
+	Lost   int    // 丢失的记录数，wal文件末尾损坏时无法知道丢失的记录数，为丢失的字节数
+	LostTo string // 原文件在lost目录中的位置
+	Reason string
+}
+
+func (r RepairReport) String() string {
+	var b strings.Builder
+	for _, f := range r.Files {
+		switch f.Status {
+		case RepairOK:
+			fmt.Fprintf(&b, "%v: ok, %v records\n", f.Path, f.Kept)
+		case RepairSalvaged:
+			fmt.Fprintf(&b, "%v: salvaged %v records, lost %v, original moved to %v: %v\n", f.Path, f.Kept, f.Lost, f.LostTo, f.Reason)
+		case RepairLost:
+			fmt.Fprintf(&b, "%v: lost, moved to %v: %v\n", f.Path, f.LostTo, f.Reason)
+		}
+	}
+	for _, names := range r.Renamed {
+		fmt.Fprintf(&b, "renamed %v -> %v\n", names[0], names[1])
+	}
+	return b.String()
+}
+
+// Repair 修复无法打开的db，db不能处于打开状态，已经打开时返回ErrCodeDbLocked。
+//
+//	检查MANIFEST、每个sst和wal文件：完好的文件保持不变；部分损坏的文件只保留可以解码的记录，重新生成文件；
+//	无法解码的文件移到dir/lost目录下。之后重新编号sst和wal文件，保证序号连续。MANIFEST损坏时根据sst目录和wal中的列族重建
+func Repair(dir string) (RepairReport, error) {
+	return RepairWithOptions(dir, Options{})
+}
+
+// RepairFS 修复fs上无法打开的db
+func RepairFS(fs vfs.FS, dir string) (RepairReport, error) {
+	return RepairWithOptions(dir, Options{FS: fs})
+}
+
+// RepairWithOptions 使用opts.FS和opts.Comparator修复db，Comparator和MANIFEST中记录的不一致时返回ErrCodeComparator，不修改任何文件。
+//
+//	每个列族的sst使用opts.ColumnFamilies中对应列族的Marshaller解码和重新写入；MANIFEST重建时列族名称为lost_{id}
+func RepairWithOptions(dir string, opts Options) (RepairReport, error) {
+	fs := opts.fs()
+	if _, err := fs.Stat(dir); err != nil {
+		return RepairReport{}, errs.NewErr(errs.ErrCodeInvalidArgument, err)
+	}
+	lock, err := fs.Lock(path.Join(dir, lockFileName))
+	if err != nil {
+		return RepairReport{}, errs.NewErr(errs.ErrCodeDbLocked, fmt.Errorf("dir:%v err:%v", dir, err))
+	}
+	defer lock.Close()
+
+	r := &repairer{fs: fs, dir: path.Clean(dir), cmp: opts.comparator(), opts: opts}
+	if m, err := loadManifest(fs, r.dir); err == nil {
+		err = m.checkComparator(r.cmp, r.dir)
+		if err != nil {
+			return RepairReport{}, err
+		}
+	}
+	err = r.repairWals()
+	if err != nil {
+		return r.report, err
+	}
+	err = r.repairManifest()
+	if err != nil {
+		return r.report, err
+	}
+	for _, sstDirName := range r.sstDirs {
+		err = r.repairSstDir(sstDirName)
+		if err != nil {
+			return r.report, err
+		}
+	}
+	return r.report, nil
+}
+
+type repairer struct {
+	fs      vfs.FS
+	dir     string
+	cmp     kv.Comparator
+	opts    Options
+	report  RepairReport
+	cfIDs   map[int]struct{} // wal中出现过的列族
+	sstDirs []string
+
+	marshallers map[string]kv.MarshalOp // sst目录名称对应列族的Marshaller，根据MANIFEST中的列族名称确定
+}
+
+func (r *repairer) repairWals() error {
+	r.cfIDs = make(map[int]struct{})
+	walDir := path.Join(r.dir, "wal")
+	if _, err := r.fs.Stat(walDir); os.IsNotExist(err) {
+		return nil
+	}
+	files, err := wal.ListFilesFS(r.fs, walDir)
+	if err != nil {
+		return err
+	}
+	var kept []string
+	for _, file := range files {
+		rel := r.rel(file)
+		info, err := wal.ReadFileFS(r.fs, file, nil)
+		if err != nil {
+			lostTo, err2 := r.moveToLost(rel)
+			if err2 != nil {
+				return err2
+			}
+			r.add(RepairFile{Path: rel, Status: RepairLost, LostTo: lostTo, Reason: err.Error()})
+			continue
+		}
+		var records []wal.Record
+		for _, item := range info.Records {
+			records = append(records, item.Record)
+			r.collectColumnFamilies(item.Record)
+		}
+		if info.Err == "" {
+			r.add(RepairFile{Path: rel, Status: RepairOK, Kept: len(records)})
+			kept = append(kept, file)
+			continue
+		}
+		// 只保留末尾损坏之前的完整记录
+		tmp := file + ".repair"
+		_ = r.fs.Remove(tmp)
+		err = wal.WriteFileFS(r.fs, tmp, records, nil)
+		if err != nil {
+			return err
+		}
+		lostTo, err := r.moveToLost(rel)
+		if err != nil {
+			return err
+		}
+		err = r.fs.Rename(tmp, file)
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeWal, err)
+		}
+		r.add(RepairFile{Path: rel, Status: RepairSalvaged, Kept: len(records), Lost: int(info.Size - info.Valid), LostTo: lostTo, Reason: info.Err})
+		kept = append(kept, file)
+	}
+	// 恢复时从最大的序号向前查找，遇到不存在的序号就停止，所以序号需要连续
+	for i, file := range kept {
+		err = r.rename(file, path.Join(walDir, fmt.Sprintf("%v.wal.log", i+1)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *repairer) collectColumnFamilies(rec wal.Record) {
+	for _, item := range rec.Batch {
+		r.collectColumnFamilies(item)
+	}
+	if len(rec.Batch) == 0 && rec.CF != 0 {
+		r.cfIDs[rec.CF] = struct{}{}
+	}
+}
+
+// MANIFEST损坏时，根据sst目录和wal中出现过的列族重建，列族名称无法恢复，使用lost_{id}
+func (r *repairer) repairManifest() error {
+	entries, err := r.fs.List(r.dir)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeManifest, err)
+	}
+	ids := make(map[int]struct{})
+	for id := range r.cfIDs {
+		ids[id] = struct{}{}
+	}
+	for _, name := range entries {
+		if !isDir(r.fs, path.Join(r.dir, name)) {
+			continue
+		}
+		if name == "sst" {
+			r.sstDirs = append(r.sstDirs, name)
+			continue
+		}
+		if id, err := strconv.Atoi(strings.TrimPrefix(name, "sst_")); err == nil && strings.HasPrefix(name, "sst_") {
+			r.sstDirs = append(r.sstDirs, name)
+			ids[id] = struct{}{}
+		}
+	}
+	sort.Strings(r.sstDirs)
+
+	m, err := loadManifest(r.fs, r.dir)
+	if err == nil {
+		r.add(RepairFile{Path: manifestFileName, Status: RepairOK, Kept: len(m.ColumnFamilies)})
+		r.marshallers = sstMarshallers(m, r.opts)
+		return nil
+	}
+	reason := err.Error()
+	lostTo, err := r.moveToLost(manifestFileName)
+	if err != nil {
+		return err
+	}
+	m = &manifest{path: path.Join(r.dir, manifestFileName), fs: r.fs, NextID: 1, Comparator: r.cmp.Name()}
+	var sorted []int
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Ints(sorted)
+	for _, id := range sorted {
+		m.ColumnFamilies = append(m.ColumnFamilies, columnFamilyRecord{ID: id, Name: fmt.Sprintf("lost_%v", id)})
+		m.NextID = id + 1
+	}
+	err = m.save()
+	if err != nil {
+		return err
+	}
+	r.add(RepairFile{Path: manifestFileName, Status: RepairSalvaged, Kept: len(m.ColumnFamilies), LostTo: lostTo, Reason: reason})
+	r.marshallers = sstMarshallers(m, r.opts)
+	return nil
+}
+
+func (r *repairer) repairSstDir(name string) error {
+	dir := path.Join(r.dir, name)
+	files, err := r.fs.List(dir)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	levels := make(map[int][]sstFile)
+	for _, fileName := range files {
+		if isDir(r.fs, path.Join(dir, fileName)) {
+			continue
+		}
+		rel := path.Join(name, fileName)
+		level, index, ok := parseSstName(fileName)
+		if !ok {
+			lostTo, err := r.moveToLost(rel)
+			if err != nil {
+				return err
+			}
+			r.add(RepairFile{Path: rel, Status: RepairLost, LostTo: lostTo, Reason: "invalid sst file name"})
+			continue
+		}
+		kept, err := r.repairSst(rel, r.marshallers[name])
+		if err != nil {
+			return err
+		}
+		if kept {
+			levels[level] = append(levels[level], sstFile{index: index, path: path.Join(dir, fileName)})
+		}
+	}
+
+	for level, list := range levels {
+		sort.Slice(list, func(i, j int) bool {
+			return list[i].index < list[j].index
+		})
+		for i, file := range list {
+			err = r.rename(file.path, path.Join(dir, fmt.Sprintf("%v.%v.db", level, i)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type sstFile struct {
+	index int
+	path  string
+}
+
+// 检查一个sst，返回修复后是否还保留这个文件。marsher为sst所属列族的Marshaller
+func (r *repairer) repairSst(rel string, marsher kv.MarshalOp) (bool, error) {
+	file := path.Join(r.dir, rel)
+	info, err := sstable.InspectFS(r.fs, file, marsher, r.opts.comparator())
+	if err != nil {
+		lostTo, err2 := r.moveToLost(rel)
+		if err2 != nil {
+			return false, err2
+		}
+		r.add(RepairFile{Path: rel, Status: RepairLost, LostTo: lostTo, Reason: err.Error()})
+		return false, nil
+	}
+	var entries []kv.Kv
+	for _, e := range info.Entries {
+		if !e.Corrupt {
+			entries = append(entries, e.Kv)
+		}
+	}
+	if len(info.Problems) == 0 {
+		r.add(RepairFile{Path: rel, Status: RepairOK, Kept: len(entries)})
+		return true, nil
+	}
+
+	var problems []string
+	for _, p := range info.Problems {
+		problems = append(problems, p.String())
+	}
+	reason := strings.Join(problems, "; ")
+	if len(entries) == 0 && len(info.RangeDels) == 0 {
+		lostTo, err := r.moveToLost(rel)
+		if err != nil {
+			return false, err
+		}
+		r.add(RepairFile{Path: rel, Status: RepairLost, Lost: len(info.Entries), LostTo: lostTo, Reason: reason})
+		return false, nil
+	}
+
+	// 可以解码的记录重新写入一个sst
+	tmp := file + ".repair"
+	_ = r.fs.Remove(tmp)
+	// Inspect按字节序返回，Writer需要按Comparator的顺序添加
+	sort.Slice(entries, func(i, j int) bool {
+		return r.cmp.Compare(entries[i].Key, entries[j].Key) < 0
+	})
+	w, err := sstable.NewWriterFS(r.fs, tmp, marsher, r.cmp)
+	if err != nil {
+		return false, err
+	}
+	for _, item := range entries {
+		err = w.Add(item)
+		if err != nil {
+			return false, err
+		}
+	}
+	for _, rd := range info.RangeDels {
+		err = w.DeleteRange(rd.Start, rd.End)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = w.Finish()
+	if err != nil {
+		return false, err
+	}
+	lostTo, err := r.moveToLost(rel)
+	if err != nil {
+		return false, err
+	}
+	err = r.fs.Rename(tmp, file)
+	if err != nil {
+		return false, errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	r.add(RepairFile{Path: rel, Status: RepairSalvaged, Kept: len(entries), Lost: len(info.Entries) - len(entries), LostTo: lostTo, Reason: reason})
+	return true, nil
+}
+
+// 解析{level}.{index}.db
+func parseSstName(name string) (int, int, bool) {
+	list := strings.Split(name, ".")
+	if len(list) != 3 || list[2] != "db" {
+		return 0, 0, false
+	}
+	level, err := strconv.Atoi(list[0])
+	if err != nil || level < 0 {
+		return 0, 0, false
+	}
+	index, err := strconv.Atoi(list[1])
+	if err != nil || index < 0 {
+		return 0, 0, false
+	}
+	return level, index, true
+}
+
+// 将文件移到lost目录下相同的相对路径，已经存在时增加后缀
+func (r *repairer) moveToLost(rel string) (string, error) {
+	lostRel := path.Join(lostDirName, rel)
+	for i := 1; ; i++ {
+		if _, err := r.fs.Stat(path.Join(r.dir, lostRel)); os.IsNotExist(err) {
+			break
+		}
+		lostRel = path.Join(lostDirName, fmt.Sprintf("%v.%v", rel, i))
+	}
+	dst := path.Join(r.dir, lostRel)
+	err := r.fs.MkdirAll(path.Dir(dst), 0755)
+	if err != nil {
+		return "", errs.NewErr(errs.ErrCodeRepair, err)
+	}
+	err = r.fs.Rename(path.Join(r.dir, rel), dst)
+	if err != nil {
+		return "", errs.NewErr(errs.ErrCodeRepair, err)
+	}
+	return lostRel, nil
+}
+
+// 按从小到大的顺序重命名时，新的序号不会大于旧的序号，不会覆盖还没有处理的文件
+func (r *repairer) rename(from, to string) error {
+	if from == to {
+		return nil
+	}
+	err := r.fs.Rename(from, to)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeRepair, err)
+	}
+	r.report.Renamed = append(r.report.Renamed, [2]string{r.rel(from), r.rel(to)})
+	return nil
+}
+
+func (r *repairer) add(f RepairFile) {
+	r.report.Files = append(r.report.Files, f)
+}
+
+func (r *repairer) rel(file string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(file, r.dir), "/")
+}
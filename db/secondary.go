@@ -0,0 +1,132 @@
+package db
+
+import (
+	"fmt"
+	"path"
+
+	"lsmtree/errs"
+	"lsmtree/sstable"
+)
+
+// 打开db的方式
+type openMode int
+
+const (
+	modePrimary   openMode = iota // 获取目录锁，可以读写
+	modeReadOnly                  // 只读，内容固定为打开时的状态
+	modeSecondary                 // 只读，可以通过TryCatchUpWithPrimary读取主实例新的写入
+)
+
+func (m openMode) String() string {
+	switch m {
+	case modePrimary:
+		return "primary"
+	case modeReadOnly:
+		return "read-only"
+	case modeSecondary:
+		return "secondary"
+	}
+	return fmt.Sprintf("openMode(%d)", int(m))
+}
+
+// OpenReadOnly 只读打开dir下的db，可以和写入这个db的主实例同时打开，用于离线分析。
+//
+//	读取的是打开时sst和wal中的内容，之后主实例的写入不可见。不获取目录锁，不创建、删除任何文件，不启动后台任务；
+//	写入、flush、合并、创建和删除列族、Checkpoint都返回ErrCodeReadOnly。dir不存在时返回ErrCodeInvalidArgument
+func OpenReadOnly(dir string, opts Options) (*Db, error) {
+	return open(dir, opts, modeReadOnly)
+}
+
+// OpenSecondary 以从实例的方式打开dir下的db。和OpenReadOnly一样只读，可以调用TryCatchUpWithPrimary读取主实例新的写入
+func OpenSecondary(dir string, opts Options) (*Db, error) {
+	return open(dir, opts, modeSecondary)
+}
+
+// 只读打开或者从实例
+func (d *Db) readOnly() bool {
+	return d.mode != modePrimary
+}
+
+// TryCatchUpWithPrimary 重新读取MANIFEST、wal和sst，使从实例看到主实例已经写入wal的数据、flush和合并后的sst，以及新建和删除的列族。
+//
+//	主实例正在合并或者删除文件时可能读取失败，此时返回错误，从实例的内容不变，可以稍后重试。
+//	只能在OpenSecondary打开的db上调用，否则返回ErrCodeInvalidArgument
+func (d *Db) TryCatchUpWithPrimary() (err error) {
+	if d.mode != modeSecondary {
+		return errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("db:%v opened as %v, not secondary", d.dir, d.mode))
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	defer func() {
+		// 读取到一半的文件被主实例删除时会panic
+		if e := recover(); e != nil {
+			var ok bool
+			if err, ok = e.(error); !ok {
+				err = errs.NewErr(errs.ErrCodeUnknown, fmt.Errorf("%v", e))
+			}
+			d.logger.Warn("catch up with primary failed", "dir", d.dir, "err", err)
+		}
+	}()
+
+	// 主实例先写入sst再删除wal，先读取wal再读取sst时，flush中的数据至少出现在其中一处。
+	// 主实例先记录MANIFEST再写入新列族的数据，读取wal之后再读取MANIFEST，wal中的列族都能找到
+	w := d.newWal()
+	mems, imms := w.RestoreColumnFamilies(path.Join(d.dir, "wal"))
+	m, err := loadManifest(d.fs, d.dir)
+	if err != nil {
+		return err
+	}
+	err = m.checkComparator(d.opts.comparator(), d.dir)
+	if err != nil {
+		return err
+	}
+
+	// 先构建所有的列族，全部成功后再替换，失败时保持原来的内容
+	records := append([]columnFamilyRecord{{ID: 0, Name: DefaultColumnFamilyName}}, m.ColumnFamilies...)
+	cfs := make(map[int]*ColumnFamily)
+	ssts := make(map[int]sstable.TableTreeOp)
+	for _, record := range records {
+		cf, ok := d.cfs[record.ID]
+		if ok {
+			ssts[record.ID], err = cf.restoreTableTree()
+		} else {
+			cf, err = d.newColumnFamily(record.ID, record.Name, d.opts.ColumnFamilies[record.Name])
+			if err == nil {
+				ssts[record.ID] = cf.sst
+			}
+		}
+		if err != nil {
+			for _, sst := range ssts {
+				if sst != nil {
+					_ = sst.Close()
+				}
+			}
+			return err
+		}
+		cfs[record.ID] = cf
+	}
+
+	d.w = w
+	for id, cf := range d.cfs {
+		if _, ok := cfs[id]; !ok {
+			cf.dropped = true
+			_ = cf.sst.Close()
+		}
+	}
+	d.cfs = cfs
+	d.manifest = m
+	for id, cf := range cfs {
+		if cf.sst != ssts[id] {
+			_ = cf.sst.Close() // 读取都持有db.lock，不会再使用旧的sst
+		}
+		cf.sst = ssts[id]
+		cf.mem = cf.newMemtable()
+		if mem, ok := mems[id]; ok {
+			cf.mem = mem
+			cf.mem.SetLimit(cf.opts.MemtableSize)
+		}
+		cf.imm = imms[id]
+	}
+	d.logger.Info("catch up with primary", "dir", d.dir, "column families", len(cfs), "wal", w.GetPath())
+	return nil
+}
@@ -0,0 +1,224 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"lsmtree/kv"
+	"lsmtree/wal"
+)
+
+// Statistics db运行时的计数器和耗时分布，所有方法都可以并发调用。通过Db.Statistics获取
+type Statistics struct {
+	bytesWritten atomic.Int64 // 写入的key和value的字节数
+	bytesRead    atomic.Int64 // GetKv返回的value的字节数
+	memtableHit  atomic.Int64 // 在memtable或者immemtable中找到key
+	memtableMiss atomic.Int64
+
+	// sst的布隆过滤器：useful表示过滤器判定key不在sst中，没有查找索引；
+	// useless表示过滤器判定key可能存在，但索引中没有这个key
+	filterUseful  atomic.Int64
+	filterUseless atomic.Int64
+
+	compactReadBytes  atomic.Int64
+	compactWriteBytes atomic.Int64
+	stallNanos        atomic.Int64 // 写入等待后台flush、合并释放db.lock的时间
+
+	lock      sync.Mutex
+	levelHits []int64 // 每一层sst中找到key的次数
+
+	getLatency Histogram
+	putLatency Histogram
+}
+
+// StatisticsData Statistics某一时刻的值
+type StatisticsData struct {
+	BytesWritten      int64
+	BytesRead         int64
+	MemtableHit       int64
+	MemtableMiss      int64
+	LevelHits         []int64
+	FilterUseful      int64
+	FilterUseless     int64
+	CompactReadBytes  int64
+	CompactWriteBytes int64
+	StallTime         time.Duration
+	GetLatency        HistogramData
+	PutLatency        HistogramData
+}
+
+func (s *Statistics) Data() StatisticsData {
+	s.lock.Lock()
+	levelHits := append([]int64(nil), s.levelHits...)
+	s.lock.Unlock()
+	return StatisticsData{
+		BytesWritten:      s.bytesWritten.Load(),
+		BytesRead:         s.bytesRead.Load(),
+		MemtableHit:       s.memtableHit.Load(),
+		MemtableMiss:      s.memtableMiss.Load(),
+		LevelHits:         levelHits,
+		FilterUseful:      s.filterUseful.Load(),
+		FilterUseless:     s.filterUseless.Load(),
+		CompactReadBytes:  s.compactReadBytes.Load(),
+		CompactWriteBytes: s.compactWriteBytes.Load(),
+		StallTime:         time.Duration(s.stallNanos.Load()),
+		GetLatency:        s.getLatency.Data(),
+		PutLatency:        s.putLatency.Data(),
+	}
+}
+
+func (s *Statistics) String() string {
+	data := s.Data()
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "bytes.written: %v\n", data.BytesWritten)
+	fmt.Fprintf(b, "bytes.read: %v\n", data.BytesRead)
+	fmt.Fprintf(b, "memtable.hit: %v\n", data.MemtableHit)
+	fmt.Fprintf(b, "memtable.miss: %v\n", data.MemtableMiss)
+	for level, hits := range data.LevelHits {
+		fmt.Fprintf(b, "sst.hit.level%v: %v\n", level, hits)
+	}
+	fmt.Fprintf(b, "filter.useful: %v\n", data.FilterUseful)
+	fmt.Fprintf(b, "filter.useless: %v\n", data.FilterUseless)
+	fmt.Fprintf(b, "compact.read.bytes: %v\n", data.CompactReadBytes)
+	fmt.Fprintf(b, "compact.write.bytes: %v\n", data.CompactWriteBytes)
+	fmt.Fprintf(b, "stall.time: %v\n", data.StallTime)
+	fmt.Fprintf(b, "get.latency: %v\n", data.GetLatency)
+	fmt.Fprintf(b, "put.latency: %v\n", data.PutLatency)
+	return b.String()
+}
+
+// RecordSearch 实现sstable.StatsRecorder，只统计找到key的层
+func (s *Statistics) RecordSearch(level int, result kv.SearchResult) {
+	if result == kv.None {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.levelHits) <= level {
+		s.levelHits = append(s.levelHits, 0)
+	}
+	s.levelHits[level]++
+}
+
+// RecordFilter 实现sstable.StatsRecorder
+func (s *Statistics) RecordFilter(useful bool) {
+	if useful {
+		s.filterUseful.Add(1)
+		return
+	}
+	s.filterUseless.Add(1)
+}
+
+// RecordCompaction 实现sstable.StatsRecorder
+func (s *Statistics) RecordCompaction(readBytes, writeBytes int64) {
+	s.compactReadBytes.Add(readBytes)
+	s.compactWriteBytes.Add(writeBytes)
+}
+
+func (s *Statistics) recordGet(val kv.Kv, result kv.SearchResult, start time.Time) {
+	if result == kv.Success {
+		s.bytesRead.Add(int64(len(val.Value)))
+	}
+	s.getLatency.Add(time.Since(start))
+}
+
+func (s *Statistics) recordWrite(records []wal.Record) {
+	n := 0
+	for _, item := range records {
+		n += len(item.Key) + len(item.Value)
+		for _, operand := range item.Operands {
+			n += len(operand)
+		}
+	}
+	s.bytesWritten.Add(int64(n))
+}
+
+// 耗时分布的桶的上界，按1、2、5递增
+var histogramBounds = func() []time.Duration {
+	var bounds []time.Duration
+	for d := time.Microsecond; d <= 10*time.Second; d *= 10 {
+		bounds = append(bounds, d, 2*d, 5*d)
+	}
+	return bounds
+}()
+
+// Histogram 耗时分布，分位数按桶的上界估算
+type Histogram struct {
+	lock    sync.Mutex
+	count   int64
+	sum     time.Duration
+	min     time.Duration
+	max     time.Duration
+	buckets []int64 // 比histogramBounds多一个桶，保存超过所有上界的耗时
+}
+
+// HistogramData Histogram某一时刻的值
+type HistogramData struct {
+	Count   int64
+	Average time.Duration
+	Min     time.Duration
+	Max     time.Duration
+	P50     time.Duration
+	P99     time.Duration
+}
+
+func (d HistogramData) String() string {
+	return fmt.Sprintf("count:%v avg:%v min:%v max:%v p50:%v p99:%v", d.Count, d.Average, d.Min, d.Max, d.P50, d.P99)
+}
+
+func (h *Histogram) Add(d time.Duration) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.count == 0 || d < h.min {
+		h.min = d
+	}
+	if d > h.max {
+		h.max = d
+	}
+	if h.buckets == nil {
+		h.buckets = make([]int64, len(histogramBounds)+1)
+	}
+	h.count++
+	h.sum += d
+	i := 0
+	for i < len(histogramBounds) && d > histogramBounds[i] {
+		i++
+	}
+	h.buckets[i]++
+}
+
+func (h *Histogram) Data() HistogramData {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	data := HistogramData{Count: h.count, Min: h.min, Max: h.max}
+	if h.count == 0 {
+		return data
+	}
+	data.Average = h.sum / time.Duration(h.count)
+	data.P50 = h.percentile(0.5)
+	data.P99 = h.percentile(0.99)
+	return data
+}
+
+// 调用方需要持有h.lock
+func (h *Histogram) percentile(p float64) time.Duration {
+	target := int64(float64(h.count)*p + 0.5)
+	if target < 1 {
+		target = 1
+	}
+	seen := int64(0)
+	for i, n := range h.buckets {
+		seen += n
+		if seen < target {
+			continue
+		}
+		if i < len(histogramBounds) && histogramBounds[i] < h.max {
+			return histogramBounds[i]
+		}
+		break
+	}
+	return h.max
+}
@@ -0,0 +1,324 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+	"lsmtree/memtable"
+	"lsmtree/sstable"
+	"lsmtree/wal"
+)
+
+// Txn 事务。写入先缓存在事务私有的memtable中，提交时通过wal原子地写入。
+//
+//	乐观事务在Commit时检查事务读取过的key在事务开始后是否被修改，有冲突时返回errs.ErrCodeTxnConflict；
+//	悲观事务(Options.TransactionDB)在Set、Delete、GetForUpdate时对key加锁，提交或回滚时释放，Commit不会冲突。
+//	Txn不是并发安全的，一个Txn只应该在一个goroutine中使用
+type Txn struct {
+	db          *Db
+	pessimistic bool
+	startSeq    uint64
+	batch       *WriteBatch
+	mems        map[int]memtable.MemtableOp // 每个列族私有的memtable，用于读到自己的写入
+	reads       map[cfKey]struct{}
+	locked      map[cfKey]struct{} // 悲观事务持有的锁
+	closed      bool
+}
+
+type cfKey struct {
+	cf  int
+	key string // string(kv.Kv.Key)
+}
+
+// BeginTxn 开始一个事务，Options.TransactionDB为true时为悲观事务，否则为乐观事务
+func (d *Db) BeginTxn() *Txn {
+	t := &Txn{
+		db:          d,
+		pessimistic: d.opts.TransactionDB,
+		batch:       d.NewWriteBatch(),
+		mems:        make(map[int]memtable.MemtableOp),
+		reads:       make(map[cfKey]struct{}),
+		locked:      make(map[cfKey]struct{}),
+	}
+	if !t.pessimistic {
+		d.writeLock.Lock()
+		t.startSeq = d.txns.begin(t)
+		d.writeLock.Unlock()
+	}
+	return t
+}
+
+// Get cf为nil时读取默认列族，其他方法同理。优先读取事务自己的写入，sst损坏时返回错误
+func (t *Txn) Get(cf *ColumnFamily, key []byte) (kv.Kv, kv.SearchResult, error) {
+	return t.GetContext(context.Background(), cf, key)
+}
+
+// GetContext 可以取消的Get
+func (t *Txn) GetContext(ctx context.Context, cf *ColumnFamily, key []byte) (kv.Kv, kv.SearchResult, error) {
+	return t.get(ctx, cf, key)
+}
+
+func (t *Txn) get(ctx context.Context, cf *ColumnFamily, key []byte) (kv.Kv, kv.SearchResult, error) {
+	cf = t.batch.cf(cf)
+	if mem, ok := t.mems[cf.id]; ok {
+		chain := kv.MergeChain{Now: t.db.opts.now().UnixNano()}
+		if chain.Add(mem.Search(key)) {
+			res, result := cf.resolve(chain.Result())
+			return res, result, nil
+		}
+	}
+	t.reads[cfKey{cf: cf.id, key: string(key)}] = struct{}{}
+	return cf.GetKvContext(ctx, key)
+}
+
+// GetForUpdate 读取key，悲观事务会先对key加锁，保证提交前key不会被其他事务修改。
+// 乐观事务与Get相同，在Commit时检查冲突
+func (t *Txn) GetForUpdate(cf *ColumnFamily, key []byte) (kv.Kv, kv.SearchResult, error) {
+	return t.GetForUpdateContext(context.Background(), cf, key)
+}
+
+// GetForUpdateContext 可以取消的GetForUpdate，悲观事务等待行锁时ctx取消返回ctx.Err()，事务不会结束
+func (t *Txn) GetForUpdateContext(ctx context.Context, cf *ColumnFamily, key []byte) (kv.Kv, kv.SearchResult, error) {
+	err := t.lock(ctx, cf, key)
+	if err != nil {
+		return kv.Kv{}, kv.None, err
+	}
+	return t.get(ctx, cf, key)
+}
+
+func (t *Txn) Set(cf *ColumnFamily, val kv.Kv) error {
+	return t.SetContext(context.Background(), cf, val)
+}
+
+func (t *Txn) SetContext(ctx context.Context, cf *ColumnFamily, val kv.Kv) error {
+	err := t.lock(ctx, cf, val.Key)
+	if err != nil {
+		return err
+	}
+	t.batch.SetKv(cf, val)
+	t.applyLast()
+	return nil
+}
+
+func (t *Txn) Delete(cf *ColumnFamily, key []byte) error {
+	return t.DeleteContext(context.Background(), cf, key)
+}
+
+func (t *Txn) DeleteContext(ctx context.Context, cf *ColumnFamily, key []byte) error {
+	err := t.lock(ctx, cf, key)
+	if err != nil {
+		return err
+	}
+	t.batch.DeleteKv(cf, key)
+	t.applyLast()
+	return nil
+}
+
+// 悲观事务对key加锁，等待超过Options.LockTimeout、ctx取消或者会形成死锁时返回错误，事务中已经持有的锁不会释放
+func (t *Txn) lock(ctx context.Context, cf *ColumnFamily, key []byte) error {
+	if t.closed {
+		return errs.New(errs.ErrCodeTxnClosed)
+	}
+	if !t.pessimistic {
+		return nil
+	}
+	k := cfKey{cf: t.batch.cf(cf).id, key: string(key)}
+	err := t.db.locks.lock(ctx, t, k, t.db.opts.lockTimeout())
+	if err != nil {
+		return err
+	}
+	t.locked[k] = struct{}{}
+	return nil
+}
+
+// 将batch中最新的记录写入私有的memtable
+func (t *Txn) applyLast() {
+	rec := t.batch.records[len(t.batch.records)-1]
+	mem, ok := t.mems[rec.CF]
+	if !ok {
+		mem = memtable.NewMemtableWithComparator("", t.db.opts.Comparator)
+		t.mems[rec.CF] = mem
+	}
+	apply(mem, rec.Kv)
+}
+
+// Commit 原子地写入事务中的所有操作，乐观事务会先检查冲突。无论成功与否，事务都会结束
+func (t *Txn) Commit() error {
+	return t.CommitContext(context.Background())
+}
+
+// CommitContext 可以取消的Commit，取消规则见Db.SetKvContext。ctx取消时事务也会结束，所有写入都不会生效
+func (t *Txn) CommitContext(ctx context.Context) error {
+	if t.closed {
+		return errs.New(errs.ErrCodeTxnClosed)
+	}
+	if t.pessimistic {
+		defer t.close()
+		return t.write(ctx, t.db.write)
+	}
+
+	d := t.db
+	err := lockContext(ctx, d.writeLock)
+	if err != nil {
+		t.closed = true
+		go func() { // 结束乐观事务需要持有writeLock，不再让已经取消的调用方等待
+			d.writeLock.Lock()
+			d.txns.end(t)
+			d.writeLock.Unlock()
+		}()
+		return err
+	}
+	defer d.writeLock.Unlock()
+	defer t.close()
+
+	for k := range t.reads {
+		if d.txns.changedSince(k, t.startSeq) {
+			return errs.NewErr(errs.ErrCodeTxnConflict, fmt.Errorf("key:%q changed since txn start", k.key))
+		}
+	}
+	return t.write(ctx, d.writeLocked)
+}
+
+func (t *Txn) write(ctx context.Context, write func(ctx context.Context, rec wal.Record) error) error {
+	if t.batch.err != nil {
+		return t.batch.err
+	}
+	if len(t.batch.records) == 0 {
+		return nil
+	}
+	return write(ctx, wal.Record{Batch: t.batch.records})
+}
+
+// Rollback 丢弃事务中的所有写入
+func (t *Txn) Rollback() error {
+	if t.closed {
+		return errs.New(errs.ErrCodeTxnClosed)
+	}
+	if t.pessimistic {
+		t.close()
+		return nil
+	}
+	t.db.writeLock.Lock()
+	defer t.db.writeLock.Unlock()
+	t.close()
+	return nil
+}
+
+// 结束事务，释放持有的锁。乐观事务的调用方需要持有db.writeLock
+func (t *Txn) close() {
+	t.closed = true
+	if t.pessimistic {
+		t.db.locks.unlock(t, t.locked)
+		return
+	}
+	t.db.txns.end(t)
+}
+
+// txnTracker 记录活跃事务开始之后每个key最后一次被写入的序号，用于乐观事务的冲突检测。
+//
+//	没有活跃事务时不记录，事务结束后清理不再需要的记录
+type txnTracker struct {
+	seq    uint64 // 每次写入加1
+	active map[*Txn]struct{}
+	keys   map[cfKey]uint64
+	ranges []rangeWrite
+	cmp    kv.Comparator
+}
+
+type rangeWrite struct {
+	cf     int
+	r      kv.RangeTombstone
+	closed bool // 为true时r.End也包含在范围内，用于导入的文件
+	seq    uint64
+}
+
+func (w rangeWrite) contains(cmp kv.Comparator, key []byte) bool {
+	if w.closed {
+		return cmp.Compare(key, w.r.Start) >= 0 && cmp.Compare(key, w.r.End) <= 0
+	}
+	return w.r.Contains(cmp, key)
+}
+
+func newTxnTracker(cmp kv.Comparator) *txnTracker {
+	return &txnTracker{
+		active: make(map[*Txn]struct{}),
+		keys:   make(map[cfKey]uint64),
+		cmp:    cmp,
+	}
+}
+
+func (tr *txnTracker) begin(t *Txn) uint64 {
+	tr.active[t] = struct{}{}
+	return tr.seq
+}
+
+func (tr *txnTracker) end(t *Txn) {
+	delete(tr.active, t)
+	if len(tr.active) == 0 {
+		tr.keys = make(map[cfKey]uint64)
+		tr.ranges = nil
+		return
+	}
+	// 只保留比最早的活跃事务更新的记录
+	minSeq := tr.seq
+	for t := range tr.active {
+		if t.startSeq < minSeq {
+			minSeq = t.startSeq
+		}
+	}
+	for k, seq := range tr.keys {
+		if seq <= minSeq {
+			delete(tr.keys, k)
+		}
+	}
+	var ranges []rangeWrite
+	for _, r := range tr.ranges {
+		if r.seq > minSeq {
+			ranges = append(ranges, r)
+		}
+	}
+	tr.ranges = ranges
+}
+
+// 记录一次写入，批量写入的所有操作使用同一个序号
+func (tr *txnTracker) track(records []wal.Record) {
+	tr.seq++
+	if len(tr.active) == 0 {
+		return
+	}
+	for _, rec := range records {
+		if rec.Kind == kv.KindRangeDelete {
+			r := kv.RangeTombstone{Start: rec.Key, End: rec.Value}
+			tr.ranges = append(tr.ranges, rangeWrite{cf: rec.CF, r: r, seq: tr.seq})
+			continue
+		}
+		tr.keys[cfKey{cf: rec.CF, key: string(rec.Key)}] = tr.seq
+	}
+}
+
+// 导入的文件使用同一个序号。KeyRange的Largest包含在范围内
+func (tr *txnTracker) trackRanges(cf int, ranges []sstable.KeyRange) {
+	tr.seq++
+	if len(tr.active) == 0 {
+		return
+	}
+	for _, r := range ranges {
+		rd := kv.RangeTombstone{Start: r.Smallest, End: r.Largest}
+		tr.ranges = append(tr.ranges, rangeWrite{cf: cf, r: rd, closed: true, seq: tr.seq})
+	}
+}
+
+// 判断k在序号seq之后是否被写入
+func (tr *txnTracker) changedSince(k cfKey, seq uint64) bool {
+	if tr.keys[k] > seq {
+		return true
+	}
+	for _, r := range tr.ranges {
+		if r.cf == k.cf && r.seq > seq && r.contains(tr.cmp, []byte(k.key)) {
+			return true
+		}
+	}
+	return false
+}
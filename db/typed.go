@@ -0,0 +1,194 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+)
+
+// Typed 在一个列族上按类型读写kv：key使用keys编码，value使用values序列化。
+//
+//	keys编码后的顺序需要和db的Comparator一致，迭代器才能按K的顺序遍历，kv提供的KeyEncoder都按Bytewise保持顺序
+type Typed[K, V any] struct {
+	cf     *ColumnFamily
+	keys   kv.KeyEncoder[K]
+	values kv.MarshalOp
+}
+
+// NewTyped 在cf上创建Typed，values为nil时使用kv.Json
+func NewTyped[K, V any](cf *ColumnFamily, keys kv.KeyEncoder[K], values kv.MarshalOp) *Typed[K, V] {
+	if values == nil {
+		values = kv.Json{}
+	}
+	return &Typed[K, V]{cf: cf, keys: keys, values: values}
+}
+
+// Put 序列化v后写入k
+func (t *Typed[K, V]) Put(k K, v V) error {
+	return t.PutContext(context.Background(), k, v)
+}
+
+// PutContext 可以取消的Put
+func (t *Typed[K, V]) PutContext(ctx context.Context, k K, v V) error {
+	key, err := t.encode(k)
+	if err != nil {
+		return err
+	}
+	value, err := t.values.Marshal(v)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeMarshal, fmt.Errorf("marshal value of key:%v err:%v", k, err))
+	}
+	return t.cf.SetKvContext(ctx, kv.Kv{Key: key, Value: value})
+}
+
+// Get 读取k的值，k不存在或者已经删除时返回false
+func (t *Typed[K, V]) Get(k K) (V, bool, error) {
+	return t.GetContext(context.Background(), k)
+}
+
+// GetContext 可以取消的Get
+func (t *Typed[K, V]) GetContext(ctx context.Context, k K) (V, bool, error) {
+	var v V
+	key, err := t.encode(k)
+	if err != nil {
+		return v, false, err
+	}
+	item, result, err := t.cf.GetKvContext(ctx, key)
+	if err != nil || result != kv.Success {
+		return v, false, err
+	}
+	err = t.values.Unmarshal(item.Value, &v)
+	if err != nil {
+		return v, false, errs.NewErr(errs.ErrCodeMarshal, fmt.Errorf("unmarshal value of key:%v err:%v", k, err))
+	}
+	return v, true, nil
+}
+
+// Delete 删除k
+func (t *Typed[K, V]) Delete(k K) error {
+	return t.DeleteContext(context.Background(), k)
+}
+
+// DeleteContext 可以取消的Delete
+func (t *Typed[K, V]) DeleteContext(ctx context.Context, k K) error {
+	key, err := t.encode(k)
+	if err != nil {
+		return err
+	}
+	return t.cf.DeleteKvContext(ctx, key)
+}
+
+// NewIterator 遍历[start, end)。end编码后为空时无法作为上界，返回ErrCodeInvalidArgument，遍历到末尾使用NewFullIterator
+func (t *Typed[K, V]) NewIterator(start, end K) (*TypedIterator[K, V], error) {
+	return t.NewIteratorContext(context.Background(), start, end)
+}
+
+// NewIteratorContext 可以取消的NewIterator
+func (t *Typed[K, V]) NewIteratorContext(ctx context.Context, start, end K) (*TypedIterator[K, V], error) {
+	startKey, err := t.encode(start)
+	if err != nil {
+		return nil, err
+	}
+	endKey, err := t.encode(end)
+	if err != nil {
+		return nil, err
+	}
+	if len(endKey) == 0 { // Iterator把空的end当作没有上界
+		return nil, errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("end key:%v encodes to empty key", end))
+	}
+	return t.newIterator(ctx, startKey, endKey)
+}
+
+// NewFullIterator 遍历列族中所有的kv
+func (t *Typed[K, V]) NewFullIterator() (*TypedIterator[K, V], error) {
+	return t.NewFullIteratorContext(context.Background())
+}
+
+// NewFullIteratorContext 可以取消的NewFullIterator
+func (t *Typed[K, V]) NewFullIteratorContext(ctx context.Context) (*TypedIterator[K, V], error) {
+	return t.newIterator(ctx, nil, nil)
+}
+
+// 编码k，keys实现了kv.KeyChecker时先检查k能否正确编码
+func (t *Typed[K, V]) encode(k K) ([]byte, error) {
+	if checker, ok := t.keys.(kv.KeyChecker[K]); ok {
+		if err := checker.CheckKey(k); err != nil {
+			return nil, errs.NewErr(errs.ErrCodeInvalidArgument, err)
+		}
+	}
+	return t.keys.EncodeKey(k), nil
+}
+
+func (t *Typed[K, V]) newIterator(ctx context.Context, start, end []byte) (*TypedIterator[K, V], error) {
+	it, err := t.cf.NewIteratorContext(ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	res := &TypedIterator[K, V]{typed: t, it: it}
+	res.decode()
+	return res, nil
+}
+
+// TypedIterator 按类型遍历的Iterator。
+//
+//	每移动到一个kv时解码key和value，解码失败时Valid返回false，Err返回错误。提前结束遍历时需要调用Close
+type TypedIterator[K, V any] struct {
+	typed *Typed[K, V]
+	it    *Iterator
+	key   K
+	value V
+	err   error
+}
+
+func (it *TypedIterator[K, V]) Valid() bool {
+	return it.err == nil && it.it.Valid()
+}
+
+func (it *TypedIterator[K, V]) Next() {
+	it.it.Next()
+	it.decode()
+}
+
+func (it *TypedIterator[K, V]) Key() K {
+	return it.key
+}
+
+func (it *TypedIterator[K, V]) Value() V {
+	return it.value
+}
+
+// Err 解码key或value失败，或者遍历时读取sst失败的错误
+func (it *TypedIterator[K, V]) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.it.Err()
+}
+
+// Close 释放sst的文件句柄，可以重复调用
+func (it *TypedIterator[K, V]) Close() error {
+	return it.it.Close()
+}
+
+// 解码当前的kv
+func (it *TypedIterator[K, V]) decode() {
+	if !it.Valid() {
+		return
+	}
+	key, err := it.typed.keys.DecodeKey(it.it.Key())
+	if err != nil {
+		it.err = errs.NewErr(errs.ErrCodeMarshal, fmt.Errorf("decode key:%q err:%v", it.it.Key(), err))
+		it.it.Close()
+		return
+	}
+	var value V
+	err = it.typed.values.Unmarshal(it.it.Value(), &value)
+	if err != nil {
+		it.err = errs.NewErr(errs.ErrCodeMarshal, fmt.Errorf("unmarshal value of key:%v err:%v", key, err))
+		it.it.Close()
+		return
+	}
+	it.key, it.value = key, value
+}
@@ -0,0 +1,137 @@
+package db
+
+import (
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+	"lsmtree/sstable"
+	"lsmtree/vfs"
+	"lsmtree/wal"
+)
+
+// Corruption 校验发现的一处损坏
+type Corruption struct {
+	Path   string
+	Offset int64 // 损坏的位置，-1表示文件无法解析
+	Reason string
+}
+
+// VerifyChecksums 读取db中的每个sst和wal文件，检查校验和，返回所有损坏的位置。
+//
+//	检查期间会阻塞写入和后台的flush、合并。发现损坏时可以关闭db后使用Repair修复
+func (d *Db) VerifyChecksums() ([]Corruption, error) {
+	d.writeLock.Lock()
+	defer d.writeLock.Unlock()
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+
+	var list []Corruption
+	for _, cf := range d.sortedColumnFamilies() {
+		l, err := verifySstDir(d.fs, sstDir(d.dir, cf.id), cf.opts.Marshaller, d.opts.comparator())
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, l...)
+	}
+	l, err := verifyWalDir(d.fs, path.Join(d.dir, "wal"))
+	if err != nil {
+		return nil, err
+	}
+	return append(list, l...), nil
+}
+
+// VerifyChecksums 检查没有打开的db目录，sst使用kv.Json解码。不会修改任何文件
+func VerifyChecksums(dir string) ([]Corruption, error) {
+	return VerifyChecksumsWithOptions(dir, Options{})
+}
+
+// VerifyChecksumsFS 检查fs上没有打开的db目录
+func VerifyChecksumsFS(fs vfs.FS, dir string) ([]Corruption, error) {
+	return VerifyChecksumsWithOptions(dir, Options{FS: fs})
+}
+
+// VerifyChecksumsWithOptions 检查opts.FS上没有打开的db目录，每个列族的sst使用opts.ColumnFamilies中对应列族的Marshaller解码。
+// MANIFEST无法读取时作为一处损坏返回，之后只能确定默认列族的Marshaller
+func VerifyChecksumsWithOptions(dir string, opts Options) ([]Corruption, error) {
+	fs := opts.fs()
+	entries, err := fs.List(dir)
+	if err != nil {
+		return nil, errs.NewErr(errs.ErrCodeInvalidArgument, err)
+	}
+	var list []Corruption
+	m, err := loadManifest(fs, dir)
+	if err != nil {
+		list = append(list, Corruption{Path: path.Join(dir, manifestFileName), Offset: -1, Reason: err.Error()})
+	}
+	marshallers := sstMarshallers(m, opts)
+	for _, name := range entries {
+		if !isDir(fs, path.Join(dir, name)) {
+			continue
+		}
+		_, err := strconv.Atoi(strings.TrimPrefix(name, "sst_"))
+		if name != "sst" && (!strings.HasPrefix(name, "sst_") || err != nil) {
+			continue
+		}
+		l, err := verifySstDir(fs, path.Join(dir, name), marshallers[name], opts.comparator())
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, l...)
+	}
+	l, err := verifyWalDir(fs, path.Join(dir, "wal"))
+	if err != nil {
+		return nil, err
+	}
+	return append(list, l...), nil
+}
+
+func verifySstDir(fs vfs.FS, dir string, marsher kv.MarshalOp, cmp kv.Comparator) ([]Corruption, error) {
+	files, err := fs.List(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	var list []Corruption
+	for _, name := range files {
+		p := path.Join(dir, name)
+		if !strings.HasSuffix(name, ".db") || isDir(fs, p) {
+			continue
+		}
+		info, err := sstable.InspectFS(fs, p, marsher, cmp)
+		if err != nil {
+			list = append(list, Corruption{Path: p, Offset: -1, Reason: err.Error()})
+			continue
+		}
+		for _, problem := range info.Problems {
+			list = append(list, Corruption{Path: p, Offset: problem.Offset, Reason: problem.Reason})
+		}
+	}
+	return list, nil
+}
+
+func verifyWalDir(fs vfs.FS, dir string) ([]Corruption, error) {
+	if _, err := fs.Stat(dir); os.IsNotExist(err) {
+		return nil, nil
+	}
+	files, err := wal.ListFilesFS(fs, dir)
+	if err != nil {
+		return nil, err
+	}
+	var list []Corruption
+	for _, file := range files {
+		info, err := wal.ReadFileFS(fs, file, nil)
+		if err != nil {
+			return nil, err
+		}
+		if info.Err != "" {
+			list = append(list, Corruption{Path: file, Offset: info.Valid, Reason: info.Err})
+		}
+	}
+	return list, nil
+}
@@ -7,6 +7,21 @@ const (
 	ErrCodeMemtable
 	ErrCodeSstable
 	ErrCodeWal
+	ErrCodeInvalidArgument
+	ErrCodeMergeOperator
+	ErrCodeManifest
+	ErrCodeColumnFamily
+	ErrCodeTxnConflict
+	ErrCodeTxnClosed
+	ErrCodeTxnLockTimeout
+	ErrCodeTxnDeadlock
+	ErrCodeBackup
+	ErrCodeRepair
+	ErrCodeChecksum
+	ErrCodeReadOnly
+	ErrCodeDbLocked
+	ErrCodeDbClosed
+	ErrCodeComparator
 )
 
 var lsmTreeDescription = map[ErrCode]Desc{
@@ -15,6 +30,22 @@ var lsmTreeDescription = map[ErrCode]Desc{
 	ErrCodeMemtable: {"memtable错误", ""},
 	ErrCodeSstable:  {"sstable错误", ""},
 	ErrCodeWal:      {"wal错误", ""},
+
+	ErrCodeInvalidArgument: {"参数错误", "invalid argument"},
+	ErrCodeMergeOperator:   {"没有配置合并操作或合并失败", "merge operator not set or merge failed"},
+	ErrCodeManifest:        {"MANIFEST错误", "manifest error"},
+	ErrCodeColumnFamily:    {"列族不存在或已存在", "column family not found or already exists"},
+	ErrCodeTxnConflict:     {"事务读取的key在事务开始后被修改，请重试事务", "transaction conflict, retry the transaction"},
+	ErrCodeTxnClosed:       {"事务已经提交或回滚", "transaction already committed or rolled back"},
+	ErrCodeTxnLockTimeout:  {"等待行锁超时，请回滚后重试事务", "lock wait timeout, roll back and retry the transaction"},
+	ErrCodeTxnDeadlock:     {"等待行锁会形成死锁，请回滚后重试事务", "deadlock detected, roll back and retry the transaction"},
+	ErrCodeBackup:          {"checkpoint或备份失败", "checkpoint or backup failed"},
+	ErrCodeRepair:          {"修复db失败", "repair failed"},
+	ErrCodeChecksum:        {"文件损坏，校验和不一致，可以使用Repair修复", "checksum mismatch, file corrupted, try Repair"},
+	ErrCodeReadOnly:        {"db以只读方式打开，或者后台任务失败后处于只读模式，排除故障后调用Resume恢复写入", "db is opened read-only, or is read-only after a background error, call Resume after fixing it"},
+	ErrCodeDbLocked:        {"db目录已经被其他进程或者Db打开", "db directory is locked by another process or Db"},
+	ErrCodeDbClosed:        {"db已经关闭或者正在关闭", "db is closed or closing"},
+	ErrCodeComparator:      {"Comparator和创建db时使用的不一致", "comparator does not match the one the db was created with"},
 }
 
 func init() {
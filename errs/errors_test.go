@@ -7,12 +7,14 @@ import (
 
 func TestErr(t *testing.T) {
 	demo()
-	FromError(New(ErrCodeSstable))
+	if code, _ := FromError(NewErr(ErrCodeSstable, fmt.Errorf("1"))); code != ErrCodeSstable {
+		t.Fatalf("FromError code:%v", code)
+	}
 
 	Lang = "En"
 	demo()
 
-	New(ErrCodeSstable).Error()
+	_ = New(ErrCodeSstable).Error()
 }
 
 // errs使用示例。
@@ -62,7 +62,8 @@ func (e BaseError) Error() string {
 }
 
 func FromError(err error) (code ErrCode, has bool) {
-	if target := (&BaseError{}); errors.As(err, &target) {
+	var target BaseError
+	if errors.As(err, &target) {
 		return target.code, true
 	}
 
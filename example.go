@@ -14,11 +14,11 @@ func main() {
 	os.MkdirAll(dir, 0755)
 	dbInst.Init(dir)
 	defer dbInst.Shutdown()
-	dbInst.SetKv(kv.Kv{"1", []byte("1"), false})
+	dbInst.SetKv(kv.Kv{Key: []byte("1"), Value: []byte("1"), Deleted: false})
 
-	fmt.Println(dbInst.GetKv("1"))
+	fmt.Println(dbInst.GetKv([]byte("1")))
 
-	dbInst.DeleteKv("1")
-	fmt.Println(dbInst.GetKv("1"))
+	dbInst.DeleteKv([]byte("1"))
+	fmt.Println(dbInst.GetKv([]byte("1")))
 
 }
@@ -0,0 +1,44 @@
+package kv
+
+import "bytes"
+
+// Comparator 定义key的顺序，memtable、sst、合并和迭代器都使用同一个Comparator。
+//
+//	Compare返回负数、0、正数分别表示a小于、等于、大于b，只有a和b的字节完全相同时才能返回0。
+//	Name会记录在db的MANIFEST中，之后打开db时Comparator的Name需要一致，修改了顺序的Comparator需要使用新的Name
+type Comparator interface {
+	Name() string
+	Compare(a, b []byte) int
+}
+
+// Bytewise 按字节序比较，和key为string时的顺序一致，是默认的Comparator
+type Bytewise struct {
+}
+
+func (c Bytewise) Name() string {
+	return "Bytewise"
+}
+
+func (c Bytewise) Compare(a, b []byte) int {
+	return bytes.Compare(a, b)
+}
+
+// ReverseBytewise 按字节序从大到小排列，例如key以大端序的时间戳开头时，新的key排在前面
+type ReverseBytewise struct {
+}
+
+func (c ReverseBytewise) Name() string {
+	return "ReverseBytewise"
+}
+
+func (c ReverseBytewise) Compare(a, b []byte) int {
+	return bytes.Compare(b, a)
+}
+
+// OrBytewise c为nil时返回Bytewise
+func OrBytewise(c Comparator) Comparator {
+	if c == nil {
+		return Bytewise{}
+	}
+	return c
+}
@@ -0,0 +1,93 @@
+package kv
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"time"
+)
+
+// KeyEncoder 将K编码为key，编码后的key按Bytewise比较的顺序和K的顺序一致
+type KeyEncoder[K any] interface {
+	EncodeKey(k K) []byte
+	DecodeKey(data []byte) (K, error)
+}
+
+// KeyChecker KeyEncoder无法正确编码所有K时实现，CheckKey返回错误的k编码后的顺序或者解码结果不正确。
+// Typed在编码key之前检查
+type KeyChecker[K any] interface {
+	CheckKey(k K) error
+}
+
+// Integer 可以使用IntKey编码的整数类型
+type Integer interface {
+	~int | ~int8 | ~int16 | ~int32 | ~int64 | ~uint | ~uint8 | ~uint16 | ~uint32 | ~uint64 | ~uintptr
+}
+
+// IntKey 将整数编码为8byte的大端序，有符号整数翻转符号位，使负数排在正数之前
+type IntKey[T Integer] struct {
+}
+
+// 有符号整数需要翻转的符号位
+func (e IntKey[T]) signBit() uint64 {
+	var zero T
+	if zero-1 < zero {
+		return 1 << 63
+	}
+	return 0
+}
+
+func (e IntKey[T]) EncodeKey(k T) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(k)^e.signBit())
+}
+
+func (e IntKey[T]) DecodeKey(data []byte) (T, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("int key len:%v != 8", len(data))
+	}
+	return T(binary.BigEndian.Uint64(data) ^ e.signBit()), nil
+}
+
+// StringKey 直接使用string的字节作为key
+type StringKey struct {
+}
+
+func (e StringKey) EncodeKey(k string) []byte {
+	return []byte(k)
+}
+
+func (e StringKey) DecodeKey(data []byte) (string, error) {
+	return string(data), nil
+}
+
+// TimeKey 将时间按UnixNano编码，和IntKey[int64]相同。
+//
+//	只保留到纳秒的时间点，DecodeKey返回本地时区的时间，不包含单调时钟读数，比较时需要使用time.Time.Equal。
+//	UnixNano只能表示[1677-09-21, 2262-04-11]之间的时间，time.Time{}等超出范围的时间编码结果不正确，CheckKey返回错误
+type TimeKey struct {
+}
+
+var (
+	minTimeKey = time.Unix(0, math.MinInt64)
+	maxTimeKey = time.Unix(0, math.MaxInt64)
+)
+
+// CheckKey 实现KeyChecker
+func (e TimeKey) CheckKey(k time.Time) error {
+	if k.Before(minTimeKey) || k.After(maxTimeKey) {
+		return fmt.Errorf("time key %v out of range [%v, %v]", k, minTimeKey.UTC(), maxTimeKey.UTC())
+	}
+	return nil
+}
+
+func (e TimeKey) EncodeKey(k time.Time) []byte {
+	return IntKey[int64]{}.EncodeKey(k.UnixNano())
+}
+
+func (e TimeKey) DecodeKey(data []byte) (time.Time, error) {
+	n, err := IntKey[int64]{}.DecodeKey(data)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, n), nil
+}
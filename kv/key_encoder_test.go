@@ -0,0 +1,62 @@
+package kv
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// 编码后按字节序排列的顺序和values的顺序一致，并且可以解码回原值
+func testKeyOrder[K any](t *testing.T, e KeyEncoder[K], values []K, equal func(a, b K) bool) {
+	for i, v := range values {
+		data := e.EncodeKey(v)
+		decoded, err := e.DecodeKey(data)
+		assert.Nil(t, err)
+		assert.True(t, equal(v, decoded), "%v != %v", v, decoded)
+		if i > 0 {
+			assert.Equal(t, -1, bytes.Compare(e.EncodeKey(values[i-1]), data), "%v < %v", values[i-1], v)
+		}
+	}
+}
+
+func eq[K comparable](a, b K) bool {
+	return a == b
+}
+
+func TestKeyEncoder(t *testing.T) {
+	testKeyOrder[int64](t, IntKey[int64]{}, []int64{math.MinInt64, -256, -1, 0, 1, 255, 256, math.MaxInt64}, eq[int64])
+	testKeyOrder[int8](t, IntKey[int8]{}, []int8{-128, -1, 0, 127}, eq[int8])
+	testKeyOrder[uint64](t, IntKey[uint64]{}, []uint64{0, 1, 256, math.MaxUint64}, eq[uint64])
+	testKeyOrder[string](t, StringKey{}, []string{"", "a", "a\x00", "ab", "b"}, eq[string])
+	testKeyOrder[time.Time](t, TimeKey{}, []time.Time{time.Unix(-1, 0), time.Unix(0, 0), time.Unix(0, 1), time.Unix(100, 0)}, time.Time.Equal)
+
+	_, err := IntKey[int64]{}.DecodeKey([]byte("1"))
+	assert.NotNil(t, err)
+
+	// 超出UnixNano范围的时间无法正确编码
+	minTime, maxTime := time.Unix(0, math.MinInt64), time.Unix(0, math.MaxInt64)
+	testKeyOrder[time.Time](t, TimeKey{}, []time.Time{minTime, maxTime}, time.Time.Equal)
+	assert.Nil(t, TimeKey{}.CheckKey(minTime))
+	assert.Nil(t, TimeKey{}.CheckKey(maxTime))
+	assert.NotNil(t, TimeKey{}.CheckKey(time.Time{}))
+	assert.NotNil(t, TimeKey{}.CheckKey(minTime.Add(-1)))
+	assert.NotNil(t, TimeKey{}.CheckKey(maxTime.Add(1)))
+}
+
+func TestMarshalOp(t *testing.T) {
+	type value struct {
+		Name  string
+		Count int
+	}
+	for _, m := range []MarshalOp{Json{}, Gob{}} {
+		data, err := m.Marshal(value{Name: "a", Count: 2})
+		assert.Nil(t, err)
+		var v value
+		assert.Nil(t, m.Unmarshal(data, &v))
+		assert.Equal(t, value{Name: "a", Count: 2}, v)
+	}
+	assert.NotNil(t, Gob{}.Unmarshal([]byte("1"), &struct{}{}))
+}
@@ -9,9 +9,53 @@ const (
 	Success                     // 查找成功
 )
 
+// Kind 记录的类型
+type Kind int
+
+const (
+	KindSet         Kind = iota // 普通记录，写入或删除（Deleted）一个key
+	KindRangeDelete             // 范围删除，删除[Key, Value)内的所有key，Value存放的是End
+	KindMerge                   // 合并操作数，读取时才使用MergeOperator合并
+)
+
 // Kv  todo 对应leveldb的blcok？
 type Kv struct {
-	Key     string
+	Key     []byte // 顺序由Comparator决定
 	Value   []byte // 序列化后存入 使用 MarshalOp
 	Deleted bool
+	Kind    Kind `json:",omitempty"`
+
+	ExpireAt int64 `json:",omitempty"` // 过期时间（UnixNano），0表示永不过期。合并记录的ExpireAt是基准值的过期时间
+
+	// Kind为KindMerge时使用
+	Operands [][]byte `json:",omitempty"` // 按从旧到新的顺序记录还没有合并的操作数
+	HasBase  bool     `json:",omitempty"` // 为true时Value是合并的基准值（nil或空表示key不存在或值为空），不需要再查找更旧的数据
+}
+
+// Expired 判断记录在now（UnixNano）时是否已经过期
+func (k Kv) Expired(now int64) bool {
+	return k.ExpireAt > 0 && k.ExpireAt <= now
+}
+
+// RangeTombstone 范围删除的墓碑，覆盖[Start, End)。
+//
+//	墓碑只对比它更旧的数据生效：同一个memtable/sst里，墓碑之后写入的key不会被它覆盖。
+type RangeTombstone struct {
+	Start []byte
+	End   []byte
+}
+
+// Contains 按cmp的顺序判断key是否在[Start, End)内
+func (r RangeTombstone) Contains(cmp Comparator, key []byte) bool {
+	return cmp.Compare(key, r.Start) >= 0 && cmp.Compare(key, r.End) < 0
+}
+
+// Covered 判断key是否被任意一个墓碑覆盖
+func Covered(cmp Comparator, tombstones []RangeTombstone, key []byte) bool {
+	for _, r := range tombstones {
+		if r.Contains(cmp, key) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,34 @@
+package kv
+
+// LegacyKv key为string时Kv序列化后的格式，用于读取之前版本写入的wal和sst
+type LegacyKv struct {
+	Key      string
+	Value    []byte
+	Deleted  bool
+	Kind     Kind     `json:",omitempty"`
+	ExpireAt int64    `json:",omitempty"`
+	Operands [][]byte `json:",omitempty"`
+	HasBase  bool     `json:",omitempty"`
+}
+
+func (k LegacyKv) Kv() Kv {
+	return Kv{
+		Key:      []byte(k.Key),
+		Value:    k.Value,
+		Deleted:  k.Deleted,
+		Kind:     k.Kind,
+		ExpireAt: k.ExpireAt,
+		Operands: k.Operands,
+		HasBase:  k.HasBase,
+	}
+}
+
+// LegacyRangeTombstone key为string时RangeTombstone序列化后的格式
+type LegacyRangeTombstone struct {
+	Start string
+	End   string
+}
+
+func (r LegacyRangeTombstone) RangeTombstone() RangeTombstone {
+	return RangeTombstone{Start: []byte(r.Start), End: []byte(r.End)}
+}
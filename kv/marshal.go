@@ -1,6 +1,8 @@
 package kv
 
 import (
+	"bytes"
+	"encoding/gob"
 	"encoding/json"
 )
 
@@ -19,3 +21,20 @@ func (j Json) Marshal(v any) ([]byte, error) {
 func (j Json) Unmarshal(data []byte, v any) error {
 	return json.Unmarshal(data, v)
 }
+
+// Gob 使用encoding/gob序列化，每次Marshal都会写入类型信息。接口类型的值需要先调用gob.Register注册具体类型
+type Gob struct {
+}
+
+func (g Gob) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (g Gob) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
@@ -0,0 +1,154 @@
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// MergeOperator 用户自定义的合并操作，用于在不先读取的情况下修改一个key的值。
+//
+//	操作数写入时不会立即合并，而是在读取和sst合并时才调用FullMerge
+type MergeOperator interface {
+	Name() string
+	// FullMerge 将operands（从旧到新）依次合并到existing上，existing为nil表示key不存在。
+	// 值为空的key和不存在的key一样传入nil，gob等序列化方式不区分nil和空值
+	FullMerge(key []byte, existing []byte, operands [][]byte) ([]byte, error)
+}
+
+// Stack 将较新的合并记录newer叠加到同一个key更旧的查找结果上
+func Stack(newer Kv, older Kv, result SearchResult) Kv {
+	item := Kv{
+		Key:      newer.Key,
+		Kind:     KindMerge,
+		HasBase:  true,
+		Operands: append([][]byte{}, newer.Operands...),
+	}
+	switch {
+	case result == Deleted: // 基准值为不存在的key
+	case older.Kind == KindMerge:
+		item.Operands = append(append([][]byte{}, older.Operands...), newer.Operands...)
+		item.Value = older.Value
+		item.HasBase = older.HasBase
+		item.ExpireAt = older.ExpireAt
+	default:
+		item.Value = older.Value
+		item.ExpireAt = older.ExpireAt // 合并后的值沿用基准值的过期时间
+	}
+	return item
+}
+
+// Resolve 调用op合并item中的操作数，得到一条普通记录。item不是合并记录时原样返回。
+// 基准值在now（UnixNano）时已经过期的，视为key不存在；基准值为空时和key不存在一样传入nil
+func Resolve(op MergeOperator, item Kv, now int64) (Kv, error) {
+	if item.Kind != KindMerge {
+		return item, nil
+	}
+	if op == nil {
+		return Kv{}, fmt.Errorf("key:%q has merge operands but no merge operator", item.Key)
+	}
+	var existing []byte
+	var expireAt int64
+	if item.HasBase && !item.Expired(now) {
+		if len(item.Value) > 0 {
+			existing = item.Value
+		}
+		expireAt = item.ExpireAt
+	}
+	value, err := op.FullMerge(item.Key, existing, item.Operands)
+	if err != nil {
+		return Kv{}, err
+	}
+	return Kv{Key: item.Key, Value: value, ExpireAt: expireAt}, nil
+}
+
+// MergeChain 按从新到旧的顺序查找同一个key时，用于累积遇到的合并记录
+type MergeChain struct {
+	Now int64 // 当前时间（UnixNano），过期的记录视为已删除。为0时不检查过期
+
+	item   Kv
+	result SearchResult
+}
+
+// Add 加入一条更旧的查找结果，返回key的值是否已经确定（不需要再查找更旧的数据）
+func (c *MergeChain) Add(item Kv, result SearchResult) bool {
+	if result == Success && item.Kind != KindMerge && item.Expired(c.Now) {
+		item, result = Kv{}, Deleted
+	}
+	switch {
+	case result == None:
+	case c.result == None:
+		c.item, c.result = item, result
+	default:
+		c.item, c.result = Stack(c.item, item, result), Success
+	}
+	return c.Done()
+}
+
+func (c *MergeChain) Done() bool {
+	if c.result != Success {
+		return c.result != None
+	}
+	return c.item.Kind != KindMerge || c.item.HasBase
+}
+
+func (c *MergeChain) Result() (Kv, SearchResult) {
+	return c.item, c.result
+}
+
+// Int64Add 将值视为int64（8byte小端）进行累加，适用于计数器
+type Int64Add struct {
+}
+
+func (o Int64Add) Name() string {
+	return "Int64Add"
+}
+
+func (o Int64Add) FullMerge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	var sum int64
+	if existing != nil {
+		v, err := DecodeInt64(existing)
+		if err != nil {
+			return nil, err
+		}
+		sum = v
+	}
+	for _, operand := range operands {
+		v, err := DecodeInt64(operand)
+		if err != nil {
+			return nil, err
+		}
+		sum += v
+	}
+	return EncodeInt64(sum), nil
+}
+
+func EncodeInt64(v int64) []byte {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, uint64(v))
+	return data
+}
+
+func DecodeInt64(data []byte) (int64, error) {
+	if len(data) != 8 {
+		return 0, fmt.Errorf("int64 value len:%v != 8", len(data))
+	}
+	return int64(binary.LittleEndian.Uint64(data)), nil
+}
+
+// ListAppend 将操作数用Separator连接后追加到原值的末尾，适用于只追加的列表
+type ListAppend struct {
+	Separator []byte
+}
+
+func (o ListAppend) Name() string {
+	return "ListAppend"
+}
+
+func (o ListAppend) FullMerge(key []byte, existing []byte, operands [][]byte) ([]byte, error) {
+	list := operands
+	if existing != nil {
+		list = append([][]byte{existing}, operands...)
+	}
+	return bytes.Join(list, o.Separator), nil
+}
@@ -0,0 +1,117 @@
+package kv
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInt64Add(t *testing.T) {
+	op := Int64Add{}
+	v, err := op.FullMerge([]byte("1"), nil, [][]byte{EncodeInt64(1), EncodeInt64(2)})
+	assert.Nil(t, err)
+	assert.Equal(t, EncodeInt64(3), v)
+
+	v, err = op.FullMerge([]byte("1"), EncodeInt64(10), [][]byte{EncodeInt64(-1)})
+	assert.Nil(t, err)
+	assert.Equal(t, EncodeInt64(9), v)
+
+	_, err = op.FullMerge([]byte("1"), []byte("1"), nil)
+	assert.NotNil(t, err)
+}
+
+func TestListAppend(t *testing.T) {
+	op := ListAppend{Separator: []byte(",")}
+	v, err := op.FullMerge([]byte("1"), nil, [][]byte{[]byte("a"), []byte("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a,b"), v)
+
+	v, err = op.FullMerge([]byte("1"), []byte("a"), [][]byte{[]byte("b")})
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("a,b"), v)
+}
+
+func TestMergeChain(t *testing.T) {
+	op := ListAppend{Separator: []byte(",")}
+
+	// 新的合并记录 -> 旧的合并记录 -> 普通记录
+	chain := MergeChain{}
+	assert.False(t, chain.Add(Kv{}, None))
+	assert.False(t, chain.Add(Kv{Key: []byte("1"), Kind: KindMerge, Operands: [][]byte{[]byte("c")}}, Success))
+	assert.False(t, chain.Add(Kv{Key: []byte("1"), Kind: KindMerge, Operands: [][]byte{[]byte("b")}}, Success))
+	assert.True(t, chain.Add(Kv{Key: []byte("1"), Value: []byte("a")}, Success))
+	item, result := chain.Result()
+	assert.Equal(t, Success, result)
+	item, err := Resolve(op, item, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, Kv{Key: []byte("1"), Value: []byte("a,b,c")}, item)
+
+	// 基准值被删除时，从不存在的key开始合并
+	chain = MergeChain{}
+	chain.Add(Kv{Key: []byte("1"), Kind: KindMerge, Operands: [][]byte{[]byte("b")}}, Success)
+	assert.True(t, chain.Add(Kv{}, Deleted))
+	item, _ = chain.Result()
+	item, err = Resolve(op, item, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("b"), item.Value)
+
+	_, err = Resolve(nil, Kv{Key: []byte("1"), Kind: KindMerge}, 0)
+	assert.NotNil(t, err)
+}
+
+func TestMergeChain_Gob(t *testing.T) {
+	op := ListAppend{Separator: []byte(",")}
+	resolve := func(base Kv, result SearchResult) (before, after Kv) {
+		chain := MergeChain{}
+		chain.Add(Kv{Key: []byte("1"), Kind: KindMerge, Operands: [][]byte{[]byte("b")}}, Success)
+		assert.True(t, chain.Add(base, result))
+		item, _ := chain.Result()
+		before, err := Resolve(op, item, 0)
+		assert.Nil(t, err)
+
+		// gob不区分nil和空值，写入sst再读出后合并的结果不变
+		data, err := Gob{}.Marshal(item)
+		assert.Nil(t, err)
+		var decoded Kv
+		assert.Nil(t, Gob{}.Unmarshal(data, &decoded))
+		after, err = Resolve(op, decoded, 0)
+		assert.Nil(t, err)
+		return before, after
+	}
+
+	t.Log("case: 基准值不存在")
+	before, after := resolve(Kv{}, Deleted)
+	assert.Equal(t, []byte("b"), before.Value)
+	assert.Equal(t, before, after)
+
+	t.Log("case: 基准值为空，和不存在的key一样")
+	before, after = resolve(Kv{Key: []byte("1"), Value: []byte{}}, Success)
+	assert.Equal(t, []byte("b"), before.Value)
+	assert.Equal(t, before, after)
+	before, after = resolve(Kv{Key: []byte("1")}, Success)
+	assert.Equal(t, []byte("b"), before.Value)
+	assert.Equal(t, before, after)
+}
+
+func TestMergeChain_Expired(t *testing.T) {
+	// 过期的记录视为已删除，不会再查找更旧的数据
+	chain := MergeChain{Now: 10}
+	assert.True(t, chain.Add(Kv{Key: []byte("1"), Value: []byte("a"), ExpireAt: 10}, Success))
+	_, result := chain.Result()
+	assert.Equal(t, Deleted, result)
+
+	chain = MergeChain{Now: 10}
+	assert.True(t, chain.Add(Kv{Key: []byte("1"), Value: []byte("a"), ExpireAt: 11}, Success))
+	_, result = chain.Result()
+	assert.Equal(t, Success, result)
+
+	// 合并记录的基准值过期后，从不存在的key开始合并
+	op := ListAppend{Separator: []byte(",")}
+	item := Kv{Key: []byte("1"), Value: []byte("a"), Kind: KindMerge, Operands: [][]byte{[]byte("b")}, HasBase: true, ExpireAt: 10}
+	merged, err := Resolve(op, item, 9)
+	assert.Nil(t, err)
+	assert.Equal(t, Kv{Key: []byte("1"), Value: []byte("a,b"), ExpireAt: 10}, merged)
+	merged, err = Resolve(op, item, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, Kv{Key: []byte("1"), Value: []byte("b")}, merged)
+}
@@ -0,0 +1,93 @@
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger db内部使用的分级日志。keyvals为交替出现的字段名和值，例如 "file", path, "duration", d，和slog的约定一致
+type Logger interface {
+	Debug(msg string, keyvals ...any)
+	Info(msg string, keyvals ...any)
+	Warn(msg string, keyvals ...any)
+	Error(msg string, keyvals ...any)
+}
+
+// Level 日志级别
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "DEBUG"
+	case LevelInfo:
+		return "INFO"
+	case LevelWarn:
+		return "WARN"
+	case LevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// Nop 丢弃所有日志，是Options.Logger的默认值
+type Nop struct{}
+
+func (Nop) Debug(msg string, keyvals ...any) {}
+func (Nop) Info(msg string, keyvals ...any)  {}
+func (Nop) Warn(msg string, keyvals ...any)  {}
+func (Nop) Error(msg string, keyvals ...any) {}
+
+// OrNop l为nil时返回Nop
+func OrNop(l Logger) Logger {
+	if l == nil {
+		return Nop{}
+	}
+	return l
+}
+
+// Std 使用标准库的log.Logger输出，低于Level的日志会被丢弃，格式为 "INFO msg key=value ..."
+type Std struct {
+	Logger *log.Logger // 为nil时使用log.Default()
+	Level  Level
+}
+
+func (s Std) Debug(msg string, keyvals ...any) { s.log(LevelDebug, msg, keyvals) }
+func (s Std) Info(msg string, keyvals ...any)  { s.log(LevelInfo, msg, keyvals) }
+func (s Std) Warn(msg string, keyvals ...any)  { s.log(LevelWarn, msg, keyvals) }
+func (s Std) Error(msg string, keyvals ...any) { s.log(LevelError, msg, keyvals) }
+
+func (s Std) log(level Level, msg string, keyvals []any) {
+	if level < s.Level {
+		return
+	}
+	l := s.Logger
+	if l == nil {
+		l = log.Default()
+	}
+	l.Print(Format(level, msg, keyvals...))
+}
+
+// Format 将一条日志格式化为 "LEVEL msg key=value ..."，落单的值使用!BADKEY作为字段名
+func Format(level Level, msg string, keyvals ...any) string {
+	b := &strings.Builder{}
+	b.WriteString(level.String())
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for i := 0; i < len(keyvals); i += 2 {
+		if i+1 == len(keyvals) {
+			fmt.Fprintf(b, " !BADKEY=%v", keyvals[i])
+			break
+		}
+		fmt.Fprintf(b, " %v=%v", keyvals[i], keyvals[i+1])
+	}
+	return b.String()
+}
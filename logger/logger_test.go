@@ -0,0 +1,26 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, "INFO flush file=1.wal.log level=0", Format(LevelInfo, "flush", "file", "1.wal.log", "level", 0))
+	assert.Equal(t, "WARN merge !BADKEY=1", Format(LevelWarn, "merge", 1))
+}
+
+func TestStd(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := Std{Logger: log.New(buf, "", 0), Level: LevelInfo}
+	l.Debug("debug")
+	l.Info("info", "duration", "1ms")
+	l.Error("error")
+	assert.Equal(t, "INFO info duration=1ms\nERROR error\n", buf.String())
+
+	// nil时丢弃日志
+	OrNop(nil).Error("dropped")
+}
@@ -0,0 +1,31 @@
+//go:build go1.21
+
+package logger
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Slog 将日志转发给slog.Logger
+type Slog struct {
+	Logger *slog.Logger // 为nil时使用slog.Default()
+}
+
+// NewSlog l为nil时使用slog.Default()
+func NewSlog(l *slog.Logger) Slog {
+	return Slog{Logger: l}
+}
+
+func (s Slog) Debug(msg string, keyvals ...any) { s.log(slog.LevelDebug, msg, keyvals) }
+func (s Slog) Info(msg string, keyvals ...any)  { s.log(slog.LevelInfo, msg, keyvals) }
+func (s Slog) Warn(msg string, keyvals ...any)  { s.log(slog.LevelWarn, msg, keyvals) }
+func (s Slog) Error(msg string, keyvals ...any) { s.log(slog.LevelError, msg, keyvals) }
+
+func (s Slog) log(level slog.Level, msg string, keyvals []any) {
+	l := s.Logger
+	if l == nil {
+		l = slog.Default()
+	}
+	l.Log(context.Background(), level, msg, keyvals...)
+}
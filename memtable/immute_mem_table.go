@@ -6,8 +6,9 @@ import (
 
 // 不可变memtable
 type ImmemtableOp interface {
-	Search(key string) (kv.Kv, kv.SearchResult)
+	Search(key []byte) (kv.Kv, kv.SearchResult)
 	GetValues() []kv.Kv
+	GetRangeDels() []kv.RangeTombstone
 	GetName() string
 }
 
@@ -6,15 +6,25 @@ import (
 
 // todo 后续可以添加 红黑树/跳表实现
 type MemtableOp interface {
-	Search(key string) (kv.Kv, kv.SearchResult)
-	Set(key string, value []byte) (oldValue kv.Kv, hasOld bool)
-	Delete(key string) (oldValue kv.Kv, hasOld bool)
+	Search(key []byte) (kv.Kv, kv.SearchResult)
+	Set(key []byte, value []byte) (oldValue kv.Kv, hasOld bool)
+	Put(item kv.Kv) // 写入一条完整的记录（例如带有过期时间的记录），覆盖已有的记录
+	Delete(key []byte) (oldValue kv.Kv, hasOld bool)
+	DeleteRange(start, end []byte)           // 范围删除[start, end)
+	MergeOperand(key []byte, operand []byte) // 写入一个合并操作数
 	GetValues() []kv.Kv
+	GetRangeDels() []kv.RangeTombstone
 	GetName() string
 	CheckCap() bool     // 检查memtable是否超过阈值
+	SetLimit(limit int) // 设置CheckCap的阈值
 	Merge(o MemtableOp) // 将o合并到self指针
 }
 
 func NewMemtable(path string) MemtableOp {
 	return NewTree(path)
 }
+
+// NewMemtableWithComparator 按cmp的顺序排列key的memtable，cmp为nil时使用kv.Bytewise
+func NewMemtableWithComparator(path string, cmp kv.Comparator) MemtableOp {
+	return NewTreeWithComparator(path, cmp)
+}
@@ -13,12 +13,16 @@ type Tree struct {
 	Count int
 	lock  *sync.RWMutex
 	name  string //wal文件的path。
+	limit int    // Count超过这个值时，memtable需要形成immemtable
+	cmp   kv.Comparator
+
+	rangeDels []kv.RangeTombstone // 范围删除的墓碑，按写入顺序排列
 }
 
 const countLimit = 50
 
 func (tree *Tree) CheckCap() bool {
-	if tree.Count > countLimit {
+	if tree.Count > tree.limit {
 		return true
 	}
 	return false
@@ -31,43 +35,66 @@ type treeNode struct {
 }
 
 func NewTree(name string) *Tree {
+	return NewTreeWithComparator(name, nil)
+}
+
+// NewTreeWithComparator 按cmp的顺序排列key，cmp为nil时使用kv.Bytewise
+func NewTreeWithComparator(name string, cmp kv.Comparator) *Tree {
 	return &Tree{
 		name:  name,
 		root:  nil,
 		Count: 0,
 		lock:  &sync.RWMutex{},
+		limit: countLimit,
+		cmp:   kv.OrBytewise(cmp),
 	}
 }
 
+// SetLimit 修改CheckCap的阈值，limit<=0时使用默认值
+func (tree *Tree) SetLimit(limit int) {
+	if limit <= 0 {
+		limit = countLimit
+	}
+	tree.limit = limit
+}
+
 // Search 查找 Key 的值
-func (tree *Tree) Search(key string) (kv.Kv, kv.SearchResult) {
+func (tree *Tree) Search(key []byte) (kv.Kv, kv.SearchResult) {
 	tree.lock.RLock()
 	defer tree.lock.RUnlock()
 
 	if tree == nil {
 		log.Fatal("tree is nil.")
 	}
+	return tree.search(key)
+}
 
+func (tree *Tree) search(key []byte) (kv.Kv, kv.SearchResult) {
 	// 二分查找
 	node := tree.root
 	for node != nil {
-		if key == node.Val.Key {
+		c := tree.cmp.Compare(key, node.Val.Key)
+		if c == 0 {
 			if node.Val.Deleted {
 				return kv.Kv{}, kv.Deleted
 			}
 			return node.Val, kv.Success
 		}
-		if key < node.Val.Key {
+		if c < 0 {
 			node = node.Left
 		} else {
 			node = node.Right
 		}
 	}
+	// 树上没有这个key，再看是否被范围删除覆盖
+	if kv.Covered(tree.cmp, tree.rangeDels, key) {
+		return kv.Kv{}, kv.Deleted
+	}
 	return kv.Kv{}, kv.None
 }
 
 // Set 设置 Key 的值并返回旧值
-func (tree *Tree) Set(key string, value []byte) (oldValue kv.Kv, hasOld bool) {
+func (tree *Tree) Set(key []byte, value []byte) (oldValue kv.Kv, hasOld bool) {
 	tree.lock.Lock()
 	defer tree.lock.Unlock()
 
@@ -92,18 +119,18 @@ func (tree *Tree) Set(key string, value []byte) (oldValue kv.Kv, hasOld bool) {
 
 	// 二分查找，找到合适的位置后插入/覆盖/标记删除
 	for current != nil {
-		if key == current.Val.Key {
+		c := tree.cmp.Compare(key, current.Val.Key)
+		if c == 0 {
 			// 覆盖
 			old := current.Val
-			current.Val.Value = value
-			current.Val.Deleted = false
+			current.Val = newNode.Val
 			if old.Deleted {
 				return kv.Kv{}, false
 			} else {
 				return old, true
 			}
 		}
-		if key < current.Val.Key {
+		if c < 0 {
 			// 找到合适的插入位置
 			if current.Left == nil {
 				current.Left = newNode
@@ -126,7 +153,7 @@ func (tree *Tree) Set(key string, value []byte) (oldValue kv.Kv, hasOld bool) {
 }
 
 // Delete 删除 key 并返回旧值
-func (tree *Tree) Delete(key string) (oldValue kv.Kv, hasOld bool) {
+func (tree *Tree) Delete(key []byte) (oldValue kv.Kv, hasOld bool) {
 	tree.lock.Lock()
 	defer tree.lock.Unlock()
 
@@ -150,18 +177,18 @@ func (tree *Tree) Delete(key string) (oldValue kv.Kv, hasOld bool) {
 	// 二分查找，找到元素进行删除
 	current := tree.root
 	for current != nil {
-		if key == current.Val.Key {
+		c := tree.cmp.Compare(key, current.Val.Key)
+		if c == 0 {
 			// 标记删除
 			if current.Val.Deleted {
 				return kv.Kv{}, false
 			}
-			current.Val.Deleted = true
-			current.Val.Value = nil
+			current.Val = newNode.Val
 			tree.Count--
 			return current.Val, true
 		}
 
-		if key < current.Val.Key {
+		if c < 0 {
 			if current.Left == nil {
 				current.Left = newNode
 				return kv.Kv{}, false
@@ -178,6 +205,101 @@ func (tree *Tree) Delete(key string) (oldValue kv.Kv, hasOld bool) {
 	return kv.Kv{}, false
 }
 
+// DeleteRange 范围删除[start, end)
+//
+//	树上已有的key直接标记删除，同时记录墓碑，用于覆盖更旧的imm/sst中的key。
+//	之后再写入的key不受这个墓碑影响。
+func (tree *Tree) DeleteRange(start, end []byte) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	if tree == nil {
+		log.Fatal("deleteRange:tree is nil")
+	}
+
+	r := kv.RangeTombstone{Start: start, End: end}
+	markDeleted(tree.cmp, tree.root, r, &tree.Count)
+	tree.rangeDels = append(tree.rangeDels, r)
+	tree.Count++ // 墓碑也占用memtable的容量
+}
+
+func (tree *Tree) GetRangeDels() []kv.RangeTombstone {
+	tree.lock.RLock()
+	defer tree.lock.RUnlock()
+	list := make([]kv.RangeTombstone, len(tree.rangeDels))
+	copy(list, tree.rangeDels)
+	return list
+}
+
+// 将r覆盖的节点标记删除，利用二叉排序树的性质剪枝
+func markDeleted(cmp kv.Comparator, root *treeNode, r kv.RangeTombstone, count *int) {
+	if root == nil {
+		return
+	}
+	if cmp.Compare(root.Val.Key, r.Start) > 0 {
+		markDeleted(cmp, root.Left, r, count)
+	}
+	if r.Contains(cmp, root.Val.Key) && !root.Val.Deleted {
+		root.Val = kv.Kv{Key: root.Val.Key, Deleted: true}
+		*count--
+	}
+	if cmp.Compare(root.Val.Key, r.End) < 0 {
+		markDeleted(cmp, root.Right, r, count)
+	}
+}
+
+// MergeOperand 写入一个合并操作数，叠加在这个key已有的记录上
+func (tree *Tree) MergeOperand(key []byte, operand []byte) {
+	tree.mergeEntry(kv.Kv{Key: key, Kind: kv.KindMerge, Operands: [][]byte{operand}})
+}
+
+// 将一条合并记录叠加到已有的记录上，已有记录和墓碑都可以作为合并的基准值
+func (tree *Tree) mergeEntry(item kv.Kv) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+
+	if !item.HasBase {
+		old, result := tree.search(item.Key)
+		if result != kv.None {
+			item = kv.Stack(item, old, result)
+		}
+	}
+	tree.put(item)
+}
+
+// Put 直接写入一条完整的记录，覆盖已有的记录
+func (tree *Tree) Put(item kv.Kv) {
+	tree.lock.Lock()
+	defer tree.lock.Unlock()
+	tree.put(item)
+}
+
+func (tree *Tree) put(item kv.Kv) {
+	node := &tree.root
+	for *node != nil {
+		current := *node
+		c := tree.cmp.Compare(item.Key, current.Val.Key)
+		if c == 0 {
+			if current.Val.Deleted && !item.Deleted {
+				tree.Count++
+			} else if !current.Val.Deleted && item.Deleted {
+				tree.Count--
+			}
+			current.Val = item
+			return
+		}
+		if c < 0 {
+			node = &current.Left
+		} else {
+			node = &current.Right
+		}
+	}
+	*node = &treeNode{Val: item}
+	if !item.Deleted {
+		tree.Count++
+	}
+}
+
 // GetValues 获取树中的所有元素，这是一个有序元素列表
 func (tree *Tree) GetValues() []kv.Kv {
 	tree.lock.RLock()
@@ -189,11 +311,17 @@ func (tree *Tree) GetValues() []kv.Kv {
 }
 
 func (tree *Tree) Merge(o MemtableOp) {
+	// o的墓碑比tree中的数据新，但比o自己的数据旧，所以先处理墓碑
+	for _, r := range o.GetRangeDels() {
+		tree.DeleteRange(r.Start, r.End)
+	}
 	for _, item := range o.GetValues() {
 		if item.Deleted {
 			tree.Delete(item.Key)
+		} else if item.Kind == kv.KindMerge {
+			tree.mergeEntry(item)
 		} else {
-			tree.Set(item.Key, item.Value)
+			tree.Put(item)
 		}
 	}
 }
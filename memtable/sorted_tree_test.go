@@ -12,36 +12,36 @@ import (
 
 func TestTree_Search(t *testing.T) {
 	tree := NewTree("1")
-	tree.Set("2", []byte("2"))
-	tree.Set("1", []byte("1"))
-	tree.Delete("2")
+	tree.Set([]byte("2"), []byte("2"))
+	tree.Set([]byte("1"), []byte("1"))
+	tree.Delete([]byte("2"))
 
-	//assert.Equal(t, []kv.Kv{{"1", []byte("1"), false}, {"2", nil, true}}, tree.GetValues())
-	data, result := tree.Search("1")
-	assert.Equal(t, kv.Kv{"1", []byte("1"), false}, data)
+	//assert.Equal(t, []kv.Kv{{Key: "1", Value: []byte("1"), Deleted: false}, {Key: "2", Value: nil, Deleted: true}}, tree.GetValues())
+	data, result := tree.Search([]byte("1"))
+	assert.Equal(t, kv.Kv{Key: []byte("1"), Value: []byte("1"), Deleted: false}, data)
 	assert.Equal(t, kv.Success, result)
 
-	data, result = tree.Search("2")
+	data, result = tree.Search([]byte("2"))
 	assert.Equal(t, kv.Kv{}, data)
 	assert.Equal(t, kv.Deleted, result)
 
-	data, result = tree.Search("3")
+	data, result = tree.Search([]byte("3"))
 	assert.Equal(t, kv.Kv{}, data)
 	assert.Equal(t, kv.None, result)
 
-	tree.Set("3", []byte("3"))
-	data, result = tree.Search("3")
-	assert.Equal(t, kv.Kv{"3", []byte("3"), false}, data)
+	tree.Set([]byte("3"), []byte("3"))
+	data, result = tree.Search([]byte("3"))
+	assert.Equal(t, kv.Kv{Key: []byte("3"), Value: []byte("3"), Deleted: false}, data)
 	assert.Equal(t, kv.Success, result)
 
-	tree.Set("5", []byte("5"))
-	tree.Set("4", []byte("4"))
-	tree.Delete("3")
-	tree.Delete("5")
-	tree.Delete("6") // 删除一个不存在的key，会添加node
-	tree.Set("2", []byte("2"))
+	tree.Set([]byte("5"), []byte("5"))
+	tree.Set([]byte("4"), []byte("4"))
+	tree.Delete([]byte("3"))
+	tree.Delete([]byte("5"))
+	tree.Delete([]byte("6")) // 删除一个不存在的key，会添加node
+	tree.Set([]byte("2"), []byte("2"))
 
-	data, result = tree.Search("6")
+	data, result = tree.Search([]byte("6"))
 	assert.Equal(t, kv.Kv{}, data)
 	assert.Equal(t, kv.Deleted, result)
 
@@ -49,15 +49,15 @@ func TestTree_Search(t *testing.T) {
 
 func TestTree_Set(t *testing.T) {
 	tree := NewTree("1")
-	tree.Set("2", []byte("2"))
-	tree.Set("1", []byte("1"))
+	tree.Set([]byte("2"), []byte("2"))
+	tree.Set([]byte("1"), []byte("1"))
 
-	assert.Equal(t, []kv.Kv{{"1", []byte("1"), false}, {"2", []byte("2"), false}}, tree.GetValues())
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1"), Deleted: false}, {Key: []byte("2"), Value: []byte("2"), Deleted: false}}, tree.GetValues())
 
 	go func() {
-		tree.Set("3", []byte("3"))
-		tree.Set("5", []byte("5"))
-		tree.Set("4", []byte("4"))
+		tree.Set([]byte("3"), []byte("3"))
+		tree.Set([]byte("5"), []byte("5"))
+		tree.Set([]byte("4"), []byte("4"))
 	}()
 
 	go func() {
@@ -67,58 +67,58 @@ func TestTree_Set(t *testing.T) {
 	time.Sleep(time.Second)
 
 	assert.Equal(t, []kv.Kv{
-		{"1", []byte("1"), false},
-		{"2", []byte("2"), false},
-		{"3", []byte("3"), false},
-		{"4", []byte("4"), false},
-		{"5", []byte("5"), false},
+		{Key: []byte("1"), Value: []byte("1"), Deleted: false},
+		{Key: []byte("2"), Value: []byte("2"), Deleted: false},
+		{Key: []byte("3"), Value: []byte("3"), Deleted: false},
+		{Key: []byte("4"), Value: []byte("4"), Deleted: false},
+		{Key: []byte("5"), Value: []byte("5"), Deleted: false},
 	}, tree.GetValues())
 
 }
 
 func TestTree_Delete(t *testing.T) {
 	tree := NewTree("1")
-	tree.Set("2", []byte("2"))
-	tree.Set("1", []byte("1"))
-	tree.Delete("2")
+	tree.Set([]byte("2"), []byte("2"))
+	tree.Set([]byte("1"), []byte("1"))
+	tree.Delete([]byte("2"))
 
-	assert.Equal(t, []kv.Kv{{"1", []byte("1"), false}, {"2", nil, true}}, tree.GetValues())
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1"), Deleted: false}, {Key: []byte("2"), Value: nil, Deleted: true}}, tree.GetValues())
 
-	tree.Set("3", []byte("3"))
-	tree.Set("5", []byte("5"))
-	tree.Set("4", []byte("4"))
-	tree.Delete("3")
-	tree.Delete("5")
-	tree.Delete("6") // 删除一个不存在的key，会添加node
-	tree.Set("2", []byte("2"))
+	tree.Set([]byte("3"), []byte("3"))
+	tree.Set([]byte("5"), []byte("5"))
+	tree.Set([]byte("4"), []byte("4"))
+	tree.Delete([]byte("3"))
+	tree.Delete([]byte("5"))
+	tree.Delete([]byte("6")) // 删除一个不存在的key，会添加node
+	tree.Set([]byte("2"), []byte("2"))
 
 	assert.Equal(t, []kv.Kv{
-		{"1", []byte("1"), false},
-		{"2", []byte("2"), false},
-		{"3", nil, true},
-		{"4", []byte("4"), false},
-		{"5", nil, true},
-		{"6", nil, true},
+		{Key: []byte("1"), Value: []byte("1"), Deleted: false},
+		{Key: []byte("2"), Value: []byte("2"), Deleted: false},
+		{Key: []byte("3"), Value: nil, Deleted: true},
+		{Key: []byte("4"), Value: []byte("4"), Deleted: false},
+		{Key: []byte("5"), Value: nil, Deleted: true},
+		{Key: []byte("6"), Value: nil, Deleted: true},
 	}, tree.GetValues())
 
 }
 
 func TestTree_CheckCap(t *testing.T) {
 	tree := NewTree("1")
-	tree.Delete("91")
+	tree.Delete([]byte("91"))
 	tree.GetName()
-	tree.Set("90", []byte("2"))
+	tree.Set([]byte("90"), []byte("2"))
 	assert.Equal(t, false, tree.CheckCap())
 	for i := 0; i < 60; i++ {
-		tree.Set(strconv.Itoa(i), []byte("2"))
+		tree.Set([]byte(strconv.Itoa(i)), []byte("2"))
 	}
 	assert.Equal(t, true, tree.CheckCap())
 	for i := 0; i < 60; i++ {
-		tree.Set(strconv.Itoa(i), []byte("2"))
+		tree.Set([]byte(strconv.Itoa(i)), []byte("2"))
 	}
 
 	for i := 0; i < 60; i++ {
-		tree.Delete(strconv.Itoa(i))
+		tree.Delete([]byte(strconv.Itoa(i)))
 	}
 
 	assert.Equal(t, false, tree.CheckCap())
@@ -126,13 +126,100 @@ func TestTree_CheckCap(t *testing.T) {
 
 func TestTree_Merge(t *testing.T) {
 	tree := NewTree("1")
-	tree.Delete("91")
+	tree.Delete([]byte("91"))
 
 	tree2 := NewTree("2")
-	tree2.Set("1", []byte("1"))
-	tree2.Set("91", []byte("1"))
+	tree2.Set([]byte("1"), []byte("1"))
+	tree2.Set([]byte("91"), []byte("1"))
 
 	tree.Merge(tree2)
-	expect := []kv.Kv{kv.Kv{Key: "1", Value: []byte("1"), Deleted: false}, kv.Kv{Key: "91", Value: []byte("1"), Deleted: false}}
+	expect := []kv.Kv{kv.Kv{Key: []byte("1"), Value: []byte("1"), Deleted: false}, kv.Kv{Key: []byte("91"), Value: []byte("1"), Deleted: false}}
 	assert.Equal(t, expect, tree.GetValues())
 }
+
+func TestTree_DeleteRange(t *testing.T) {
+	tree := NewTree("1")
+	for i := 1; i <= 5; i++ {
+		tree.Set([]byte(strconv.Itoa(i)), []byte("1"))
+	}
+	tree.DeleteRange([]byte("2"), []byte("4"))
+	tree.Set([]byte("3"), []byte("3")) // 墓碑之后写入的key不受影响
+
+	assert.Equal(t, []kv.Kv{
+		{Key: []byte("1"), Value: []byte("1"), Deleted: false},
+		{Key: []byte("2"), Value: nil, Deleted: true},
+		{Key: []byte("3"), Value: []byte("3"), Deleted: false},
+		{Key: []byte("4"), Value: []byte("1"), Deleted: false},
+		{Key: []byte("5"), Value: []byte("1"), Deleted: false},
+	}, tree.GetValues())
+	assert.Equal(t, []kv.RangeTombstone{{Start: []byte("2"), End: []byte("4")}}, tree.GetRangeDels())
+
+	// 树上不存在的key，被墓碑覆盖时视为已删除
+	_, result := tree.Search([]byte("21"))
+	assert.Equal(t, kv.Deleted, result)
+	_, result = tree.Search([]byte("4"))
+	assert.Equal(t, kv.Success, result)
+	_, result = tree.Search([]byte("41"))
+	assert.Equal(t, kv.None, result)
+
+	// 合并时o的墓碑会删除tree中已有的key
+	tree2 := NewTree("2")
+	tree2.DeleteRange([]byte("4"), []byte("6"))
+	tree2.Set([]byte("5"), []byte("5"))
+	tree.Merge(tree2)
+	_, result = tree.Search([]byte("4"))
+	assert.Equal(t, kv.Deleted, result)
+	data, result := tree.Search([]byte("5"))
+	assert.Equal(t, kv.Kv{Key: []byte("5"), Value: []byte("5"), Deleted: false}, data)
+}
+
+func TestTree_MergeOperand(t *testing.T) {
+	tree := NewTree("1")
+	tree.MergeOperand([]byte("1"), []byte("a"))
+	tree.Set([]byte("2"), []byte("x"))
+	tree.MergeOperand([]byte("2"), []byte("b"))
+	tree.DeleteRange([]byte("3"), []byte("4"))
+	tree.MergeOperand([]byte("3"), []byte("c"))
+
+	data, result := tree.Search([]byte("1"))
+	assert.Equal(t, kv.Success, result)
+	assert.Equal(t, kv.Kv{Key: []byte("1"), Kind: kv.KindMerge, Operands: [][]byte{[]byte("a")}}, data)
+
+	// 同一个memtable中已有的值和墓碑都是合并的基准值
+	data, _ = tree.Search([]byte("2"))
+	assert.Equal(t, kv.Kv{Key: []byte("2"), Value: []byte("x"), Kind: kv.KindMerge, Operands: [][]byte{[]byte("b")}, HasBase: true}, data)
+	data, _ = tree.Search([]byte("3"))
+	assert.Equal(t, kv.Kv{Key: []byte("3"), Kind: kv.KindMerge, Operands: [][]byte{[]byte("c")}, HasBase: true}, data)
+
+	// 合并时o的操作数叠加在tree已有的记录上
+	tree2 := NewTree("2")
+	tree2.MergeOperand([]byte("1"), []byte("d"))
+	tree.Merge(tree2)
+	data, _ = tree.Search([]byte("1"))
+	assert.Equal(t, [][]byte{[]byte("a"), []byte("d")}, data.Operands)
+
+	tree.Set([]byte("1"), []byte("y"))
+	data, _ = tree.Search([]byte("1"))
+	assert.Equal(t, kv.Kv{Key: []byte("1"), Value: []byte("y"), Deleted: false}, data)
+}
+
+func TestTree_Comparator(t *testing.T) {
+	tree := NewTreeWithComparator("1", kv.ReverseBytewise{})
+	for _, key := range []string{"2", "1", "3"} {
+		tree.Set([]byte(key), []byte(key))
+	}
+	assert.Equal(t, []kv.Kv{
+		{Key: []byte("3"), Value: []byte("3")},
+		{Key: []byte("2"), Value: []byte("2")},
+		{Key: []byte("1"), Value: []byte("1")},
+	}, tree.GetValues())
+
+	// 范围删除也按comparator的顺序，[3, 1)包含3和2
+	tree.DeleteRange([]byte("3"), []byte("1"))
+	_, result := tree.Search([]byte("25"))
+	assert.Equal(t, kv.Deleted, result)
+	_, result = tree.Search([]byte("2"))
+	assert.Equal(t, kv.Deleted, result)
+	_, result = tree.Search([]byte("1"))
+	assert.Equal(t, kv.Success, result)
+}
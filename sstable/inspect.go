@@ -0,0 +1,211 @@
+package sstable
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sort"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+	"lsmtree/vfs"
+)
+
+// TableInfo sst文件解析后的内容，用于排查问题。和SsTable不同，文件损坏时不会panic，而是记录在Problems中
+type TableInfo struct {
+	Path      string
+	Size      int64
+	Meta      MetaInfo
+	Entries   []Entry // 按key排序，顺序由InspectFS的cmp决定
+	RangeDels []kv.RangeTombstone
+	Problems  []Problem // 校验和不一致或者索引和数据不一致的地方，为空表示检查通过
+}
+
+// Problem 文件中损坏的位置
+type Problem struct {
+	Offset int64
+	Reason string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("offset:%v %v", p.Offset, p.Reason)
+}
+
+// Entry 索引中的一项和它在数据区对应的kv
+type Entry struct {
+	Key      []byte
+	Position Position
+	Kv       kv.Kv
+	Corrupt  bool // 数据区中的kv无法解码或者和索引不一致
+}
+
+// Inspect 读取并检查path上的sst，kv按kv.Bytewise排序。元数据或索引无法解析时返回错误，校验和不一致等问题记录在TableInfo.Problems中
+func Inspect(path string, marsher kv.MarshalOp) (TableInfo, error) {
+	return InspectFS(vfs.Default, path, marsher, nil)
+}
+
+// InspectFS 读取并检查fs上的sst，kv按cmp排序，cmp为nil时使用kv.Bytewise
+func InspectFS(fs vfs.FS, path string, marsher kv.MarshalOp, cmp kv.Comparator) (TableInfo, error) {
+	if marsher == nil {
+		marsher = kv.Json{}
+	}
+	cmp = kv.OrBytewise(cmp)
+	data, err := vfs.ReadFile(fs, path)
+	if err != nil {
+		return TableInfo{}, errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	info := TableInfo{Path: path, Size: int64(len(data))}
+	info.Meta, err = parseMetaInfo(data)
+	if err != nil {
+		return info, err
+	}
+	meta := info.Meta
+
+	footer := footerSize(meta.Version)
+	if meta.PointStart < 0 || meta.PointLen < 0 || meta.PointStart+meta.PointLen > info.Size-footer {
+		return info, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("offset:%v index [%v, +%v) out of file size:%v", info.Size-footer, meta.PointStart, meta.PointLen, info.Size))
+	}
+	index := data[meta.PointStart : meta.PointStart+meta.PointLen]
+	checked := meta.Version >= 3
+	if checked && crc32.ChecksumIEEE(index) != meta.PointChecksum {
+		info.problem(meta.PointStart, "index checksum mismatch")
+	}
+	entries, err := unmarshalIndex(marsher, cmp, meta.Version, index)
+	if err != nil {
+		return info, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("offset:%v unmarshal index err:%v", meta.PointStart, err))
+	}
+
+	if meta.RangeDelLen > 0 {
+		end := meta.RangeDelStart + meta.RangeDelLen
+		if meta.RangeDelStart < meta.PointStart+meta.PointLen || end > info.Size-footer {
+			info.problem(info.Size-footer, "range del block [%v, +%v) out of range", meta.RangeDelStart, meta.RangeDelLen)
+		} else if checked && crc32.ChecksumIEEE(data[meta.RangeDelStart:end]) != meta.RangeDelChecksum {
+			info.problem(meta.RangeDelStart, "range del checksum mismatch")
+		} else if info.RangeDels, err = unmarshalRangeDels(marsher, meta.Version, data[meta.RangeDelStart:end]); err != nil {
+			info.problem(meta.RangeDelStart, "unmarshal range del block err:%v", err)
+		}
+	}
+
+	for _, e := range entries {
+		info.Entries = append(info.Entries, Entry{Key: e.Key, Position: e.Position})
+	}
+	// sst可能是用其他Comparator写入的，按调用方指定的cmp重新排序
+	sort.Slice(info.Entries, func(i, j int) bool {
+		return cmp.Compare(info.Entries[i].Key, info.Entries[j].Key) < 0
+	})
+	for i := range info.Entries {
+		e := &info.Entries[i]
+		if e.Position.Start < 0 || e.Position.Len <= 0 || e.Position.Start+e.Position.Len > meta.PointStart {
+			info.entryProblem(e, "key:%q position [%v, +%v) out of data block", e.Key, e.Position.Start, e.Position.Len)
+			continue
+		}
+		item := data[e.Position.Start : e.Position.Start+e.Position.Len]
+		if checked && crc32.ChecksumIEEE(item) != e.Position.Checksum {
+			info.entryProblem(e, "key:%q checksum mismatch", e.Key)
+			continue
+		}
+		e.Kv, err = unmarshalKv(marsher, meta.Version, item)
+		if err != nil {
+			info.entryProblem(e, "key:%q unmarshal err:%v", e.Key, err)
+			continue
+		}
+		if !bytes.Equal(e.Kv.Key, e.Key) {
+			info.entryProblem(e, "key:%q data has key:%q", e.Key, e.Kv.Key)
+		}
+		if e.Kv.Deleted != e.Position.Deleted {
+			info.entryProblem(e, "key:%q index deleted:%v data deleted:%v", e.Key, e.Position.Deleted, e.Kv.Deleted)
+		}
+	}
+	info.checkDataCovered()
+	return info, nil
+}
+
+// 数据区的每个字节都应该属于一个kv，kv之间不能重叠
+func (info *TableInfo) checkDataCovered() {
+	positions := make([]Position, 0, len(info.Entries))
+	for _, e := range info.Entries {
+		positions = append(positions, e.Position)
+	}
+	sort.Slice(positions, func(i, j int) bool {
+		return positions[i].Start < positions[j].Start
+	})
+	offset := int64(0)
+	for _, pos := range positions {
+		if pos.Start != offset {
+			info.problem(offset, "data block [%v, %v) not referenced or overlapped by index", offset, pos.Start)
+		}
+		offset = pos.Start + pos.Len
+	}
+	if offset != info.Meta.PointStart {
+		info.problem(offset, "data block ends at %v, index starts at %v", offset, info.Meta.PointStart)
+	}
+}
+
+func (info *TableInfo) entryProblem(e *Entry, format string, args ...any) {
+	e.Corrupt = true
+	info.problem(e.Position.Start, format, args...)
+}
+
+func (info *TableInfo) problem(offset int64, format string, args ...any) {
+	info.Problems = append(info.Problems, Problem{Offset: offset, Reason: fmt.Sprintf(format, args...)})
+}
+
+// Verify 读取整个文件，检查校验和以及索引和数据是否一致
+func (s *SsTable) Verify() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	info, err := InspectFS(s.fs, s.filePath, s.marsher, s.cmp)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeChecksum, fmt.Errorf("sst:%v err:%v", s.filePath, err))
+	}
+	if len(info.Problems) > 0 {
+		return errs.NewErr(errs.ErrCodeChecksum, fmt.Errorf("sst:%v %v", s.filePath, info.Problems[0]))
+	}
+	return nil
+}
+
+// 元数据的长度
+func footerSize(version int64) int64 {
+	size := int64(metaInfoSize)
+	if version >= 2 {
+		size += metaInfoExtV2
+	}
+	if version >= 3 {
+		size += metaInfoExtV3
+	}
+	return size
+}
+
+// 从文件内容的末尾解析元数据，布局见SsTable
+func parseMetaInfo(data []byte) (MetaInfo, error) {
+	size := int64(len(data))
+	if size < metaInfoSize {
+		return MetaInfo{}, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("file size:%v less than footer", size))
+	}
+	field := func(offset int64) int64 {
+		return int64(binary.LittleEndian.Uint64(data[offset : offset+8]))
+	}
+	metaStart := size - metaInfoSize
+	info := MetaInfo{
+		Version:    field(metaStart),
+		DataStart:  field(metaStart + 8),
+		DataLen:    field(metaStart + 16),
+		PointStart: field(metaStart + 24),
+		PointLen:   field(metaStart + 32),
+	}
+	if info.Version < 2 {
+		return info, nil
+	}
+	if size < footerSize(info.Version) {
+		return MetaInfo{}, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("file size:%v less than footer", size))
+	}
+	info.RangeDelStart = field(metaStart - metaInfoExtV2)
+	info.RangeDelLen = field(metaStart - metaInfoExtV2 + 8)
+	if info.Version < 3 {
+		return info, nil
+	}
+	info.PointChecksum = uint32(field(metaStart - metaInfoExtV2 - metaInfoExtV3))
+	info.RangeDelChecksum = uint32(field(metaStart - metaInfoExtV2 - metaInfoExtV3 + 8))
+	return info, nil
+}
@@ -0,0 +1,119 @@
+package sstable
+
+import (
+	"fmt"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+)
+
+// Iterator 按cmp的顺序遍历一个sst中[start, end)内的kv，包含删除标记和合并记录。
+//
+//	创建时只读取索引，移动到一个kv时才从数据区读取并检查校验和。Iterator持有sst的文件句柄，
+//	sst被合并删除或者关闭之后依然可以读取，最后一个Iterator关闭时才关闭句柄
+type Iterator struct {
+	sst       *SsTable
+	entries   []indexEntry        // 范围内的索引
+	rangeDels []kv.RangeTombstone // sst中所有的墓碑
+	index     int
+	item      kv.Kv
+	err       error
+	closed    bool
+}
+
+// NewIterator start为空表示没有下界，end为空表示没有上界。使用完需要调用Close
+func (s *SsTable) NewIterator(start, end []byte) (*Iterator, error) {
+	it, err := s.newIterator(start, end)
+	if err != nil {
+		return nil, err
+	}
+	it.read()
+	return it, nil
+}
+
+func (s *SsTable) newIterator(start, end []byte) (*Iterator, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v closed", s.filePath))
+	}
+	if s.startPoints == nil {
+		err := s.restoreStartPoints()
+		if err != nil {
+			return nil, err
+		}
+	}
+	lo, hi := 0, len(s.startPoints)
+	if len(start) > 0 {
+		lo = s.seek(start)
+	}
+	if len(end) > 0 {
+		hi = s.seek(end)
+	}
+	if hi < lo {
+		hi = lo
+	}
+	s.refs++
+	return &Iterator{sst: s, entries: s.startPoints[lo:hi], rangeDels: s.rangeDels}, nil
+}
+
+// Valid 遍历结束或者读取失败时返回false，读取失败时Err返回错误
+func (it *Iterator) Valid() bool {
+	return it.err == nil && it.index < len(it.entries)
+}
+
+func (it *Iterator) Next() {
+	it.index++
+	it.read()
+}
+
+// Item 当前的kv，删除标记的Deleted为true
+func (it *Iterator) Item() kv.Kv {
+	return it.item
+}
+
+// RangeDels sst中的墓碑，只覆盖比这个sst更旧的数据
+func (it *Iterator) RangeDels() []kv.RangeTombstone {
+	return it.rangeDels
+}
+
+// Err 读取数据区失败的错误，校验和不一致时为ErrCodeChecksum
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close 释放sst的文件句柄，可以重复调用
+func (it *Iterator) Close() error {
+	if it.closed {
+		return nil
+	}
+	it.closed = true
+	s := it.sst
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.refs--
+	if s.refs == 0 && s.closed {
+		return s.f.Close()
+	}
+	return nil
+}
+
+// 读取当前位置的kv
+func (it *Iterator) read() {
+	if !it.Valid() {
+		return
+	}
+	e := it.entries[it.index]
+	it.sst.lock.Lock()
+	item, res, err := it.sst.getKv(e.Position)
+	it.sst.lock.Unlock()
+	if err != nil {
+		it.err = err
+		return
+	}
+	if res == kv.Deleted {
+		item = kv.Kv{Key: e.Key, Deleted: true}
+	}
+	it.item = item
+}
@@ -1,22 +1,34 @@
 package sstable
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
+	"path"
+	"sort"
 	"sync"
 
 	"lsmtree/errs"
 	"lsmtree/kv"
 	"lsmtree/memtable"
+	"lsmtree/misc/bloom_filter"
+	"lsmtree/vfs"
 )
 
 type SstOp interface {
 	Encode(imm memtable.ImmemtableOp) error
-	Search(key string) (kv.Kv, kv.SearchResult)
+	Search(key []byte) (kv.Kv, kv.SearchResult, error) // 读取的数据校验和不一致时返回ErrCodeChecksum
 	Decode() (memtable.MemtableOp, error)
-	Delete() error
+	Delete() error // 删除文件并关闭句柄
+	Close() error  // 关闭文件句柄，之后不能再读取
+	KeyRange() (KeyRange, bool, error)
+	NewIterator(start, end []byte) (*Iterator, error) // 遍历[start, end)，只读取索引，移动到一个kv时再读取数据区
+	Verify() error                                    // 读取整个文件并检查校验和
+	Size() (int64, error)                             // 文件大小
+	NumEntries() int                                  // 索引中key的个数，包含删除标记，索引无法读取时为0
+	Path() string
 }
 
 // 元数据 描述了稀疏索引和数据区的位置。用于在字节数组上切分（编解码）
@@ -29,37 +41,135 @@ type MetaInfo struct {
 	// 稀疏索引区
 	PointStart int64
 	PointLen   int64
+
+	// 范围删除区 Version>=2 才有
+	RangeDelStart int64
+	RangeDelLen   int64
+
+	// 稀疏索引区和范围删除区的crc32校验和 Version>=3 才有，数据区的校验和保存在每个Position中
+	PointChecksum    uint32
+	RangeDelChecksum uint32
 }
 
+// Version 4的key为[]byte，元数据和Version 3相同。之前版本的key为string，按kv.LegacyKv的格式解码
+
+const (
+	metaInfoSize   = 40 // Version 1的元数据，5个int64
+	metaInfoExtV2  = 16 // Version 2在元数据之前追加的范围删除区位置，2个int64
+	metaInfoExtV3  = 16 // Version 3在Version 2追加的字段之前再追加的校验和，2个int64
+	currentVersion = 4
+)
+
 // Position 元素定位，存储在稀疏索引区中，表示一个元素的起始位置和长度
 type Position struct {
-	Start   int64
-	Len     int64
-	Deleted bool // Key 已经被删除
+	Start    int64
+	Len      int64
+	Deleted  bool   // Key 已经被删除
+	Checksum uint32 // 数据区中这个kv的crc32校验和，Version>=3 才有
 }
 
-// SsTable 存储在磁盘上。 [数据区,稀疏索引区,元数据]
+// 稀疏索引区中的一项，Version 4的索引区为按key顺序排列的[]indexEntry
+type indexEntry struct {
+	Key []byte
+	Position
+}
+
+// SsTable 存储在磁盘上。 [数据区,稀疏索引区,范围删除区,元数据]
 //
-//	其中磁盘上的稀疏索引区可以直接反序列化为map[string]Position
+//	其中磁盘上的稀疏索引区可以直接反序列化为[]indexEntry（Version 4之前为map[string]Position）
 //	   数据区写入的时候是一个一个kv.Kv写入的，因此还原时需要通过Position进行切分后再反序列化为kv.Kv
+//	   范围删除区可以直接反序列化为[]kv.RangeTombstone
+//	   元数据固定在文件末尾40byte，Version 2在这40byte之前再追加16byte的范围删除区位置，
+//	   Version 3再在之前追加16byte的校验和
 type SsTable struct {
-	f        *os.File // 文件句柄，sstable写在这个文件下
+	fs       vfs.FS
+	f        vfs.File // 文件句柄，sstable写在这个文件下
 	filePath string
 
 	tableMetaInfo MetaInfo // 元数据
 
 	// 确定该 SSTable 中是否存在此 Key // todo 还可以使用布隆过滤器来优化，这样在startPoints不需要一直放到内存，有需要再取
-	startPoints map[string]Position // 文件的稀疏索引
+	startPoints []indexEntry              // 文件的稀疏索引，按cmp的顺序排列，读取后不再修改
+	rangeDels   []kv.RangeTombstone       // 范围删除的墓碑，只覆盖比这个sst更旧的数据
+	filter      *bloom_filter.BloomFilter // 索引中所有key的布隆过滤器，第一次Search时构建
+	stats       StatsRecorder             // 为nil时不统计过滤器的效果
 
 	lock    sync.Locker
 	marsher kv.MarshalOp
+	cmp     kv.Comparator
+
+	refs   int  // 还没有关闭的Iterator个数
+	closed bool // 已经Close或者Delete，最后一个Iterator关闭时再关闭文件句柄
 }
 
+// 删除文件后，还没有关闭的Iterator继续通过已经打开的句柄读取
 func (s *SsTable) Delete() error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	return os.Remove(s.filePath)
+	err := s.fs.Remove(s.filePath)
+	if err != nil {
+		return err
+	}
+	return s.closeFile()
+}
+
+func (s *SsTable) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.closeFile()
+}
+
+// 还有Iterator在读取时推迟到最后一个Iterator关闭。调用方需要持有s.lock
+func (s *SsTable) closeFile() error {
+	s.closed = true
+	if s.refs > 0 {
+		return nil
+	}
+	return s.f.Close()
+}
+
+// 重命名文件后目录落盘，已经打开的句柄继续使用
+func (s *SsTable) rename(name string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.fs.Rename(s.filePath, name)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	s.filePath = name
+	err = s.fs.Sync(path.Dir(name))
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	return nil
+}
+
+func (s *SsTable) Size() (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	info, err := s.f.Stat()
+	if err != nil {
+		return 0, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v stat err:%v", s.filePath, err))
+	}
+	return info.Size(), nil
+}
+
+func (s *SsTable) Path() string {
+	return s.filePath
+}
+
+func (s *SsTable) NumEntries() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.startPoints == nil && s.restoreStartPoints() != nil {
+		return 0
+	}
+	return len(s.startPoints)
 }
 
 func (s *SsTable) Decode() (memtable.MemtableOp, error) {
@@ -67,56 +177,94 @@ func (s *SsTable) Decode() (memtable.MemtableOp, error) {
 	defer s.lock.Unlock()
 
 	// 将sst转化为memtable
-	tree := memtable.NewTree("")
-	s.restoreStartPoints()
+	tree := memtable.NewTreeWithComparator("", s.cmp)
+	err := s.restoreStartPoints()
+	if err != nil {
+		return nil, err
+	}
 
-	for key, pos := range s.startPoints {
-		item, res := s.getKv(pos)
+	// 墓碑只覆盖更旧的数据，先放入墓碑，再放入本sst的kv
+	for _, r := range s.rangeDels {
+		tree.DeleteRange(r.Start, r.End)
+	}
+	for _, e := range s.startPoints {
+		item, res, err := s.getKv(e.Position)
+		if err != nil {
+			return nil, err
+		}
 		if res == kv.Deleted {
-			tree.Delete(key)
+			tree.Delete(e.Key)
 			continue
 		}
-		tree.Set(key, item.Value)
+		tree.Put(item)
 	}
 	return tree, nil
 }
 
-func (s *SsTable) Search(key string) (kv.Kv, kv.SearchResult) {
+func (s *SsTable) Search(key []byte) (kv.Kv, kv.SearchResult, error) {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	if len(s.startPoints) == 0 {
+	if s.startPoints == nil {
 		// 尝试读取f，然后构造s.startPoint
-		s.restoreStartPoints()
+		err := s.restoreStartPoints()
+		if err != nil {
+			return kv.Kv{}, kv.None, err
+		}
+	}
+
+	if s.filter == nil {
+		s.filter = bloom_filter.New()
+		for _, e := range s.startPoints {
+			s.filter.Insert(e.Key)
+		}
+	}
+
+	// 过滤器判定key不存在时不需要查找索引
+	if !s.filter.MayContain(key) {
+		s.recordFilter(true)
+	} else if i := s.seek(key); i < len(s.startPoints) && s.cmp.Compare(s.startPoints[i].Key, key) == 0 {
+		// 从startPoint拿到key是否存在，然后直接从f读取
+		return s.getKv(s.startPoints[i].Position)
+	} else {
+		s.recordFilter(false)
+	}
+	if kv.Covered(s.cmp, s.rangeDels, key) {
+		return kv.Kv{}, kv.Deleted, nil
 	}
+	return kv.Kv{}, kv.None, nil
+}
 
-	// 从startPoint拿到key是否存在，然后直接从f读取
-	if pos, ok := s.startPoints[key]; ok {
-		return s.getKv(pos)
+func (s *SsTable) recordFilter(useful bool) {
+	if s.stats != nil {
+		s.stats.RecordFilter(useful)
 	}
-	return kv.Kv{}, kv.None
 }
 
-func (s *SsTable) getKv(pos Position) (kv.Kv, kv.SearchResult) {
+// 索引中第一个不小于key的位置。调用方需要持有s.lock
+func (s *SsTable) seek(key []byte) int {
+	return sort.Search(len(s.startPoints), func(i int) bool {
+		return s.cmp.Compare(s.startPoints[i].Key, key) >= 0
+	})
+}
+
+func (s *SsTable) getKv(pos Position) (kv.Kv, kv.SearchResult, error) {
 	if pos.Deleted {
-		return kv.Kv{}, kv.Deleted
+		return kv.Kv{}, kv.Deleted, nil
 	}
-	_, err := s.f.Seek(pos.Start, 0)
+	data := make([]byte, pos.Len)
+	_, err := s.f.ReadAt(data, pos.Start) // 将key对应的字节数据全部读到data内存
 	if err != nil {
-		panic(err)
+		return kv.Kv{}, kv.None, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v offset:%v read err:%v", s.filePath, pos.Start, err))
 	}
-	size := pos.Len
-	data := make([]byte, size)
-	_, err = s.f.Read(data) // 将key对应的字节数据全部读到data内存
-	if err != nil {
-		panic(err)
+	if s.tableMetaInfo.Version >= 3 && crc32.ChecksumIEEE(data) != pos.Checksum {
+		return kv.Kv{}, kv.None, errs.NewErr(errs.ErrCodeChecksum, fmt.Errorf("sst:%v offset:%v checksum mismatch", s.filePath, pos.Start))
 	}
-	item := kv.Kv{}
-	err = s.marsher.Unmarshal(data, &item)
+	item, err := unmarshalKv(s.marsher, s.tableMetaInfo.Version, data)
 	if err != nil {
-		panic(err)
+		return kv.Kv{}, kv.None, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v offset:%v unmarshal err:%v", s.filePath, pos.Start, err))
 	}
-	return item, kv.Success
+	return item, kv.Success, nil
 }
 
 func (s *SsTable) Encode(imm memtable.ImmemtableOp) error {
@@ -126,18 +274,19 @@ func (s *SsTable) Encode(imm memtable.ImmemtableOp) error {
 	// 将imm的每一个kv拿出来序列化，然后写入startPoints，写入f。
 	//   直到imm的kv都写完（即数据区写完）
 	start := int64(0)
-	sp := make(map[string]Position)
+	var index []indexEntry
 	for _, item := range imm.GetValues() {
 		itemByte, err := s.marsher.Marshal(item)
 		if err != nil {
 			return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("marshal err:%v", err))
 		}
 		itemByteLen := len(itemByte)
-		sp[item.Key] = Position{
-			Start:   start,
-			Len:     int64(itemByteLen),
-			Deleted: item.Deleted,
-		}
+		index = append(index, indexEntry{Key: item.Key, Position: Position{
+			Start:    start,
+			Len:      int64(itemByteLen),
+			Deleted:  item.Deleted,
+			Checksum: crc32.ChecksumIEEE(itemByte),
+		}})
 
 		err = binary.Write(s.f, binary.LittleEndian, itemByte)
 		if err != nil {
@@ -147,127 +296,219 @@ func (s *SsTable) Encode(imm memtable.ImmemtableOp) error {
 		start = start + int64(itemByteLen)
 	}
 
+	err := writeIndex(s.f, s.marsher, start, index, imm.GetRangeDels())
+	if err != nil {
+		return err
+	}
+	err = s.f.Sync()
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	return nil
+}
+
+// 在数据区之后写入索引区、范围删除区和元数据，start为数据区的长度
+func writeIndex(f io.Writer, marsher kv.MarshalOp, start int64, index []indexEntry, rangeDels []kv.RangeTombstone) error {
 	//   再序列化startPoints，写入索引区
-	spBytes, err := s.marsher.Marshal(sp)
+	if index == nil {
+		index = []indexEntry{}
+	}
+	spBytes, err := marsher.Marshal(index)
 	if err != nil {
 		return errs.NewErr(errs.ErrCodeSstable, err)
 	}
 	spStart := start
 	spBytesLen := int64(len(spBytes))
-	err = binary.Write(s.f, binary.LittleEndian, spBytes)
+	err = binary.Write(f, binary.LittleEndian, spBytes)
 	if err != nil {
 		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("Write err:%v", err))
 	}
 	start = start + spBytesLen
 
-	//   再写入元数据,这里直接写40bytes，不需要序列化后再写入
-	info := MetaInfo{
-		Version:    1,
-		DataStart:  0,
-		DataLen:    spStart - 1,
-		PointStart: spStart,
-		PointLen:   spBytesLen,
-	}
-	fmt.Printf("info:%#v \n", info)
-	err = binary.Write(s.f, binary.LittleEndian, info.Version)
-	if err != nil {
-		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("Write err:%v", err))
+	//   再序列化墓碑，写入范围删除区
+	if rangeDels == nil {
+		rangeDels = []kv.RangeTombstone{}
 	}
-	err = binary.Write(s.f, binary.LittleEndian, info.DataStart)
+	rdBytes, err := marsher.Marshal(rangeDels)
 	if err != nil {
-		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("Write err:%v", err))
+		return errs.NewErr(errs.ErrCodeSstable, err)
 	}
-	err = binary.Write(s.f, binary.LittleEndian, info.DataLen)
+	rdStart := start
+	rdBytesLen := int64(len(rdBytes))
+	err = binary.Write(f, binary.LittleEndian, rdBytes)
 	if err != nil {
 		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("Write err:%v", err))
 	}
-	err = binary.Write(s.f, binary.LittleEndian, info.PointStart)
-	if err != nil {
-		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("Write err:%v", err))
+
+	//   再写入元数据,这里直接写72bytes，不需要序列化后再写入
+	info := MetaInfo{
+		Version:          currentVersion,
+		DataStart:        0,
+		DataLen:          spStart - 1,
+		PointStart:       spStart,
+		PointLen:         spBytesLen,
+		RangeDelStart:    rdStart,
+		RangeDelLen:      rdBytesLen,
+		PointChecksum:    crc32.ChecksumIEEE(spBytes),
+		RangeDelChecksum: crc32.ChecksumIEEE(rdBytes),
 	}
-	err = binary.Write(s.f, binary.LittleEndian, info.PointLen)
-	if err != nil {
-		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("Write err:%v", err))
+	// 新版本追加的字段写在前面，保证文件末尾40byte的布局和Version 1一致
+	fields := []int64{int64(info.PointChecksum), int64(info.RangeDelChecksum),
+		info.RangeDelStart, info.RangeDelLen,
+		info.Version, info.DataStart, info.DataLen, info.PointStart, info.PointLen}
+	for _, field := range fields {
+		err = binary.Write(f, binary.LittleEndian, field)
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("Write err:%v", err))
+		}
 	}
 
 	return nil
 }
 
-func (s *SsTable) restoreStartPoints() {
-	info := s.restoreMetaInfo()
+// 读取元数据、索引区和范围删除区，校验和不一致时返回ErrCodeChecksum
+func (s *SsTable) restoreStartPoints() error {
+	info, err := s.restoreMetaInfo()
+	if err != nil {
+		return err
+	}
+	s.tableMetaInfo = info
 
 	// 从f 读取StartPoints
-	_, err := s.f.Seek(info.PointStart, 0)
+	data := make([]byte, info.PointLen)
+	_, err = s.f.ReadAt(data, info.PointStart) // 将StartPoints 对应的字节数据全部读到data内存
 	if err != nil {
-		panic(err)
+		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v offset:%v read index err:%v", s.filePath, info.PointStart, err))
 	}
-	data := make([]byte, info.PointLen)
-	_, err = s.f.Read(data) // 将StartPoints 对应的字节数据全部读到data内存
+	if info.Version >= 3 && crc32.ChecksumIEEE(data) != info.PointChecksum {
+		return errs.NewErr(errs.ErrCodeChecksum, fmt.Errorf("sst:%v offset:%v index checksum mismatch", s.filePath, info.PointStart))
+	}
+	index, err := unmarshalIndex(s.marsher, s.cmp, info.Version, data)
 	if err != nil {
-		panic(err)
+		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v unmarshal index err:%v", s.filePath, err))
+	}
+
+	// 从f 读取范围删除区，Version 1的sst没有这个区域
+	var rangeDels []kv.RangeTombstone
+	if info.RangeDelLen > 0 {
+		data = make([]byte, info.RangeDelLen)
+		_, err = s.f.ReadAt(data, info.RangeDelStart)
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v offset:%v read range del err:%v", s.filePath, info.RangeDelStart, err))
+		}
+		if info.Version >= 3 && crc32.ChecksumIEEE(data) != info.RangeDelChecksum {
+			return errs.NewErr(errs.ErrCodeChecksum, fmt.Errorf("sst:%v offset:%v range del checksum mismatch", s.filePath, info.RangeDelStart))
+		}
+		rangeDels, err = unmarshalRangeDels(s.marsher, info.Version, data)
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v unmarshal range del err:%v", s.filePath, err))
+		}
+	}
+	s.startPoints, s.rangeDels = index, rangeDels
+	return nil
+}
+
+// 解码数据区中的一个kv
+func unmarshalKv(marsher kv.MarshalOp, version int64, data []byte) (kv.Kv, error) {
+	if version >= 4 {
+		item := kv.Kv{}
+		err := marsher.Unmarshal(data, &item)
+		return item, err
+	}
+	item := kv.LegacyKv{}
+	err := marsher.Unmarshal(data, &item)
+	return item.Kv(), err
+}
+
+// 解码索引区，返回按cmp的顺序排列的索引。Version 4的索引写入时已经按cmp的顺序排列，直接使用；
+// 之前版本的索引为map，需要排序
+func unmarshalIndex(marsher kv.MarshalOp, cmp kv.Comparator, version int64, data []byte) ([]indexEntry, error) {
+	var index []indexEntry
+	if version >= 4 {
+		err := marsher.Unmarshal(data, &index)
+		return index, err
 	}
 	sp := make(map[string]Position)
-	err = s.marsher.Unmarshal(data, &sp)
+	err := marsher.Unmarshal(data, &sp)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	s.startPoints = sp
+	index = make([]indexEntry, 0, len(sp))
+	for key, pos := range sp {
+		index = append(index, indexEntry{Key: []byte(key), Position: pos})
+	}
+	sort.Slice(index, func(i, j int) bool {
+		return cmp.Compare(index[i].Key, index[j].Key) < 0
+	})
+	return index, nil
 }
 
-func (s *SsTable) restoreMetaInfo() MetaInfo {
+// 解码范围删除区
+func unmarshalRangeDels(marsher kv.MarshalOp, version int64, data []byte) ([]kv.RangeTombstone, error) {
+	var rangeDels []kv.RangeTombstone
+	if version >= 4 {
+		err := marsher.Unmarshal(data, &rangeDels)
+		return rangeDels, err
+	}
+	var legacy []kv.LegacyRangeTombstone
+	err := marsher.Unmarshal(data, &legacy)
+	for _, r := range legacy {
+		rangeDels = append(rangeDels, r.RangeTombstone())
+	}
+	return rangeDels, err
+}
+
+func (s *SsTable) restoreMetaInfo() (MetaInfo, error) {
 	stat, err := s.f.Stat()
 	if err != nil {
-		panic(err)
+		return MetaInfo{}, errs.NewErr(errs.ErrCodeSstable, err)
 	}
-	size := int64(40)
 	fileSize := stat.Size()
-	metaStart := fileSize - size // 取最后40个byte，即MetaInfo的长度（5个int64）
-	_, err = s.f.Seek(metaStart, 0)
-	data := make([]byte, size)
-	_, err = s.f.Read(data) // 将MetaInfo对应的字节数据全部读到data内存
-	if err != nil {
-		panic(err)
+	// 只读取文件末尾最长的元数据，文件更短时读取整个文件
+	footer := footerSize(currentVersion)
+	if footer > fileSize {
+		footer = fileSize
 	}
-	//fmt.Printf("data:%s\n", data)
-
-	var version, dataStart, dataLen, pointStart, pointLen int64
-	buf := bytes.NewBuffer(data[0:8])
-	err = binary.Read(buf, binary.LittleEndian, &version)
-	buf = bytes.NewBuffer(data[8:16])
-	err = binary.Read(buf, binary.LittleEndian, &dataStart)
-	buf = bytes.NewBuffer(data[16:24])
-	err = binary.Read(buf, binary.LittleEndian, &dataLen)
-	buf = bytes.NewBuffer(data[24:32])
-	err = binary.Read(buf, binary.LittleEndian, &pointStart)
-	buf = bytes.NewBuffer(data[32:40])
-	err = binary.Read(buf, binary.LittleEndian, &pointLen)
-
+	data := make([]byte, footer)
+	_, err = s.f.ReadAt(data, fileSize-footer)
 	if err != nil {
-		panic(err)
+		return MetaInfo{}, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v read meta info err:%v", s.filePath, err))
 	}
-	info := MetaInfo{
-		Version:    version,
-		DataStart:  dataStart,  //data[8:16],
-		DataLen:    dataLen,    //data[16:24],
-		PointStart: pointStart, //data[24:32],
-		PointLen:   pointLen,   //data[32:],
+	info, err := parseMetaInfo(data)
+	if err != nil {
+		return MetaInfo{}, errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("sst:%v err:%v", s.filePath, err))
 	}
-
-	return info
+	return info, nil
 }
 
 func NewSst(path string) SstOp {
-	// todo 区分读写
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	return NewSstWithMarshaller(path, kv.Json{})
+}
+
+// NewSstWithMarshaller 使用marsher序列化sst的数据区、索引区和范围删除区
+func NewSstWithMarshaller(path string, marsher kv.MarshalOp) SstOp {
+	return NewSstWithFS(vfs.Default, path, marsher)
+}
+
+// NewSstWithFS 在fs上打开或者创建path，key按kv.Bytewise排列
+func NewSstWithFS(fs vfs.FS, path string, marsher kv.MarshalOp) SstOp {
+	return openSst(fs, path, os.O_RDWR|os.O_CREATE|os.O_APPEND, marsher, nil)
+}
+
+// flag为os.O_RDONLY时只读打开已有的sst，文件不存在时panic。cmp为nil时使用kv.Bytewise
+func openSst(fs vfs.FS, path string, flag int, marsher kv.MarshalOp, cmp kv.Comparator) *SsTable {
+	f, err := fs.OpenFile(path, flag, 0666)
 	if err != nil {
 		panic(err)
 	}
 	return &SsTable{
+		fs:            fs,
 		f:             f,
 		filePath:      path,
 		tableMetaInfo: MetaInfo{},
 		startPoints:   nil,
 		lock:          &sync.Mutex{},
-		marsher:       kv.Json{},
+		marsher:       marsher,
+		cmp:           kv.OrBytewise(cmp),
 	}
 }
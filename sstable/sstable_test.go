@@ -1,6 +1,8 @@
 package sstable
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"path"
@@ -9,8 +11,10 @@ import (
 
 	"github.com/stretchr/testify/assert"
 
+	"lsmtree/errs"
 	"lsmtree/kv"
 	"lsmtree/memtable"
+	"lsmtree/vfs"
 )
 
 func TestSst(t *testing.T) {
@@ -22,14 +26,16 @@ func TestSst(t *testing.T) {
 	name := fmt.Sprintf("%v.%v%v", 0, 1, sstFileSuffix)
 	sst := NewSst(path.Join(dir, name))
 	imm := memtable.NewTree("")
-	imm.Set("1", []byte("1"))
-	imm.Set("2", []byte("1"))
-	imm.Set("3", []byte("1"))
-	imm.Delete("3")
+	imm.Set([]byte("1"), []byte("1"))
+	imm.Set([]byte("2"), []byte("1"))
+	imm.Set([]byte("3"), []byte("1"))
+	imm.Delete([]byte("3"))
 	err = sst.Encode(imm)
 	assert.Nil(t, err)
 	sstInst := sst.(*SsTable)
-	t.Logf("restoreMeta:%#v", sstInst.restoreMetaInfo())
+	meta, err := sstInst.restoreMetaInfo()
+	assert.Nil(t, err)
+	t.Logf("restoreMeta:%#v", meta)
 
 	// 验证 索引区，数据区，是否都符合预期。
 	mem, err := sstInst.Decode()
@@ -37,14 +43,363 @@ func TestSst(t *testing.T) {
 	assert.Equal(t, imm.GetValues(), mem.GetValues())
 	t.Logf("startPoints:%#v", sstInst.startPoints)
 
-	_, res := sstInst.Search("3")
+	_, res, err := sstInst.Search([]byte("3"))
+	assert.Nil(t, err)
 	assert.Equal(t, kv.Deleted, res)
 
-	k, res := sst.Search("2")
+	k, res, err := sst.Search([]byte("2"))
+	assert.Nil(t, err)
 	assert.Equal(t, kv.Success, res)
-	assert.Equal(t, kv.Kv{"2", []byte("1"), false}, k)
+	assert.Equal(t, kv.Kv{Key: []byte("2"), Value: []byte("1"), Deleted: false}, k)
 
-	k, res = sst.Search("6")
+	k, res, err = sst.Search([]byte("6"))
+	assert.Nil(t, err)
 	assert.Equal(t, kv.None, res)
 
 }
+
+type filterRecorder struct {
+	useful, useless int
+}
+
+func (r *filterRecorder) RecordSearch(level int, result kv.SearchResult) {}
+
+func (r *filterRecorder) RecordFilter(useful bool) {
+	if useful {
+		r.useful++
+	} else {
+		r.useless++
+	}
+}
+
+func (r *filterRecorder) RecordCompaction(readBytes, writeBytes int64) {}
+
+func TestSst_Filter(t *testing.T) {
+	sst := openSst(vfs.NewMem(), "0.0.db", os.O_RDWR|os.O_CREATE|os.O_APPEND, kv.Json{}, nil)
+	recorder := &filterRecorder{}
+	sst.stats = recorder
+	imm := memtable.NewTree("")
+	for i := 0; i < 3000; i++ { // 过滤器的位数固定，key多时误判的比例较高
+		imm.Set([]byte(fmt.Sprintf("k%v", i)), []byte("1"))
+	}
+	assert.Nil(t, sst.Encode(imm))
+
+	for i := 0; i < 3000; i += 100 {
+		_, res, err := sst.Search([]byte(fmt.Sprintf("k%v", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, kv.Success, res)
+	}
+	assert.Equal(t, filterRecorder{}, *recorder)
+
+	for i := 0; i < 200; i++ {
+		_, res, err := sst.Search([]byte(fmt.Sprintf("x%v", i)))
+		assert.Nil(t, err)
+		assert.Equal(t, kv.None, res)
+	}
+	assert.Equal(t, 200, recorder.useful+recorder.useless)
+	assert.True(t, recorder.useful > 0)
+	assert.True(t, recorder.useless > 0)
+}
+
+func TestSst_Iterator(t *testing.T) {
+	fs := vfs.NewMem()
+	sst := NewSstWithFS(fs, "0.0.db", kv.Json{})
+	imm := memtable.NewTree("")
+	for _, key := range []string{"5", "1", "3", "2", "4"} {
+		imm.Set([]byte(key), []byte(key))
+	}
+	imm.Delete([]byte("3"))
+	imm.DeleteRange([]byte("7"), []byte("8"))
+	assert.Nil(t, sst.Encode(imm))
+
+	collect := func(it *Iterator) []string {
+		var keys []string
+		for ; it.Valid(); it.Next() {
+			item := it.Item()
+			if item.Deleted {
+				keys = append(keys, string(item.Key)+"-")
+				continue
+			}
+			assert.Equal(t, item.Key, item.Value)
+			keys = append(keys, string(item.Key))
+		}
+		assert.Nil(t, it.Err())
+		return keys
+	}
+	it, err := sst.NewIterator(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "2", "3-", "4", "5"}, collect(it))
+	assert.Equal(t, []kv.RangeTombstone{{Start: []byte("7"), End: []byte("8")}}, it.RangeDels())
+	assert.Nil(t, it.Close())
+	it, err = sst.NewIterator([]byte("2"), []byte("5"))
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"2", "3-", "4"}, collect(it))
+	assert.Nil(t, it.Close())
+	it, err = sst.NewIterator([]byte("6"), []byte("2"))
+	assert.Nil(t, err)
+	assert.False(t, it.Valid())
+	assert.Nil(t, it.Close())
+
+	t.Log("case: sst删除后Iterator继续读取，最后一个Iterator关闭时关闭文件句柄")
+	it, err = sst.NewIterator([]byte("4"), nil)
+	assert.Nil(t, err)
+	assert.Nil(t, sst.Delete())
+	assert.Equal(t, 1, fs.OpenFiles())
+	assert.Equal(t, []string{"4", "5"}, collect(it))
+	assert.Nil(t, it.Close())
+	assert.Nil(t, it.Close())
+	assert.Equal(t, 0, fs.OpenFiles())
+	_, err = sst.NewIterator(nil, nil)
+	assert.NotNil(t, err)
+}
+
+func TestSst_RangeDel(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/range_del/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	name := fmt.Sprintf("%v.%v%v", 0, 1, sstFileSuffix)
+	sst := NewSst(path.Join(dir, name))
+	imm := memtable.NewTree("")
+	imm.Set([]byte("1"), []byte("1"))
+	imm.DeleteRange([]byte("1"), []byte("3"))
+	imm.Set([]byte("2"), []byte("2"))
+	err = sst.Encode(imm)
+	assert.Nil(t, err)
+
+	sstInst := sst.(*SsTable)
+	info, err := sstInst.restoreMetaInfo()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(currentVersion), info.Version)
+	assert.Equal(t, info.PointStart+info.PointLen, info.RangeDelStart)
+
+	mem, err := sst.Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, imm.GetValues(), mem.GetValues())
+	assert.Equal(t, []kv.RangeTombstone{{Start: []byte("1"), End: []byte("3")}}, mem.GetRangeDels())
+
+	_, res, err := sst.Search([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+	_, res, err = sst.Search([]byte("11")) // 索引中没有，但被墓碑覆盖
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+	k, res, err := sst.Search([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, kv.Kv{Key: []byte("2"), Value: []byte("2"), Deleted: false}, k)
+	_, res, err = sst.Search([]byte("3"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.None, res)
+}
+
+func TestWriter(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/writer/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	p := path.Join(dir, "external.sst")
+	w, err := NewWriter(p, nil)
+	assert.Nil(t, err)
+	assert.Nil(t, w.Set([]byte("a"), []byte("1")))
+	assert.Nil(t, w.Delete([]byte("b")))
+	assert.Nil(t, w.Set([]byte("c"), []byte("3")))
+	assert.NotNil(t, w.Set([]byte("c"), []byte("3"))) // key需要递增
+	assert.NotNil(t, w.Set([]byte("b"), []byte("2")))
+	assert.Nil(t, w.DeleteRange([]byte("d"), []byte("f")))
+	assert.Nil(t, w.Finish())
+	_, err = NewWriter(p, nil)
+	assert.NotNil(t, err)
+
+	sst := NewSst(p)
+	k, res, err := sst.Search([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, []byte("1"), k.Value)
+	_, res, err = sst.Search([]byte("b"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+	_, res, err = sst.Search([]byte("e"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+
+	r, err := ReadKeyRange(p, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, KeyRange{Smallest: []byte("a"), Largest: []byte("f")}, r)
+
+	t.Log("case: 空的sst和损坏的sst")
+	w, err = NewWriter(path.Join(dir, "empty.sst"), nil)
+	assert.Nil(t, err)
+	assert.NotNil(t, w.Finish())
+	err = os.WriteFile(path.Join(dir, "broken.sst"), []byte("broken"), 0666)
+	assert.Nil(t, err)
+	_, err = ReadKeyRange(path.Join(dir, "broken.sst"), nil)
+	assert.NotNil(t, err)
+}
+
+func TestInspect(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/inspect/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	p := path.Join(dir, "0.0.db")
+	sst := NewSst(p)
+	imm := memtable.NewTree("")
+	imm.Set([]byte("2"), []byte("2"))
+	imm.Set([]byte("1"), []byte("1"))
+	imm.Delete([]byte("3"))
+	imm.DeleteRange([]byte("4"), []byte("5"))
+	err = sst.Encode(imm)
+	assert.Nil(t, err)
+
+	info, err := Inspect(p, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(info.Problems))
+	assert.Equal(t, int64(currentVersion), info.Meta.Version)
+	assert.Equal(t, 3, len(info.Entries))
+	assert.Equal(t, []byte("1"), info.Entries[0].Key)
+	assert.Equal(t, []byte("1"), info.Entries[0].Kv.Value)
+	assert.True(t, info.Entries[2].Kv.Deleted)
+	assert.Equal(t, []kv.RangeTombstone{{Start: []byte("4"), End: []byte("5")}}, info.RangeDels)
+
+	t.Log("case: 按Comparator排序")
+	rp := path.Join(dir, "1.0.db")
+	w, err := NewWriterFS(vfs.Default, rp, nil, kv.ReverseBytewise{})
+	assert.Nil(t, err)
+	for _, key := range []string{"3", "2", "1"} {
+		assert.Nil(t, w.Set([]byte(key), []byte(key)))
+	}
+	assert.Nil(t, w.Finish())
+	info, err = InspectFS(vfs.Default, rp, nil, kv.ReverseBytewise{})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(info.Problems))
+	var keys []string
+	for _, e := range info.Entries {
+		keys = append(keys, string(e.Key))
+	}
+	assert.Equal(t, []string{"3", "2", "1"}, keys)
+
+	t.Log("case: 数据区损坏时记录问题")
+	data, err := os.ReadFile(p)
+	assert.Nil(t, err)
+	data[info.Entries[1].Position.Start] = 'x'
+	err = os.WriteFile(p, data, 0666)
+	assert.Nil(t, err)
+	info, err = Inspect(p, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(info.Problems))
+
+	t.Log("case: 元数据损坏时返回错误")
+	err = os.WriteFile(p, data[:10], 0666)
+	assert.Nil(t, err)
+	_, err = Inspect(p, nil)
+	assert.NotNil(t, err)
+}
+
+func TestSsTable_Checksum(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/checksum/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	p := path.Join(dir, "0.0.db")
+	imm := memtable.NewTree("")
+	imm.Set([]byte("1"), []byte("abc"))
+	imm.Set([]byte("2"), []byte("2"))
+	err = NewSst(p).Encode(imm)
+	assert.Nil(t, err)
+	assert.Nil(t, NewSst(p).Verify())
+
+	// 修改value中的一个字节，修改后的数据仍然可以解码，只有校验和能发现
+	data, err := os.ReadFile(p)
+	assert.Nil(t, err)
+	i := bytes.Index(data, []byte("YWJj")) // base64("abc")
+	assert.True(t, i > 0)
+	data[i+3] = 'k'
+	err = os.WriteFile(p, data, 0666)
+	assert.Nil(t, err)
+
+	info, err := Inspect(p, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(info.Problems))
+	assert.Equal(t, info.Entries[0].Position.Start, info.Problems[0].Offset)
+	assert.True(t, info.Entries[0].Corrupt)
+
+	err = NewSst(p).Verify()
+	code, _ := errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	_, _, err = NewSst(p).Search([]byte("1"))
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	_, err = NewSst(p).Decode()
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	it, err := NewSst(p).NewIterator(nil, nil)
+	assert.Nil(t, err)
+	assert.False(t, it.Valid())
+	code, _ = errs.FromError(it.Err())
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	assert.Nil(t, it.Close())
+
+	t.Log("case: 开启VerifyChecksums时合并前发现损坏，放弃合并")
+	tree, err := RestoreTableTree(dir, Options{VerifyChecksums: true})
+	assert.Nil(t, err)
+	err = tree.CompactLevel(0)
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	_, err = os.Stat(p)
+	assert.Nil(t, err)
+
+	t.Log("case: 没有开启VerifyChecksums时合并读到损坏的kv，返回错误")
+	tree, err = RestoreTableTree(dir, Options{})
+	assert.Nil(t, err)
+	err = tree.CompactLevel(0)
+	code, _ = errs.FromError(err)
+	assert.Equal(t, errs.ErrCodeChecksum, code)
+	_, err = os.Stat(p)
+	assert.Nil(t, err)
+}
+
+func TestSst_LegacyVersion(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/legacy/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	// 手工构造Version 1的sst：key为string，索引区为map[string]Position，末尾40byte的元数据
+	var data []byte
+	index := make(map[string]Position)
+	for _, item := range []kv.LegacyKv{{Key: "1", Value: []byte("1")}, {Key: "2", Deleted: true}} {
+		b, err := kv.Json{}.Marshal(item)
+		assert.Nil(t, err)
+		index[item.Key] = Position{Start: int64(len(data)), Len: int64(len(b)), Deleted: item.Deleted}
+		data = append(data, b...)
+	}
+	sp, err := kv.Json{}.Marshal(index)
+	assert.Nil(t, err)
+	dataLen := int64(len(data))
+	data = append(data, sp...)
+	for _, field := range []int64{1, 0, dataLen - 1, dataLen, int64(len(sp))} {
+		data = binary.LittleEndian.AppendUint64(data, uint64(field))
+	}
+	p := path.Join(dir, fmt.Sprintf("0.0%v", sstFileSuffix))
+	err = os.WriteFile(p, data, 0666)
+	assert.Nil(t, err)
+
+	sst := NewSst(p)
+	k, res, err := sst.Search([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, kv.Kv{Key: []byte("1"), Value: []byte("1")}, k)
+	_, res, err = sst.Search([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+	info, err := Inspect(p, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(info.Problems))
+	assert.Equal(t, int64(1), info.Meta.Version)
+	assert.Equal(t, []byte("2"), info.Entries[1].Key)
+}
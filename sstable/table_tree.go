@@ -2,61 +2,153 @@ package sstable
 
 import (
 	"fmt"
+	"io"
 	"os"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
+	"lsmtree/errs"
 	"lsmtree/kv"
+	"lsmtree/logger"
 	"lsmtree/memtable"
+	"lsmtree/vfs"
 )
 
 // 默认实现是tableTree，todo 后续可以使用read through的方式增加cache的实现
 type TableTreeOp interface {
-	Search(key string) (kv.Kv, kv.SearchResult)
+	Search(key []byte) (kv.Kv, kv.SearchResult, error) // sst损坏时返回错误，校验和不一致时为ErrCodeChecksum
 	Insert(imm memtable.ImmemtableOp) error
 	CheckCompactLevels() []int
 	CompactLevel(level int) error
+	NewIterators(start, end []byte) ([]*Iterator, error) // 从新到旧返回每个sst上的Iterator，使用完需要关闭
+	Ingest(file string, r KeyRange) (int, error)         // 导入db之外构建的sst，返回放入的层
+	Levels() []int                                       // 每一层sst的个数
+	LevelStats() ([]LevelStat, error)
+	Files() ([][]TableFileInfo, error) // 每一层的sst，层内按index排序
+	Close() error                      // 关闭所有sst的文件句柄，之后不能再读写
 }
 
-func RestoreTableTree(dir string) TableTreeOp {
-	// 从dir读取所有sst文件，构建一个tableTree
-	tree := &TableTree{lock: &sync.Mutex{}, sstDir: dir}
+// TableFileInfo 一个sst文件
+type TableFileInfo struct {
+	Path  string
+	Level int
+	Size  int64
+}
+
+// LevelStat 一层sst的统计
+type LevelStat struct {
+	Files   int
+	Size    int64 // 所有sst文件的大小之和
+	Entries int   // 所有sst索引中key的个数之和，不同sst中相同的key重复计算
+}
+
+// StatsRecorder 接收查找和合并时的统计，由db实现
+type StatsRecorder interface {
+	RecordSearch(level int, result kv.SearchResult) // 每在一个sst中查找一次调用一次
+	RecordFilter(useful bool)                       // 布隆过滤器判定key不存在时useful为true，判定可能存在但索引中没有时为false
+	RecordCompaction(readBytes, writeBytes int64)
+}
+
+// Options TableTree的配置
+type Options struct {
+	MergeOperator kv.MergeOperator // sst合并时用于合并操作数，为nil时保留操作数
+	Now           func() time.Time // 时钟，用于判断记录是否过期，默认为time.Now
+	LevelLimit    int              // 每一层允许的sst个数，超过时触发合并，0表示使用levelCountLimit
+	Marshaller    kv.MarshalOp     // sst的序列化方式，默认为kv.Json
+	Comparator    kv.Comparator    // key的顺序，默认为kv.Bytewise
+
+	VerifyChecksums bool // 合并前校验参与合并的sst，发现损坏时放弃合并，避免将损坏的数据写入新的sst
+	ReadOnly        bool // 只读打开sst，不删除残留的临时文件，用于读取其他进程正在写入的db
+
+	Stats  StatsRecorder // 为nil时不统计
+	Logger logger.Logger // 为nil时不输出日志
+	FS     vfs.FS        // sst所在的文件系统，默认为vfs.Default
+}
+
+func (o Options) fs() vfs.FS {
+	if o.FS == nil {
+		return vfs.Default
+	}
+	return o.FS
+}
+
+func (o Options) cmp() kv.Comparator {
+	return kv.OrBytewise(o.Comparator)
+}
+
+func (o Options) log() logger.Logger {
+	return logger.OrNop(o.Logger)
+}
+
+func (o Options) now() int64 {
+	if o.Now == nil {
+		return time.Now().UnixNano()
+	}
+	return o.Now().UnixNano()
+}
+
+// RestoreTableTree 从dir读取所有sst文件，构建一个tableTree。写入sst时残留的临时文件会被删除，
+// 其他不符合{level}.{index}.db的文件(例如Repair中断时留下的.repair文件)会被跳过，读取目录失败时返回错误
+func RestoreTableTree(dir string, opts Options) (TableTreeOp, error) {
+	tree := &TableTree{lock: &sync.Mutex{}, sstDir: dir, opts: opts}
 	tree.lock.Lock()
 	defer tree.lock.Unlock()
 
-	sstPathList := getSstPathList2(dir) // 返回顺序需要排序 0.1.db 1.1.db 1.2.db 2.1.db
+	files, err := getSstPathList2(opts.fs(), dir)
+	if err != nil {
+		return nil, err
+	}
+	var sstPathList []string
+	for _, sstPath := range files {
+		if strings.HasSuffix(sstPath, sstTmpFileSuffix) {
+			if opts.ReadOnly {
+				continue // 其他进程正在写入的sst
+			}
+			// 写入过程中崩溃残留的临时文件，对应的数据还在wal或者参与合并的sst中
+			opts.log().Warn("remove unfinished sst", "file", sstPath)
+			_ = opts.fs().Remove(sstPath)
+			continue
+		}
+		if _, _, ok := parseSstPath(dir, sstPath); !ok {
+			// Repair中断时.repair文件可能是唯一的副本，不能删除，重新执行Repair处理
+			opts.log().Warn("skip unknown file in sst dir", "file", sstPath)
+			continue
+		}
+		sstPathList = append(sstPathList, sstPath)
+	}
+	// 返回顺序需要排序 0.1.db 1.1.db 1.2.db 2.1.db，按字符串排序时0.10.db会排在0.9.db之前
+	sort.SliceStable(sstPathList, func(i, j int) bool {
+		li, ii, _ := parseSstPath(dir, sstPathList[i])
+		lj, ij, _ := parseSstPath(dir, sstPathList[j])
+		if li != lj {
+			return li < lj
+		}
+		return ii < ij
+	})
 	for _, sstPath := range sstPathList {
-		level, index := parseSstPath(dir, sstPath)
-		_ = index
-		sst := NewSst(sstPath)
+		level, _, _ := parseSstPath(dir, sstPath)
+		sst := tree.newSst(sstPath)
 		//fmt.Println("level:", level)
 
 		// 构建sst，放入tree
-		if len(tree.levels) > level {
-			tree.levels[level].table = append(tree.levels[level].table, sst)
-		} else {
-			for i := 0; i < level; i++ { // 如果是1.0.db这种情况，需要在tree上先新增level为0的tableNode
-				node := &tableNode{
-					level: level,
-					table: []SstOp{},
-				}
-				tree.levels = append(tree.levels, node)
-			}
+		for len(tree.levels) <= level { // 如果是1.0.db这种情况，需要在tree上先新增level为0的tableNode
 			node := &tableNode{
-				level: level,
-				table: []SstOp{sst},
+				level: len(tree.levels),
+				table: []SstOp{},
 			}
 			tree.levels = append(tree.levels, node)
 		}
+		tree.levels[level].table = append(tree.levels[level].table, sst)
 	}
-	return tree
+	return tree, nil
 }
 
-func getSstPathList(dir string) []string {
-	files, err := os.ReadDir(dir)
+func getSstPathList(fs vfs.FS, dir string) []string {
+	files, err := fs.List(dir)
 	if err != nil {
 		panic(err)
 	}
@@ -66,9 +158,11 @@ func getSstPathList(dir string) []string {
 		path  string
 	}
 	var list []item
-	for _, file := range files {
-		name := file.Name()
-		level, index := parseSstPath(dir, name)
+	for _, name := range files {
+		level, index, ok := parseSstPath(dir, name)
+		if !ok {
+			continue
+		}
 		list = append(list, item{
 			level: level,
 			index: index,
@@ -98,39 +192,37 @@ func getSstPathList(dir string) []string {
 	return strs
 }
 
-func getSstPathList2(dir string) []string {
-	files, err := os.ReadDir(dir)
+func getSstPathList2(fs vfs.FS, dir string) ([]string, error) {
+	files, err := fs.List(dir) // 可以使用字符串直接比较，因为命名规则符合字符串的比较大小的要求。
 	if err != nil {
-		if strings.Contains(err.Error(), "no such file or directory") {
-			return nil
+		if os.IsNotExist(err) {
+			return nil, nil
 		}
-		panic(err)
+		return nil, errs.NewErr(errs.ErrCodeSstable, err)
 	}
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].Name() < files[j].Name() // 可以使用字符串直接比较，因为命名规则符合字符串的比较大小的要求。
-	})
 	list := []string{}
-	for _, file := range files {
-		list = append(list, path.Join(dir, file.Name()))
+	for _, name := range files {
+		list = append(list, path.Join(dir, name))
 	}
-	return list
+	return list, nil
 }
 
-func parseSstPath(dir, sstPath string) (int, int) {
+// 解析{level}.{index}.db，不符合时返回false
+func parseSstPath(dir, sstPath string) (int, int, bool) {
 	_, sstPath = path.Split(sstPath) // 移除dir，预期是1.0.db这样的文件名
 	list := strings.Split(sstPath, ".")
-	if len(list) != 3 {
-		panic(fmt.Sprintf("sstPath:%v 不符合{level}.{index}.db", sstPath))
+	if len(list) != 3 || "."+list[2] != sstFileSuffix {
+		return 0, 0, false
 	}
 	level, err := strconv.Atoi(list[0])
-	if err != nil {
-		panic(err)
+	if err != nil || level < 0 {
+		return 0, 0, false
 	}
 	index, err := strconv.Atoi(list[1])
-	if err != nil {
-		panic(err)
+	if err != nil || index < 0 {
+		return 0, 0, false
 	}
-	return level, index
+	return level, index, true
 }
 
 /*
@@ -143,6 +235,7 @@ type TableTree struct {
 	levels []*tableNode // 存储N层 sstable链表
 	lock   sync.Locker
 	sstDir string
+	opts   Options
 }
 
 //// sstable链表
@@ -157,20 +250,150 @@ type tableNode struct {
 	table []SstOp
 }
 
-const sstFileSuffix = ".db"
+const (
+	sstFileSuffix    = ".db"
+	sstTmpFileSuffix = ".tmp"
+)
 
-func (t *TableTree) Search(key string) (kv.Kv, kv.SearchResult) {
+func (t *TableTree) newSst(path string) *SsTable {
+	marsher := t.opts.Marshaller
+	if marsher == nil {
+		marsher = kv.Json{}
+	}
+	flag := os.O_RDWR | os.O_CREATE | os.O_APPEND
+	if t.opts.ReadOnly {
+		flag = os.O_RDONLY // sst可能已经被其他进程合并后删除，不能重新创建一个空文件
+	}
+	sst := openSst(t.opts.fs(), path, flag, marsher, t.opts.Comparator)
+	sst.stats = t.opts.Stats
+	return sst
+}
+
+// level层下一个sst的路径，序号比这一层已有的sst都大。
+// 合并时崩溃可能只删除了部分旧的sst，序号不一定连续，不能使用这一层sst的个数作为序号
+func (t *TableTree) nextSstPath(level int) string {
+	index := 0
+	if level < len(t.levels) {
+		for _, sst := range t.levels[level].table {
+			if _, i, _ := parseSstPath(t.sstDir, sst.Path()); i >= index {
+				index = i + 1
+			}
+		}
+	}
+	return path.Join(t.sstDir, fmt.Sprintf("%v.%v%v", level, index, sstFileSuffix))
+}
+
+// 先写入临时文件，落盘后再重命名为sstPath，崩溃时不会留下不完整的sst
+func (t *TableTree) writeSst(sstPath string, imm memtable.ImmemtableOp) (SstOp, error) {
+	tmp := sstPath + sstTmpFileSuffix
+	_ = t.opts.fs().Remove(tmp)
+	sst := t.newSst(tmp)
+	err := sst.Encode(imm)
+	if err == nil {
+		err = sst.rename(sstPath)
+	}
+	if err != nil {
+		sst.Close()
+		return nil, err
+	}
+	return sst, nil
+}
+
+// Search 返回key最新的记录。遇到合并记录时会继续查找更旧的sst，返回叠加后的合并记录。读取的sst损坏时返回错误
+func (t *TableTree) Search(key []byte) (kv.Kv, kv.SearchResult, error) {
+	chain := kv.MergeChain{Now: t.opts.now()}
 	// 优先先读新的sst。即level小，index大的
-	for _, sstList := range t.levels {
+	for level, sstList := range t.levels {
 		for i := len(sstList.table) - 1; i >= 0; i-- {
 			sst := sstList.table[i]
-			res, result := sst.Search(key) //todo search 时，先走布隆过滤器？ 然后解码后再读索引
-			if result != kv.None {
-				return res, result
+			res, result, err := sst.Search(key) //todo search 时，先走布隆过滤器？ 然后解码后再读索引
+			if err != nil {
+				return kv.Kv{}, kv.None, err
+			}
+			if t.opts.Stats != nil {
+				t.opts.Stats.RecordSearch(level, result)
+			}
+			if chain.Add(res, result) {
+				res, result = chain.Result()
+				return res, result, nil
+			}
+		}
+	}
+	res, result := chain.Result()
+	return res, result, nil
+}
+
+// NewIterators 从新到旧返回每个sst上遍历[start, end)的Iterator，出错时关闭已经创建的Iterator
+func (t *TableTree) NewIterators(start, end []byte) ([]*Iterator, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var list []*Iterator
+	for _, sstList := range t.levels {
+		for i := len(sstList.table) - 1; i >= 0; i-- {
+			it, err := sstList.table[i].NewIterator(start, end)
+			if err != nil {
+				for _, it := range list {
+					it.Close()
+				}
+				return nil, err
+			}
+			list = append(list, it)
+		}
+	}
+	return list, nil
+}
+
+func (t *TableTree) Levels() []int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	counts := make([]int, 0, len(t.levels))
+	for _, sstList := range t.levels {
+		counts = append(counts, len(sstList.table))
+	}
+	return counts
+}
+
+// LevelStats 每一层sst的统计，读取sst文件大小失败时返回错误
+func (t *TableTree) LevelStats() ([]LevelStat, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	stats := make([]LevelStat, 0, len(t.levels))
+	for _, sstList := range t.levels {
+		stat := LevelStat{Files: len(sstList.table)}
+		for _, sst := range sstList.table {
+			size, err := sst.Size()
+			if err != nil {
+				return nil, err
 			}
+			stat.Size += size
+			stat.Entries += sst.NumEntries()
 		}
+		stats = append(stats, stat)
 	}
-	return kv.Kv{}, kv.None
+	return stats, nil
+}
+
+// Files 每一层的sst，读取sst文件大小失败时返回错误
+func (t *TableTree) Files() ([][]TableFileInfo, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	files := make([][]TableFileInfo, 0, len(t.levels))
+	for level, sstList := range t.levels {
+		list := make([]TableFileInfo, 0, len(sstList.table))
+		for _, sst := range sstList.table {
+			size, err := sst.Size()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, TableFileInfo{Path: sst.Path(), Level: level, Size: size})
+		}
+		files = append(files, list)
+	}
+	return files, nil
 }
 
 // 将imm转化为sst，放入tabletree管理
@@ -178,21 +401,19 @@ func (t *TableTree) Insert(imm memtable.ImmemtableOp) error {
 	t.lock.Lock()
 	defer t.lock.Unlock()
 	// 获取最大的level0的index，然后作为path
-	var name string
-	if len(t.levels) > 0 {
-		index := len(t.levels[0].table)
-		level := t.levels[0].level
-		name = fmt.Sprintf("%v.%v%v", level, index, sstFileSuffix)
-	} else {
-		name = fmt.Sprintf("%v.%v%v", 0, 0, sstFileSuffix)
+	sstPath := t.nextSstPath(0)
+	t.opts.fs().MkdirAll(t.sstDir, 0755) //确保目录t.sstDir存在
+	start := time.Now()
+	sst, err := t.writeSst(sstPath, imm) //编码并写入sst.f
+	if err != nil {
+		return err
 	}
-	sstPath := path.Join(t.sstDir, name)
-	os.MkdirAll(t.sstDir, 0755) //确保目录t.sstDir存在
-	sst := NewSst(sstPath)
-	err := sst.Encode(imm) //编码并写入sst.f
+	size, err := sst.Size()
 	if err != nil {
+		_ = sst.Delete() // 没有放入tabletree，下次flush重新写入
 		return err
 	}
+	t.opts.log().Debug("write sst", "file", sstPath, "level", 0, "size", size, "duration", time.Since(start))
 	insertLevel := 0 // 不可变memtable始终会插入到第0层
 	if len(t.levels) == 0 {
 		node := &tableNode{
@@ -206,6 +427,83 @@ func (t *TableTree) Insert(imm memtable.ImmemtableOp) error {
 	return nil
 }
 
+// Ingest 将db之外构建的sst复制到tabletree中，作为比已有数据都新的sst。返回放入的层。
+//
+//	sst放入最深的一层，要求这一层以及更浅的层都没有和r重叠的sst；和第0层重叠时放入第0层，作为最新的sst
+func (t *TableTree) Ingest(file string, r KeyRange) (int, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	level := 0
+	for i, sstList := range t.levels {
+		overlap := false
+		for _, sst := range sstList.table {
+			sr, ok, err := sst.KeyRange()
+			if err != nil {
+				return 0, err
+			}
+			if ok && sr.Overlaps(r, t.opts.cmp()) {
+				overlap = true
+				break
+			}
+		}
+		if overlap {
+			break
+		}
+		level = i
+	}
+	for len(t.levels) <= level {
+		t.levels = append(t.levels, &tableNode{level: len(t.levels), table: []SstOp{}})
+	}
+
+	sstPath := t.nextSstPath(level)
+	err := t.opts.fs().MkdirAll(t.sstDir, 0755)
+	if err != nil {
+		return 0, errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	// 先复制到临时文件，崩溃时不会留下不完整的sst
+	tmp := sstPath + sstTmpFileSuffix
+	_ = t.opts.fs().Remove(tmp)
+	err = copyFile(t.opts.fs(), file, tmp)
+	if err != nil {
+		_ = t.opts.fs().Remove(tmp)
+		return 0, err
+	}
+	err = t.opts.fs().Rename(tmp, sstPath)
+	if err == nil {
+		err = t.opts.fs().Sync(t.sstDir)
+	}
+	if err != nil {
+		_ = t.opts.fs().Remove(tmp)
+		return 0, errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	t.levels[level].table = append(t.levels[level].table, t.newSst(sstPath))
+	return level, nil
+}
+
+// 复制文件并落盘
+func copyFile(fs vfs.FS, src, dst string) error {
+	in, err := fs.Open(src)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	defer in.Close()
+	out, err := fs.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("copy %v err:%v", src, err))
+	}
+	err = out.Sync()
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	return nil
+}
+
 // 每次允许的sstable个数，超过说明该层需要合并 //todo 这里如何重构？
 var levelCountLimit = map[int]int{
 	0: 10,
@@ -222,13 +520,34 @@ func (t *TableTree) CheckCompactLevels() []int {
 	// 检查每一层的个数是否超过阈值
 	var list []int
 	for i, sstList := range t.levels {
-		if len(sstList.table) > levelCountLimit[i] { // todo 这里判断标准是否合理？是否需要重构？
+		limit := levelCountLimit[i]
+		if t.opts.LevelLimit > 0 {
+			limit = t.opts.LevelLimit
+		}
+		if len(sstList.table) > limit { // todo 这里判断标准是否合理？是否需要重构？
 			list = append(list, i)
 		}
 	}
 	return list
 }
 
+// Close 关闭所有sst的文件句柄，返回第一个错误
+func (t *TableTree) Close() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var first error
+	for _, node := range t.levels {
+		for _, sst := range node.table {
+			err := sst.Close()
+			if err != nil && first == nil {
+				first = errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("close %v err:%v", sst.Path(), err))
+			}
+		}
+	}
+	return first
+}
+
 // 将level的所有sst合并为一个sst后，放入level+1的tabletree上
 func (t *TableTree) CompactLevel(level int) error {
 	t.lock.Lock()
@@ -238,45 +557,69 @@ func (t *TableTree) CompactLevel(level int) error {
 		return nil
 	}
 	tableLen := len(t.levels[level].table)
-
-	// 获取level+1的长度作为index
-	var name string
-	if len(t.levels) > level+1 {
-		index := len(t.levels[level+1].table)
-		name = fmt.Sprintf("%v.%v%v", level+1, index, sstFileSuffix)
-	} else {
-		name = fmt.Sprintf("%v.%v%v", level+1, 0, sstFileSuffix)
+	if t.opts.VerifyChecksums {
+		for _, sst := range t.levels[level].table {
+			err := sst.Verify()
+			if err != nil {
+				return err
+			}
+		}
 	}
-	sstPath := path.Join(t.sstDir, name)
-	temp := NewSst(sstPath)
-	tree := memtable.NewTree("")
+
+	sstPath := t.nextSstPath(level + 1)
+	start := time.Now()
+	tree := memtable.NewTreeWithComparator("", t.opts.Comparator)
+	readBytes := int64(0)
 	for i := 0; i < tableLen; i++ {
 		sst := t.levels[level].table[i]
+		size, err := sst.Size()
+		if err != nil {
+			return err
+		}
+		readBytes += size
 		o, err := sst.Decode()
 		if err != nil {
-			panic(err)
+			return err
 		}
 		tree.Merge(o)
 	}
 
+	// 更深的层没有数据时，墓碑已经没有可以覆盖的数据了
+	bottom := true
+	for i := level + 1; i < len(t.levels); i++ {
+		if len(t.levels[i].table) > 0 {
+			bottom = false
+		}
+	}
+
 	// tree encode为sst
-	err := temp.Encode(tree) //编码并写入sst.f
+	temp, err := t.writeSst(sstPath, compactTree(tree, bottom, t.opts.MergeOperator, t.opts.now(), t.opts.cmp())) //编码并写入sst.f
+	if err != nil {
+		return err
+	}
+	writeBytes, err := temp.Size()
 	if err != nil {
+		_ = temp.Delete() // 没有放入tabletree，旧的sst保持不变
 		return err
 	}
+	if t.opts.Stats != nil {
+		t.opts.Stats.RecordCompaction(readBytes, writeBytes)
+	}
+	t.opts.log().Debug("write sst", "file", sstPath, "level", level+1, "inputs", tableLen,
+		"read", readBytes, "size", writeBytes, "duration", time.Since(start))
 
 	//将temp作为下一个level的sst放入
 	if len(t.levels) > level+1 {
 		t.levels[level+1].table = append(t.levels[level+1].table, temp)
 	} else {
 		node := &tableNode{
-			level: 0,
+			level: level + 1,
 			table: []SstOp{temp},
 		}
 		t.levels = append(t.levels, node)
 	}
 
-	// 清理level层的sst。文件和内存
+	// 清理level层的sst。文件和内存。按从旧到新的顺序删除，崩溃时留下的是较新的sst，不会覆盖合并后的数据
 	for _, sst := range t.levels[level].table {
 		err = sst.Delete()
 		if err != nil {
@@ -284,6 +627,47 @@ func (t *TableTree) CompactLevel(level int) error {
 		}
 	}
 	t.levels[level].table = nil
+	err = t.opts.fs().Sync(t.sstDir)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, err)
+	}
 
 	return nil
 }
+
+// 丢弃合并后多余的数据：被墓碑覆盖的删除标记不需要再单独保存；
+// 如果合并到了最底层，墓碑本身也可以丢弃。
+// 能确定基准值的合并记录会使用op合并为普通记录，过期的记录会被删除。
+func compactTree(tree memtable.MemtableOp, bottom bool, op kv.MergeOperator, now int64, cmp kv.Comparator) memtable.MemtableOp {
+	res := memtable.NewTreeWithComparator("", cmp)
+	rangeDels := tree.GetRangeDels()
+	if !bottom {
+		for _, r := range rangeDels {
+			res.DeleteRange(r.Start, r.End)
+		}
+	}
+	for _, item := range tree.GetValues() {
+		if item.Deleted {
+			if kv.Covered(cmp, rangeDels, item.Key) {
+				continue
+			}
+			res.Delete(item.Key)
+			continue
+		}
+		if item.Kind == kv.KindMerge && op != nil && (item.HasBase || bottom) {
+			merged, err := kv.Resolve(op, item, now)
+			if err == nil { // 合并失败时保留操作数，读取时再返回错误
+				item = merged
+			}
+		}
+		if item.Kind != kv.KindMerge && item.Expired(now) {
+			// 下层可能还有这个key更旧的值，需要保留删除标记
+			if !bottom {
+				res.Delete(item.Key)
+			}
+			continue
+		}
+		res.Put(item)
+	}
+	return res
+}
@@ -11,6 +11,7 @@ import (
 
 	"lsmtree/kv"
 	"lsmtree/memtable"
+	"lsmtree/vfs"
 )
 
 func Test_getSstPathList2(t *testing.T) {
@@ -40,7 +41,8 @@ func Test_getSstPathList2(t *testing.T) {
 		path.Join(dir, "3.4.db"),
 	}
 
-	res := getSstPathList2(dir)
+	res, err := getSstPathList2(vfs.Default, dir)
+	assert.Nil(t, err)
 	assert.Equal(t, expectFileList, res)
 
 }
@@ -72,7 +74,7 @@ func Test_getSstPathList(t *testing.T) {
 		path.Join(dir, "3.4.db"),
 	}
 
-	res := getSstPathList(dir)
+	res := getSstPathList(vfs.Default, dir)
 	assert.Equal(t, expectFileList, res)
 
 }
@@ -83,28 +85,32 @@ func TestTableTree_Insert_Search(t1 *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	tt := RestoreTableTree(dir)
+	tt, err := RestoreTableTree(dir, Options{})
+	assert.Nil(t1, err)
 	tableTree := tt.(*TableTree)
 	assert.Equal(t1, 0, len(tableTree.levels))
 
 	imm := memtable.NewTree("")
-	imm.Set("1", []byte("1"))
-	imm.Set("2", []byte("1"))
-	imm.Set("3", []byte("1"))
-	imm.Delete("3")
+	imm.Set([]byte("1"), []byte("1"))
+	imm.Set([]byte("2"), []byte("1"))
+	imm.Set([]byte("3"), []byte("1"))
+	imm.Delete([]byte("3"))
 
 	err = tableTree.Insert(imm)
 	assert.Nil(t1, err)
 
 	assert.Equal(t1, 1, len(tableTree.levels))
-	_, res := tableTree.Search("3")
+	_, res, err := tableTree.Search([]byte("3"))
+	assert.Nil(t1, err)
 	assert.Equal(t1, kv.Deleted, res)
 
-	val, res := tableTree.Search("2")
-	assert.Equal(t1, kv.Kv{"2", []byte("1"), false}, val)
+	val, res, err := tableTree.Search([]byte("2"))
+	assert.Nil(t1, err)
+	assert.Equal(t1, kv.Kv{Key: []byte("2"), Value: []byte("1"), Deleted: false}, val)
 	assert.Equal(t1, kv.Success, res)
 
-	_, res = tableTree.Search("6")
+	_, res, err = tableTree.Search([]byte("6"))
+	assert.Nil(t1, err)
 	assert.Equal(t1, kv.None, res)
 }
 
@@ -114,31 +120,32 @@ func TestTableTree_CompactLevel(t *testing.T) {
 	if err != nil {
 		panic(err)
 	}
-	tt := RestoreTableTree(dir)
+	tt, err := RestoreTableTree(dir, Options{})
+	assert.Nil(t, err)
 	tableTree := tt.(*TableTree)
 	assert.Equal(t, 0, len(tableTree.levels))
 
 	// 构造多个sst
 	imm := memtable.NewTree("")
-	imm.Set("1", []byte("1"))
-	imm.Set("2", []byte("1"))
-	imm.Set("3", []byte("1"))
+	imm.Set([]byte("1"), []byte("1"))
+	imm.Set([]byte("2"), []byte("1"))
+	imm.Set([]byte("3"), []byte("1"))
 	err = tableTree.Insert(imm)
 
 	imm = memtable.NewTree("")
-	imm.Set("4", []byte("1"))
+	imm.Set([]byte("4"), []byte("1"))
 	err = tableTree.Insert(imm)
 
 	imm = memtable.NewTree("")
-	imm.Set("5", []byte("1"))
-	imm.Delete("1")
+	imm.Set([]byte("5"), []byte("1"))
+	imm.Delete([]byte("1"))
 	err = tableTree.Insert(imm)
 
 	assert.Equal(t, 0, len(tableTree.CheckCompactLevels()))
 
 	for i := 0; i < 8; i++ {
 		imm = memtable.NewTree("")
-		imm.Delete("1")
+		imm.Delete([]byte("1"))
 		err = tableTree.Insert(imm)
 	}
 	assert.Equal(t, 11, len(tableTree.levels[0].table))
@@ -150,31 +157,39 @@ func TestTableTree_CompactLevel(t *testing.T) {
 	assert.Equal(t, 0, len(tableTree.levels[0].table))
 	assert.Equal(t, 1, len(tableTree.levels[1].table))
 
-	_, res := tableTree.Search("1")
+	_, res, err := tableTree.Search([]byte("1"))
+	assert.Nil(t, err)
 	assert.Equal(t, kv.Deleted, res)
 
-	val, res := tableTree.Search("2")
-	assert.Equal(t, kv.Kv{"2", []byte("1"), false}, val)
+	val, res, err := tableTree.Search([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Kv{Key: []byte("2"), Value: []byte("1"), Deleted: false}, val)
 	assert.Equal(t, kv.Success, res)
 
-	val, res = tableTree.Search("5")
-	assert.Equal(t, kv.Kv{"5", []byte("1"), false}, val)
+	val, res, err = tableTree.Search([]byte("5"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Kv{Key: []byte("5"), Value: []byte("1"), Deleted: false}, val)
 	assert.Equal(t, kv.Success, res)
 
-	_, res = tableTree.Search("16")
+	_, res, err = tableTree.Search([]byte("16"))
+	assert.Nil(t, err)
 	assert.Equal(t, kv.None, res)
 
 	// 重建1.0.db
-	tt = RestoreTableTree(dir)
-	val, res = tt.Search("2")
-	assert.Equal(t, kv.Kv{"2", []byte("1"), false}, val)
+	tt, err = RestoreTableTree(dir, Options{})
+	assert.Nil(t, err)
+	val, res, err = tt.Search([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Kv{Key: []byte("2"), Value: []byte("1"), Deleted: false}, val)
 	assert.Equal(t, kv.Success, res)
 
-	val, res = tt.Search("5")
-	assert.Equal(t, kv.Kv{"5", []byte("1"), false}, val)
+	val, res, err = tt.Search([]byte("5"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Kv{Key: []byte("5"), Value: []byte("1"), Deleted: false}, val)
 	assert.Equal(t, kv.Success, res)
 
-	_, res = tt.Search("16")
+	_, res, err = tt.Search([]byte("16"))
+	assert.Nil(t, err)
 	assert.Equal(t, kv.None, res)
 
 	tableTree = tt.(*TableTree)
@@ -182,3 +197,268 @@ func TestTableTree_CompactLevel(t *testing.T) {
 	assert.Equal(t, 0, len(tableTree.levels[0].table))
 	assert.Equal(t, 1, len(tableTree.levels[1].table))
 }
+
+func TestTableTree_CompactLevel_RangeDel(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/op_range_del/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	tt, err := RestoreTableTree(dir, Options{})
+	assert.Nil(t, err)
+	tableTree := tt.(*TableTree)
+
+	imm := memtable.NewTree("")
+	imm.Set([]byte("1"), []byte("1"))
+	imm.Set([]byte("2"), []byte("1"))
+	imm.Set([]byte("3"), []byte("1"))
+	err = tableTree.Insert(imm)
+	assert.Nil(t, err)
+
+	imm = memtable.NewTree("")
+	imm.DeleteRange([]byte("1"), []byte("3"))
+	imm.Set([]byte("21"), []byte("1"))
+	err = tableTree.Insert(imm)
+	assert.Nil(t, err)
+
+	_, res, err := tableTree.Search([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+
+	// 下层没有数据，合并后被覆盖的key和墓碑都会被丢弃
+	err = tableTree.CompactLevel(0)
+	assert.Nil(t, err)
+	mem, err := tableTree.levels[1].table[0].Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, []kv.Kv{
+		{Key: []byte("21"), Value: []byte("1"), Deleted: false},
+		{Key: []byte("3"), Value: []byte("1"), Deleted: false},
+	}, mem.GetValues())
+	assert.Equal(t, 0, len(mem.GetRangeDels()))
+
+	// 下层有数据时，墓碑需要保留
+	imm = memtable.NewTree("")
+	imm.DeleteRange([]byte("3"), []byte("4"))
+	err = tableTree.Insert(imm)
+	assert.Nil(t, err)
+	err = tableTree.CompactLevel(0)
+	assert.Nil(t, err)
+	_, res, err = tableTree.Search([]byte("3"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+	mem, err = tableTree.levels[1].table[1].Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, []kv.RangeTombstone{{Start: []byte("3"), End: []byte("4")}}, mem.GetRangeDels())
+
+	its, err := tableTree.NewIterators(nil, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(its))
+	for _, it := range its {
+		assert.Nil(t, it.Close())
+	}
+}
+
+func TestTableTree_CompactLevel_Merge(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/op_merge/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	tt, err := RestoreTableTree(dir, Options{MergeOperator: kv.Int64Add{}})
+	assert.Nil(t, err)
+	tableTree := tt.(*TableTree)
+
+	imm := memtable.NewTree("")
+	imm.Set([]byte("1"), kv.EncodeInt64(1))
+	err = tableTree.Insert(imm)
+	assert.Nil(t, err)
+
+	imm = memtable.NewTree("")
+	imm.MergeOperand([]byte("1"), kv.EncodeInt64(2))
+	imm.MergeOperand([]byte("2"), kv.EncodeInt64(3))
+	err = tableTree.Insert(imm)
+	assert.Nil(t, err)
+
+	// 查找时跨sst叠加操作数
+	val, res, err := tableTree.Search([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, kv.Kv{Key: []byte("1"), Value: kv.EncodeInt64(1), Kind: kv.KindMerge, Operands: [][]byte{kv.EncodeInt64(2)}, HasBase: true}, val)
+
+	// 合并到最底层时操作数会被合并为普通记录
+	err = tableTree.CompactLevel(0)
+	assert.Nil(t, err)
+	val, res, err = tableTree.Search([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Kv{Key: []byte("1"), Value: kv.EncodeInt64(3), Deleted: false}, val)
+	val, res, err = tableTree.Search([]byte("2"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Kv{Key: []byte("2"), Value: kv.EncodeInt64(3), Deleted: false}, val)
+}
+
+func TestTableTree_CompactLevel_Expired(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/op_expired/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	now := time.Unix(100, 0)
+	tt, err := RestoreTableTree(dir, Options{Now: func() time.Time { return now }})
+	assert.Nil(t, err)
+	tableTree := tt.(*TableTree)
+
+	imm := memtable.NewTree("")
+	imm.Put(kv.Kv{Key: []byte("1"), Value: []byte("1"), ExpireAt: time.Unix(101, 0).UnixNano()})
+	imm.Put(kv.Kv{Key: []byte("2"), Value: []byte("1"), ExpireAt: time.Unix(200, 0).UnixNano()})
+	err = tableTree.Insert(imm)
+	assert.Nil(t, err)
+	val, res, err := tableTree.Search([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, time.Unix(101, 0).UnixNano(), val.ExpireAt)
+
+	now = time.Unix(150, 0)
+	_, res, err = tableTree.Search([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Deleted, res)
+
+	// 合并到最底层时过期的key被物理删除
+	err = tableTree.CompactLevel(0)
+	assert.Nil(t, err)
+	mem, err := tableTree.levels[1].table[0].Decode()
+	assert.Nil(t, err)
+	assert.Equal(t, []kv.Kv{{Key: []byte("2"), Value: []byte("1"), ExpireAt: time.Unix(200, 0).UnixNano()}}, mem.GetValues())
+}
+
+func TestTableTree_Ingest(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/ingest/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	tt, err := RestoreTableTree(path.Join(dir, "sst"), Options{})
+	assert.Nil(t, err)
+	tableTree := tt.(*TableTree)
+
+	imm := memtable.NewTree("")
+	imm.Set([]byte("a"), []byte("old"))
+	imm.Set([]byte("b"), []byte("old"))
+	err = tableTree.Insert(imm)
+	assert.Nil(t, err)
+	err = tableTree.CompactLevel(0)
+	assert.Nil(t, err)
+	imm = memtable.NewTree("")
+	imm.Set([]byte("x"), []byte("old"))
+	err = tableTree.Insert(imm)
+	assert.Nil(t, err)
+
+	ingest := func(name string, keys ...string) int {
+		p := path.Join(dir, name)
+		w, err := NewWriter(p, nil)
+		assert.Nil(t, err)
+		for _, key := range keys {
+			assert.Nil(t, w.Set([]byte(key), []byte("new")))
+		}
+		assert.Nil(t, w.Finish())
+		r, err := ReadKeyRange(p, nil)
+		assert.Nil(t, err)
+		level, err := tableTree.Ingest(p, r)
+		assert.Nil(t, err)
+		return level
+	}
+
+	t.Log("case: 和第1层重叠，放入第0层")
+	assert.Equal(t, 0, ingest("1.sst", "b", "c"))
+	t.Log("case: 都不重叠，放入最深的一层")
+	assert.Equal(t, 1, ingest("2.sst", "m", "n"))
+	t.Log("case: 和第0层重叠，放入第0层作为最新的sst")
+	assert.Equal(t, 0, ingest("3.sst", "x"))
+
+	for _, key := range []string{"b", "c", "m", "x"} {
+		k, res, err := tableTree.Search([]byte(key))
+		assert.Nil(t, err)
+		assert.Equal(t, kv.Success, res)
+		assert.Equal(t, []byte("new"), k.Value)
+	}
+	k, _, err := tableTree.Search([]byte("a"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("old"), k.Value)
+
+	// 重启后仍然能读到导入的数据
+	restored, err := RestoreTableTree(path.Join(dir, "sst"), Options{})
+	assert.Nil(t, err)
+	tableTree = restored.(*TableTree)
+	k, _, err = tableTree.Search([]byte("x"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), k.Value)
+	k, _, err = tableTree.Search([]byte("m"))
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("new"), k.Value)
+}
+
+func TestTableTree_Comparator(t *testing.T) {
+	dir := fmt.Sprintf("out/sst/comparator/%v", time.Now().Unix())
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		panic(err)
+	}
+	opts := Options{Comparator: kv.ReverseBytewise{}}
+	restored, err := RestoreTableTree(dir, opts)
+	assert.Nil(t, err)
+	tableTree := restored.(*TableTree)
+	for _, keys := range [][]string{{"1", "3"}, {"2", "4"}} {
+		imm := memtable.NewTreeWithComparator("", opts.Comparator)
+		for _, key := range keys {
+			imm.Set([]byte(key), []byte(key))
+		}
+		err = tableTree.Insert(imm)
+		assert.Nil(t, err)
+	}
+	err = tableTree.CompactLevel(0)
+	assert.Nil(t, err)
+
+	// 合并后的sst按comparator的顺序排列
+	mem, err := tableTree.levels[1].table[0].Decode()
+	assert.Nil(t, err)
+	var keys []string
+	for _, item := range mem.GetValues() {
+		keys = append(keys, string(item.Key))
+	}
+	assert.Equal(t, []string{"4", "3", "2", "1"}, keys)
+	r, ok, err := tableTree.levels[1].table[0].KeyRange()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, KeyRange{Smallest: []byte("4"), Largest: []byte("1")}, r)
+
+	k, res, err := tableTree.Search([]byte("3"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, []byte("3"), k.Value)
+}
+
+func TestRestoreTableTree_UnknownFiles(t *testing.T) {
+	fs := vfs.NewMem()
+	opts := Options{FS: fs}
+	tt, err := RestoreTableTree("sst", opts)
+	assert.Nil(t, err)
+	imm := memtable.NewTree("")
+	imm.Set([]byte("1"), []byte("1"))
+	assert.Nil(t, tt.Insert(imm))
+	assert.Nil(t, tt.Close())
+
+	// 写入sst和Repair中断时残留的临时文件，以及其他无法解析的文件名
+	for _, name := range []string{"0.1.db.tmp", "0.0.db.repair", "0.x.db", "LOG"} {
+		assert.Nil(t, vfs.WriteFile(fs, path.Join("sst", name), []byte("x")))
+	}
+	tt, err = RestoreTableTree("sst", opts)
+	assert.Nil(t, err)
+	assert.Equal(t, []int{1}, tt.Levels())
+	k, res, err := tt.Search([]byte("1"))
+	assert.Nil(t, err)
+	assert.Equal(t, kv.Success, res)
+	assert.Equal(t, []byte("1"), k.Value)
+	names, err := fs.List("sst")
+	assert.Nil(t, err)
+	assert.ElementsMatch(t, []string{"0.0.db", "0.0.db.repair", "0.x.db", "LOG"}, names)
+	assert.Nil(t, tt.Close())
+}
@@ -0,0 +1,188 @@
+package sstable
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+	"lsmtree/vfs"
+)
+
+// Writer 在db之外构建sst，key需要按Comparator从小到大的顺序添加，Finish之后可以通过Db.IngestExternalFiles导入db。
+//
+//	生成的文件和flush、合并产生的sst格式相同
+type Writer struct {
+	f       vfs.File
+	path    string
+	marsher kv.MarshalOp
+	cmp     kv.Comparator
+
+	offset    int64 // 数据区已经写入的长度
+	index     []indexEntry
+	rangeDels []kv.RangeTombstone
+	lastKey   []byte
+	finished  bool
+}
+
+// NewWriter 创建path并写入sst，path不能已经存在。marsher为nil时使用kv.Json，需要和导入的列族的Marshaller一致，
+// key按kv.Bytewise排列
+func NewWriter(path string, marsher kv.MarshalOp) (*Writer, error) {
+	return NewWriterFS(vfs.Default, path, marsher, nil)
+}
+
+// NewWriterFS 在fs上创建path并写入sst，cmp需要和导入的db的Comparator一致，为nil时使用kv.Bytewise
+func NewWriterFS(fs vfs.FS, path string, marsher kv.MarshalOp, cmp kv.Comparator) (*Writer, error) {
+	if marsher == nil {
+		marsher = kv.Json{}
+	}
+	f, err := fs.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return nil, errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	return &Writer{
+		f:       f,
+		path:    path,
+		marsher: marsher,
+		cmp:     kv.OrBytewise(cmp),
+	}, nil
+}
+
+// Add 写入一条记录，key需要比之前添加的key都大。范围删除使用DeleteRange
+func (w *Writer) Add(item kv.Kv) error {
+	if w.finished {
+		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("writer:%v already finished", w.path))
+	}
+	if item.Kind == kv.KindRangeDelete {
+		return errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("use DeleteRange to add range tombstone"))
+	}
+	if len(w.index) > 0 && w.cmp.Compare(item.Key, w.lastKey) <= 0 {
+		return errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("key:%q is not greater than last key:%q", item.Key, w.lastKey))
+	}
+	if item.Deleted {
+		item.Value = nil
+	}
+	data, err := w.marsher.Marshal(item)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("marshal err:%v", err))
+	}
+	err = binary.Write(w.f, binary.LittleEndian, data)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, fmt.Errorf("Write err:%v", err))
+	}
+	key := append([]byte(nil), item.Key...) // 调用方可能复用item.Key
+	w.index = append(w.index, indexEntry{Key: key, Position: Position{
+		Start:    w.offset,
+		Len:      int64(len(data)),
+		Deleted:  item.Deleted,
+		Checksum: crc32.ChecksumIEEE(data),
+	}})
+	w.offset += int64(len(data))
+	w.lastKey = key
+	return nil
+}
+
+func (w *Writer) Set(key []byte, value []byte) error {
+	return w.Add(kv.Kv{Key: key, Value: value})
+}
+
+func (w *Writer) Delete(key []byte) error {
+	return w.Add(kv.Kv{Key: key, Deleted: true})
+}
+
+// DeleteRange 删除[start, end)内比这个sst更旧的数据，不要求顺序
+func (w *Writer) DeleteRange(start, end []byte) error {
+	if w.cmp.Compare(start, end) >= 0 {
+		return errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("start:%q >= end:%q", start, end))
+	}
+	w.rangeDels = append(w.rangeDels, kv.RangeTombstone{Start: start, End: end})
+	return nil
+}
+
+// Finish 写入索引区和元数据，并将文件落盘。没有任何记录时返回错误
+func (w *Writer) Finish() error {
+	if w.finished {
+		return nil
+	}
+	w.finished = true
+	defer w.f.Close()
+	if len(w.index) == 0 && len(w.rangeDels) == 0 {
+		return errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("empty sst:%v", w.path))
+	}
+	err := writeIndex(w.f, w.marsher, w.offset, w.index, w.rangeDels)
+	if err != nil {
+		return err
+	}
+	err = w.f.Sync()
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	return nil
+}
+
+// KeyRange sst中key的范围，包含范围删除覆盖的范围
+type KeyRange struct {
+	Smallest []byte
+	Largest  []byte // 包含在范围内
+}
+
+// Overlaps 按cmp的顺序判断两个范围是否重叠
+func (r KeyRange) Overlaps(o KeyRange, cmp kv.Comparator) bool {
+	return cmp.Compare(r.Smallest, o.Largest) <= 0 && cmp.Compare(o.Smallest, r.Largest) <= 0
+}
+
+// KeyRange 返回sst中key的范围，sst为空时ok为false
+func (s *SsTable) KeyRange() (r KeyRange, ok bool, err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.startPoints == nil {
+		err = s.restoreStartPoints()
+		if err != nil {
+			return KeyRange{}, false, err
+		}
+	}
+	add := func(smallest, largest []byte) {
+		if !ok || s.cmp.Compare(smallest, r.Smallest) < 0 {
+			r.Smallest = smallest
+		}
+		if !ok || s.cmp.Compare(largest, r.Largest) > 0 {
+			r.Largest = largest
+		}
+		ok = true
+	}
+	if n := len(s.startPoints); n > 0 {
+		add(s.startPoints[0].Key, s.startPoints[n-1].Key)
+	}
+	for _, rd := range s.rangeDels {
+		add(rd.Start, rd.End) // End不包含在范围内，这里多算了一个key，不影响重叠判断的正确性
+	}
+	return r, ok, nil
+}
+
+// ReadKeyRange 读取db之外的sst文件按kv.Bytewise排列的key范围，文件损坏或者为空时返回错误
+func ReadKeyRange(path string, marsher kv.MarshalOp) (r KeyRange, err error) {
+	return ReadKeyRangeFS(vfs.Default, path, marsher, nil)
+}
+
+// ReadKeyRangeFS 读取fs上的sst文件按cmp排列的key范围，cmp为nil时使用kv.Bytewise
+func ReadKeyRangeFS(fs vfs.FS, path string, marsher kv.MarshalOp, cmp kv.Comparator) (r KeyRange, err error) {
+	if marsher == nil {
+		marsher = kv.Json{}
+	}
+	_, err = fs.Stat(path)
+	if err != nil {
+		return KeyRange{}, errs.NewErr(errs.ErrCodeSstable, err)
+	}
+	sst := openSst(fs, path, os.O_RDONLY, marsher, cmp)
+	defer sst.f.Close()
+	r, ok, err := sst.KeyRange()
+	if err != nil {
+		return KeyRange{}, err
+	}
+	if !ok {
+		return KeyRange{}, errs.NewErr(errs.ErrCodeInvalidArgument, fmt.Errorf("empty sst:%v", path))
+	}
+	return r, nil
+}
@@ -0,0 +1,411 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"sync"
+)
+
+// ErrInjected FaultFS注入的错误
+var ErrInjected = errors.New("vfs: injected fault")
+
+// Op 可以注入错误的操作
+type Op int
+
+const (
+	OpWrite  Op = iota // File.Write和File.Truncate
+	OpSync             // File.Sync和FS.Sync
+	OpCreate           // 创建文件，包括OpenFile时带O_CREATE
+	OpRename
+	OpRemove // Remove和RemoveAll
+)
+
+// FaultFS 在MemFS上注入故障，用于测试崩溃一致性。
+//
+//	文件的内容只有Sync之后才会在Crash时保留，没有Sync的写入在Crash时丢弃；
+//	创建、重命名、删除文件以及硬链接等目录项的修改，只有对所在的目录调用FS.Sync之后才会在Crash时保留。
+//	目录本身的创建和删除立即生效，Crash时会补上保留下来的文件所在的目录。
+//	可以让指定的操作失败，或者在若干次修改之后模拟进程崩溃：之后所有的操作都返回ErrInjected，直到调用Crash
+type FaultFS struct {
+	mem *MemFS
+
+	lock      sync.Mutex
+	synced    map[*memNode][]byte // 文件最后一次Sync时的内容
+	durable   map[string]*memNode // 所在目录最后一次Sync时的目录项
+	partial   *rand.Rand          // 不为nil时失败的写入和Crash时没有落盘的追加写入会保留随机长度的前缀
+	open      map[*faultFile]struct{}
+	failAt    map[Op]int // 操作再执行多少次时失败一次
+	crashIn   int        // 再执行多少次修改后崩溃，0表示不崩溃
+	crashed   bool
+	mutations int
+}
+
+// NewFault 在mem上注入故障，mem中已有的内容视为已经落盘
+func NewFault(mem *MemFS) *FaultFS {
+	fs := &FaultFS{
+		mem:     mem,
+		synced:  make(map[*memNode][]byte),
+		durable: make(map[string]*memNode),
+		open:    make(map[*faultFile]struct{}),
+		failAt:  make(map[Op]int),
+	}
+	mem.lock.Lock()
+	defer mem.lock.Unlock()
+	for name, node := range mem.files {
+		fs.synced[node] = append([]byte(nil), node.data...)
+		fs.durable[name] = node
+	}
+	return fs
+}
+
+// PartialWrites 模拟写入到一半时失败或者崩溃：注入错误的File.Write会写入p的一个随机长度的前缀后返回ErrInjected；
+// Crash时只在末尾追加、没有Sync的内容保留一个随机长度的前缀，而不是全部丢弃。seed决定随机的长度
+func (fs *FaultFS) PartialWrites(seed int64) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.partial = rand.New(rand.NewSource(seed))
+}
+
+// FailNth 之后第n次(从1开始)执行op时返回ErrInjected，没有调用PartialWrites时失败的写入不会写入任何数据
+func (fs *FaultFS) FailNth(op Op, n int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.failAt[op] = n
+}
+
+// CrashAfter 再执行n次修改(写入、落盘、创建、重命名、删除)后模拟进程崩溃，之后所有的操作都返回ErrInjected
+func (fs *FaultFS) CrashAfter(n int) {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.crashIn = n
+}
+
+// Crashed 是否已经模拟了进程崩溃
+func (fs *FaultFS) Crashed() bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.crashed
+}
+
+// Mutations 已经执行的修改次数，可以用来选择CrashAfter的参数
+func (fs *FaultFS) Mutations() int {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.mutations
+}
+
+// Crash 模拟机器崩溃后重启：丢弃所有没有Sync的写入和目录项的修改，关闭所有打开的文件，释放所有的锁，清除注入的错误
+func (fs *FaultFS) Crash() {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	for f := range fs.open {
+		f.dead = true
+	}
+	fs.open = make(map[*faultFile]struct{})
+	fs.failAt = make(map[Op]int)
+	fs.crashIn = 0
+	fs.crashed = false
+
+	fs.mem.lock.Lock()
+	defer fs.mem.lock.Unlock()
+	files := make(map[string]*memNode, len(fs.durable))
+	restored := make(map[*memNode]struct{})
+	for name, node := range fs.durable {
+		files[name] = node
+		for dir := path.Dir(name); ; dir = path.Dir(dir) {
+			if _, ok := fs.mem.dirs[dir]; ok {
+				break
+			}
+			fs.mem.dirs[dir] = struct{}{}
+		}
+		if _, ok := restored[node]; ok {
+			continue // 硬链接
+		}
+		restored[node] = struct{}{}
+		synced := fs.synced[node]
+		data := append([]byte(nil), synced...)
+		if fs.partial != nil && len(node.data) > len(synced) && string(node.data[:len(synced)]) == string(synced) {
+			unsynced := node.data[len(synced):]
+			data = append(data, unsynced[:fs.partial.Intn(len(unsynced)+1)]...)
+		}
+		node.data = data
+		fs.synced[node] = append([]byte(nil), data...) // 重启后看到的内容就是磁盘上的内容
+	}
+	fs.mem.files = files
+	fs.mem.locks = make(map[string]struct{}) // 进程崩溃时释放所有的锁
+}
+
+// Corrupt 将name在offset处的字节按位取反，已经落盘的内容也会被修改
+func (fs *FaultFS) Corrupt(name string, offset int64) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.mem.lock.Lock()
+	defer fs.mem.lock.Unlock()
+	node, ok := fs.mem.files[path.Clean(name)]
+	if !ok {
+		return &os.PathError{Op: "corrupt", Path: name, Err: os.ErrNotExist}
+	}
+	if offset < 0 || offset >= int64(len(node.data)) {
+		return &os.PathError{Op: "corrupt", Path: name, Err: errors.New("offset out of range")}
+	}
+	node.data[offset] = ^node.data[offset]
+	if data := fs.synced[node]; offset < int64(len(data)) {
+		data[offset] = ^data[offset]
+	}
+	return nil
+}
+
+// 执行一次操作前检查是否需要返回错误。mutation表示操作会修改文件系统
+func (fs *FaultFS) check(op Op, mutation bool) error {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	if fs.crashed {
+		return ErrInjected
+	}
+	if !mutation {
+		return nil
+	}
+	fs.mutations++
+	if fs.crashIn > 0 {
+		fs.crashIn--
+		if fs.crashIn == 0 {
+			fs.crashed = true
+			return ErrInjected
+		}
+	}
+	if n, ok := fs.failAt[op]; ok {
+		if n <= 1 {
+			delete(fs.failAt, op)
+			return ErrInjected
+		}
+		fs.failAt[op] = n - 1
+	}
+	return nil
+}
+
+// 崩溃后只读的操作也失败
+func (fs *FaultFS) checkRead() error {
+	return fs.check(0, false)
+}
+
+func (fs *FaultFS) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *FaultFS) Create(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (fs *FaultFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	var err error
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 {
+		err = fs.check(OpCreate, true)
+	} else {
+		err = fs.checkRead()
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	f, err := fs.mem.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	file := &faultFile{fs: fs, memFile: f.(*memFile)}
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.open[file] = struct{}{}
+	return file, nil
+}
+
+func (fs *FaultFS) Rename(oldname, newname string) error {
+	if err := fs.check(OpRename, true); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return fs.mem.Rename(oldname, newname)
+}
+
+func (fs *FaultFS) Remove(name string) error {
+	if err := fs.check(OpRemove, true); err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return fs.mem.Remove(name)
+}
+
+func (fs *FaultFS) RemoveAll(name string) error {
+	if err := fs.check(OpRemove, true); err != nil {
+		return &os.PathError{Op: "removeall", Path: name, Err: err}
+	}
+	return fs.mem.RemoveAll(name)
+}
+
+func (fs *FaultFS) MkdirAll(dir string, perm os.FileMode) error {
+	if err := fs.check(OpCreate, true); err != nil {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: err}
+	}
+	return fs.mem.MkdirAll(dir, perm)
+}
+
+func (fs *FaultFS) List(dir string) ([]string, error) {
+	if err := fs.checkRead(); err != nil {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: err}
+	}
+	return fs.mem.List(dir)
+}
+
+func (fs *FaultFS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.checkRead(); err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return fs.mem.Stat(name)
+}
+
+func (fs *FaultFS) Link(oldname, newname string) error {
+	if err := fs.check(OpCreate, true); err != nil {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	return fs.mem.Link(oldname, newname)
+}
+
+func (fs *FaultFS) Sync(dir string) error {
+	if err := fs.check(OpSync, true); err != nil {
+		return &os.PathError{Op: "sync", Path: dir, Err: err}
+	}
+	err := fs.mem.Sync(dir)
+	if err != nil {
+		return err
+	}
+	dir = path.Clean(dir)
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	fs.mem.lock.Lock()
+	defer fs.mem.lock.Unlock()
+	for name := range fs.durable {
+		if path.Dir(name) == dir {
+			delete(fs.durable, name)
+		}
+	}
+	for name, node := range fs.mem.files {
+		if path.Dir(name) == dir {
+			fs.durable[name] = node
+		}
+	}
+	return nil
+}
+
+func (fs *FaultFS) Lock(name string) (io.Closer, error) {
+	if err := fs.check(OpCreate, true); err != nil {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: err}
+	}
+	return fs.mem.Lock(name)
+}
+
+// Crash之后dead为true，所有操作都返回os.ErrClosed
+type faultFile struct {
+	fs *FaultFS
+	*memFile
+	dead bool // 由fs.lock保护
+}
+
+func (f *faultFile) check(op Op, mutation bool) error {
+	f.fs.lock.Lock()
+	dead := f.dead
+	f.fs.lock.Unlock()
+	if dead {
+		return os.ErrClosed
+	}
+	err := f.fs.check(op, mutation)
+	if err != nil {
+		return &os.PathError{Op: "fault", Path: f.name, Err: err}
+	}
+	return nil
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.check(0, false); err != nil {
+		return 0, err
+	}
+	return f.memFile.Read(p)
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check(0, false); err != nil {
+		return 0, err
+	}
+	return f.memFile.ReadAt(p, off)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.check(OpWrite, true); err != nil {
+		if n := f.partialLen(len(p)); n > 0 {
+			_, _ = f.memFile.Write(p[:n])
+			return n, err
+		}
+		return 0, err
+	}
+	return f.memFile.Write(p)
+}
+
+// 失败的写入在PartialWrites时写入的长度
+func (f *faultFile) partialLen(n int) int {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if f.dead || f.fs.partial == nil || n == 0 {
+		return 0
+	}
+	return f.fs.partial.Intn(n)
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check(0, false); err != nil {
+		return 0, err
+	}
+	return f.memFile.Seek(offset, whence)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.check(0, false); err != nil {
+		return nil, err
+	}
+	return f.memFile.Stat()
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.check(OpSync, true); err != nil {
+		return err
+	}
+	err := f.memFile.Sync()
+	if err != nil {
+		return err
+	}
+	f.fs.mem.lock.Lock()
+	data := append([]byte(nil), f.node.data...)
+	f.fs.mem.lock.Unlock()
+
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if !f.dead {
+		f.fs.synced[f.node] = data
+	}
+	return nil
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.check(OpWrite, true); err != nil {
+		return err
+	}
+	return f.memFile.Truncate(size)
+}
+
+func (f *faultFile) Close() error {
+	f.fs.lock.Lock()
+	dead := f.dead
+	delete(f.fs.open, f)
+	f.fs.lock.Unlock()
+	if dead {
+		return os.ErrClosed
+	}
+	return f.memFile.Close()
+}
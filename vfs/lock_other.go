@@ -0,0 +1,12 @@
+//go:build !unix && !windows
+
+package vfs
+
+import (
+	"os"
+)
+
+// 其他平台没有可用的文件锁，不阻止其他进程同时打开同一个目录，需要调用方保证只有一个进程写入
+func lockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build unix
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+)
+
+// 进程退出或者文件关闭时，flock会自动释放
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
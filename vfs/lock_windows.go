@@ -0,0 +1,26 @@
+//go:build windows
+
+package vfs
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+)
+
+// 对文件的第一个字节加排他锁，已经被其他进程锁定时立即失败。进程退出或者文件关闭时自动释放
+func lockFile(f *os.File) error {
+	ol := new(syscall.Overlapped)
+	r1, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(ol)))
+	if r1 == 0 {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,403 @@
+package vfs
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MemFS 内存文件系统，所有数据保存在内存中，用于测试。可以并发使用。
+//
+//	和操作系统一样，创建文件时父目录需要存在；删除或者重命名后，已经打开的文件仍然可以读写原来的内容
+type MemFS struct {
+	lock  sync.Mutex
+	files map[string]*memNode
+	dirs  map[string]struct{}
+	locks map[string]struct{}
+	open  int // 没有关闭的文件个数
+}
+
+type memNode struct {
+	data    []byte
+	modTime time.Time
+}
+
+// NewMem 创建一个只有根目录的内存文件系统
+func NewMem() *MemFS {
+	return &MemFS{
+		files: make(map[string]*memNode),
+		dirs:  map[string]struct{}{".": {}, "/": {}},
+		locks: make(map[string]struct{}),
+	}
+}
+
+func (m *MemFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *MemFS) Create(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+}
+
+func (m *MemFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = path.Clean(name)
+	if _, ok := m.dirs[name]; ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	}
+	node, ok := m.files[name]
+	switch {
+	case ok && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if _, ok := m.dirs[path.Dir(name)]; !ok {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		node = &memNode{modTime: time.Now()}
+		m.files[name] = node
+	}
+	if flag&os.O_TRUNC != 0 {
+		node.data = nil
+	}
+	m.open++
+	return &memFile{fs: m, name: name, node: node, flag: flag}, nil
+}
+
+// OpenFiles 返回还没有关闭的文件个数，用于检查是否泄漏了文件句柄
+func (m *MemFS) OpenFiles() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.open
+}
+
+func (m *MemFS) Rename(oldname, newname string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	node, ok := m.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := m.dirs[path.Dir(newname)]; !ok {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	delete(m.files, oldname)
+	m.files[newname] = node
+	return nil
+}
+
+func (m *MemFS) Remove(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = path.Clean(name)
+	if _, ok := m.files[name]; ok {
+		delete(m.files, name)
+		return nil
+	}
+	if _, ok := m.dirs[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	if len(m.children(name)) > 0 {
+		return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+	}
+	delete(m.dirs, name)
+	return nil
+}
+
+func (m *MemFS) RemoveAll(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = path.Clean(name)
+	prefix := name + "/"
+	delete(m.files, name)
+	delete(m.dirs, name)
+	for file := range m.files {
+		if strings.HasPrefix(file, prefix) {
+			delete(m.files, file)
+		}
+	}
+	for dir := range m.dirs {
+		if strings.HasPrefix(dir, prefix) {
+			delete(m.dirs, dir)
+		}
+	}
+	return nil
+}
+
+func (m *MemFS) MkdirAll(dir string, perm os.FileMode) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for dir = path.Clean(dir); ; dir = path.Dir(dir) {
+		if _, ok := m.files[dir]; ok {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: errors.New("not a directory")}
+		}
+		if _, ok := m.dirs[dir]; ok {
+			return nil
+		}
+		m.dirs[dir] = struct{}{}
+	}
+}
+
+func (m *MemFS) List(dir string) ([]string, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	dir = path.Clean(dir)
+	if _, ok := m.dirs[dir]; !ok {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	names := m.children(dir)
+	sort.Strings(names)
+	return names, nil
+}
+
+// dir下直接包含的文件和目录。调用方需要持有m.lock
+func (m *MemFS) children(dir string) []string {
+	var names []string
+	for file := range m.files {
+		if path.Dir(file) == dir {
+			names = append(names, path.Base(file))
+		}
+	}
+	for d := range m.dirs {
+		if d != dir && path.Dir(d) == dir {
+			names = append(names, path.Base(d))
+		}
+	}
+	return names
+}
+
+func (m *MemFS) Stat(name string) (os.FileInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = path.Clean(name)
+	if node, ok := m.files[name]; ok {
+		return memFileInfo{name: path.Base(name), size: int64(len(node.data)), modTime: node.modTime}, nil
+	}
+	if _, ok := m.dirs[name]; ok {
+		return memFileInfo{name: path.Base(name), dir: true}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (m *MemFS) Link(oldname, newname string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	oldname, newname = path.Clean(oldname), path.Clean(newname)
+	node, ok := m.files[oldname]
+	if !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	if _, ok := m.files[newname]; ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrExist}
+	}
+	if _, ok := m.dirs[path.Dir(newname)]; !ok {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: os.ErrNotExist}
+	}
+	m.files[newname] = node
+	return nil
+}
+
+func (m *MemFS) Sync(dir string) error {
+	_, err := m.Stat(dir)
+	return err
+}
+
+func (m *MemFS) Lock(name string) (io.Closer, error) {
+	f, err := m.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	name = path.Clean(name)
+	if _, ok := m.locks[name]; ok {
+		return nil, &os.PathError{Op: "lock", Path: name, Err: errors.New("resource temporarily unavailable")}
+	}
+	m.locks[name] = struct{}{}
+	return &memLock{fs: m, name: name}, nil
+}
+
+type memLock struct {
+	fs   *MemFS
+	name string
+	once sync.Once
+}
+
+func (l *memLock) Close() error {
+	l.once.Do(func() {
+		l.fs.lock.Lock()
+		defer l.fs.lock.Unlock()
+		delete(l.fs.locks, l.name)
+	})
+	return nil
+}
+
+type memFile struct {
+	fs     *MemFS
+	name   string
+	node   *memNode
+	flag   int
+	pos    int64
+	closed bool
+}
+
+func (f *memFile) check(write bool) error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	readOnly := f.flag&(os.O_WRONLY|os.O_RDWR) == 0
+	writeOnly := f.flag&os.O_WRONLY != 0
+	if (write && readOnly) || (!write && writeOnly) {
+		return &os.PathError{Op: "access", Path: f.name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	if f.pos >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[f.pos:])
+	f.pos += int64(n)
+	return n, nil
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if err := f.check(false); err != nil {
+		return 0, err
+	}
+	if off < 0 {
+		return 0, &os.PathError{Op: "readat", Path: f.name, Err: errors.New("negative offset")}
+	}
+	if off >= int64(len(f.node.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.node.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if err := f.check(true); err != nil {
+		return 0, err
+	}
+	if f.flag&os.O_APPEND != 0 {
+		f.pos = int64(len(f.node.data))
+	}
+	if end := f.pos + int64(len(p)); end > int64(len(f.node.data)) {
+		data := make([]byte, end)
+		copy(data, f.node.data)
+		f.node.data = data
+	}
+	copy(f.node.data[f.pos:], p)
+	f.pos += int64(len(p))
+	f.node.modTime = time.Now()
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.pos
+	case io.SeekEnd:
+		offset += int64(len(f.node.data))
+	default:
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("invalid whence")}
+	}
+	if offset < 0 {
+		return 0, &os.PathError{Op: "seek", Path: f.name, Err: errors.New("negative offset")}
+	}
+	f.pos = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if err := f.check(true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return &os.PathError{Op: "truncate", Path: f.name, Err: errors.New("negative size")}
+	}
+	data := make([]byte, size)
+	copy(data, f.node.data)
+	f.node.data = data
+	f.node.modTime = time.Now()
+	return nil
+}
+
+func (f *memFile) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	f.fs.open--
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if f.closed {
+		return os.ErrClosed
+	}
+	return nil
+}
+
+func (f *memFile) Stat() (os.FileInfo, error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+	if f.closed {
+		return nil, os.ErrClosed
+	}
+	return memFileInfo{name: path.Base(f.name), size: int64(len(f.node.data)), modTime: f.node.modTime}, nil
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	dir     bool
+	modTime time.Time
+}
+
+func (i memFileInfo) Name() string       { return i.name }
+func (i memFileInfo) Size() int64        { return i.size }
+func (i memFileInfo) ModTime() time.Time { return i.modTime }
+func (i memFileInfo) IsDir() bool        { return i.dir }
+func (i memFileInfo) Sys() any           { return nil }
+
+func (i memFileInfo) Mode() os.FileMode {
+	if i.dir {
+		return os.ModeDir | 0755
+	}
+	return 0666
+}
@@ -0,0 +1,75 @@
+package vfs
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+type osFS struct{}
+
+func (osFS) Open(name string) (File, error) {
+	return os.Open(name)
+}
+
+func (osFS) Create(name string) (File, error) {
+	return os.Create(name)
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Rename(oldname, newname string) error {
+	return os.Rename(oldname, newname)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) RemoveAll(name string) error {
+	return os.RemoveAll(name)
+}
+
+func (osFS) MkdirAll(dir string, perm os.FileMode) error {
+	return os.MkdirAll(dir, perm)
+}
+
+func (osFS) List(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) Sync(dir string) error {
+	return syncDir(dir)
+}
+
+func (osFS) Lock(name string) (io.Closer, error) {
+	f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = lockFile(f)
+	if err != nil {
+		f.Close()
+		return nil, &os.PathError{Op: "lock", Path: name, Err: err}
+	}
+	return f, nil // 关闭文件时释放锁
+}
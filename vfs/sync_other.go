@@ -0,0 +1,16 @@
+//go:build !windows
+
+package vfs
+
+import (
+	"os"
+)
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return f.Sync()
+}
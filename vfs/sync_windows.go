@@ -0,0 +1,13 @@
+//go:build windows
+
+package vfs
+
+import (
+	"os"
+)
+
+// windows不能对目录调用FlushFileBuffers，NTFS的目录修改由文件系统的日志保证，只检查目录存在
+func syncDir(dir string) error {
+	_, err := os.Stat(dir)
+	return err
+}
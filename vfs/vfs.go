@@ -0,0 +1,73 @@
+// Package vfs 文件系统的抽象。wal、sstable和db的所有文件操作都通过FS进行，
+// 默认使用操作系统的文件系统Default，测试时可以使用NewMem创建的内存文件系统。
+package vfs
+
+import (
+	"io"
+	"os"
+)
+
+// File 打开的文件，*os.File实现了这个接口
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Writer
+	io.Seeker
+	io.Closer
+	Sync() error
+	Stat() (os.FileInfo, error)
+	Truncate(size int64) error // 修改文件大小，不改变读写位置
+}
+
+// FS 文件系统。路径使用/分隔，错误和os包一致，可以使用os.IsNotExist、os.IsExist判断
+type FS interface {
+	Open(name string) (File, error)   // 只读打开
+	Create(name string) (File, error) // 创建或者清空文件，读写打开
+	// OpenFile 和os.OpenFile相同，支持O_RDONLY、O_WRONLY、O_RDWR、O_APPEND、O_CREATE、O_EXCL、O_TRUNC
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	RemoveAll(name string) error
+	MkdirAll(dir string, perm os.FileMode) error
+	List(dir string) ([]string, error) // dir下的文件和目录的名称，按名称排序
+	Stat(name string) (os.FileInfo, error)
+	Link(oldname, newname string) error // 硬链接，不支持时返回错误
+	Sync(dir string) error              // 将目录的修改(创建、重命名、删除文件)落盘
+	// Lock 获取name上的排他锁，文件不存在时创建。已经被锁定时返回错误，Close释放锁
+	Lock(name string) (io.Closer, error)
+}
+
+// Default 操作系统的文件系统
+var Default FS = osFS{}
+
+// ReadFile 读取整个文件
+func ReadFile(fs FS, name string) ([]byte, error) {
+	f, err := fs.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// WriteFile 创建或者清空文件，写入data后落盘
+func WriteFile(fs FS, name string, data []byte) error {
+	f, err := fs.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// Exists name是否存在
+func Exists(fs FS, name string) bool {
+	_, err := fs.Stat(name)
+	return err == nil
+}
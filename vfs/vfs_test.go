@@ -0,0 +1,188 @@
+package vfs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemFS(t *testing.T) {
+	fs := NewMem()
+	_, err := fs.Create("a/1.db")
+	assert.True(t, os.IsNotExist(err)) // 父目录不存在
+
+	assert.Nil(t, fs.MkdirAll("a/b", 0755))
+	assert.Nil(t, WriteFile(fs, "a/1.db", []byte("123")))
+	f, err := fs.OpenFile("a/1.db", os.O_RDWR|os.O_APPEND, 0666)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("45"))
+	assert.Nil(t, err)
+	_, err = f.Seek(1, io.SeekStart)
+	assert.Nil(t, err)
+	data, err := io.ReadAll(f)
+	assert.Nil(t, err)
+	assert.Equal(t, "2345", string(data))
+
+	_, err = fs.OpenFile("a/1.db", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	assert.True(t, os.IsExist(err))
+	names, err := fs.List("a")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.db", "b"}, names)
+
+	// 重命名后已经打开的文件仍然可以读取
+	assert.Nil(t, fs.Rename("a/1.db", "a/b/2.db"))
+	assert.False(t, Exists(fs, "a/1.db"))
+	buf := make([]byte, 2)
+	_, err = f.ReadAt(buf, 0)
+	assert.Nil(t, err)
+	assert.Equal(t, "12", string(buf))
+	assert.Equal(t, 1, fs.OpenFiles())
+	assert.Nil(t, f.Close())
+	assert.Equal(t, os.ErrClosed, f.Close())
+	assert.Equal(t, 0, fs.OpenFiles())
+
+	assert.Nil(t, fs.Link("a/b/2.db", "a/3.db"))
+	data, err = ReadFile(fs, "a/3.db")
+	assert.Nil(t, err)
+	assert.Equal(t, "12345", string(data))
+
+	assert.NotNil(t, fs.Remove("a"))
+	assert.Nil(t, fs.RemoveAll("a"))
+	_, err = fs.Stat("a/3.db")
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.List("a")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func testLock(t *testing.T, fs FS, name string) {
+	l, err := fs.Lock(name)
+	assert.Nil(t, err)
+	_, err = fs.Lock(name)
+	assert.NotNil(t, err)
+	assert.Nil(t, l.Close())
+	l, err = fs.Lock(name)
+	assert.Nil(t, err)
+	assert.Nil(t, l.Close())
+}
+
+func TestLock(t *testing.T) {
+	testLock(t, NewMem(), "LOCK")
+
+	dir := fmt.Sprintf("out/lock/%v", time.Now().UnixNano())
+	assert.Nil(t, Default.MkdirAll(dir, 0755))
+	testLock(t, Default, dir+"/LOCK")
+}
+
+func TestFaultFS(t *testing.T) {
+	fs := NewFault(NewMem())
+	f, err := fs.Create("1.log")
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("12"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+	_, err = f.Write([]byte("34"))
+	assert.Nil(t, err)
+	assert.Nil(t, WriteFile(fs, "2.log", []byte("ab")))
+	assert.Nil(t, fs.Sync("."))
+
+	t.Log("case: 注入写入和落盘失败")
+	fs.FailNth(OpWrite, 2)
+	_, err = f.Write([]byte("5"))
+	assert.Nil(t, err)
+	_, err = f.Write([]byte("6"))
+	assert.ErrorIs(t, err, ErrInjected)
+	fs.FailNth(OpSync, 1)
+	assert.ErrorIs(t, f.Sync(), ErrInjected)
+	data, err := ReadFile(fs, "1.log")
+	assert.Nil(t, err)
+	assert.Equal(t, "12345", string(data))
+
+	t.Log("case: 崩溃后丢弃没有落盘的写入")
+	fs.CrashAfter(2)
+	_, err = f.Write([]byte("7"))
+	assert.Nil(t, err)
+	assert.ErrorIs(t, fs.Rename("2.log", "3.log"), ErrInjected)
+	assert.True(t, fs.Crashed())
+	_, err = fs.Stat("2.log")
+	assert.ErrorIs(t, err, ErrInjected)
+	fs.Crash()
+	assert.False(t, fs.Crashed())
+	_, err = f.Write([]byte("8"))
+	assert.Equal(t, os.ErrClosed, err)
+	data, err = ReadFile(fs, "1.log")
+	assert.Nil(t, err)
+	assert.Equal(t, "12", string(data))
+	data, err = ReadFile(fs, "2.log")
+	assert.Nil(t, err)
+	assert.Equal(t, "ab", string(data))
+
+	t.Log("case: 损坏已经落盘的内容")
+	assert.Nil(t, fs.Corrupt("2.log", 1))
+	fs.Crash()
+	data, err = ReadFile(fs, "2.log")
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{'a', ^byte('b')}, data)
+	assert.True(t, os.IsNotExist(fs.Corrupt("3.log", 0)))
+}
+
+func TestFaultFS_Namespace(t *testing.T) {
+	fs := NewFault(NewMem())
+	assert.Nil(t, fs.MkdirAll("dir", 0755))
+	assert.Nil(t, WriteFile(fs, "dir/1.log", []byte("1")))
+	assert.Nil(t, fs.Sync("dir"))
+	assert.Nil(t, WriteFile(fs, "dir/2.log", []byte("2")))
+	assert.Nil(t, fs.Rename("dir/1.log", "dir/3.log"))
+
+	t.Log("case: 目录没有落盘时创建和重命名都会丢失")
+	fs.Crash()
+	names, err := fs.List("dir")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.log"}, names)
+
+	t.Log("case: 目录落盘后保留")
+	assert.Nil(t, fs.Rename("dir/1.log", "dir/3.log"))
+	assert.Nil(t, fs.Sync("dir"))
+	assert.Nil(t, fs.RemoveAll("dir"))
+	fs.Crash()
+	data, err := ReadFile(fs, "dir/3.log")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(data))
+}
+
+func TestFaultFS_PartialWrites(t *testing.T) {
+	fs := NewFault(NewMem())
+	fs.PartialWrites(1)
+	f, err := fs.Create("1.log")
+	assert.Nil(t, err)
+	assert.Nil(t, fs.Sync("."))
+	_, err = f.Write([]byte("12"))
+	assert.Nil(t, err)
+	assert.Nil(t, f.Sync())
+
+	t.Log("case: 失败的写入留下一个前缀")
+	data := bytes.Repeat([]byte("x"), 100)
+	fs.FailNth(OpWrite, 1)
+	n, err := f.Write(data)
+	assert.ErrorIs(t, err, ErrInjected)
+	assert.True(t, n < len(data))
+	info, err := f.Stat()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2+n), info.Size())
+	assert.Nil(t, f.Truncate(2))
+	_, err = f.Seek(2, io.SeekStart)
+	assert.Nil(t, err)
+
+	t.Log("case: 崩溃时没有落盘的追加写入保留一个前缀")
+	_, err = f.Write(data)
+	assert.Nil(t, err)
+	fs.Crash()
+	got, err := ReadFile(fs, "1.log")
+	assert.Nil(t, err)
+	assert.True(t, len(got) >= 2 && len(got) <= 102)
+	assert.True(t, bytes.HasPrefix(append([]byte("12"), data...), got))
+}
@@ -0,0 +1,225 @@
+package wal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"lsmtree/errs"
+	"lsmtree/kv"
+	"lsmtree/vfs"
+)
+
+// 长度前缀中的标记位，表示长度之后有4字节的crc32校验和。没有标记的是旧版本写入的记录
+const recordChecksumFlag = int64(1) << 62
+
+// 长度前缀中的标记位，表示记录中的key为[]byte。没有标记的记录key为string，按legacyRecord解码
+const recordBytesKeyFlag = int64(1) << 61
+
+// key为string时的Record，用于读取之前版本写入的wal
+type legacyRecord struct {
+	kv.LegacyKv
+	CF    int            `json:",omitempty"`
+	Batch []legacyRecord `json:",omitempty"`
+}
+
+func (r legacyRecord) record() Record {
+	rec := Record{Kv: r.Kv(), CF: r.CF}
+	for _, item := range r.Batch {
+		rec.Batch = append(rec.Batch, item.record())
+	}
+	return rec
+}
+
+// 依次解码data中的每条记录，格式为[int64记录data长度|recordChecksumFlag|recordBytesKeyFlag, uint32校验和, data]。
+// 返回最后一条完整记录的结束位置，遇到不完整、校验和不一致或者无法解码的记录时停止并返回错误
+func readRecords(data []byte, marsher kv.MarshalOp, fn func(offset int64, rec Record)) (int64, error) {
+	size := int64(len(data))
+	index := int64(0)
+	for index < size {
+		if size-index < 8 {
+			return index, errs.NewErr(errs.ErrCodeWal, fmt.Errorf("offset:%v truncated length, %v bytes left", index, size-index))
+		}
+		dataLen := int64(binary.LittleEndian.Uint64(data[index : index+8]))
+		header := int64(8)
+		checked := dataLen > 0 && dataLen&recordChecksumFlag != 0
+		bytesKey := checked && dataLen&recordBytesKeyFlag != 0
+		if checked {
+			dataLen &^= recordChecksumFlag | recordBytesKeyFlag
+			header += 4
+		}
+		if dataLen < 0 || dataLen > size-index-header {
+			return index, errs.NewErr(errs.ErrCodeWal, fmt.Errorf("offset:%v truncated record, length:%v, %v bytes left", index, dataLen, size-index-8))
+		}
+		item := data[index+header : index+header+dataLen]
+		if checked && crc32.ChecksumIEEE(item) != binary.LittleEndian.Uint32(data[index+8:index+12]) {
+			return index, errs.NewErr(errs.ErrCodeChecksum, fmt.Errorf("offset:%v checksum mismatch", index))
+		}
+		rec, err := unmarshalRecord(marsher, item, bytesKey)
+		if err != nil {
+			return index, errs.NewErr(errs.ErrCodeWal, fmt.Errorf("offset:%v unmarshal err:%v", index, err))
+		}
+		fn(index, rec)
+		index += header + dataLen
+	}
+	return index, nil
+}
+
+// valid之后的内容是否只是写入时崩溃留下的末尾：长度前缀不完整、记录超出文件末尾、损坏的记录恰好是最后一条，
+// 或者只有文件系统补上的0。返回false时valid之后还有其他记录，说明文件中间损坏
+func tornTail(data []byte, valid int64) bool {
+	rest := data[valid:]
+	if len(rest) < 8 || bytes.Count(rest, []byte{0}) == len(rest) {
+		return true
+	}
+	dataLen := int64(binary.LittleEndian.Uint64(rest[:8]))
+	header := int64(8)
+	if dataLen > 0 && dataLen&recordChecksumFlag != 0 {
+		dataLen &^= recordChecksumFlag | recordBytesKeyFlag
+		header += 4
+	}
+	return dataLen < 0 || header+dataLen >= int64(len(rest))
+}
+
+// valid之后第一条完整并且校验和一致的记录的位置，没有时返回-1。
+// 长度前缀损坏时tornTail会把它当成超出文件末尾的记录，需要向后查找确认后面没有其他记录，只能找到带校验和的记录
+func nextRecord(data []byte, valid int64) int64 {
+	size := int64(len(data))
+	for i := valid + 1; i+12 <= size; i++ {
+		dataLen := int64(binary.LittleEndian.Uint64(data[i : i+8]))
+		if dataLen <= 0 || dataLen&recordChecksumFlag == 0 {
+			continue
+		}
+		dataLen &^= recordChecksumFlag | recordBytesKeyFlag
+		if dataLen == 0 || dataLen > size-i-12 {
+			continue
+		}
+		if crc32.ChecksumIEEE(data[i+12:i+12+dataLen]) == binary.LittleEndian.Uint32(data[i+8:i+12]) {
+			return i
+		}
+	}
+	return -1
+}
+
+func unmarshalRecord(marsher kv.MarshalOp, data []byte, bytesKey bool) (Record, error) {
+	if bytesKey {
+		var rec Record
+		err := marsher.Unmarshal(data, &rec)
+		return rec, err
+	}
+	var rec legacyRecord
+	err := marsher.Unmarshal(data, &rec)
+	return rec.record(), err
+}
+
+// FileInfo 一个wal文件解码后的内容，用于排查问题
+type FileInfo struct {
+	Path    string
+	Size    int64
+	Records []RecordInfo
+	Valid   int64  // 完整记录的结束位置，小于Size时说明文件末尾损坏
+	Err     string // 末尾损坏的原因
+}
+
+// RecordInfo wal中的一条记录和它在文件中的位置
+type RecordInfo struct {
+	Offset int64 // 长度前缀的位置
+	Record Record
+}
+
+// ReadFile 解码file上的wal文件。和恢复时不同，文件末尾损坏时不会panic，而是记录在FileInfo.Err中
+func ReadFile(file string, marsher kv.MarshalOp) (FileInfo, error) {
+	return ReadFileFS(vfs.Default, file, marsher)
+}
+
+// ReadFileFS 解码fs上的wal文件
+func ReadFileFS(fs vfs.FS, file string, marsher kv.MarshalOp) (FileInfo, error) {
+	if marsher == nil {
+		marsher = kv.Json{}
+	}
+	data, err := vfs.ReadFile(fs, file)
+	if err != nil {
+		return FileInfo{}, errs.NewErr(errs.ErrCodeWal, err)
+	}
+	info := FileInfo{Path: file, Size: int64(len(data))}
+	info.Valid, err = readRecords(data, marsher, func(offset int64, rec Record) {
+		info.Records = append(info.Records, RecordInfo{Offset: offset, Record: rec})
+	})
+	if err != nil {
+		info.Err = err.Error()
+	}
+	return info, nil
+}
+
+// WriteFile 将记录写入一个新的wal文件，file不能已经存在。用于导出损坏的wal中完整的记录
+func WriteFile(file string, records []Record, marsher kv.MarshalOp) error {
+	return WriteFileFS(vfs.Default, file, records, marsher)
+}
+
+// WriteFileFS 将记录写入fs上一个新的wal文件
+func WriteFileFS(fs vfs.FS, file string, records []Record, marsher kv.MarshalOp) error {
+	if marsher == nil {
+		marsher = kv.Json{}
+	}
+	f, err := fs.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeWal, err)
+	}
+	defer f.Close()
+	w := &Wal{f: f, path: file, marsher: marsher, fs: fs}
+	w.lock = &sync.Mutex{}
+	for _, rec := range records {
+		err = w.WriteRecord(rec)
+		if err != nil {
+			return err
+		}
+	}
+	err = f.Sync()
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeWal, err)
+	}
+	return nil
+}
+
+// ListFiles 返回dir下的wal文件，按序号从小到大排序
+func ListFiles(dir string) ([]string, error) {
+	return ListFilesFS(vfs.Default, dir)
+}
+
+// ListFilesFS 返回fs上dir下的wal文件，按序号从小到大排序
+func ListFilesFS(fs vfs.FS, dir string) ([]string, error) {
+	files, err := fs.List(dir)
+	if err != nil {
+		return nil, errs.NewErr(errs.ErrCodeWal, err)
+	}
+	type item struct {
+		index int
+		name  string
+	}
+	var list []item
+	for _, name := range files {
+		if !strings.HasSuffix(name, walFileSuffix) {
+			continue
+		}
+		index, err := strconv.Atoi(strings.TrimSuffix(name, walFileSuffix))
+		if err != nil {
+			continue
+		}
+		list = append(list, item{index: index, name: name})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].index < list[j].index
+	})
+	var paths []string
+	for _, i := range list {
+		paths = append(paths, path.Join(dir, i.name))
+	}
+	return paths, nil
+}
@@ -1,10 +1,10 @@
 package wal
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"hash/crc32"
+	"io"
 	"os"
 	"path"
 	"strconv"
@@ -14,7 +14,9 @@ import (
 
 	"lsmtree/errs"
 	"lsmtree/kv"
+	"lsmtree/logger"
 	"lsmtree/memtable"
+	"lsmtree/vfs"
 )
 
 /*
@@ -26,18 +28,49 @@ WAL 需要具备两种能力：
 */
 
 type Wal struct {
-	f    *os.File // memtable的wal
+	f    vfs.File // memtable的wal
 	path string   // memtable的wal
 	dir  string
 	lock *sync.Mutex
 
-	marsher kv.MarshalOp
+	marsher  kv.MarshalOp
+	logger   logger.Logger
+	fs       vfs.FS
+	cmp      kv.Comparator
+	sync     bool
+	readOnly bool
+	broken   error // 写入失败后没能去掉已经写入的部分，之后的记录会跟在损坏的记录后面，不能再写入
+}
+
+// Options Wal的配置
+type Options struct {
+	FS     vfs.FS        // wal所在的文件系统，默认为vfs.Default
+	Logger logger.Logger // 为nil时不输出日志
+	Sync   bool          // 每条记录写入后落盘
+
+	Comparator kv.Comparator // 恢复的memtable中key的顺序，默认为kv.Bytewise
+
+	// 只读打开，用于读取其他进程正在写入的wal：恢复时不创建目录和wal文件，也不保留文件句柄，不能写入。
+	// 最新的wal末尾不完整的记录会被忽略，这条记录可能还在写入
+	ReadOnly bool
 }
 
 func New() *Wal {
+	return NewWithOptions(Options{})
+}
+
+func NewWithOptions(opts Options) *Wal {
 	w := &Wal{}
 	w.lock = &sync.Mutex{}
 	w.marsher = kv.Json{}
+	w.logger = logger.OrNop(opts.Logger)
+	w.fs = opts.FS
+	w.cmp = kv.OrBytewise(opts.Comparator)
+	w.sync = opts.Sync
+	w.readOnly = opts.ReadOnly
+	if w.fs == nil {
+		w.fs = vfs.Default
+	}
 	return w
 }
 
@@ -45,28 +78,70 @@ func (w *Wal) GetPath() string {
 	return w.path
 }
 
+// Record wal中的一条记录。只有默认列族的单个操作时，序列化后和kv.Kv一致
+type Record struct {
+	kv.Kv
+	CF    int      `json:",omitempty"` // 列族id，默认列族为0
+	Batch []Record `json:",omitempty"` // 批量写入的所有操作放在一条记录中，保证恢复时的原子性
+}
+
 // Write 将kv写入wal
 func (w *Wal) Write(val kv.Kv) error {
+	return w.WriteRecord(Record{Kv: val})
+}
+
+// WriteRecord 将一条记录写入wal
+func (w *Wal) WriteRecord(rec Record) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
+	if w.readOnly {
+		return errs.NewErr(errs.ErrCodeReadOnly, fmt.Errorf("wal:%v opened read-only", w.dir))
+	}
+	if w.f == nil {
+		return errs.NewErr(errs.ErrCodeWal, fmt.Errorf("wal:%v closed", w.path))
+	}
+	if w.broken != nil {
+		return errs.NewErr(errs.ErrCodeWal, fmt.Errorf("wal:%v broken by previous write err:%v", w.path, w.broken))
+	}
 
-	data, err := w.marsher.Marshal(val)
+	data, err := w.marsher.Marshal(rec)
 	if err != nil {
 		return errs.NewErr(errs.ErrCodeWal, fmt.Errorf("err:%v", err))
 	}
 
-	//先写入一个 8 字节，再将 Key/Value 序列化写入。
-	// [int64记录data长度, data]
-	err = binary.Write(w.f, binary.LittleEndian, int64(len(data)))
+	//先写入一个 8 字节，再写入data的校验和，最后将 Key/Value 序列化写入。
+	// [int64记录data长度|recordChecksumFlag|recordBytesKeyFlag, uint32 crc32(data), data]
+	// 整条记录一次写入，写入失败时截断已经写入的部分，不会在文件中间留下不完整的记录
+	buf := make([]byte, 12, 12+len(data))
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(int64(len(data))|recordChecksumFlag|recordBytesKeyFlag))
+	binary.LittleEndian.PutUint32(buf[8:12], crc32.ChecksumIEEE(data))
+	buf = append(buf, data...)
+	n, err := w.f.Write(buf)
 	if err != nil {
+		if n > 0 {
+			w.truncateWritten(int64(n))
+		}
 		return errs.NewErr(errs.ErrCodeWal, fmt.Errorf("err:%v", err))
 	}
+	if w.sync {
+		err = w.f.Sync()
+		if err != nil {
+			return errs.NewErr(errs.ErrCodeWal, fmt.Errorf("sync err:%v", err))
+		}
+	}
+	return nil
+}
 
-	err = binary.Write(w.f, binary.LittleEndian, data)
+// 去掉写入失败的记录已经写入的n个字节，失败时标记wal不可再写入。调用方需要持有w.lock
+func (w *Wal) truncateWritten(n int64) {
+	info, err := w.f.Stat()
+	if err == nil {
+		err = w.f.Truncate(info.Size() - n)
+	}
 	if err != nil {
-		return errs.NewErr(errs.ErrCodeWal, fmt.Errorf("err:%v", err))
+		w.broken = err
+		w.logger.Error("truncate failed wal record", "file", w.path, "err", err)
 	}
-	return nil
 }
 
 const walFileSuffix = ".wal.log" // wal文件最大的序号为memtable的wal，其余的为
@@ -75,29 +150,40 @@ const walFileSuffix = ".wal.log" // wal文件最大的序号为memtable的wal，
 func (w *Wal) initMemtable(dir string) memtable.MemtableOp {
 	start := time.Now()
 	defer func() {
-		log.Println("Load wal cost:", time.Since(start))
+		w.logger.Debug("load wal", "file", w.path, "duration", time.Since(start))
 	}()
+	w.open(dir)
+	return w.loadToMemory()
+}
+
+// 打开memtable的wal文件，后续的写入都追加到这个文件
+func (w *Wal) open(dir string) {
 	//如果目录不存在，创建目录
-	err := os.MkdirAll(dir, 0755)
+	err := w.fs.MkdirAll(dir, 0755)
 	if err != nil {
 		panic(err)
 	}
 	// 获取这个目录下最大序号的文件
-	walFileName := getMemtableFileName(dir)
+	walFileName := getMemtableFileName(w.fs, dir)
 
 	walPath := path.Join(dir, walFileName)
-	f, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	f, err := w.fs.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		panic(err)
+	}
+	// 新创建的wal需要目录落盘后才能在崩溃后保留
+	err = w.fs.Sync(dir)
 	if err != nil {
+		f.Close()
 		panic(err)
 	}
 	w.dir = dir
 	w.f = f
 	w.path = walPath
-	return w.loadToMemory()
 }
 
-func getMemtableFileName(dir string) string {
-	files, err := os.ReadDir(dir)
+func getMemtableFileName(fs vfs.FS, dir string) string {
+	files, err := fs.List(dir)
 	if err != nil {
 		panic(err)
 	}
@@ -107,15 +193,24 @@ func getMemtableFileName(dir string) string {
 	}
 	memtableFile := files[0]
 	for i := 1; i < len(files); i++ {
-		if memtableFile.Name() < files[i].Name() {
+		if fileIndex(memtableFile) < fileIndex(files[i]) { // 按字符串比较时9.wal.log比10.wal.log大
 			memtableFile = files[i]
 		}
 	}
-	return memtableFile.Name()
+	return memtableFile
 }
 
-func getImmemtableFileNames(dir string) []string {
-	memtableFileName := getMemtableFileName(dir)
+// wal文件名中的序号，不是wal文件时返回-1
+func fileIndex(name string) int {
+	index, err := strconv.Atoi(strings.TrimSuffix(name, walFileSuffix))
+	if err != nil || !strings.HasSuffix(name, walFileSuffix) {
+		return -1
+	}
+	return index
+}
+
+func getImmemtableFileNames(fs vfs.FS, dir string) []string {
+	memtableFileName := getMemtableFileName(fs, dir)
 	memtableIndex := strings.ReplaceAll(memtableFileName, walFileSuffix, "")
 	_memtableIndex, err := strconv.Atoi(memtableIndex)
 	if err != nil {
@@ -125,7 +220,7 @@ func getImmemtableFileNames(dir string) []string {
 	// 检查是否存在_memtableIndex-1的文件
 	for i := _memtableIndex - 1; i > 0; i-- {
 		filename := fmt.Sprintf("%v%v", i, walFileSuffix)
-		_, err := os.Stat(path.Join(dir, filename))
+		_, err := fs.Stat(path.Join(dir, filename))
 		if err != nil {
 			break
 		}
@@ -143,30 +238,46 @@ func (w *Wal) loadToMemory() memtable.MemtableOp {
 	f := w.f
 	marsher := w.marsher
 
-	return w.decode(path, f, marsher)
+	return w.decode(path, f, marsher, true)
+}
+
+// 将wal文件decode为默认列族的memtable或者immemtable，newest见decodeColumnFamilies
+func (w *Wal) decode(path string, f vfs.File, marsher kv.MarshalOp, newest bool) *memtable.Tree {
+	trees := w.decodeColumnFamilies(path, f, marsher, newest)
+	if tree, ok := trees[0]; ok {
+		return tree
+	}
+	return memtable.NewTreeWithComparator(path, w.cmp)
 }
 
-// 将wal文件decode为memtable或者immemtable
-func (w *Wal) decode(path string, f *os.File, marsher kv.MarshalOp) *memtable.Tree {
-	info, _ := os.Stat(path)
+// 将wal文件decode为每个列族的memtable或者immemtable，key为列族id。
+//
+//	newest为true时是最新的wal，写入记录时崩溃会在末尾留下不完整或者校验和不一致的记录，这条记录的写入没有成功返回，
+//	将文件截断到最后一条完整记录的结束位置后继续使用。损坏的记录之后还有完整的记录时说明是文件中间损坏，
+//	以ErrCodeChecksum panic。其他位置的损坏，以及更旧的wal中的损坏都会panic
+func (w *Wal) decodeColumnFamilies(path string, f vfs.File, marsher kv.MarshalOp, newest bool) map[int]*memtable.Tree {
+	info, err := f.Stat()
+	if err != nil {
+		panic(err)
+	}
 	size := info.Size()
-	tree := memtable.NewTree(path)
+	trees := make(map[int]*memtable.Tree)
 	//首先读取文件开头的 8 个字节，确定第一个元素的字节数量 n，然后将 8 ~ (8+n) 范围中的二进制数据反序列化为treeNode
 	//（根据操作类型调用tree的Set或Delete方法，从而还原一个tree）
 	// 读取 (8+n) ~ (8+n)+8 位置的 8 个字节，以便确定下一个元素的数据长度，直到读完wal文件
 
 	if size == 0 {
-		return tree
+		return trees
 	}
 
-	_, err := f.Seek(0, 0)
+	_, err = f.Seek(0, 0)
 	if err != nil {
 		panic(err)
 	}
 
 	// 文件指针移动到最后，以便追加
 	defer func() {
-		_, err := f.Seek(size-1, 0)
+		_, err := f.Seek(0, io.SeekEnd)
 		if err != nil {
 			panic(err)
 		}
@@ -178,32 +289,56 @@ func (w *Wal) decode(path string, f *os.File, marsher kv.MarshalOp) *memtable.Tr
 		panic(err)
 	}
 
-	dataLen := int64(0)
-	index := int64(0)
-	for index < size {
-		indexData := data[index : index+8]
-		buf := bytes.NewBuffer(indexData)
-		err := binary.Read(buf, binary.LittleEndian, &dataLen) // 将元素的长度写到dataLen（从将8byte的字节数组转为int64）
-		if err != nil {
+	valid, err := readRecords(data, marsher, func(offset int64, rec Record) {
+		w.applyRecord(trees, rec, path)
+	})
+	if err != nil {
+		if !newest {
 			panic(err)
 		}
-
-		index += 8
-		dataArea := data[index : index+dataLen]
-		var val kv.Kv
-		err = marsher.Unmarshal(dataArea, &val)
-		if err != nil {
+		if next := nextRecord(data, valid); next >= 0 {
+			panic(errs.NewErr(errs.ErrCodeChecksum, fmt.Errorf("%v offset:%v corrupted, found valid record at offset:%v, err:%v", path, valid, next, err)))
+		}
+		if !tornTail(data, valid) {
 			panic(err)
 		}
-		if val.Deleted {
-			tree.Delete(val.Key)
-		} else {
-			tree.Set(val.Key, val.Value)
+		w.logger.Warn("truncate incomplete wal tail", "file", path, "offset", valid, "size", size, "err", err)
+		err = f.Truncate(valid)
+		if err == nil {
+			err = f.Sync()
 		}
+		if err != nil {
+			panic(errs.NewErr(errs.ErrCodeWal, fmt.Errorf("truncate %v err:%v", path, err)))
+		}
+	}
+	return trees
+}
 
-		index += dataLen
+// 将一条记录还原到对应列族的tree上
+func (w *Wal) applyRecord(trees map[int]*memtable.Tree, rec Record, path string) {
+	if len(rec.Batch) > 0 {
+		for _, item := range rec.Batch {
+			w.applyRecord(trees, item, path)
+		}
+		return
+	}
+	tree, ok := trees[rec.CF]
+	if !ok {
+		tree = memtable.NewTreeWithComparator(path, w.cmp)
+		trees[rec.CF] = tree
+	}
+	val := rec.Kv
+	if val.Kind == kv.KindRangeDelete {
+		tree.DeleteRange(val.Key, val.Value)
+	} else if val.Kind == kv.KindMerge {
+		for _, operand := range val.Operands {
+			tree.MergeOperand(val.Key, operand)
+		}
+	} else if val.Deleted {
+		tree.Delete(val.Key)
+	} else {
+		tree.Put(val)
 	}
-	return tree
 }
 
 func (w *Wal) Restore(dir string) (memtable.MemtableOp, []memtable.ImmemtableOp) {
@@ -214,16 +349,87 @@ func (w *Wal) Restore(dir string) (memtable.MemtableOp, []memtable.ImmemtableOp)
 	return memt, immemList
 }
 
+// RestoreColumnFamilies 从wal恢复所有列族的memtable和immemtable，key为列族id。
+//
+//	所有列族共用一个wal，wal文件中没有数据的列族不会出现在返回值中
+func (w *Wal) RestoreColumnFamilies(dir string) (map[int]memtable.MemtableOp, map[int][]memtable.ImmemtableOp) {
+	start := time.Now()
+	mems := make(map[int]memtable.MemtableOp)
+	imms := make(map[int][]memtable.ImmemtableOp)
+	if w.readOnly {
+		_, err := w.fs.Stat(dir)
+		if os.IsNotExist(err) {
+			return mems, imms
+		}
+		w.dir = dir
+		w.path = path.Join(dir, getMemtableFileName(w.fs, dir))
+		for cf, tree := range w.decodeReadOnly(w.path, true) {
+			mems[cf] = tree
+		}
+	} else {
+		w.open(dir)
+		w.lock.Lock()
+		for cf, tree := range w.decodeColumnFamilies(w.path, w.f, w.marsher, true) {
+			mems[cf] = tree
+		}
+		w.lock.Unlock()
+	}
+
+	for _, file := range getImmemtableFileNames(w.fs, dir) { // 从新到旧
+		walPath := path.Join(dir, file)
+		var trees map[int]*memtable.Tree
+		if w.readOnly {
+			trees = w.decodeReadOnly(walPath, false)
+		} else {
+			f, err := w.fs.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+			if err != nil {
+				panic(err)
+			}
+			trees = w.decodeColumnFamilies(walPath, f, w.marsher, false)
+			f.Close() // imm的wal不会再写入
+		}
+		for cf, tree := range trees {
+			imms[cf] = append(imms[cf], tree)
+		}
+	}
+	w.logger.Info("restore wal", "dir", dir, "file", w.path, "duration", time.Since(start))
+	return mems, imms
+}
+
+// 只读打开时解码wal文件。文件不存在时说明已经被写入sst后删除，返回空的结果；
+// tail为true时是其他进程正在追加的wal，末尾不完整或者校验和不一致的记录可能还没有写完，忽略这部分内容
+func (w *Wal) decodeReadOnly(walPath string, tail bool) map[int]*memtable.Tree {
+	trees := make(map[int]*memtable.Tree)
+	data, err := vfs.ReadFile(w.fs, walPath)
+	if os.IsNotExist(err) {
+		return trees
+	}
+	if err != nil {
+		panic(err)
+	}
+	valid, err := readRecords(data, w.marsher, func(offset int64, rec Record) {
+		w.applyRecord(trees, rec, walPath)
+	})
+	if err != nil {
+		if !tail {
+			panic(err)
+		}
+		w.logger.Debug("ignore incomplete wal tail", "file", walPath, "offset", valid, "err", err)
+	}
+	return trees
+}
+
 func (w *Wal) initImmemtable(dir string) []memtable.ImmemtableOp {
 	var list []memtable.ImmemtableOp
-	files := getImmemtableFileNames(dir) // imm的文件名是从大到小的顺序的。即后续imm列表的key的内容是从新到旧的。
+	files := getImmemtableFileNames(w.fs, dir) // imm的文件名是从大到小的顺序的。即后续imm列表的key的内容是从新到旧的。
 	for _, file := range files {
 		walPath := path.Join(dir, file)
-		f, err := os.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		f, err := w.fs.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 		if err != nil {
 			panic(err)
 		}
-		tree := w.decode(walPath, f, w.marsher)
+		tree := w.decode(walPath, f, w.marsher, false)
+		f.Close()
 		list = append(list, tree)
 	}
 	return list
@@ -233,7 +439,14 @@ func (w *Wal) initImmemtable(dir string) []memtable.ImmemtableOp {
 func (w *Wal) Delete(filePath string) error {
 	w.lock.Lock()
 	defer w.lock.Unlock()
-	return os.Remove(filePath)
+	if w.readOnly {
+		return errs.NewErr(errs.ErrCodeReadOnly, fmt.Errorf("wal:%v opened read-only", w.dir))
+	}
+	err := w.fs.Remove(filePath)
+	if err != nil {
+		return err
+	}
+	return w.fs.Sync(w.dir)
 }
 
 // Reset 创建一个新的wal供memtable使用
@@ -241,7 +454,7 @@ func (w *Wal) Reset() *Wal {
 	w.lock.Lock()
 	defer w.lock.Unlock()
 
-	memtableFileName := getMemtableFileName(w.dir)
+	memtableFileName := getMemtableFileName(w.fs, w.dir)
 	memtableIndex := strings.ReplaceAll(memtableFileName, walFileSuffix, "")
 	_memtableIndex, err := strconv.Atoi(memtableIndex)
 	if err != nil {
@@ -249,12 +462,39 @@ func (w *Wal) Reset() *Wal {
 	}
 	newIndex := _memtableIndex + 1
 	filename := fmt.Sprintf("%v%v", newIndex, walFileSuffix) //创建一个序号更大的wal文件
-	w.path = path.Join(w.dir, filename)
+	walPath := path.Join(w.dir, filename)
 
-	f, err := os.OpenFile(w.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	f, err := w.fs.OpenFile(walPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		panic(err)
+	}
+	err = w.fs.Sync(w.dir)
 	if err != nil {
+		f.Close()
 		panic(err)
 	}
+	w.f.Close() // 旧的wal成为immemtable的wal，不会再写入
 	w.f = f
+	w.path = walPath
+	w.broken = nil
 	return w
 }
+
+// Close 将memtable的wal落盘后关闭，之后不能再写入
+func (w *Wal) Close() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.f == nil {
+		return nil // 只读打开时不保留文件句柄
+	}
+	err := w.f.Sync()
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeWal, fmt.Errorf("sync %v err:%v", w.path, err))
+	}
+	err = w.f.Close()
+	if err != nil {
+		return errs.NewErr(errs.ErrCodeWal, fmt.Errorf("close %v err:%v", w.path, err))
+	}
+	w.f = nil
+	return nil
+}
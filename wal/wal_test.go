@@ -1,13 +1,18 @@
 package wal
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"os"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 
+	"lsmtree/errs"
 	"lsmtree/kv"
+	"lsmtree/vfs"
 )
 
 func TestWal(t *testing.T) {
@@ -16,43 +21,292 @@ func TestWal(t *testing.T) {
 	tree := wal.initMemtable(dir)
 	//t.Logf("%#v", tree)
 
-	err := wal.Write(kv.Kv{"1", []byte("1"), false})
+	err := wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("1"), Deleted: false})
 	assert.Nil(t, err)
 
-	err = wal.Write(kv.Kv{"2", []byte("2"), false})
+	err = wal.Write(kv.Kv{Key: []byte("2"), Value: []byte("2"), Deleted: false})
 	assert.Nil(t, err)
 
-	err = wal.Write(kv.Kv{"2", nil, true})
+	err = wal.Write(kv.Kv{Key: []byte("2"), Value: nil, Deleted: true})
 	assert.Nil(t, err)
 
 	wal = New()
 	tree = wal.initMemtable(dir)
 	//t.Logf("%#v", tree)
-	assert.Equal(t, []kv.Kv{{"1", []byte("1"), false}, {"2", nil, true}}, tree.GetValues())
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1"), Deleted: false}, {Key: []byte("2"), Value: nil, Deleted: true}}, tree.GetValues())
 
 	// 构造多个wal，验证多个wal的恢复情况
 	wal = wal.Reset()
-	err = wal.Write(kv.Kv{"1", []byte("1"), false})
+	err = wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("1"), Deleted: false})
 	assert.Nil(t, err)
 
 	wal = wal.Reset()
-	err = wal.Write(kv.Kv{"2", []byte("2"), false})
+	err = wal.Write(kv.Kv{Key: []byte("2"), Value: []byte("2"), Deleted: false})
 	assert.Nil(t, err)
 
 	wal = New()
 	mem, imm := wal.Restore(dir)
 	assert.Equal(t, dir+"/3.wal.log", mem.GetName())
-	assert.Equal(t, []kv.Kv{{"2", []byte("2"), false}}, mem.GetValues())
+	assert.Equal(t, []kv.Kv{{Key: []byte("2"), Value: []byte("2"), Deleted: false}}, mem.GetValues())
 
 	assert.Equal(t, 2, len(imm))
 	assert.Equal(t, dir+"/2.wal.log", imm[0].GetName())
-	assert.Equal(t, []kv.Kv{{"1", []byte("1"), false}}, imm[0].GetValues())
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1"), Deleted: false}}, imm[0].GetValues())
 
 	assert.Equal(t, dir+"/1.wal.log", imm[1].GetName())
-	assert.Equal(t, []kv.Kv{{"1", []byte("1"), false}, {"2", nil, true}}, imm[1].GetValues())
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1"), Deleted: false}, {Key: []byte("2"), Value: nil, Deleted: true}}, imm[1].GetValues())
 
 	// 验证删除wal的case
 	err = wal.Delete(imm[0].GetName())
 	assert.Nil(t, err)
 
 }
+
+func TestWal_RangeDelete(t *testing.T) {
+	dir := fmt.Sprintf("out/wal/range_del/%v", time.Now().Unix())
+	wal := New()
+	wal.initMemtable(dir)
+
+	err := wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("1"), Deleted: false})
+	assert.Nil(t, err)
+	err = wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("2"), Kind: kv.KindRangeDelete})
+	assert.Nil(t, err)
+
+	wal = New()
+	tree := wal.initMemtable(dir)
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: nil, Deleted: true}}, tree.GetValues())
+	assert.Equal(t, []kv.RangeTombstone{{Start: []byte("1"), End: []byte("2")}}, tree.GetRangeDels())
+}
+
+func TestWal_Merge(t *testing.T) {
+	dir := fmt.Sprintf("out/wal/merge/%v", time.Now().Unix())
+	wal := New()
+	wal.initMemtable(dir)
+
+	err := wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("1"), Deleted: false})
+	assert.Nil(t, err)
+	err = wal.Write(kv.Kv{Key: []byte("1"), Kind: kv.KindMerge, Operands: [][]byte{[]byte("2")}})
+	assert.Nil(t, err)
+
+	wal = New()
+	tree := wal.initMemtable(dir)
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1"), Kind: kv.KindMerge, Operands: [][]byte{[]byte("2")}, HasBase: true}}, tree.GetValues())
+}
+
+func TestWal_ColumnFamilies(t *testing.T) {
+	dir := fmt.Sprintf("out/wal/cf/%v", time.Now().Unix())
+	wal := New()
+	wal.initMemtable(dir)
+
+	err := wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("1"), Deleted: false})
+	assert.Nil(t, err)
+	err = wal.WriteRecord(Record{Batch: []Record{
+		{Kv: kv.Kv{Key: []byte("2"), Value: []byte("2")}, CF: 1},
+		{Kv: kv.Kv{Key: []byte("1"), Deleted: true}},
+	}})
+	assert.Nil(t, err)
+
+	wal = wal.Reset()
+	err = wal.WriteRecord(Record{Kv: kv.Kv{Key: []byte("3"), Value: []byte("3")}, CF: 2})
+	assert.Nil(t, err)
+
+	wal = New()
+	mems, imms := wal.RestoreColumnFamilies(dir)
+	assert.Equal(t, 1, len(mems))
+	assert.Equal(t, []kv.Kv{{Key: []byte("3"), Value: []byte("3")}}, mems[2].GetValues())
+
+	assert.Equal(t, 2, len(imms))
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: nil, Deleted: true}}, imms[0][0].GetValues())
+	assert.Equal(t, []kv.Kv{{Key: []byte("2"), Value: []byte("2")}}, imms[1][0].GetValues())
+	assert.Equal(t, dir+"/1.wal.log", imms[1][0].GetName())
+
+	// 只有默认列族的记录时，和kv.Kv的序列化结果一致
+	data, err := kv.Json{}.Marshal(Record{Kv: kv.Kv{Key: []byte("1"), Value: []byte("1")}})
+	assert.Nil(t, err)
+	expect, err := kv.Json{}.Marshal(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	assert.Equal(t, expect, data)
+}
+
+func TestWal_ReadOnly(t *testing.T) {
+	fs := vfs.NewMem()
+	ro := NewWithOptions(Options{FS: fs, ReadOnly: true})
+	mems, imms := ro.RestoreColumnFamilies("wal")
+	assert.Equal(t, 0, len(mems)+len(imms))
+	assert.False(t, vfs.Exists(fs, "wal")) // 不创建目录
+
+	wal := NewWithOptions(Options{FS: fs})
+	wal.RestoreColumnFamilies("wal")
+	err := wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	wal = wal.Reset()
+	err = wal.Write(kv.Kv{Key: []byte("2"), Value: []byte("2")})
+	assert.Nil(t, err)
+	// 正在写入的记录只写了一半
+	f, err := fs.OpenFile(wal.GetPath(), os.O_WRONLY|os.O_APPEND, 0666)
+	assert.Nil(t, err)
+	_, err = f.Write([]byte{1, 2, 3})
+	assert.Nil(t, err)
+
+	ro = NewWithOptions(Options{FS: fs, ReadOnly: true})
+	mems, imms = ro.RestoreColumnFamilies("wal")
+	assert.Equal(t, []kv.Kv{{Key: []byte("2"), Value: []byte("2")}}, mems[0].GetValues())
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1")}}, imms[0][0].GetValues())
+	names, err := fs.List("wal")
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1.wal.log", "2.wal.log"}, names)
+	code, _ := errs.FromError(ro.Write(kv.Kv{Key: []byte("3")}))
+	assert.Equal(t, errs.ErrCodeReadOnly, code)
+}
+
+func TestWal_TornTail(t *testing.T) {
+	fs := vfs.NewMem()
+	wal := NewWithOptions(Options{FS: fs})
+	wal.RestoreColumnFamilies("wal")
+	err := wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	err = wal.Write(kv.Kv{Key: []byte("2"), Value: []byte("abc")})
+	assert.Nil(t, err)
+	path := wal.GetPath()
+	data, err := vfs.ReadFile(fs, path)
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+
+	t.Log("case: 最新的wal末尾只写了一半，截断后继续写入")
+	err = vfs.WriteFile(fs, path, append(append([]byte{}, data...), 1, 2, 3))
+	assert.Nil(t, err)
+	wal = NewWithOptions(Options{FS: fs})
+	mems, _ := wal.RestoreColumnFamilies("wal")
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1")}, {Key: []byte("2"), Value: []byte("abc")}}, mems[0].GetValues())
+	info, err := fs.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(len(data)), info.Size())
+	err = wal.Write(kv.Kv{Key: []byte("3"), Value: []byte("3")})
+	assert.Nil(t, err)
+	assert.Nil(t, wal.Close())
+	wal = NewWithOptions(Options{FS: fs})
+	mems, _ = wal.RestoreColumnFamilies("wal")
+	assert.Equal(t, 3, len(mems[0].GetValues()))
+	assert.Nil(t, wal.Close())
+
+	t.Log("case: 最新的wal最后一条记录校验和不一致")
+	broken := append([]byte{}, data...)
+	i := bytes.Index(broken, []byte("YWJj")) // base64("abc")
+	assert.True(t, i > 0)
+	broken[i+3] = 'k'
+	err = vfs.WriteFile(fs, path, broken)
+	assert.Nil(t, err)
+	wal = NewWithOptions(Options{FS: fs})
+	mems, _ = wal.RestoreColumnFamilies("wal")
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1")}}, mems[0].GetValues())
+	assert.Nil(t, wal.Close())
+
+	t.Log("case: 中间的记录损坏")
+	broken = append([]byte{}, data...)
+	i = bytes.Index(broken, []byte("MQ==")) // base64("1")
+	assert.True(t, i > 0)
+	broken[i] = 'N'
+	err = vfs.WriteFile(fs, path, broken)
+	assert.Nil(t, err)
+	assert.Panics(t, func() { NewWithOptions(Options{FS: fs}).RestoreColumnFamilies("wal") })
+
+	t.Log("case: 中间记录的长度前缀损坏，后面还有完整的记录")
+	broken = append([]byte{}, data...)
+	broken[7] ^= 0xff
+	err = vfs.WriteFile(fs, path, broken)
+	assert.Nil(t, err)
+	assert.Panics(t, func() { NewWithOptions(Options{FS: fs}).RestoreColumnFamilies("wal") })
+
+	t.Log("case: 更旧的wal末尾不完整")
+	err = vfs.WriteFile(fs, path, append(append([]byte{}, data...), 1, 2, 3))
+	assert.Nil(t, err)
+	err = vfs.WriteFile(fs, "wal/2.wal.log", nil)
+	assert.Nil(t, err)
+	assert.Panics(t, func() { NewWithOptions(Options{FS: fs}).RestoreColumnFamilies("wal") })
+}
+
+func TestReadFile(t *testing.T) {
+	dir := fmt.Sprintf("out/wal/read/%v", time.Now().Unix())
+	wal := New()
+	wal.initMemtable(dir)
+	err := wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("1")})
+	assert.Nil(t, err)
+	err = wal.WriteRecord(Record{Batch: []Record{
+		{Kv: kv.Kv{Key: []byte("2"), Value: []byte("2")}, CF: 1},
+		{Kv: kv.Kv{Key: []byte("1"), Deleted: true}},
+	}})
+	assert.Nil(t, err)
+	wal = wal.Reset()
+	err = wal.Write(kv.Kv{Key: []byte("3"), Value: []byte("3")})
+	assert.Nil(t, err)
+
+	files, err := ListFiles(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{dir + "/1.wal.log", dir + "/2.wal.log"}, files)
+
+	info, err := ReadFile(files[0], nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", info.Err)
+	assert.Equal(t, info.Size, info.Valid)
+	assert.Equal(t, 2, len(info.Records))
+	assert.Equal(t, int64(0), info.Records[0].Offset)
+	assert.Equal(t, 2, len(info.Records[1].Record.Batch))
+	second := info.Records[1].Offset
+
+	t.Log("case: 末尾的记录不完整")
+	data, err := os.ReadFile(files[0])
+	assert.Nil(t, err)
+	err = os.WriteFile(files[0], data[:len(data)-3], 0666)
+	assert.Nil(t, err)
+	info, err = ReadFile(files[0], nil)
+	assert.Nil(t, err)
+	assert.NotEqual(t, "", info.Err)
+	assert.Equal(t, 1, len(info.Records))
+	assert.Equal(t, second, info.Valid)
+
+	t.Log("case: 导出完整的记录后可以正常恢复")
+	exported := dir + "/export/1.wal.log"
+	err = os.MkdirAll(dir+"/export", 0755)
+	assert.Nil(t, err)
+	err = WriteFile(exported, []Record{info.Records[0].Record}, nil)
+	assert.Nil(t, err)
+	wal = New()
+	mem := wal.initMemtable(dir + "/export")
+	assert.Equal(t, []kv.Kv{{Key: []byte("1"), Value: []byte("1")}}, mem.GetValues())
+}
+
+func TestReadFile_Checksum(t *testing.T) {
+	dir := fmt.Sprintf("out/wal/checksum/%v", time.Now().Unix())
+	wal := New()
+	wal.initMemtable(dir)
+	err := wal.Write(kv.Kv{Key: []byte("1"), Value: []byte("abc")})
+	assert.Nil(t, err)
+	err = wal.Write(kv.Kv{Key: []byte("2"), Value: []byte("2")})
+	assert.Nil(t, err)
+	file := wal.GetPath()
+
+	data, err := os.ReadFile(file)
+	assert.Nil(t, err)
+	i := bytes.Index(data, []byte("YWJj")) // base64("abc")
+	assert.True(t, i > 0)
+	data[i+3] = 'k'
+	err = os.WriteFile(file, data, 0666)
+	assert.Nil(t, err)
+	info, err := ReadFile(file, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(info.Records))
+	assert.Equal(t, int64(0), info.Valid)
+	assert.Contains(t, info.Err, "checksum mismatch")
+
+	t.Log("case: 没有校验和的旧记录仍然可以读取")
+	rec, err := kv.Json{}.Marshal(legacyRecord{LegacyKv: kv.LegacyKv{Key: "old", Value: []byte("1")}})
+	assert.Nil(t, err)
+	old := binary.LittleEndian.AppendUint64(nil, uint64(len(rec)))
+	old = append(old, rec...)
+	err = os.WriteFile(file, old, 0666)
+	assert.Nil(t, err)
+	info, err = ReadFile(file, nil)
+	assert.Nil(t, err)
+	assert.Equal(t, "", info.Err)
+	assert.Equal(t, []byte("old"), info.Records[0].Record.Key)
+}